@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+
+	"github.com/MostafaSensei106/GoPix/internal/cache"
+	"github.com/MostafaSensei106/GoPix/internal/stats"
+)
+
+var cachePruneOlderThan time.Duration
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Inspect and maintain the conversion cache",
+	Long: `GoPix remembers every output it writes from a kept source, keyed on the source
+content and the full conversion settings, so re-running a job on an unchanged
+tree skips the work. The cache lives in ~/.gopix/cache.`,
+}
+
+var cacheStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show the number of cached conversions and stale entries",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := cache.Open(cache.DefaultDir())
+		if err != nil {
+			return err
+		}
+		s := store.Stats()
+		color.Cyan("🗃️  Cache directory: %s", s.Dir)
+		color.White("📦 Entries: %d", s.Entries)
+		color.White("🖼️  Cached outputs: %s", stats.FormatBytes(s.OutputBytes))
+		color.White("🧾 Index size: %s", stats.FormatBytes(s.IndexBytes))
+		if s.Stale > 0 {
+			color.Yellow("🧹 Stale entries: %d (run \"gopix cache prune\")", s.Stale)
+		}
+		return nil
+	},
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove entries whose source or output changed or disappeared",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := cache.Open(cache.DefaultDir())
+		if err != nil {
+			return err
+		}
+		removed := store.Prune(cachePruneOlderThan)
+		if err := store.Save(); err != nil {
+			return err
+		}
+		color.Green("🧹 Removed %d cache entries", removed)
+		return nil
+	},
+}
+
+var cacheClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "Remove every cache entry",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := cache.Open(cache.DefaultDir())
+		if err != nil {
+			return err
+		}
+		entries := store.Stats().Entries
+		if err := store.Clear(); err != nil {
+			return fmt.Errorf("failed to clear cache: %w", err)
+		}
+		color.Green("🗑️  Cleared %d cache entries", entries)
+		return nil
+	},
+}
+
+func init() {
+	cachePruneCmd.Flags().DurationVar(&cachePruneOlderThan, "older-than", 0, "Also remove entries not used for this long (e.g. 720h)")
+
+	cacheCmd.AddCommand(cacheStatsCmd, cachePruneCmd, cacheClearCmd)
+}
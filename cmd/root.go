@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,6 +14,7 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/MostafaSensei106/GoPix/internal/batch"
+	"github.com/MostafaSensei106/GoPix/internal/cache"
 	"github.com/MostafaSensei106/GoPix/internal/config"
 	"github.com/MostafaSensei106/GoPix/internal/converter"
 	"github.com/MostafaSensei106/GoPix/internal/logger"
@@ -29,19 +31,47 @@ var (
 	cfg       *config.Config
 
 	// Command flags
-	inputDir     string
-	targetFormat string
-	keepOriginal bool
-	dryRun       bool
-	verbose      bool
-	workers      uint8
-	quality      uint16
-	maxDimension uint16
-	backup       bool
-	resumeFlag   bool
-	rateLimit    float64
-	logToFile    bool
-	metadata     string
+	inputDir      string
+	targetFormat  string
+	keepOriginal  bool
+	dryRun        bool
+	verbose       bool
+	workers       uint8
+	quality       uint16
+	maxDimension  uint16
+	resizeOpts    converter.ResizeOptions
+	renditions    converter.RenditionOptions
+	backup        bool
+	resumeFlag    bool
+	rateLimit     float64
+	logToFile     bool
+	metadata      string
+	metadataAllow []string
+	metadataDeny  []string
+	encoderOpts   []string
+	memoryBudget  uint32
+	noCache       bool
+	targetSize    string
+	targetDown    bool
+	targetSSIM    float64
+	maxDSSIM      float64
+	onlyIfSmaller bool
+	minSavings    float64
+	optimize      bool
+	animation     converter.AnimationOptions
+	pageOpts      converter.PageOptions
+	colorOpts     converter.ColorOptions
+	noAutoOrient  bool
+	opSpecs       []string
+	operations    []converter.Operation
+	watermark     converter.WatermarkOptions
+	adjust        converter.AdjustOptions
+	alphaOpts     converter.AlphaOptions
+	rawOpts       converter.RawOptions
+
+	// qualityFlagSet reports whether --quality was passed explicitly, in which
+	// case it takes precedence over the per-format qualities in output_settings.
+	qualityFlagSet bool
 
 	// Batch processing flags
 	recursiveSearch   bool
@@ -51,6 +81,9 @@ var (
 	groupByFolder     bool
 	skipEmptyDirs     bool
 	followSymlinks    bool
+	nameTemplate      string
+	onConflict        string
+	fixExtensions     bool
 )
 
 var rootCmd = &cobra.Command{
@@ -88,6 +121,7 @@ GitHub: https://github.com/MostafaSensei106/GoPix`,
 		}
 
 		// Apply config defaults if not set via flags
+		qualityFlagSet = cmd.Flags().Changed("quality")
 		if workers == 0 {
 			workers = cfg.Workers
 		}
@@ -97,15 +131,117 @@ GitHub: https://github.com/MostafaSensei106/GoPix`,
 		if maxDimension == 0 {
 			maxDimension = cfg.MaxDimension
 		}
+		applyResizeDefaults(cfg.Resize)
+		if err := resizeOpts.Validate(); err != nil {
+			return err
+		}
+		if len(renditions.Widths) == 0 {
+			renditions.Widths = cfg.Renditions.Widths
+		}
+		if len(renditions.Formats) == 0 {
+			renditions.Formats = cfg.Renditions.Formats
+		}
+		if renditions.Template == "" {
+			renditions.Template = cfg.Renditions.Template
+		}
+		if err := renditions.Validate(); err != nil {
+			return err
+		}
+		if animation.Frame == 0 {
+			animation.Frame = cfg.Frame
+		}
+		if !animation.Split {
+			animation.Split = cfg.SplitFrames
+		}
+		if err := animation.Validate(); err != nil {
+			return err
+		}
+		if animation.Split && renditions.Enabled() {
+			return fmt.Errorf("--split-frames cannot be combined with renditions")
+		}
 		if targetFormat == "" {
 			targetFormat = cfg.DefaultFormat
 		}
+		if pageOpts.Ranges == "" {
+			pageOpts.Ranges = cfg.Pages
+		}
+		if pageOpts.Mode == "" {
+			pageOpts.Mode = cfg.PageMode
+		}
+		if err := pageOpts.Validate(); err != nil {
+			return err
+		}
+		if pageOpts.Mode == converter.PagesJoin && targetFormat != "tiff" {
+			return fmt.Errorf("--page-mode join writes multi-page TIFFs, use -t tiff")
+		}
+		if pageOpts.Mode == converter.PagesSplit && renditions.Enabled() {
+			return fmt.Errorf("--page-mode split cannot be combined with renditions")
+		}
+		if colorOpts.Profile == "" {
+			colorOpts.Profile = cfg.ColorProfile
+		}
+		if colorOpts.ICC == "" {
+			colorOpts.ICC = cfg.ICC
+		}
+		if colorOpts.Depth == 0 {
+			colorOpts.Depth = cfg.Depth
+		}
+		if err := colorOpts.Validate(); err != nil {
+			return err
+		}
+		if !noAutoOrient {
+			noAutoOrient = cfg.NoAutoOrient
+		}
+		if len(opSpecs) == 0 {
+			opSpecs = cfg.Operations
+		}
+		ops, err := converter.ParseOperations(opSpecs)
+		if err != nil {
+			return err
+		}
+		operations = ops
+		applyWatermarkDefaults(cfg.Watermark)
+		if err := watermark.Validate(); err != nil {
+			return err
+		}
+		applyAdjustDefaults(cfg.Adjust)
+		if err := adjust.Validate(); err != nil {
+			return err
+		}
+		if alphaOpts.Policy == "" {
+			alphaOpts.Policy = cfg.Alpha
+		}
+		if alphaOpts.Background == "" {
+			alphaOpts.Background = cfg.Background
+		}
+		if alphaOpts.Fallback == "" {
+			alphaOpts.Fallback = cfg.AlphaFallback
+		}
+		if err := alphaOpts.Validate(); err != nil {
+			return err
+		}
+		applyRawDefaults(cfg.Raw)
+		if err := rawOpts.Validate(); err != nil {
+			return err
+		}
 		if metadata == "" {
 			metadata = cfg.Metadata
 		}
+		if memoryBudget == 0 {
+			memoryBudget = cfg.MemoryBudgetMB
+		}
+		if len(metadataAllow) == 0 {
+			metadataAllow = cfg.MetadataAllow
+		}
+		if len(metadataDeny) == 0 {
+			metadataDeny = cfg.MetadataDeny
+		}
+		if !converter.IsValidMetadataMode(metadata) {
+			return fmt.Errorf("invalid metadata mode %q (expected one of %s)", metadata, strings.Join(converter.MetadataModes, ", "))
+		}
 
 		// Validate inputs
-		if err := validator.ValidateInputs(inputDir, targetFormat, cfg.Extentions); err != nil {
+		if err := validator.ValidateInputs(inputDir, targetFormat, cfg.Extentions, converter.TargetName); err != nil {
 			return err
 		}
 
@@ -134,12 +270,27 @@ func runConversion() error {
 		GroupByFolder:     groupByFolder,
 		SkipEmptyDirs:     skipEmptyDirs,
 		FollowSymlinks:    followSymlinks,
+		NameTemplate:      nameTemplate,
+		OnConflict:        onConflict,
 	}
 
 	// Override with config defaults if flags not set
 	if !recursiveSearch && !preserveStructure && outputDir == "" && !groupByFolder && !skipEmptyDirs && !followSymlinks {
 		batchConfig = &cfg.BatchProcessing
 	}
+	if batchConfig.NameTemplate == "" {
+		batchConfig.NameTemplate = cfg.BatchProcessing.NameTemplate
+	}
+	if batchConfig.OnConflict == "" {
+		batchConfig.OnConflict = cfg.BatchProcessing.OnConflict
+	}
+	if batchConfig.OnConflict == "" {
+		batchConfig.OnConflict = batch.ConflictOverwrite
+	}
+	batchConfig.NoAutoOrient = noAutoOrient
+	if !batch.IsValidConflictPolicy(batchConfig.OnConflict) {
+		return fmt.Errorf("invalid conflict policy %q (expected one of %s)", batchConfig.OnConflict, strings.Join(batch.ConflictPolicies, ", "))
+	}
 
 	batchProcessor := batch.NewBatchProcessor(batchConfig)
 
@@ -148,12 +299,68 @@ func runConversion() error {
 		return fmt.Errorf("batch input validation failed: %v", err)
 	}
 
-	// Collect all image files using batch processor
-	fileInfos, err := batchProcessor.CollectFiles(inputDir, cfg.Extentions)
+	// Collect all image files using batch processor. PDFs are only picked up
+	// when pages are handled explicitly, camera RAW files unless disabled.
+	inputExts := append([]string(nil), cfg.Extentions...)
+	if pageOpts.Enabled() {
+		inputExts = append(inputExts, "pdf")
+	}
+	if rawOpts.Enabled() {
+		inputExts = append(inputExts, converter.RawExtensions...)
+	}
+	fileInfos, err := batchProcessor.CollectFiles(inputDir, inputExts)
 	if err != nil {
 		return fmt.Errorf("failed to collect files: %v", err)
 	}
 
+	// Files are sniffed while collected; report those whose extension does
+	// not match their content, and rename them when asked to
+	if !fixExtensions {
+		fixExtensions = cfg.FixExtensions
+	}
+	var mismatches, fixedExtensions uint32
+	for i, file := range fileInfos {
+		if !file.ExtensionMismatch() {
+			continue
+		}
+		mismatches++
+		if !fixExtensions {
+			if verbose {
+				color.Yellow("🔎 %s holds a %s image", file.Path, file.Format)
+			}
+			continue
+		}
+		renamed, err := batch.FixExtension(file, dryRun)
+		if err != nil {
+			color.Yellow("⚠️  %v", err)
+			continue
+		}
+		if dryRun {
+			color.Cyan("🔧 Would rename %s -> %s", file.Path, renamed.Path)
+			continue
+		}
+		color.Green("🔧 Renamed %s -> %s", file.Path, renamed.Path)
+		fileInfos[i] = renamed
+		fixedExtensions++
+	}
+	if mismatches > 0 && !fixExtensions {
+		color.Yellow("🔎 %d files have an extension that does not match their content (--fix-extensions renames them)", mismatches)
+	}
+
+	// Every selected page of a split document becomes its own job
+	if pageOpts.Mode == converter.PagesSplit {
+		if batchConfig.NameTemplate != "" {
+			nt, err := batch.ParseNameTemplate(batchConfig.NameTemplate)
+			if err != nil {
+				return err
+			}
+			if !nt.HasToken("page") {
+				return fmt.Errorf("name template %q needs {page} to split pages", batchConfig.NameTemplate)
+			}
+		}
+		fileInfos = batchProcessor.ExpandPages(fileInfos, pageOpts.PagesOf)
+	}
+
 	if len(fileInfos) == 0 {
 		color.Yellow("⚠️  No supported image files found in: %s", inputDir)
 		return nil
@@ -178,6 +385,82 @@ func runConversion() error {
 		color.Cyan("📤 Output directory: %s", batchConfig.OutputDir)
 	}
 
+	// Plan every output path up front so collisions are caught before any work starts
+	outputPaths, err := batchProcessor.PlanOutputPaths(inputDir, fileInfos, targetFormat)
+	if err != nil {
+		return fmt.Errorf("failed to plan output paths: %v", err)
+	}
+	if batchConfig.NameTemplate != "" {
+		color.Cyan("🏷️  Name template: %s", batchConfig.NameTemplate)
+	}
+
+	// Apply the alpha policy up front, so fallback outputs go through the
+	// conflict checks like any other output
+	fileFormats, hasAlpha, alphaSkips := planAlpha(fileInfos, outputPaths)
+
+	// Resolve outputs shared by several inputs or already on disk, checking
+	// every rendition variant and split frame a file writes
+	planner := converter.NewImageConverter(converter.ConvertOptions{
+		Renditions:   renditions,
+		Animation:    animation,
+		Pages:        pageOpts,
+		NoAutoOrient: noAutoOrient,
+	})
+	expand := func(i int, outputPath string) []string {
+		paths, err := planner.OutputPaths(fileInfos[i].Path, fileFormats[i], outputPath, fileInfos[i].Page)
+		if err != nil {
+			// Reported when the file is converted
+			return []string{outputPath}
+		}
+		return paths
+	}
+	plan, collisions, err := batch.ResolveConflicts(fileInfos, outputPaths, batchConfig.OnConflict, expand)
+	if len(collisions) > 0 {
+		printConflictPlan(plan, collisions, batchConfig.OnConflict)
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := range plan {
+		if plan[i].SkipReason == "" {
+			plan[i].SkipReason = alphaSkips[i]
+		}
+	}
+	if dryRun {
+		printDryRunPlan(plan, hasAlpha)
+	}
+
+	// Files skipped by the conflict or alpha policy are reported without being queued
+	files = files[:0]
+	outputPaths = outputPaths[:0]
+	filePages := make([]int, 0, len(plan))
+	jobFormats := make([]string, 0, len(plan))
+	var skippedResults []*converter.ConversionResult
+	for i, planned := range plan {
+		if planned.SkipReason != "" {
+			skippedResults = append(skippedResults, &converter.ConversionResult{
+				OriginalPath: planned.File.Path,
+				OriginalSize: planned.File.Size,
+				SkipReason:   planned.SkipReason,
+				Page:         planned.File.Page,
+				HasAlpha:     hasAlpha[i],
+			})
+			continue
+		}
+		files = append(files, planned.File.Path)
+		outputPaths = append(outputPaths, planned.OutputPath)
+		filePages = append(filePages, planned.File.Page)
+		jobFormats = append(jobFormats, fileFormats[i])
+	}
+
+	// Every source produces one result per rendition variant
+	variantsPerFile := renditions.Count()
+	totalResults := len(files) * variantsPerFile
+	if renditions.Enabled() {
+		color.Cyan("🖼️  Producing %d renditions per image (%d outputs)", variantsPerFile, totalResults)
+	}
+
 	// Setup conversion state for resume capability
 	sessionID := generateSessionID()
 	conversionState := &resume.ConversionState{
@@ -195,14 +478,108 @@ func runConversion() error {
 		}
 	}
 
+	// Build per-format encoder options: config file, then --quality, then --encoder-opt
+	encoderOptions, err := converter.ParseEncoderOptions(cfg.OutputSettings)
+	if err != nil {
+		return fmt.Errorf("invalid output settings: %w", err)
+	}
+	if qualityFlagSet {
+		encoderOptions.SetQuality(int(quality))
+	}
+	if err := encoderOptions.ApplyOverrides(encoderOpts); err != nil {
+		return err
+	}
+
+	// Resolve the target output size
+	if targetSize == "" {
+		targetSize = cfg.TargetSize
+	}
+	if !targetDown {
+		targetDown = cfg.TargetDownscale
+	}
+	targetBytes, err := parseByteSize(targetSize)
+	if err != nil {
+		return err
+	}
+
+	// Resolve the perceptual quality target, --max-dssim is the same floor expressed as DSSIM
+	if maxDSSIM > 0 {
+		if targetSSIM > 0 {
+			return fmt.Errorf("--target-ssim and --max-dssim cannot be combined")
+		}
+		targetSSIM = converter.DSSIMToSSIM(maxDSSIM)
+	}
+	if targetSSIM == 0 {
+		targetSSIM = cfg.TargetSSIM
+	}
+	if targetSSIM < 0 || targetSSIM >= 1 {
+		return fmt.Errorf("invalid SSIM target %.4f (expected 0 < ssim < 1)", targetSSIM)
+	}
+	if targetSSIM > 0 && targetBytes > 0 {
+		return fmt.Errorf("a perceptual target cannot be combined with --target-size")
+	}
+
+	// Resolve the only-if-smaller policy, a minimum saving implies it
+	if !onlyIfSmaller {
+		onlyIfSmaller = cfg.OnlyIfSmaller
+	}
+	if minSavings == 0 {
+		minSavings = cfg.MinSavings
+	}
+	if minSavings < 0 || minSavings >= 100 {
+		return fmt.Errorf("invalid minimum savings %.1f%% (expected 0-99)", minSavings)
+	}
+	if minSavings > 0 {
+		onlyIfSmaller = true
+	}
+	if !optimize {
+		optimize = cfg.Optimize
+	}
+
 	// Setup converter
 	converterOptions := converter.ConvertOptions{
-		Quality:      quality,
-		MaxDimension: maxDimension,
-		KeepOriginal: keepOriginal,
-		DryRun:       dryRun,
-		Backup:       backup,
-		Metadata:     metadata,
+		Quality:         quality,
+		MaxDimension:    maxDimension,
+		Resize:          resizeOpts,
+		Renditions:      renditions,
+		Animation:       animation,
+		Pages:           pageOpts,
+		Color:           colorOpts,
+		NoAutoOrient:    noAutoOrient,
+		Operations:      operations,
+		Watermark:       watermark,
+		Adjust:          adjust,
+		Alpha:           alphaOpts,
+		Raw:             rawOpts,
+		KeepOriginal:    keepOriginal,
+		DryRun:          dryRun,
+		Backup:          backup,
+		Metadata:        metadata,
+		MetadataAllow:   metadataAllow,
+		MetadataDeny:    metadataDeny,
+		Encoder:         encoderOptions,
+		MemoryBudget:    int64(memoryBudget) * 1024 * 1024,
+		TargetSize:      targetBytes,
+		TargetDownscale: targetDown,
+		TargetSSIM:      targetSSIM,
+		OnlyIfSmaller:   onlyIfSmaller,
+		MinSavings:      minSavings,
+		Optimize:        optimize,
+	}
+
+	// Open the persistent cache, a broken cache only costs a full run
+	if cfg.CacheEnabled && !noCache {
+		store, err := cache.Open(cache.DefaultDir())
+		if err != nil {
+			logger.Logger.Warnf("Conversion cache disabled: %v", err)
+		} else {
+			converterOptions.Cache = store
+			defer func() {
+				if err := store.Save(); err != nil {
+					logger.Logger.Warnf("Failed to save conversion cache: %v", err)
+				}
+			}()
+		}
 	}
 
 	imageConverter := converter.NewImageConverter(converterOptions)
@@ -211,25 +588,24 @@ func runConversion() error {
 	pool := worker.NewWorkerPool(workers, imageConverter, rateLimit)
 
 	// Setup progress tracking
-	progressReporter := progress.NewProgressReporter(uint32(len(files)), "Converting images")
+	progressReporter := progress.NewProgressReporter(uint32(totalResults), "Converting images")
 	statistics := stats.NewConversionStatistics()
 
 	// Set batch processing flags in statistics
 	statistics.BatchMode = true
 	statistics.RecursiveSearch = batchConfig.RecursiveSearch
 	statistics.PreserveStructure = batchConfig.PreserveStructure
+	statistics.ExtensionMismatches = mismatches
+	statistics.ExtensionsFixed = fixedExtensions
+	for _, result := range skippedResults {
+		statistics.AddResult(result)
+	}
 
 	// Start processing
 	pool.Start()
 	defer pool.Stop()
 
-	// Send jobs to worker pool - pre-calculate output paths to reduce allocations
-	outputPaths := make([]string, 0, len(files))
-	for _, file := range files {
-		outputPath := batchProcessor.GetOutputPath(inputDir, file, targetFormat)
-		outputPaths = append(outputPaths, outputPath)
-	}
-
+	// Send jobs to worker pool
 	go func() {
 		for i, file := range files {
 			// Create output directory if needed
@@ -240,8 +616,9 @@ func runConversion() error {
 
 			pool.AddJob(worker.Job{
 				Path:       file,
-				Format:     targetFormat,
+				Format:     jobFormats[i],
 				OutputPath: outputPaths[i],
+				Page:       filePages[i],
 			})
 		}
 	}()
@@ -251,7 +628,7 @@ func runConversion() error {
 	timeout := time.NewTimer(30 * time.Second)
 	defer timeout.Stop()
 
-	for processedCount < len(files) {
+	for processedCount < totalResults {
 		select {
 		case result := <-pool.Results():
 			processedCount++
@@ -262,6 +639,9 @@ func runConversion() error {
 			// Update progress - reuse string builder for efficiency
 			var msgBuilder strings.Builder
 			baseName := filepath.Base(result.OriginalPath)
+			if result.Page > 0 {
+				baseName += " (page " + strconv.Itoa(result.Page) + ")"
+			}
 
 			if result.Error != nil {
 				msgBuilder.Grow(len(baseName) + 4)
@@ -269,7 +649,13 @@ func runConversion() error {
 				msgBuilder.WriteString(baseName)
 				progressReporter.UpdateWithMessage(1, msgBuilder.String())
 				logger.Logger.Errorf("Conversion failed: %s - %v", result.OriginalPath, result.Error)
-			} else if result.NewSize == 0 {
+			} else if result.NotBeneficial {
+				msgBuilder.Grow(len(baseName) + 4)
+				msgBuilder.WriteString("♻️  ")
+				msgBuilder.WriteString(baseName)
+				progressReporter.UpdateWithMessage(1, msgBuilder.String())
+				logger.Logger.Infof("Not beneficial, kept original: %s (%d -> %d bytes)", result.OriginalPath, result.OriginalSize, result.NewSize)
+			} else if result.NewSize == 0 || result.SkipReason != "" {
 				msgBuilder.Grow(len(baseName) + 4)
 				msgBuilder.WriteString("⏭️  ")
 				msgBuilder.WriteString(baseName)
@@ -279,7 +665,15 @@ func runConversion() error {
 				msgBuilder.WriteString("✅ ")
 				msgBuilder.WriteString(baseName)
 				progressReporter.UpdateWithMessage(1, msgBuilder.String())
-				logger.Logger.Infof("Converted: %s -> %s", result.OriginalPath, result.NewPath)
+				if targetSSIM > 0 {
+					logger.Logger.Infof("Converted: %s -> %s (quality %d, SSIM %.4f)", result.OriginalPath, result.NewPath, result.Quality, result.SSIM)
+				} else if targetBytes > 0 {
+					logger.Logger.Infof("Converted: %s -> %s (quality %d, %d bytes)", result.OriginalPath, result.NewPath, result.Quality, result.NewSize)
+				} else if result.Frames > 1 {
+					logger.Logger.Infof("Converted: %s -> %s (%d frames)", result.OriginalPath, result.NewPath, result.Frames)
+				} else {
+					logger.Logger.Infof("Converted: %s -> %s", result.OriginalPath, result.NewPath)
+				}
 			}
 
 			// Update resume state - batch updates to reduce I/O
@@ -342,6 +736,256 @@ func handleResume() error {
 	return runConversion()
 }
 
+// printConflictPlan lists the colliding outputs and what the conflict policy
+// does with each input. Outputs that merely exist on disk are summarized
+// unless running verbose or dry.
+func printConflictPlan(plan []batch.PlannedOutput, collisions []batch.Collision, policy string) {
+	decisions := make(map[string]string, len(plan))
+	for _, planned := range plan {
+		if planned.SkipReason != "" {
+			decisions[planned.File.DisplayPath()] = "skip (" + planned.SkipReason + ")"
+		} else {
+			decisions[planned.File.DisplayPath()] = "-> " + describeOutputs(planned)
+		}
+	}
+
+	existing := 0
+	color.Yellow("💥 Output conflicts (policy: %s)", policy)
+	for _, collision := range collisions {
+		if len(collision.Inputs) == 1 && !verbose && !dryRun {
+			existing++
+			continue
+		}
+		suffix := ""
+		if collision.Exists {
+			suffix = " (exists)"
+		}
+		color.Yellow("  %s%s", collision.OutputPath, suffix)
+		for _, input := range collision.Inputs {
+			color.White("    %s %s", input, decisions[input])
+		}
+	}
+	if existing > 0 {
+		color.Yellow("  %d outputs already exist (use --dry-run to list them)", existing)
+	}
+}
+
+// describeOutputs names the paths a planned file writes: the output path, or
+// the first of several rendition variants or frames and how many follow.
+func describeOutputs(planned batch.PlannedOutput) string {
+	switch len(planned.Outputs) {
+	case 0:
+		return planned.OutputPath
+	case 1:
+		return planned.Outputs[0]
+	default:
+		return fmt.Sprintf("%s (+%d more)", planned.Outputs[0], len(planned.Outputs)-1)
+	}
+}
+
+// planAlpha applies the alpha policy to every file converted to the target
+// format. It returns the format each file is written in, whether it has
+// transparency and why it is skipped, if so, and switches the output paths of
+// fallbacks. Headers are only read when the policy needs them or for the
+// dry-run plan. Renditions settle their formats per variant while converting.
+func planAlpha(files []batch.FileInfo, outputPaths []string) ([]string, []bool, []string) {
+	formats := make([]string, len(files))
+	hasAlpha := make([]bool, len(files))
+	skips := make([]string, len(files))
+	for i := range files {
+		formats[i] = targetFormat
+	}
+
+	decides := !converter.SupportsAlpha(targetFormat) && alphaOpts.Policy != "" && alphaOpts.Policy != converter.AlphaFlatten && !renditions.Enabled()
+	if !decides && !dryRun {
+		return formats, hasAlpha, skips
+	}
+	for i, file := range files {
+		alpha, err := converter.HasAlpha(file.Path)
+		if err != nil {
+			// Reported when the file is converted
+			continue
+		}
+		hasAlpha[i] = alpha
+		if !decides {
+			continue
+		}
+		// Failures are left to the converter, which reports them per file
+		format, skipReason, err := alphaOpts.Resolve(alpha, targetFormat)
+		switch {
+		case err != nil:
+		case skipReason != "":
+			skips[i] = skipReason
+		case format != targetFormat:
+			formats[i] = format
+			outputPaths[i] = strings.TrimSuffix(outputPaths[i], filepath.Ext(outputPaths[i])) + "." + format
+			if outputPaths[i] == file.Path {
+				skips[i] = "has transparency, kept as " + format
+			}
+		}
+	}
+	return formats, hasAlpha, skips
+}
+
+// printDryRunPlan lists what a run would do with each input, with columns
+// telling the format detected from the content, flagged when the extension
+// does not match it, and which sources have transparency.
+func printDryRunPlan(plan []batch.PlannedOutput, hasAlpha []bool) {
+	width, formatWidth := len("INPUT"), len("FORMAT")
+	formats := make([]string, len(plan))
+	for i, planned := range plan {
+		width = max(width, len(planned.File.DisplayPath()))
+		formats[i] = planned.File.Format
+		switch {
+		case formats[i] == "":
+			formats[i] = "?"
+		case planned.File.ExtensionMismatch():
+			formats[i] += " (mismatch)"
+		}
+		formatWidth = max(formatWidth, len(formats[i]))
+	}
+	color.Cyan("📋 Plan (dry run)")
+	color.Cyan("  %-*s  %-*s  %-5s  %s", width, "INPUT", formatWidth, "FORMAT", "ALPHA", "OUTPUT")
+	for i, planned := range plan {
+		alpha := "no"
+		if hasAlpha[i] {
+			alpha = "yes"
+		}
+		decision := describeOutputs(planned)
+		if planned.SkipReason != "" {
+			decision = "skip (" + planned.SkipReason + ")"
+		}
+		color.White("  %-*s  %-*s  %-5s  %s", width, planned.File.DisplayPath(), formatWidth, formats[i], alpha, decision)
+	}
+}
+
+// applyResizeDefaults fills the resize options not set via flags from the config file.
+func applyResizeDefaults(rc config.ResizeConfig) {
+	if resizeOpts.Width == 0 && resizeOpts.Height == 0 && resizeOpts.Percent == 0 {
+		resizeOpts.Width = rc.Width
+		resizeOpts.Height = rc.Height
+		resizeOpts.Percent = rc.Percent
+	}
+	if resizeOpts.Mode == "" {
+		resizeOpts.Mode = rc.Mode
+	}
+	if !resizeOpts.Upscale {
+		resizeOpts.Upscale = rc.Upscale
+	}
+	if resizeOpts.Gravity == "" {
+		resizeOpts.Gravity = rc.Gravity
+	}
+	if resizeOpts.Kernel == "" {
+		resizeOpts.Kernel = rc.Kernel
+	}
+	if resizeOpts.Background == "" {
+		resizeOpts.Background = rc.Background
+	}
+}
+
+// applyWatermarkDefaults fills the watermark options not set via flags from the config file.
+func applyWatermarkDefaults(wc config.WatermarkConfig) {
+	if watermark.Image == "" && watermark.Text == "" {
+		watermark.Image = wc.Image
+		watermark.Text = wc.Text
+	}
+	if watermark.Font == "" {
+		watermark.Font = wc.Font
+	}
+	if watermark.Color == "" {
+		watermark.Color = wc.Color
+	}
+	if watermark.Position == "" {
+		watermark.Position = wc.Position
+	}
+	if watermark.Margin == 0 {
+		watermark.Margin = wc.Margin
+	}
+	if watermark.Opacity == 0 {
+		watermark.Opacity = wc.Opacity
+	}
+	if watermark.Scale == 0 {
+		watermark.Scale = wc.Scale
+	}
+	if !watermark.Tile {
+		watermark.Tile = wc.Tile
+	}
+}
+
+// applyAdjustDefaults fills the filter options not set via flags from the config file.
+func applyAdjustDefaults(ac config.AdjustConfig) {
+	if adjust.Sharpen == "" {
+		adjust.Sharpen = ac.Sharpen
+	}
+	if adjust.SharpenSigma == 0 {
+		adjust.SharpenSigma = ac.SharpenSigma
+	}
+	if adjust.Blur == 0 {
+		adjust.Blur = ac.Blur
+	}
+	if adjust.Brightness == 0 {
+		adjust.Brightness = ac.Brightness
+	}
+	if adjust.Contrast == 0 {
+		adjust.Contrast = ac.Contrast
+	}
+	if adjust.Saturation == 0 {
+		adjust.Saturation = ac.Saturation
+	}
+	if adjust.Gamma == 0 {
+		adjust.Gamma = ac.Gamma
+	}
+	if !adjust.Grayscale {
+		adjust.Grayscale = ac.Grayscale
+	}
+	if !adjust.Sepia {
+		adjust.Sepia = ac.Sepia
+	}
+}
+
+// applyRawDefaults fills the RAW options not set via flags from the config file.
+func applyRawDefaults(rc config.RawConfig) {
+	if rawOpts.Decode == "" {
+		rawOpts.Decode = rc.Decode
+	}
+	if rawOpts.WhiteBalance == "" {
+		rawOpts.WhiteBalance = rc.WhiteBalance
+	}
+	if rawOpts.Exposure == 0 {
+		rawOpts.Exposure = rc.Exposure
+	}
+}
+
+// parseByteSize parses sizes such as "200KB", "1.5MB", "500k" or "123456"
+// (bytes). Units are binary, 1KB = 1024 bytes. An empty string is 0.
+func parseByteSize(raw string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(raw))
+	if s == "" {
+		return 0, nil
+	}
+
+	multiplier := 1.0
+	for _, unit := range []struct {
+		suffix string
+		size   float64
+	}{
+		{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+	} {
+		if strings.HasSuffix(s, unit.suffix) {
+			multiplier = unit.size
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid size %q (expected e.g. 200KB or 1.5MB)", raw)
+	}
+	return int64(value * multiplier), nil
+}
+
 // generateSessionID generates a random 8-byte session ID as a hexadecimal string.
 func generateSessionID() string {
 	bytes := make([]byte, 8)
@@ -367,20 +1011,76 @@ func Execute() {
 func init() {
 	// Input/Output flags
 	rootCmd.Flags().StringVarP(&inputDir, "path", "p", "", "Path to the image folder (required)")
-	rootCmd.Flags().StringVarP(&targetFormat, "to", "t", "", "Target format (png, jpg, jpeg, webp, avif, heif, gif, tiff)")
+	rootCmd.Flags().StringVarP(&targetFormat, "to", "t", "", "Target format ("+strings.Join(converter.TargetFormats(), ", ")+")")
 	rootCmd.Flags().BoolVar(&keepOriginal, "keep", false, "Keep original images after conversion")
 	rootCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Preview changes without converting")
 
 	// Quality and processing flags
 	rootCmd.Flags().Uint16VarP(&quality, "quality", "q", 0, "Output quality (1-100, default 80)")
 	rootCmd.Flags().Uint16Var(&maxDimension, "max-size", 0, "Maximum width/height in pixels default no limit")
+	rootCmd.Flags().IntVar(&resizeOpts.Width, "width", 0, "Target width in pixels (0 = keep aspect ratio from --height)")
+	rootCmd.Flags().IntVar(&resizeOpts.Height, "height", 0, "Target height in pixels (0 = keep aspect ratio from --width)")
+	rootCmd.Flags().StringVar(&resizeOpts.Mode, "resize-mode", "", "How to fit --width/--height (fit, contain, cover, fill, exact) default fit")
+	rootCmd.Flags().Float64Var(&resizeOpts.Percent, "scale", 0, "Scale by percentage instead of --width/--height (e.g. 50)")
+	rootCmd.Flags().BoolVar(&resizeOpts.Upscale, "upscale", false, "Allow enlarging images smaller than the target size (exact mode always does)")
+	rootCmd.Flags().StringVar(&resizeOpts.Gravity, "gravity", "", "Crop/pad anchor (centre, north, south, east, west, north-east, ..., smart, attention)")
+	rootCmd.Flags().StringVar(&resizeOpts.Kernel, "kernel", "", "Resize kernel (nearest, linear, cubic, mitchell, lanczos2, lanczos3) default lanczos3")
+	rootCmd.Flags().StringVar(&resizeOpts.Background, "pad-color", "", "Padding color for contain and fill modes (#rrggbb, #rrggbbaa, transparent)")
+	rootCmd.Flags().BoolVar(&noAutoOrient, "no-auto-orient", false, "Keep pixels as stored instead of rotating them by the EXIF orientation")
+	rootCmd.Flags().StringArrayVar(&opSpecs, "op", nil, "Transform operation, repeatable and run in order: rotate=DEG, flip, flop, crop=X,Y,W,H, trim[=N], pad=W:H[,COLOR], flatten[=COLOR]")
+	rootCmd.Flags().StringVar(&adjust.Sharpen, "sharpen", "", "Unsharp mask after resizing (off, auto = only downscaled images, always) default off")
+	rootCmd.Flags().Float64Var(&adjust.SharpenSigma, "sharpen-sigma", 0, "Unsharp mask radius default 0.5")
+	rootCmd.Flags().Float64Var(&adjust.Blur, "blur", 0, "Gaussian blur sigma (e.g. 2)")
+	rootCmd.Flags().Float64Var(&adjust.Brightness, "brightness", 0, "Lightness factor (e.g. 1.1 for 10% brighter)")
+	rootCmd.Flags().Float64Var(&adjust.Contrast, "contrast", 0, "Contrast factor (e.g. 1.2)")
+	rootCmd.Flags().Float64Var(&adjust.Saturation, "saturation", 0, "Saturation factor (e.g. 0.8)")
+	rootCmd.Flags().Float64Var(&adjust.Gamma, "gamma", 0, "Gamma exponent, above 1 brightens the mid-tones (e.g. 1.2)")
+	rootCmd.Flags().BoolVar(&adjust.Grayscale, "grayscale", false, "Convert outputs to grayscale")
+	rootCmd.Flags().BoolVar(&adjust.Sepia, "sepia", false, "Tone outputs in sepia")
+	rootCmd.Flags().StringVar(&alphaOpts.Policy, "alpha", "", "Transparency the target format cannot store (flatten, fail, skip, fallback) default flatten")
+	rootCmd.Flags().StringVar(&alphaOpts.Background, "background", "", "Color transparency is flattened onto (#rrggbb) default white")
+	rootCmd.Flags().StringVar(&alphaOpts.Fallback, "alpha-fallback", "", "Format written instead by --alpha fallback default png")
+	rootCmd.Flags().StringVar(&rawOpts.Decode, "raw-decode", "", "Camera RAW decoder (preview = embedded JPEG, full = libvips demosaic, off = ignore RAW files) default preview")
+	rootCmd.Flags().StringVar(&rawOpts.WhiteBalance, "white-balance", "", "White balance of RAW files (camera, auto or r,g,b gains such as 1.1,1,0.9) default camera")
+	rootCmd.Flags().Float64Var(&rawOpts.Exposure, "exposure", 0, "Exposure compensation of RAW files in stops (e.g. 0.7 or -1)")
+	rootCmd.Flags().StringVar(&watermark.Image, "watermark", "", "Overlay image (e.g. a logo PNG) composited onto every output after resizing")
+	rootCmd.Flags().StringVar(&watermark.Text, "watermark-text", "", "Overlay text composited onto every output, instead of --watermark")
+	rootCmd.Flags().StringVar(&watermark.Font, "watermark-font", "", "Font of --watermark-text (e.g. \"sans bold\") default sans")
+	rootCmd.Flags().StringVar(&watermark.Color, "watermark-color", "", "Color of --watermark-text (#rrggbb) default white")
+	rootCmd.Flags().StringVar(&watermark.Position, "watermark-position", "", "Watermark anchor (centre, north, south, east, west, north-east, ...) default south-east")
+	rootCmd.Flags().IntVar(&watermark.Margin, "watermark-margin", 0, "Watermark distance to the edges and between tiles in pixels")
+	rootCmd.Flags().Float64Var(&watermark.Opacity, "watermark-opacity", 0, "Watermark opacity from 0 to 1 default opaque")
+	rootCmd.Flags().Float64Var(&watermark.Scale, "watermark-scale", 0, "Watermark width relative to the output width (e.g. 0.2) default: image size, 0.25 for text")
+	rootCmd.Flags().BoolVar(&watermark.Tile, "watermark-tile", false, "Repeat the watermark over the whole image")
+	rootCmd.Flags().IntSliceVar(&renditions.Widths, "renditions", nil, "Produce one output per width from a single decode (e.g. 320,640,1280)")
+	rootCmd.Flags().StringSliceVar(&renditions.Formats, "rendition-formats", nil, "Formats to encode every rendition to (e.g. webp,avif,jpg) default: --to")
+	rootCmd.Flags().StringVar(&renditions.Template, "rendition-template", "", "Rendition file name template with {name}, {width}, {ext} default \"{name}-{width}w.{ext}\"")
+	rootCmd.Flags().IntVar(&animation.Frame, "frame", 0, "Convert only this frame of animated images (1-based) default: all frames")
+	rootCmd.Flags().BoolVar(&animation.Split, "split-frames", false, "Write every frame of animated images to its own file (name-01.png, name-02.png, ...)")
+	rootCmd.Flags().StringVar(&pageOpts.Ranges, "pages", "", "Pages of multi-page TIFF/PDF documents to convert (e.g. 1-3,5 or 2-) default: all")
+	rootCmd.Flags().StringVar(&pageOpts.Mode, "page-mode", "", "How to convert document pages: single (first selected page), split (one file per page), join (one multi-page TIFF) default single")
+	rootCmd.Flags().StringVar(&colorOpts.Profile, "color-profile", "", "Convert colors to srgb or the ICC profile file at this path default: keep the source colors")
+	rootCmd.Flags().StringVar(&colorOpts.ICC, "icc", "", "Color profile handling (embed, strip) default embed")
+	rootCmd.Flags().IntVar(&colorOpts.Depth, "depth", 0, "Bits per channel (8, 16) for PNG and TIFF outputs default: keep the source depth")
+	rootCmd.Flags().StringVar(&targetSize, "target-size", "", "Maximum output size, the quality is searched per image to fit (e.g. 200KB, 1.5MB)")
+	rootCmd.Flags().BoolVar(&targetDown, "target-downscale", false, "Shrink images that exceed --target-size even at the lowest quality")
+	rootCmd.Flags().Float64Var(&targetSSIM, "target-ssim", 0, "Pick the lowest quality whose output keeps this SSIM to the source (e.g. 0.98)")
+	rootCmd.Flags().Float64Var(&maxDSSIM, "max-dssim", 0, "Pick the lowest quality whose output stays under this DSSIM (e.g. 0.01)")
+	rootCmd.Flags().BoolVar(&onlyIfSmaller, "only-if-smaller", false, "Discard outputs that are not smaller than the source and keep the original")
+	rootCmd.Flags().BoolVar(&optimize, "optimize", false, "Losslessly re-encode files already in the target format instead of skipping them")
+	rootCmd.Flags().Float64Var(&minSavings, "min-savings", 0, "Minimum size reduction in percent for --only-if-smaller (implies it)")
 	rootCmd.Flags().Uint8VarP(&workers, "workers", "w", 0, "Number of parallel workers Default: Max CPU Cores Available")
 	rootCmd.Flags().Float64Var(&rateLimit, "rate-limit", 0, "Operations per second limit Default: No limit")
+	rootCmd.Flags().Uint32Var(&memoryBudget, "memory-budget", 0, "Max MB of decoded pixels and encoded outputs held across all workers Default: No limit")
+	rootCmd.Flags().StringArrayVar(&encoderOpts, "encoder-opt", nil, "Per-format encoder option as format.option=value, repeatable (e.g. webp.lossless=true)")
 
 	// Feature flags
 	rootCmd.Flags().BoolVar(&backup, "backup", false, "Create backup of original files")
+	rootCmd.Flags().BoolVar(&noCache, "no-cache", false, "Convert everything again, ignoring the conversion cache")
 	rootCmd.Flags().BoolVar(&resumeFlag, "resume", false, "Resume previous interrupted conversion")
-	rootCmd.Flags().StringVar(&metadata, "metadata", "keep", "Metadata handling (keep, strip, strip-location)")
+	rootCmd.Flags().StringVar(&metadata, "metadata", "keep", "Metadata handling (keep, strip, strip-location, keep-copyright)")
+	rootCmd.Flags().StringSliceVar(&metadataAllow, "metadata-allow", nil, "EXIF/XMP/IPTC tags to keep regardless of --metadata, glob patterns (e.g. Copyright,exif:Make)")
+	rootCmd.Flags().StringSliceVar(&metadataDeny, "metadata-deny", nil, "EXIF/XMP/IPTC tags to always remove, glob patterns (e.g. GPS*,iptc:City)")
 	// rootCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose logging")
 	rootCmd.Flags().BoolVar(&logToFile, "log-file", false, "Save logs to file")
 
@@ -392,6 +1092,9 @@ func init() {
 	rootCmd.Flags().BoolVar(&groupByFolder, "group-by-folder", false, "Group results by source folder")
 	rootCmd.Flags().BoolVar(&skipEmptyDirs, "skip-empty", true, "Skip directories with no images")
 	rootCmd.Flags().BoolVar(&followSymlinks, "follow-symlinks", false, "Follow symbolic links")
+	rootCmd.Flags().StringVar(&onConflict, "on-conflict", "", "When outputs collide or already exist: skip, overwrite, suffix-rename, fail, newer-wins default overwrite")
+	rootCmd.Flags().BoolVar(&fixExtensions, "fix-extensions", false, "Rename files whose extension does not match their content, without re-encoding them")
+	rootCmd.Flags().StringVar(&nameTemplate, "name-template", "", "Output path template relative to the output directory, tokens: {name} {ext} {dir} {date:2006-01-02} {width} {height} {hash8} {index:04} {page}")
 
 	// Mark required flags
 	rootCmd.MarkFlagRequired("path")
@@ -401,4 +1104,5 @@ func init() {
 	rootCmd.SetVersionTemplate("GoPix {{.Version}}\n")
 
 	rootCmd.AddCommand(upgradeCmd)
+	rootCmd.AddCommand(cacheCmd)
 }
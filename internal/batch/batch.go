@@ -6,8 +6,10 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/MostafaSensei106/GoPix/internal/config"
+	"github.com/MostafaSensei106/GoPix/internal/converter"
 	"github.com/MostafaSensei106/GoPix/internal/logger"
 	"github.com/MostafaSensei106/GoPix/internal/validator"
 )
@@ -33,7 +35,26 @@ type FileInfo struct {
 	RelPath   string // Relative path from input directory
 	Dir       string // Directory containing the file
 	Extension string
+	Format    string // Format detected from the content, "" = not recognised
 	Size      int64
+	ModTime   time.Time
+	Page      int // Page of a multi-page document handled as its own job (1-based), 0 = whole file
+	Pages     int // Last selected page of the document when Page is set, pads page numbers
+}
+
+// DisplayPath returns the path of the file, followed by the page for the
+// pages of a split document, e.g. "scans/a.tiff (page 2)".
+func (f FileInfo) DisplayPath() string {
+	if f.Page > 0 {
+		return fmt.Sprintf("%s (page %d)", f.Path, f.Page)
+	}
+	return f.Path
+}
+
+// ExtensionMismatch reports whether the content of the file is in another
+// format than its extension names, e.g. a PNG saved as photo.jpg.
+func (f FileInfo) ExtensionMismatch() bool {
+	return f.Format != "" && converter.LookupFormat(f.Extension) != converter.LookupFormat(f.Format)
 }
 
 // NewBatchProcessor creates a new BatchProcessor with the given configuration
@@ -80,9 +101,10 @@ func (bp *BatchProcessor) CollectFilesRecursively(inputDir string, supportedExts
 			return nil
 		}
 
-		// Check file extension
+		// Check file extension, or the content of files without one
 		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(info.Name()), "."))
-		if !extMap[ext] {
+		format, ok := detectSource(path, ext, extMap)
+		if !ok {
 			return nil
 		}
 
@@ -107,7 +129,9 @@ func (bp *BatchProcessor) CollectFilesRecursively(inputDir string, supportedExts
 			RelPath:   relPath,
 			Dir:       filepath.Dir(path),
 			Extension: ext,
+			Format:    format,
 			Size:      info.Size(),
+			ModTime:   info.ModTime(),
 		}
 
 		// Thread-safe append
@@ -163,9 +187,10 @@ func (bp *BatchProcessor) CollectFilesNonRecursive(inputDir string, supportedExt
 			continue
 		}
 
-		// Check file extension
+		// Check file extension, or the content of files without one
 		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(entry.Name()), "."))
-		if !extMap[ext] {
+		format, ok := detectSource(path, ext, extMap)
+		if !ok {
 			continue
 		}
 
@@ -182,7 +207,9 @@ func (bp *BatchProcessor) CollectFilesNonRecursive(inputDir string, supportedExt
 			RelPath:   entry.Name(),
 			Dir:       inputDir,
 			Extension: ext,
+			Format:    format,
 			Size:      info.Size(),
+			ModTime:   info.ModTime(),
 		}
 
 		files = append(files, fileInfo)
@@ -191,6 +218,59 @@ func (bp *BatchProcessor) CollectFilesNonRecursive(inputDir string, supportedExt
 	return files, nil
 }
 
+// detectSource sniffs the format of the file at path and reports whether it
+// is a source: its extension is supported, or it has none and its content is
+// in a supported format.
+func detectSource(path, ext string, extMap map[string]bool) (string, bool) {
+	if ext != "" && !extMap[ext] {
+		return "", false
+	}
+	format, err := converter.DetectFormat(path)
+	if err != nil {
+		logger.Logger.Warnf("Could not read %s: %v", path, err)
+	}
+	if ext != "" || format == "" {
+		return format, ext != ""
+	}
+	for supported := range extMap {
+		if converter.LookupFormat(supported) == converter.LookupFormat(format) {
+			return format, true
+		}
+	}
+	return format, false
+}
+
+// FixExtension renames a file whose extension does not match its content to
+// the extension of the detected format, leaving the content untouched, and
+// returns the updated FileInfo. In a dry run nothing is renamed. Camera RAW
+// files are not renamed, their vendor extension cannot be told from the
+// content.
+func FixExtension(file FileInfo, dryRun bool) (FileInfo, error) {
+	f := converter.LookupFormat(file.Format)
+	if !file.ExtensionMismatch() || f == nil || len(f.Extensions) == 0 {
+		return file, nil
+	}
+	if f.Name == "raw" {
+		return file, fmt.Errorf("cannot tell the RAW extension of %s", file.Path)
+	}
+
+	ext := f.Extensions[0]
+	path := strings.TrimSuffix(file.Path, filepath.Ext(file.Path)) + "." + ext
+	if _, err := os.Lstat(path); err == nil {
+		return file, fmt.Errorf("cannot rename %s: %s already exists", file.Path, path)
+	}
+	if !dryRun {
+		if err := os.Rename(file.Path, path); err != nil {
+			return file, fmt.Errorf("failed to rename %s: %w", file.Path, err)
+		}
+	}
+
+	file.RelPath = strings.TrimSuffix(file.RelPath, filepath.Ext(file.RelPath)) + "." + ext
+	file.Path = path
+	file.Extension = ext
+	return file, nil
+}
+
 // CollectFiles collects image files based on the batch processing configuration
 func (bp *BatchProcessor) CollectFiles(inputDir string, supportedExts []string) ([]FileInfo, error) {
 	if bp.config.RecursiveSearch {
@@ -199,6 +279,33 @@ func (bp *BatchProcessor) CollectFiles(inputDir string, supportedExts []string)
 	return bp.CollectFilesNonRecursive(inputDir, supportedExts)
 }
 
+// ExpandPages replaces every file for which pagesOf returns pages with one
+// FileInfo per page, so each page is planned, converted and reported as its
+// own unit of work. Files without pages are kept whole; files whose pages
+// cannot be read are logged and dropped.
+func (bp *BatchProcessor) ExpandPages(files []FileInfo, pagesOf func(path string) ([]int, error)) []FileInfo {
+	expanded := make([]FileInfo, 0, len(files))
+	for _, file := range files {
+		pages, err := pagesOf(file.Path)
+		if err != nil {
+			logger.Logger.Warnf("Skipping %s: %v", file.Path, err)
+			continue
+		}
+		if len(pages) == 0 {
+			expanded = append(expanded, file)
+			continue
+		}
+		last := pages[len(pages)-1]
+		for _, page := range pages {
+			pageFile := file
+			pageFile.Page = page
+			pageFile.Pages = last
+			expanded = append(expanded, pageFile)
+		}
+	}
+	return expanded
+}
+
 // GetOutputPath calculates the output path for a file based on batch processing settings
 func (bp *BatchProcessor) GetOutputPath(inputDir, filePath, targetFormat string) string {
 	// Calculate relative path from input directory
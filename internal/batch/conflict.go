@@ -0,0 +1,302 @@
+package batch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Output conflict policies.
+const (
+	ConflictSkip         = "skip"          // Keep existing outputs, the first input of a collision wins
+	ConflictOverwrite    = "overwrite"     // Replace existing outputs, the last input of a collision wins
+	ConflictSuffixRename = "suffix-rename" // Write conflicting outputs as name-1.ext, name-2.ext, ...
+	ConflictFail         = "fail"          // Abort before any work if anything conflicts
+	ConflictNewerWins    = "newer-wins"    // The most recently modified source wins, existing outputs included
+)
+
+// ConflictPolicies lists the valid values of --on-conflict.
+var ConflictPolicies = []string{ConflictSkip, ConflictOverwrite, ConflictSuffixRename, ConflictFail, ConflictNewerWins}
+
+// IsValidConflictPolicy reports whether policy is one of ConflictPolicies.
+func IsValidConflictPolicy(policy string) bool {
+	for _, p := range ConflictPolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// PlannedOutput is the resolved output of one input file.
+type PlannedOutput struct {
+	File       FileInfo
+	OutputPath string
+	Outputs    []string // Every path written for OutputPath, such as rendition variants or split frames
+	SkipReason string   // Why the file is not converted, empty when it is
+}
+
+// OutputExpander returns every path written for files[i] when its planned
+// output is outputPath: the rendition variants, the split frames, or just
+// outputPath.
+type OutputExpander func(i int, outputPath string) []string
+
+// expandOutput returns the paths written for files[i], outputPath alone when
+// expand is nil.
+func expandOutput(expand OutputExpander, i int, outputPath string) []string {
+	if expand == nil {
+		return []string{outputPath}
+	}
+	return expand(i, outputPath)
+}
+
+// Collision describes an output path planned for more than one input, or
+// one that already exists on disk.
+type Collision struct {
+	OutputPath string
+	Inputs     []string
+	Exists     bool // The output path already exists on disk
+}
+
+// outputGroup holds the indices of the files planned to write the same path.
+type outputGroup struct {
+	path    string
+	indices []int
+}
+
+// pathKeys compares paths the way the file system holding them does: case
+// is only folded in directories on a case-insensitive file system, so that
+// Photo.webp and photo.webp are two files where they are.
+type pathKeys struct {
+	folds map[string]bool
+}
+
+func newPathKeys() *pathKeys {
+	return &pathKeys{folds: make(map[string]bool)}
+}
+
+// key returns the form of path under which equal paths compare equal.
+func (pk *pathKeys) key(path string) string {
+	path = filepath.Clean(path)
+	dir := filepath.Dir(path)
+	fold, ok := pk.folds[dir]
+	if !ok {
+		fold = caseInsensitive(dir)
+		pk.folds[dir] = fold
+	}
+	if fold {
+		return strings.ToLower(path)
+	}
+	return path
+}
+
+// caseInsensitive reports whether the file system holding dir, or its
+// nearest existing parent, ignores the case of file names. It is probed with
+// a temp file; when none can be created the file system is taken as case
+// sensitive.
+func caseInsensitive(dir string) bool {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+	probe, err := os.CreateTemp(dir, ".gopix-case-")
+	if err != nil {
+		return false
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+	_, err = os.Stat(filepath.Join(dir, strings.ToUpper(filepath.Base(probe.Name()))))
+	return err == nil
+}
+
+// groupByOutput groups the files by the paths they write, in order of first
+// appearance. outputs[i] holds the paths written for file i.
+func groupByOutput(outputs [][]string, keys *pathKeys) []*outputGroup {
+	byPath := make(map[string]*outputGroup, len(outputs))
+	groups := make([]*outputGroup, 0, len(outputs))
+	for i, paths := range outputs {
+		for _, path := range paths {
+			key := keys.key(path)
+			group, ok := byPath[key]
+			if !ok {
+				group = &outputGroup{path: path}
+				byPath[key] = group
+				groups = append(groups, group)
+			}
+			if n := len(group.indices); n == 0 || group.indices[n-1] != i {
+				group.indices = append(group.indices, i)
+			}
+		}
+	}
+	return groups
+}
+
+// FindCollisions reports output paths shared by several inputs. paths[i] is
+// the output of files[i].
+func FindCollisions(files []FileInfo, paths []string) []Collision {
+	outputs := make([][]string, len(paths))
+	for i, path := range paths {
+		outputs[i] = []string{path}
+	}
+	var collisions []Collision
+	for _, group := range groupByOutput(outputs, newPathKeys()) {
+		if len(group.indices) > 1 {
+			collisions = append(collisions, newCollision(files, group, false))
+		}
+	}
+	return collisions
+}
+
+func newCollision(files []FileInfo, group *outputGroup, exists bool) Collision {
+	collision := Collision{OutputPath: group.path, Exists: exists}
+	for _, i := range group.indices {
+		collision.Inputs = append(collision.Inputs, files[i].DisplayPath())
+	}
+	return collision
+}
+
+// ResolveConflicts applies the conflict policy to the planned output paths
+// (paths[i] is the output of files[i]), checking every path expand says a
+// file writes. It returns one PlannedOutput per file in order, and every
+// collision found, whether between inputs or with a file already on disk. A
+// file writing several paths is skipped when it loses any of them, and
+// renamed as a whole. With ConflictFail an error is returned when anything
+// collides.
+func ResolveConflicts(files []FileInfo, paths []string, policy string, expand OutputExpander) ([]PlannedOutput, []Collision, error) {
+	if !IsValidConflictPolicy(policy) {
+		return nil, nil, fmt.Errorf("invalid conflict policy %q (expected one of %s)", policy, strings.Join(ConflictPolicies, ", "))
+	}
+
+	keys := newPathKeys()
+	plan := make([]PlannedOutput, len(files))
+	outputs := make([][]string, len(files))
+	for i := range files {
+		outputs[i] = expandOutput(expand, i, paths[i])
+		plan[i] = PlannedOutput{File: files[i], OutputPath: paths[i], Outputs: outputs[i]}
+	}
+
+	// Every planned path is reserved so renamed outputs never land on one
+	used := make(map[string]bool, len(paths))
+	for _, written := range outputs {
+		for _, path := range written {
+			used[keys.key(path)] = true
+		}
+	}
+	// An input sitting at an output path is not an existing output
+	inputs := make(map[string]bool, len(files))
+	for _, file := range files {
+		inputs[keys.key(file.Path)] = true
+	}
+
+	var collisions []Collision
+	renamed := make(map[int]bool)
+	for _, group := range groupByOutput(outputs, keys) {
+		existing, err := os.Stat(group.path)
+		exists := err == nil && !inputs[keys.key(group.path)]
+		if len(group.indices) == 1 && !exists {
+			continue
+		}
+		collisions = append(collisions, newCollision(files, group, exists))
+
+		switch policy {
+		case ConflictSkip:
+			winner := group.indices[0]
+			if exists {
+				winner = -1
+			}
+			skipLosers(plan, group, winner)
+
+		case ConflictOverwrite:
+			skipLosers(plan, group, group.indices[len(group.indices)-1])
+
+		case ConflictNewerWins:
+			winner := group.indices[0]
+			for _, i := range group.indices[1:] {
+				if files[i].ModTime.After(files[winner].ModTime) {
+					winner = i
+				}
+			}
+			if exists && !files[winner].ModTime.After(existing.ModTime()) {
+				plan[winner].SkipReason = "existing output is newer than the source"
+				winner = -1
+			}
+			skipLosers(plan, group, winner)
+
+		case ConflictSuffixRename:
+			losers := group.indices[1:]
+			if exists {
+				losers = group.indices
+			}
+			for _, i := range losers {
+				renamed[i] = true
+			}
+		}
+	}
+
+	// Renamed files move all their outputs along with the planned one
+	for i := range files {
+		if renamed[i] {
+			plan[i].OutputPath, plan[i].Outputs = nextFreePath(paths[i], func(path string) []string {
+				return expandOutput(expand, i, path)
+			}, used, keys)
+		}
+	}
+
+	if policy == ConflictFail && len(collisions) > 0 {
+		return plan, collisions, fmt.Errorf("%d output paths conflict (use --on-conflict to choose how to resolve them)", len(collisions))
+	}
+	return plan, collisions, nil
+}
+
+// skipLosers marks every file of the group except winner (-1 = none) as skipped.
+func skipLosers(plan []PlannedOutput, group *outputGroup, winner int) {
+	for _, i := range group.indices {
+		if i == winner || plan[i].SkipReason != "" {
+			continue
+		}
+		if winner >= 0 {
+			plan[i].SkipReason = "output taken by " + plan[winner].File.DisplayPath()
+		} else {
+			plan[i].SkipReason = "output already exists"
+		}
+	}
+}
+
+// nextFreePath returns path with the lowest "-N" suffix whose written paths
+// are neither planned nor present on disk, and reserves them.
+func nextFreePath(path string, expand func(path string) []string, used map[string]bool, keys *pathKeys) (string, []string) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for n := 1; ; n++ {
+		candidate := base + "-" + strconv.Itoa(n) + ext
+		written := expand(candidate)
+		if !allFree(written, used, keys) {
+			continue
+		}
+		for _, path := range written {
+			used[keys.key(path)] = true
+		}
+		return candidate, written
+	}
+}
+
+// allFree reports whether none of paths is planned or present on disk.
+func allFree(paths []string, used map[string]bool, keys *pathKeys) bool {
+	for _, path := range paths {
+		if used[keys.key(path)] {
+			return false
+		}
+		if _, err := os.Stat(path); err == nil {
+			return false
+		}
+	}
+	return true
+}
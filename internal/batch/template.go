@@ -0,0 +1,226 @@
+package batch
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MostafaSensei106/GoPix/internal/cache"
+	"github.com/MostafaSensei106/GoPix/internal/converter"
+)
+
+// NameTemplateTokens lists the tokens understood by ParseNameTemplate.
+var NameTemplateTokens = []string{"name", "ext", "dir", "date", "width", "height", "hash8", "index", "page"}
+
+var templateTokenRe = regexp.MustCompile(`\{([a-z0-9]+)(?::([^}]*))?\}`)
+
+// exifDateLayout is the layout of EXIF DateTime* values.
+const exifDateLayout = "2006:01:02 15:04:05"
+
+// NameTemplate expands output paths such as "{date:2006/01}/{name}-{index:04}.{ext}"
+// relative to the output directory.
+type NameTemplate struct {
+	raw          string
+	needsImg     bool // {width}, {height} or {date} need the image header
+	needsSum     bool // {hash8} needs the file content
+	NoAutoOrient bool // {width} and {height} are the stored size rather than the upright one
+}
+
+// HasToken reports whether the template uses token, e.g. "page".
+func (nt *NameTemplate) HasToken(token string) bool {
+	for _, match := range templateTokenRe.FindAllStringSubmatch(nt.raw, -1) {
+		if match[1] == token {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNameTemplate validates a name template. A template without {ext} gets
+// ".{ext}" appended so outputs always carry the target extension.
+func ParseNameTemplate(raw string) (*NameTemplate, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, fmt.Errorf("name template is empty")
+	}
+	if filepath.IsAbs(raw) {
+		return nil, fmt.Errorf("name template %q must be relative to the output directory", raw)
+	}
+
+	nt := &NameTemplate{raw: raw}
+	for _, match := range templateTokenRe.FindAllStringSubmatch(raw, -1) {
+		token, arg := match[1], match[2]
+		switch token {
+		case "name", "ext", "dir":
+		case "width", "height":
+			nt.needsImg = true
+		case "date":
+			nt.needsImg = true
+			if arg == "" {
+				return nil, fmt.Errorf("{date} needs a Go time layout, e.g. {date:2006-01-02}")
+			}
+		case "hash8":
+			nt.needsSum = true
+		case "index", "page":
+			if arg != "" {
+				if _, err := strconv.Atoi(arg); err != nil {
+					return nil, fmt.Errorf("{%s:%s} needs a numeric width, e.g. {%s:04}", token, arg, token)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown token {%s} in name template (expected one of %s)", token, strings.Join(NameTemplateTokens, ", "))
+		}
+		if arg != "" && token != "date" && token != "index" && token != "page" {
+			return nil, fmt.Errorf("token {%s} takes no argument", token)
+		}
+	}
+	if strings.ContainsAny(templateTokenRe.ReplaceAllString(raw, ""), "{}") {
+		return nil, fmt.Errorf("malformed token in name template %q", raw)
+	}
+	if !strings.Contains(raw, "{ext}") {
+		nt.raw += ".{ext}"
+	}
+	return nt, nil
+}
+
+// Expand returns the output path for file, relative to the output directory.
+// index is the 1-based position of the file in the job list. {page} expands
+// to the page of a split document, or 1 for a whole file.
+func (nt *NameTemplate) Expand(file FileInfo, index int, targetFormat string) (string, error) {
+	var (
+		width, height int
+		taken         time.Time
+		hash          string
+	)
+	if nt.needsImg {
+		var err error
+		if width, height, taken, err = probeImage(file.Path, !nt.NoAutoOrient); err != nil {
+			return "", err
+		}
+	}
+	if taken.IsZero() {
+		taken = file.ModTime
+	}
+	if nt.needsSum {
+		var err error
+		if hash, err = cache.HashFile(file.Path); err != nil {
+			return "", err
+		}
+	}
+
+	relDir := filepath.Dir(file.RelPath)
+	if relDir == "." {
+		relDir = ""
+	}
+	name := strings.TrimSuffix(filepath.Base(file.Path), filepath.Ext(file.Path))
+
+	out := templateTokenRe.ReplaceAllStringFunc(nt.raw, func(token string) string {
+		match := templateTokenRe.FindStringSubmatch(token)
+		switch match[1] {
+		case "name":
+			return name
+		case "ext":
+			return targetFormat
+		case "dir":
+			return relDir
+		case "date":
+			return taken.Format(match[2])
+		case "width":
+			return strconv.Itoa(width)
+		case "height":
+			return strconv.Itoa(height)
+		case "hash8":
+			return hash[:8]
+		case "index":
+			pad, _ := strconv.Atoi(match[2])
+			return fmt.Sprintf("%0*d", pad, index)
+		case "page":
+			pad, _ := strconv.Atoi(match[2])
+			return fmt.Sprintf("%0*d", pad, max(file.Page, 1))
+		}
+		return token
+	})
+
+	out = filepath.Clean(filepath.FromSlash(out))
+	if out == "." || strings.HasPrefix(out, ".."+string(filepath.Separator)) || out == ".." {
+		return "", fmt.Errorf("name template expands to %q for %s, which leaves the output directory", out, file.Path)
+	}
+	return out, nil
+}
+
+// probeImage reads the dimensions and the EXIF capture date of an image.
+// libvips decodes lazily, so only the header is parsed. With upright the
+// dimensions are those of the image turned by its EXIF orientation, as the
+// converter writes it.
+func probeImage(path string, upright bool) (int, int, time.Time, error) {
+	img, err := converter.OpenImage(path)
+	if err != nil {
+		return 0, 0, time.Time{}, fmt.Errorf("failed to read image header of %s: %w", path, err)
+	}
+	defer img.Close()
+
+	var taken time.Time
+	for _, field := range []string{"exif-ifd2-DateTimeOriginal", "exif-ifd0-DateTime"} {
+		// libvips renders EXIF strings as "2024:05:01 10:00:00 (2024:05:01 10:00:00, ASCII, 20 components, 20 bytes)"
+		value := img.GetString(field)
+		if len(value) < len(exifDateLayout) {
+			continue
+		}
+		if t, err := time.ParseInLocation(exifDateLayout, value[:len(exifDateLayout)], time.Local); err == nil {
+			taken = t
+			break
+		}
+	}
+	width, height := img.Width(), img.PageHeight()
+	// Orientations 5 to 8 turn the image by a quarter
+	if orientation := img.Orientation(); upright && orientation >= 5 && orientation <= 8 {
+		width, height = height, width
+	}
+	return width, height, taken, nil
+}
+
+// PlanOutputPaths returns the output path of every file, in order. With a
+// name template the paths are expanded under the output directory (or the
+// input directory when none is set); otherwise GetOutputPath is used, with
+// the page number appended for the pages of a split document.
+func (bp *BatchProcessor) PlanOutputPaths(inputDir string, files []FileInfo, targetFormat string) ([]string, error) {
+	paths := make([]string, 0, len(files))
+	if bp.config.NameTemplate == "" {
+		for _, file := range files {
+			path := bp.GetOutputPath(inputDir, file.Path, targetFormat)
+			if file.Page > 0 {
+				path = PagePath(path, file.Page, file.Pages)
+			}
+			paths = append(paths, path)
+		}
+		return paths, nil
+	}
+
+	nt, err := ParseNameTemplate(bp.config.NameTemplate)
+	if err != nil {
+		return nil, err
+	}
+	nt.NoAutoOrient = bp.config.NoAutoOrient
+	root := inputDir
+	if bp.config.OutputDir != "" {
+		root = bp.config.OutputDir
+	}
+	for i, file := range files {
+		rel, err := nt.Expand(file, i+1, targetFormat)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, filepath.Join(root, rel))
+	}
+	return paths, nil
+}
+
+// PagePath returns the output path of page out of pages of a split document:
+// "scan.png" becomes "scan-01.png", "scan-02.png", ... for up to 99 pages.
+func PagePath(outputPath string, page, pages int) string {
+	ext := filepath.Ext(outputPath)
+	width := len(strconv.Itoa(pages))
+	return fmt.Sprintf("%s-%0*d%s", strings.TrimSuffix(outputPath, ext), width, page, ext)
+}
@@ -0,0 +1,253 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// indexFile is the name of the cache index inside the cache directory.
+const indexFile = "index.json"
+
+// Entry records one conversion output and what it was produced from.
+type Entry struct {
+	SourcePath    string    `json:"source_path"`
+	SourceSize    int64     `json:"source_size"`
+	SourceModTime time.Time `json:"source_mod_time"`
+	SourceHash    string    `json:"source_hash"`   // SHA-256 of the source content
+	SettingsHash  string    `json:"settings_hash"` // Hash of the effective conversion settings
+	OutputSize    int64     `json:"output_size"`
+	OutputModTime time.Time `json:"output_mod_time"`
+	LastUsed      time.Time `json:"last_used"`
+}
+
+// Store is a persistent conversion cache keyed by output path. An entry is a
+// hit when the settings hash matches, the source content is unchanged and the
+// output on disk is still the one that was written. It is safe for
+// concurrent use by the workers of a worker.WorkerPool.
+type Store struct {
+	dir     string
+	mu      sync.Mutex
+	entries map[string]*Entry
+	dirty   bool
+}
+
+// Stats summarizes the content of a Store.
+type Stats struct {
+	Entries     int
+	OutputBytes int64
+	Stale       int // Entries whose source or output is gone or changed
+	IndexBytes  int64
+	Dir         string
+}
+
+// DefaultDir returns the cache directory, "~/.gopix/cache".
+func DefaultDir() string {
+	homeDir, _ := os.UserHomeDir()
+	return filepath.Join(homeDir, ".gopix", "cache")
+}
+
+// Open loads the cache stored in dir. A missing index yields an empty store.
+func Open(dir string) (*Store, error) {
+	s := &Store{dir: dir, entries: make(map[string]*Entry)}
+
+	data, err := os.ReadFile(filepath.Join(dir, indexFile))
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache index: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		// A corrupted index only costs a full re-run, so start over
+		s.entries = make(map[string]*Entry)
+		s.dirty = true
+	}
+	return s, nil
+}
+
+// Lookup reports whether outputPath is an up-to-date conversion of
+// sourcePath with the given settings. The source is only hashed when its
+// size or modification time differ from the recorded ones.
+func (s *Store) Lookup(outputPath, sourcePath, settingsHash string) (*Entry, bool) {
+	key := filepath.Clean(outputPath)
+
+	s.mu.Lock()
+	entry, ok := s.entries[key]
+	if ok {
+		copied := *entry
+		entry = &copied
+	}
+	s.mu.Unlock()
+	if !ok || entry.SettingsHash != settingsHash {
+		return nil, false
+	}
+
+	output, err := os.Stat(outputPath)
+	if err != nil || output.Size() != entry.OutputSize || !output.ModTime().Equal(entry.OutputModTime) {
+		return nil, false
+	}
+
+	source, err := os.Stat(sourcePath)
+	if err != nil {
+		return nil, false
+	}
+	if source.Size() != entry.SourceSize || !source.ModTime().Equal(entry.SourceModTime) || entry.SourcePath != sourcePath {
+		hash, err := HashFile(sourcePath)
+		if err != nil || hash != entry.SourceHash {
+			return nil, false
+		}
+		// Same content under a new path or timestamp, remember the new stat
+		entry.SourcePath = sourcePath
+		entry.SourceSize = source.Size()
+		entry.SourceModTime = source.ModTime()
+	}
+
+	entry.LastUsed = time.Now()
+	s.mu.Lock()
+	s.entries[key] = entry
+	s.dirty = true
+	s.mu.Unlock()
+	return entry, true
+}
+
+// Put records that outputPath has just been written from sourcePath.
+func (s *Store) Put(outputPath, sourcePath, settingsHash string) error {
+	source, err := os.Stat(sourcePath)
+	if err != nil {
+		return err
+	}
+	output, err := os.Stat(outputPath)
+	if err != nil {
+		return err
+	}
+	hash, err := HashFile(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[filepath.Clean(outputPath)] = &Entry{
+		SourcePath:    sourcePath,
+		SourceSize:    source.Size(),
+		SourceModTime: source.ModTime(),
+		SourceHash:    hash,
+		SettingsHash:  settingsHash,
+		OutputSize:    output.Size(),
+		OutputModTime: output.ModTime(),
+		LastUsed:      time.Now(),
+	}
+	s.dirty = true
+	return nil
+}
+
+// Save writes the index back to disk if it changed, through a temp file so
+// an interrupted save never leaves a truncated index behind.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache index: %w", err)
+	}
+	tmpPath := filepath.Join(s.dir, indexFile+".tmp")
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write cache index: %w", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(s.dir, indexFile)); err != nil {
+		return fmt.Errorf("failed to write cache index: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+// Stats returns the number of entries, the size of the cached outputs and
+// how many entries are stale.
+func (s *Store) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := Stats{Entries: len(s.entries), Dir: s.dir}
+	for outputPath, entry := range s.entries {
+		stats.OutputBytes += entry.OutputSize
+		if isStale(outputPath, entry) {
+			stats.Stale++
+		}
+	}
+	if info, err := os.Stat(filepath.Join(s.dir, indexFile)); err == nil {
+		stats.IndexBytes = info.Size()
+	}
+	return stats
+}
+
+// Prune removes stale entries and, when maxAge is positive, entries not used
+// for longer than maxAge. It returns the number of entries removed.
+func (s *Store) Prune(maxAge time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for outputPath, entry := range s.entries {
+		if isStale(outputPath, entry) || (maxAge > 0 && time.Since(entry.LastUsed) > maxAge) {
+			delete(s.entries, outputPath)
+			removed++
+		}
+	}
+	if removed > 0 {
+		s.dirty = true
+	}
+	return removed
+}
+
+// Clear removes every entry and the index file.
+func (s *Store) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = make(map[string]*Entry)
+	s.dirty = false
+	if err := os.Remove(filepath.Join(s.dir, indexFile)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove cache index: %w", err)
+	}
+	return nil
+}
+
+// isStale reports whether the source or the output of entry is gone or has
+// changed since it was recorded. Sources are compared by stat only.
+func isStale(outputPath string, entry *Entry) bool {
+	output, err := os.Stat(outputPath)
+	if err != nil || output.Size() != entry.OutputSize || !output.ModTime().Equal(entry.OutputModTime) {
+		return true
+	}
+	source, err := os.Stat(entry.SourcePath)
+	return err != nil || source.Size() != entry.SourceSize || !source.ModTime().Equal(entry.SourceModTime)
+}
+
+// HashFile returns the hex SHA-256 of the file content.
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
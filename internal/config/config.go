@@ -5,28 +5,114 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	DefaultFormat  string                 `yaml:"default_format"`
-	Quality        uint16                 `yaml:"quality"`
-	Workers        uint8                  `yaml:"workers"`
-	MaxDimension   uint16                 `yaml:"max_dimension"`
-	LogLevel       string                 `yaml:"log_level"`
-	Extentions     []string               `yaml:"extentions"`
-	OutputSettings map[string]interface{} `yaml:"output_settings"`
-	AutoBackup     bool                   `yaml:"auto_backup"`
-	ResumeEnabled  bool                   `yaml:"resume_enabled"`
-	KeepOriginal   bool                   `yaml:"keep_original"`
-	DryRun         bool                   `yaml:"dry_run"`
-	Verbose        bool                   `yaml:"verbose"`
-	Metadata       string                 `yaml:"metadata"`
+	DefaultFormat   string                 `yaml:"default_format"`
+	Quality         uint16                 `yaml:"quality"`
+	Workers         uint8                  `yaml:"workers"`
+	MaxDimension    uint16                 `yaml:"max_dimension"`
+	LogLevel        string                 `yaml:"log_level"`
+	Extentions      []string               `yaml:"extentions"`
+	OutputSettings  map[string]interface{} `yaml:"output_settings"`
+	AutoBackup      bool                   `yaml:"auto_backup"`
+	ResumeEnabled   bool                   `yaml:"resume_enabled"`
+	KeepOriginal    bool                   `yaml:"keep_original"`
+	DryRun          bool                   `yaml:"dry_run"`
+	Verbose         bool                   `yaml:"verbose"`
+	Metadata        string                 `yaml:"metadata"`
+	CacheEnabled    bool                   `yaml:"cache_enabled"`    // Persistent conversion cache in ~/.gopix/cache
+	TargetSize      string                 `yaml:"target_size"`      // Maximum output size, e.g. "200KB", empty = off
+	TargetDownscale bool                   `yaml:"target_downscale"` // Shrink images that do not fit target_size at the lowest quality
+	TargetSSIM      float64                `yaml:"target_ssim"`      // Lowest quality keeping this SSIM (e.g. 0.98), 0 = off
+	OnlyIfSmaller   bool                   `yaml:"only_if_smaller"`  // Keep the original when the output is not smaller
+	Optimize        bool                   `yaml:"optimize"`         // Losslessly re-encode files already in the target format
+	MinSavings      float64                `yaml:"min_savings"`      // Percentage an output must save with only_if_smaller
+	MemoryBudgetMB  uint32                 `yaml:"memory_budget_mb"` // Decoded pixels in flight across workers, 0 = unlimited
+	MetadataAllow   []string               `yaml:"metadata_allow"`   // Tags kept regardless of the metadata mode
+	MetadataDeny    []string               `yaml:"metadata_deny"`    // Tags always removed
+	Frame           int                    `yaml:"frame"`            // Convert only this frame of animations (1-based), 0 = all
+	SplitFrames     bool                   `yaml:"split_frames"`     // Write every frame of animations to its own file
+	Pages           string                 `yaml:"pages"`            // Pages of TIFF/PDF documents, e.g. "1-3,5", empty = all
+	PageMode        string                 `yaml:"page_mode"`        // single, split or join
+	ColorProfile    string                 `yaml:"color_profile"`    // "srgb" or an ICC profile file to convert to, empty = keep
+	ICC             string                 `yaml:"icc"`              // embed or strip the color profile
+	Depth           int                    `yaml:"depth"`            // Bits per channel, 8 or 16, 0 = keep the source depth
+	NoAutoOrient    bool                   `yaml:"no_auto_orient"`   // Keep pixels as stored instead of applying the EXIF orientation
+	Operations      []string               `yaml:"operations"`       // Transform pipeline, e.g. ["rotate=90", "trim", "pad=1:1"]
+	Alpha           string                 `yaml:"alpha"`            // flatten, fail, skip or fallback for transparency the target cannot store
+	Background      string                 `yaml:"background"`       // Color transparency is flattened onto, empty = white
+	AlphaFallback   string                 `yaml:"alpha_fallback"`   // Format written by the fallback alpha policy, empty = png
+	FixExtensions   bool                   `yaml:"fix_extensions"`   // Rename files whose extension does not match their content
+	// Resize options
+	Resize ResizeConfig `yaml:"resize"`
+	// Rendition options
+	Renditions RenditionConfig `yaml:"renditions"`
+	// Watermark options
+	Watermark WatermarkConfig `yaml:"watermark"`
+	// Filter options
+	Adjust AdjustConfig `yaml:"adjust"`
+	// Camera RAW options
+	Raw RawConfig `yaml:"raw"`
 	// Batch processing options
 	BatchProcessing BatchConfig `yaml:"batch_processing"`
 }
 
+// ResizeConfig contains configuration for the resize stage
+type ResizeConfig struct {
+	Width      int     `yaml:"width"`      // Target width in pixels (0 = derive from height)
+	Height     int     `yaml:"height"`     // Target height in pixels (0 = derive from width)
+	Mode       string  `yaml:"mode"`       // fit, contain, cover, fill or exact
+	Percent    float64 `yaml:"percent"`    // Scale by percentage instead of width/height
+	Upscale    bool    `yaml:"upscale"`    // Allow enlarging smaller images
+	Gravity    string  `yaml:"gravity"`    // Crop/pad anchor, or smart/attention for smart cropping
+	Kernel     string  `yaml:"kernel"`     // nearest, linear, cubic, mitchell, lanczos2, lanczos3
+	Background string  `yaml:"background"` // Padding color for contain and fill modes
+}
+
+// RenditionConfig contains configuration for producing several variants per source
+type RenditionConfig struct {
+	Widths   []int    `yaml:"widths"`   // Output widths in pixels
+	Formats  []string `yaml:"formats"`  // Output formats, empty = target format
+	Template string   `yaml:"template"` // File name template, e.g. "{name}-{width}w.{ext}"
+}
+
+// WatermarkConfig contains configuration for the overlay composited onto every output
+type WatermarkConfig struct {
+	Image    string  `yaml:"image"`    // Overlay image file, e.g. a logo PNG
+	Text     string  `yaml:"text"`     // Overlay text, used instead of an image
+	Font     string  `yaml:"font"`     // Font for text, e.g. "sans bold"
+	Color    string  `yaml:"color"`    // Text color, e.g. "#ffffff"
+	Position string  `yaml:"position"` // centre, north, south, east, west, north-east, ...
+	Margin   int     `yaml:"margin"`   // Distance to the edges and between tiles in pixels
+	Opacity  float64 `yaml:"opacity"`  // 0-1, 0 = opaque
+	Scale    float64 `yaml:"scale"`    // Overlay width relative to the output width
+	Tile     bool    `yaml:"tile"`     // Repeat the overlay over the whole image
+}
+
+// AdjustConfig contains configuration for the filter stage applied after resizing
+type AdjustConfig struct {
+	Sharpen      string  `yaml:"sharpen"`       // off, auto (after downscaling) or always
+	SharpenSigma float64 `yaml:"sharpen_sigma"` // Unsharp mask radius, 0 = 0.5
+	Blur         float64 `yaml:"blur"`          // Gaussian blur sigma, 0 = off
+	Brightness   float64 `yaml:"brightness"`    // Lightness factor, e.g. 1.1, 0 = unchanged
+	Contrast     float64 `yaml:"contrast"`      // Contrast factor, e.g. 1.2, 0 = unchanged
+	Saturation   float64 `yaml:"saturation"`    // Chroma factor, e.g. 0.8, 0 = unchanged
+	Gamma        float64 `yaml:"gamma"`         // Gamma exponent, 0 = unchanged
+	Grayscale    bool    `yaml:"grayscale"`
+	Sepia        bool    `yaml:"sepia"`
+}
+
+// RawConfig contains configuration for decoding camera RAW files
+type RawConfig struct {
+	Decode       string  `yaml:"decode"`        // preview, full or off
+	WhiteBalance string  `yaml:"white_balance"` // camera, auto or "r,g,b" gains
+	Exposure     float64 `yaml:"exposure"`      // Exposure compensation in stops, -5 to 5
+}
+
 // BatchConfig contains configuration for batch processing features
 type BatchConfig struct {
 	RecursiveSearch   bool   `yaml:"recursive_search"`   // Search subdirectories recursively
@@ -36,6 +122,9 @@ type BatchConfig struct {
 	GroupByFolder     bool   `yaml:"group_by_folder"`    // Group results by source folder
 	SkipEmptyDirs     bool   `yaml:"skip_empty_dirs"`    // Skip directories with no images
 	FollowSymlinks    bool   `yaml:"follow_symlinks"`    // Follow symbolic links
+	NameTemplate      string `yaml:"name_template"`      // Output path template, e.g. "{date:2006/01}/{name}.{ext}"
+	OnConflict        string `yaml:"on_conflict"`        // skip, overwrite, suffix-rename, fail or newer-wins
+	NoAutoOrient      bool   `yaml:"-"`                  // Name templates use the stored size, set from no_auto_orient
 }
 
 // DefaultConfig returns the default configuration for gopix.
@@ -55,13 +144,14 @@ type BatchConfig struct {
 // - Keep original: false
 // - Dry run: false
 // - Verbose logging: false
+// - Conversion cache: enabled
 //
 // The output settings are as follows:
 //
 // - For PNG: use best speed compression
-// - For JPG: use quality 80
-// - For JPEG: use quality 80
-// - For WebP: use quality 80 and lossless compression
+// - For WebP: use lossy compression
+//
+// Per-format qualities are left unset so that Quality applies to every format.
 func DefaultConfig() *Config {
 	return &Config{
 		DefaultFormat: "png",
@@ -69,25 +159,19 @@ func DefaultConfig() *Config {
 		Workers:       uint8(runtime.NumCPU()),
 		MaxDimension:  0,
 		LogLevel:      "info",
-		Extentions:    []string{"png", "jpg", "jpeg", "webp", "avif", "heif", "gif", "tiff"},
+		Extentions:    []string{"png", "jpg", "jpeg", "webp", "avif", "heif", "gif", "tiff", "jxl", "jp2", "bmp", "qoi", "ico"},
 		AutoBackup:    true,
 		ResumeEnabled: true,
 		KeepOriginal:  false,
 		DryRun:        false,
 		Metadata:      "keep",
+		CacheEnabled:  true,
 		// Verbose:       false,
 		OutputSettings: map[string]interface{}{
 			"png": map[string]interface{}{
 				"compression": "best_speed",
 			},
-			"jpg": map[string]interface{}{
-				"quality": 80,
-			},
-			"jpeg": map[string]interface{}{
-				"quality": 80,
-			},
 			"webp": map[string]interface{}{
-				"quality":  80,
 				"lossless": false,
 			},
 		},
@@ -139,9 +223,56 @@ func LoadConfig() (*Config, error) {
 	if err := yaml.Unmarshal(data, &conf); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config file: %v", err)
 	}
+	dropGeneratedQualities(conf.OutputSettings)
+	conf.Extentions = addNewExtensions(conf.Extentions)
 	return &conf, nil
 }
 
+// generatedExtensions is the extentions list earlier releases wrote into every
+// new config file, before jxl, jp2, bmp, qoi and ico were supported.
+var generatedExtensions = []string{"png", "jpg", "jpeg", "webp", "avif", "heif", "gif", "tiff"}
+
+// addNewExtensions returns the current default extentions when exts is still
+// the list an earlier release generated, so that existing config files accept
+// the formats added since. A list the user edited is returned unchanged.
+func addNewExtensions(exts []string) []string {
+	if !slices.Equal(exts, generatedExtensions) {
+		return exts
+	}
+	return DefaultConfig().Extentions
+}
+
+// generatedQualities holds the per-format output_settings earlier releases
+// wrote into every new config file. They pinned jpg, jpeg and webp to
+// quality 80, hiding the top-level quality.
+var generatedQualities = map[string]map[string]interface{}{
+	"jpg":  {"quality": 80},
+	"jpeg": {"quality": 80},
+	"webp": {"quality": 80, "lossless": false},
+}
+
+// dropGeneratedQualities removes the quality from the output_settings entries
+// still exactly as an earlier release generated them, so that the top-level
+// quality applies. A per-format quality the user set or changed is kept.
+func dropGeneratedQualities(settings map[string]interface{}) {
+	for format, generated := range generatedQualities {
+		values, ok := settings[format].(map[string]interface{})
+		if !ok || len(values) != len(generated) {
+			continue
+		}
+		untouched := true
+		for key, value := range generated {
+			if values[key] != value {
+				untouched = false
+				break
+			}
+		}
+		if untouched {
+			delete(values, "quality")
+		}
+	}
+}
+
 // Save writes the current configuration to a YAML file in the user's config directory.
 // It marshals the Config struct to YAML format and saves it as "config.yaml".
 // If the marshaling or file writing fails, it returns an error detailing the failure.
@@ -0,0 +1,197 @@
+package converter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+
+	appErrors "github.com/MostafaSensei106/GoPix/internal/errors"
+)
+
+// Sharpen modes supported by AdjustOptions.Sharpen.
+const (
+	SharpenOff    = "off"    // Never sharpen (default)
+	SharpenAuto   = "auto"   // Sharpen images that have been downscaled
+	SharpenAlways = "always" // Sharpen every image
+)
+
+// SharpenModes lists the accepted values for AdjustOptions.Sharpen.
+var SharpenModes = []string{SharpenOff, SharpenAuto, SharpenAlways}
+
+// defaultSharpenSigma is the unsharp mask radius used when none is set,
+// suited to images that have just been downscaled.
+const defaultSharpenSigma = 0.5
+
+// sepiaMatrix recombines RGB into the classic sepia tones.
+var sepiaMatrix = [][]float64{
+	{0.393, 0.769, 0.189},
+	{0.349, 0.686, 0.168},
+	{0.272, 0.534, 0.131},
+}
+
+// AdjustOptions contains the settings of the filter stage, applied after
+// resizing. Zero values leave the image unchanged.
+type AdjustOptions struct {
+	Sharpen      string  // off, auto or always (default off)
+	SharpenSigma float64 // Unsharp mask radius, 0 = 0.5
+	Blur         float64 // Gaussian blur sigma, 0 = off
+	Brightness   float64 // Lightness factor, e.g. 1.1 for 10% brighter, 0 = unchanged
+	Contrast     float64 // Contrast factor around mid-grey, e.g. 1.2, 0 = unchanged
+	Saturation   float64 // Chroma factor, e.g. 0.8, 0 = unchanged
+	Gamma        float64 // Gamma exponent, above 1 brightens the mid-tones, 0 = unchanged
+	Grayscale    bool
+	Sepia        bool
+}
+
+// Validate checks the sharpen mode and the ranges of the factors.
+func (ao *AdjustOptions) Validate() error {
+	if ao.Sharpen != "" && !containsString(SharpenModes, ao.Sharpen) {
+		return fmt.Errorf("%w: unknown sharpen mode %q (expected one of %s)", appErrors.ErrInvalidOption, ao.Sharpen, strings.Join(SharpenModes, ", "))
+	}
+	for _, value := range []struct {
+		name  string
+		value float64
+	}{
+		{"sharpen sigma", ao.SharpenSigma},
+		{"blur", ao.Blur},
+		{"brightness", ao.Brightness},
+		{"contrast", ao.Contrast},
+		{"saturation", ao.Saturation},
+		{"gamma", ao.Gamma},
+	} {
+		if value.value < 0 {
+			return fmt.Errorf("%w: %s must not be negative, got %g", appErrors.ErrInvalidOption, value.name, value.value)
+		}
+	}
+	if ao.Grayscale && ao.Sepia {
+		return fmt.Errorf("%w: grayscale and sepia cannot be combined", appErrors.ErrInvalidOption)
+	}
+	return nil
+}
+
+// applyAdjustments runs the filter stage on img. downscaled tells whether the
+// resize stage made img smaller, which triggers the auto sharpen mode.
+func (ic *ImageConverter) applyAdjustments(img *vips.ImageRef, downscaled bool) error {
+	ao := ic.options.Adjust
+
+	if ao.Blur > 0 {
+		if err := img.GaussianBlur(ao.Blur); err != nil {
+			return fmt.Errorf("failed to blur image: %w", err)
+		}
+	}
+	if ao.Sharpen == SharpenAlways || (ao.Sharpen == SharpenAuto && downscaled) {
+		sigma := ao.SharpenSigma
+		if sigma == 0 {
+			sigma = defaultSharpenSigma
+		}
+		// libvips' defaults: sharpen edges only, flat areas are left alone
+		if err := img.Sharpen(sigma, 2, 3); err != nil {
+			return fmt.Errorf("failed to sharpen image: %w", err)
+		}
+	}
+	if ao.Brightness > 0 || ao.Saturation > 0 {
+		brightness, saturation := ao.Brightness, ao.Saturation
+		if brightness == 0 {
+			brightness = 1
+		}
+		if saturation == 0 {
+			saturation = 1
+		}
+		if err := keepingFormat(img, func() error { return img.Modulate(brightness, saturation, 0) }); err != nil {
+			return fmt.Errorf("failed to adjust brightness/saturation: %w", err)
+		}
+	}
+	if ao.Contrast > 0 && ao.Contrast != 1 {
+		if err := keepingFormat(img, func() error { return contrast(img, ao.Contrast) }); err != nil {
+			return fmt.Errorf("failed to adjust contrast: %w", err)
+		}
+	}
+	if ao.Gamma > 0 && ao.Gamma != 1 {
+		if err := img.Gamma(ao.Gamma); err != nil {
+			return fmt.Errorf("failed to adjust gamma: %w", err)
+		}
+	}
+	if ao.Grayscale {
+		if err := grayscale(img); err != nil {
+			return fmt.Errorf("failed to convert to grayscale: %w", err)
+		}
+	}
+	if ao.Sepia {
+		if err := keepingFormat(img, func() error { return sepia(img) }); err != nil {
+			return fmt.Errorf("failed to apply sepia: %w", err)
+		}
+	}
+	return nil
+}
+
+// keepingFormat runs op, which may turn img into floats, and casts the result
+// back to the band format img had before. Out of range values are clipped.
+func keepingFormat(img *vips.ImageRef, op func() error) error {
+	format := img.BandFormat()
+	if err := op(); err != nil {
+		return err
+	}
+	if img.BandFormat() == format {
+		return nil
+	}
+	return img.Cast(format)
+}
+
+// contrast scales the color bands of img around mid-grey by factor.
+func contrast(img *vips.ImageRef, factor float64) error {
+	mid := 128.0
+	if img.BandFormat() == vips.BandFormatUshort {
+		mid = 32768
+	}
+	bands := img.Bands()
+	colorBands := bands
+	if img.HasAlpha() {
+		colorBands--
+	}
+	a := make([]float64, bands)
+	b := make([]float64, bands)
+	for i := range a {
+		a[i] = 1
+		if i < colorBands {
+			a[i] = factor
+			b[i] = mid * (1 - factor)
+		}
+	}
+	return img.Linear(a, b)
+}
+
+// grayscale converts img to grey, keeping 16-bit depth and the alpha band.
+// The color profile no longer matches a single band, so it is removed.
+func grayscale(img *vips.ImageRef) error {
+	target := vips.InterpretationBW
+	if img.BandFormat() == vips.BandFormatUshort {
+		target = vips.InterpretationGrey16
+	}
+	if err := img.ToColorSpace(target); err != nil {
+		return err
+	}
+	if img.HasICCProfile() {
+		return img.RemoveICCProfile()
+	}
+	return nil
+}
+
+// sepia tones img, converting grey images to RGB of the same depth first.
+func sepia(img *vips.ImageRef) error {
+	if img.Bands() < 3 {
+		target := vips.InterpretationSRGB
+		if img.BandFormat() == vips.BandFormatUshort {
+			target = vips.InterpretationRGB16
+		}
+		if err := img.ToColorSpace(target); err != nil {
+			return err
+		}
+	}
+	// Recomb extends the rows for an alpha band, so it works on a copy
+	matrix := make([][]float64, len(sepiaMatrix))
+	for i, row := range sepiaMatrix {
+		matrix[i] = append([]float64(nil), row...)
+	}
+	return img.Recomb(matrix)
+}
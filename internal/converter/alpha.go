@@ -0,0 +1,149 @@
+package converter
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+
+	appErrors "github.com/MostafaSensei106/GoPix/internal/errors"
+)
+
+// Alpha policies supported by AlphaOptions.Policy, applied when a source with
+// transparency is converted to a format that cannot store it.
+const (
+	AlphaFlatten  = "flatten"  // Blend onto the background color (default)
+	AlphaFail     = "fail"     // Fail the conversion of the file
+	AlphaSkip     = "skip"     // Leave the file alone
+	AlphaFallback = "fallback" // Write the fallback format instead
+)
+
+// AlphaPolicies lists the accepted values for AlphaOptions.Policy.
+var AlphaPolicies = []string{AlphaFlatten, AlphaFail, AlphaSkip, AlphaFallback}
+
+// SupportsAlpha reports whether format can store transparency.
+func SupportsAlpha(format string) bool {
+	return formatIs(format, func(f *Format) bool { return f.Alpha })
+}
+
+// AlphaOptions controls what happens to transparency the target format
+// cannot store.
+type AlphaOptions struct {
+	Policy     string // flatten, fail, skip or fallback (default flatten)
+	Background string // Color transparency is flattened onto (default white)
+	Fallback   string // Format written by the fallback policy (default png)
+}
+
+// Validate checks the policy, the background color and the fallback format.
+func (ao *AlphaOptions) Validate() error {
+	if ao.Policy != "" && !containsString(AlphaPolicies, ao.Policy) {
+		return fmt.Errorf("%w: unknown alpha policy %q (expected one of %s)", appErrors.ErrInvalidOption, ao.Policy, strings.Join(AlphaPolicies, ", "))
+	}
+	if ao.Background != "" {
+		if _, err := ParseColor(ao.Background); err != nil {
+			return err
+		}
+	}
+	if ao.Fallback != "" && !SupportsAlpha(ao.Fallback) {
+		return fmt.Errorf("%w: alpha fallback format %q cannot store transparency", appErrors.ErrInvalidOption, ao.Fallback)
+	}
+	return nil
+}
+
+// fallback returns the format written by the fallback policy.
+func (ao *AlphaOptions) fallback() string {
+	if ao.Fallback == "" {
+		return "png"
+	}
+	return strings.ToLower(ao.Fallback)
+}
+
+// Resolve applies the policy to a source converted to format. It returns the
+// format to write, which differs from format only for the fallback policy,
+// or a reason to skip the file.
+func (ao *AlphaOptions) Resolve(hasAlpha bool, format string) (string, string, error) {
+	if !hasAlpha || SupportsAlpha(format) {
+		return format, "", nil
+	}
+	switch ao.Policy {
+	case AlphaFail:
+		return "", "", fmt.Errorf("%w: the image has transparency, which %s cannot store", appErrors.ErrUnsupportedFormat, format)
+	case AlphaSkip:
+		return "", "has transparency, which " + format + " cannot store", nil
+	case AlphaFallback:
+		return ao.fallback(), "", nil
+	}
+	return format, "", nil
+}
+
+// HasAlpha reports whether the image at path has an alpha band, reading only
+// its header.
+func HasAlpha(path string) (bool, error) {
+	img, err := OpenImage(path)
+	if err != nil {
+		return false, err
+	}
+	defer img.Close()
+	return img.HasAlpha(), nil
+}
+
+// withFormat returns path with its extension replaced by format.
+func withFormat(path, format string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + "." + format
+}
+
+// resolveAlpha applies the alpha policy to the loaded source of result. It
+// returns the format to write, or "" when the file is skipped. A fallback
+// renames the output accordingly.
+func (ic *ImageConverter) resolveAlpha(img *vips.ImageRef, format string, result *ConversionResult) (string, error) {
+	result.HasAlpha = img.HasAlpha()
+	resolved, skipReason, err := ic.options.Alpha.Resolve(result.HasAlpha, format)
+	if err != nil || skipReason != "" {
+		result.SkipReason = skipReason
+		return "", err
+	}
+	if resolved != format {
+		result.NewPath = withFormat(result.NewPath, resolved)
+		if result.NewPath == result.OriginalPath {
+			result.SkipReason = "has transparency, kept as " + resolved
+			return "", nil
+		}
+	}
+	return resolved, nil
+}
+
+// flattenAlpha blends the transparency of img onto the background color when
+// format cannot store it. Left to the encoders, it would turn black.
+func (ic *ImageConverter) flattenAlpha(img *vips.ImageRef, format string) error {
+	if !img.HasAlpha() || SupportsAlpha(format) {
+		return nil
+	}
+	background := ic.options.Alpha.Background
+	if background == "" {
+		background = "#ffffff"
+	}
+	if err := flatten(img, background); err != nil {
+		return fmt.Errorf("failed to flatten transparency: %w", err)
+	}
+	return nil
+}
+
+// flatten blends img onto the background color and drops its alpha band.
+func flatten(img *vips.ImageRef, background string) error {
+	bg, err := ParseColor(background)
+	if err != nil {
+		return err
+	}
+	// govips always passes an RGB background, which grey images cannot take
+	if img.Bands() <= 2 {
+		target := vips.InterpretationSRGB
+		if img.BandFormat() == vips.BandFormatUshort {
+			target = vips.InterpretationRGB16
+		}
+		if err := img.ToColorSpace(target); err != nil {
+			return err
+		}
+	}
+	return img.Flatten(&vips.Color{R: bg.R, G: bg.G, B: bg.B})
+}
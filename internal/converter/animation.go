@@ -0,0 +1,217 @@
+package converter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+
+	appErrors "github.com/MostafaSensei106/GoPix/internal/errors"
+)
+
+// animationFields are the image fields holding the frame timing, kept when
+// the rest of the metadata is stripped.
+var animationFields = []string{"delay", "loop", "gif-delay", "gif-loop"}
+
+// AnimationOptions controls how multi-frame sources (animated GIF, WebP and
+// AVIF) are converted. By default every frame is kept when the target format
+// supports animation, and only the first frame is converted otherwise.
+type AnimationOptions struct {
+	Frame int  // Convert only this frame (1-based), 0 = all frames
+	Split bool // Write every frame to its own file, see FramePath
+}
+
+// Validate checks that the frame selection is usable.
+func (ao *AnimationOptions) Validate() error {
+	if ao.Frame < 0 {
+		return fmt.Errorf("%w: frame number must be positive, got %d", appErrors.ErrInvalidOption, ao.Frame)
+	}
+	if ao.Frame > 0 && ao.Split {
+		return fmt.Errorf("%w: a single frame cannot be combined with splitting frames", appErrors.ErrInvalidOption)
+	}
+	return nil
+}
+
+// loadImage decodes the image at path for conversion to the given formats.
+// page selects a single page (1-based) of a document split into one job per
+// page, 0 converts the whole file. Animated sources are loaded with all their
+// frames stacked vertically when any format can store them or the frames are
+// split, and as a single frame otherwise. Documents are loaded as the pages
+// selected by the page options.
+func (ic *ImageConverter) loadImage(path string, page int, formats ...string) (*vips.ImageRef, error) {
+	// RAW files and the pure-Go backends decode a single frame or page
+	if isRawFile(path) {
+		return ic.loadRaw(path)
+	}
+	if f := goFallback(path); f != nil {
+		return loadWithGo(path, f)
+	}
+	img, err := vips.NewImageFromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", appErrors.ErrCorruptedImage, err)
+	}
+
+	ao := ic.options.Animation
+	pages := img.Pages()
+	frame := ao.Frame
+	if page == 0 {
+		if page, err = ic.sourcePage(path, pages); err != nil {
+			img.Close()
+			return nil, err
+		}
+	}
+	if page > 0 {
+		frame = page
+	}
+	if frame > pages {
+		img.Close()
+		return nil, fmt.Errorf("%w: page %d requested but the image has %d", appErrors.ErrInvalidOption, frame, pages)
+	}
+
+	params := vips.NewImportParams()
+	switch {
+	case frame > 1:
+		params.Page.Set(frame - 1)
+	case frame == 0 && pages > 1 && ic.joinsPages(path):
+		img.Close()
+		return ic.loadPages(path, pages)
+	case frame == 0 && pages > 1 && !isPagedSource(path) && (ao.Split || anyAnimated(formats)):
+		params.NumPages.Set(-1)
+	default:
+		return img, nil
+	}
+
+	// The header was only needed to count the frames, decode again with them
+	img.Close()
+	img, err = vips.LoadImageFromFile(path, params)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", appErrors.ErrCorruptedImage, err)
+	}
+	return img, nil
+}
+
+// splitFrames returns the number of frames the source at path is split
+// into when frames are split, 1 for sources loaded as a single frame.
+func (ic *ImageConverter) splitFrames(path string) (int, error) {
+	if isRawFile(path) || goFallback(path) != nil || isPagedSource(path) || ic.joinsPages(path) {
+		return 1, nil
+	}
+	img, err := vips.NewImageFromFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", appErrors.ErrCorruptedImage, err)
+	}
+	defer img.Close()
+	return img.Pages(), nil
+}
+
+// anyAnimated reports whether any of formats can store an animation.
+func anyAnimated(formats []string) bool {
+	for _, format := range formats {
+		if isAnimated(format) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAnimated reports whether format can store every frame of an animated source.
+func isAnimated(format string) bool {
+	return formatIs(format, func(f *Format) bool { return f.Animation })
+}
+
+// frameCount returns the number of frames loaded into img.
+func frameCount(img *vips.ImageRef) int {
+	pageHeight := img.PageHeight()
+	if pageHeight <= 0 || img.Height() <= pageHeight {
+		return 1
+	}
+	return img.Height() / pageHeight
+}
+
+// extractFrame returns a copy of frame i (0-based) of a multi-frame image.
+func extractFrame(img *vips.ImageRef, i int) (*vips.ImageRef, error) {
+	frame, err := img.Copy()
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy image: %w", err)
+	}
+	pageHeight := img.PageHeight()
+	// Crop, unlike ExtractArea, treats the frames as one tall image
+	if err := frame.Crop(0, i*pageHeight, img.Width(), pageHeight); err != nil {
+		frame.Close()
+		return nil, fmt.Errorf("failed to extract frame %d: %w", i+1, err)
+	}
+	if err := frame.SetPages(1); err != nil {
+		frame.Close()
+		return nil, fmt.Errorf("failed to extract frame %d: %w", i+1, err)
+	}
+	return frame, nil
+}
+
+// FramePath returns the output path of frame (1-based) out of frames when
+// splitting frames: "anim.png" becomes "anim-01.png", "anim-02.png", ...
+func FramePath(outputPath string, frame, frames int) string {
+	ext := filepath.Ext(outputPath)
+	width := len(strconv.Itoa(frames))
+	return fmt.Sprintf("%s-%0*d%s", strings.TrimSuffix(outputPath, ext), width, frame, ext)
+}
+
+// writeFrames encodes every frame of img to its own file next to
+// result.NewPath and records the total size and frame count in result. All
+// frames are encoded before the first one is written, so OnlyIfSmaller can
+// judge them together, and written frames are removed again when a later one
+// fails, so a source is either fully split or left alone.
+func (ic *ImageConverter) writeFrames(img *vips.ImageRef, format string, result *ConversionResult) error {
+	frames := frameCount(img)
+	encoded := make([][]byte, frames)
+	var total int64
+	for i := range encoded {
+		frame, err := extractFrame(img, i)
+		if err != nil {
+			return err
+		}
+		var releaseBytes func()
+		encoded[i], releaseBytes, err = ic.encodeHeld(frame, format, result)
+		frame.Close()
+		if err != nil {
+			return fmt.Errorf("frame %d: %w", i+1, err)
+		}
+		defer releaseBytes()
+		total += int64(len(encoded[i]))
+	}
+	if ic.notBeneficial(total, result) {
+		return nil
+	}
+
+	width, height := img.Width(), img.PageHeight()
+	written := make([]string, 0, frames)
+	for i, imgBytes := range encoded {
+		framePath := FramePath(result.NewPath, i+1, frames)
+		write := func(w io.Writer) error {
+			_, err := w.Write(imgBytes)
+			return err
+		}
+		verify := func(tmpPath string) error {
+			return verifyOutput(tmpPath, format, width, height, 1)
+		}
+		if err := writeFileAtomic(framePath, write, verify); err != nil {
+			for _, path := range written {
+				os.Remove(path)
+			}
+			if errors.Is(err, appErrors.ErrVerifyFailed) {
+				return fmt.Errorf("frame %d: %w", i+1, err)
+			}
+			return fmt.Errorf("failed to write frame %d to file: %w", i+1, err)
+		}
+		written = append(written, framePath)
+	}
+
+	result.NewPath = written[0]
+	result.NewSize = total
+	result.Frames = frames
+	return nil
+}
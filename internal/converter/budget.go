@@ -0,0 +1,105 @@
+package converter
+
+import (
+	"sync"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// MemoryBudget is a weighted semaphore bounding the decoded pixel bytes held
+// by all conversions in flight. One ImageConverter is shared by every worker
+// of a worker.WorkerPool, so the budget spans the whole pool.
+type MemoryBudget struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	capacity int64
+	inUse    int64
+}
+
+// NewMemoryBudget returns a budget of capacity bytes, or nil for no limit.
+func NewMemoryBudget(capacity int64) *MemoryBudget {
+	if capacity <= 0 {
+		return nil
+	}
+	mb := &MemoryBudget{capacity: capacity}
+	mb.cond = sync.NewCond(&mb.mu)
+	return mb
+}
+
+// Acquire blocks until n bytes fit in the budget and returns the amount
+// actually reserved. Requests larger than the whole budget are clamped so a
+// single oversized image can still run, just never alongside others.
+func (mb *MemoryBudget) Acquire(n int64) int64 {
+	if mb == nil {
+		return 0
+	}
+	if n > mb.capacity {
+		n = mb.capacity
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	for mb.inUse+n > mb.capacity {
+		mb.cond.Wait()
+	}
+	mb.inUse += n
+	return n
+}
+
+// Hold reserves n bytes without waiting and returns the amount reserved, all
+// of n unlike Acquire. It is for memory a conversion needs while it already
+// holds a reservation, such as the encoded output of its image: waiting then
+// could deadlock the pool, so the budget is overdrawn, by more than its whole
+// capacity if need be, and Acquire waits until it is paid back.
+func (mb *MemoryBudget) Hold(n int64) int64 {
+	if mb == nil {
+		return 0
+	}
+
+	mb.mu.Lock()
+	mb.inUse += n
+	mb.mu.Unlock()
+	return n
+}
+
+// Release returns n bytes reserved by Acquire or Hold to the budget.
+func (mb *MemoryBudget) Release(n int64) {
+	if mb == nil || n == 0 {
+		return
+	}
+	mb.mu.Lock()
+	mb.inUse -= n
+	mb.mu.Unlock()
+	mb.cond.Broadcast()
+}
+
+// DecodedSize estimates the memory needed to hold the decoded pixels of img.
+func DecodedSize(img *vips.ImageRef) int64 {
+	bytesPerBand := int64(1)
+	switch img.BandFormat() {
+	case vips.BandFormatUshort, vips.BandFormatShort:
+		bytesPerBand = 2
+	case vips.BandFormatUint, vips.BandFormatInt, vips.BandFormatFloat:
+		bytesPerBand = 4
+	case vips.BandFormatDouble, vips.BandFormatComplex:
+		bytesPerBand = 8
+	case vips.BandFormatDpComplex:
+		bytesPerBand = 16
+	}
+	return int64(img.Width()) * int64(img.Height()) * int64(img.Bands()) * bytesPerBand
+}
+
+// encodeHeld encodes img like encode, keeping the encoded bytes within the
+// memory budget: the decoded size is held while encoding, as libvips builds
+// the whole output in memory, and then the encoded size until the returned
+// release is called once the output has been written.
+func (ic *ImageConverter) encodeHeld(img *vips.ImageRef, format string, result *ConversionResult) ([]byte, func(), error) {
+	estimate := ic.budget.Hold(DecodedSize(img))
+	buf, err := ic.encode(img, format, result)
+	ic.budget.Release(estimate)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	held := ic.budget.Hold(int64(len(buf)))
+	return buf, func() { ic.budget.Release(held) }, nil
+}
@@ -0,0 +1,131 @@
+package converter
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+
+	appErrors "github.com/MostafaSensei106/GoPix/internal/errors"
+)
+
+// ICC profile modes supported by ColorOptions.ICC.
+const (
+	ICCEmbed = "embed" // Keep the profile of the output colors in the file (default)
+	ICCStrip = "strip" // Drop the profile, converting to sRGB first unless another profile is requested
+)
+
+// ICCModes lists the accepted values for ColorOptions.ICC.
+var ICCModes = []string{ICCEmbed, ICCStrip}
+
+// ProfileSRGB is the ColorOptions.Profile name of the built-in sRGB profile.
+const ProfileSRGB = "srgb"
+
+// ColorOptions controls color management. By default the source colors and
+// profile are kept; CMYK sources are converted to sRGB for targets that
+// cannot store CMYK, and profiles that would be stripped are converted to
+// sRGB first so the colors stay right.
+type ColorOptions struct {
+	Profile string // Convert to "srgb" or the ICC profile file at this path, "" = keep the source colors
+	ICC     string // embed or strip (default embed)
+	Depth   int    // Bits per channel, 8 or 16 (PNG and TIFF), 0 = keep the source depth
+}
+
+// Validate checks the profile mode, the bit depth and that a profile file exists.
+func (co *ColorOptions) Validate() error {
+	if co.ICC != "" && !containsString(ICCModes, co.ICC) {
+		return fmt.Errorf("%w: unknown ICC mode %q (expected one of %s)", appErrors.ErrInvalidOption, co.ICC, strings.Join(ICCModes, ", "))
+	}
+	if co.Depth != 0 && co.Depth != 8 && co.Depth != 16 {
+		return fmt.Errorf("%w: bit depth must be 8 or 16, got %d", appErrors.ErrInvalidOption, co.Depth)
+	}
+	if co.Profile != "" && !strings.EqualFold(co.Profile, ProfileSRGB) {
+		if _, err := os.Stat(co.Profile); err != nil {
+			return fmt.Errorf("%w: color profile: %w", appErrors.ErrInvalidOption, err)
+		}
+	}
+	return nil
+}
+
+// profilePath returns the ICC profile file libvips converts to.
+func (co *ColorOptions) profilePath() string {
+	if co.Profile == "" || strings.EqualFold(co.Profile, ProfileSRGB) {
+		return vips.SRGBIEC6196621ICCProfilePath
+	}
+	return co.Profile
+}
+
+// applyColorManagement converts img to the output profile for conversion to
+// the given formats, strips the profile when requested and adjusts the bit
+// depth.
+func (ic *ImageConverter) applyColorManagement(img *vips.ImageRef, formats ...string) error {
+	co := ic.options.Color
+	cmyk := img.Interpretation() == vips.InterpretationCMYK
+	strip := co.ICC == ICCStrip || ic.stripsAllMetadata()
+
+	var convert bool
+	switch {
+	case co.Profile != "" && !strings.EqualFold(co.Profile, ProfileSRGB):
+		convert = true
+	case co.Profile != "":
+		// Untagged RGB is already treated as sRGB
+		convert = cmyk || img.HasICCProfile()
+	default:
+		convert = (cmyk && !allStoreCMYK(formats)) || (strip && img.HasICCProfile())
+	}
+
+	if convert {
+		// Untagged sources are assumed to be sRGB, or generic CMYK
+		fallback := vips.SRGBIEC6196621ICCProfilePath
+		if cmyk {
+			fallback = "cmyk"
+		}
+		if err := img.TransformICCProfileWithFallback(co.profilePath(), fallback); err != nil {
+			return fmt.Errorf("failed to convert color profile: %w", err)
+		}
+	}
+	if co.ICC == ICCStrip && img.HasICCProfile() {
+		if err := img.RemoveICCProfile(); err != nil {
+			return fmt.Errorf("failed to strip color profile: %w", err)
+		}
+	}
+	return setDepth(img, co.Depth)
+}
+
+// allStoreCMYK reports whether every format can store CMYK pixels.
+func allStoreCMYK(formats []string) bool {
+	for _, format := range formats {
+		if !formatIs(format, func(f *Format) bool { return f.CMYK }) {
+			return false
+		}
+	}
+	return len(formats) > 0
+}
+
+// setDepth converts RGB and grey images to depth bits per channel, keeping
+// the source depth when depth is 0. Formats without 16-bit support are
+// reduced to 8 bits by their encoder anyway.
+func setDepth(img *vips.ImageRef, depth int) error {
+	var target vips.Interpretation
+	grey := img.Bands() <= 2
+	switch {
+	case depth == 8 && img.BandFormat() == vips.BandFormatUshort && grey:
+		target = vips.InterpretationBW
+	case depth == 8 && img.BandFormat() == vips.BandFormatUshort:
+		target = vips.InterpretationSRGB
+	case depth == 16 && img.BandFormat() == vips.BandFormatUchar && grey:
+		target = vips.InterpretationGrey16
+	case depth == 16 && img.BandFormat() == vips.BandFormatUchar:
+		target = vips.InterpretationRGB16
+	default:
+		return nil
+	}
+	if img.Interpretation() == vips.InterpretationCMYK {
+		return nil
+	}
+	if err := img.ToColorSpace(target); err != nil {
+		return fmt.Errorf("failed to convert to %d-bit: %w", depth, err)
+	}
+	return nil
+}
@@ -1,30 +1,54 @@
 package converter
 
 import (
-	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/davidbyttow/govips/v2/vips"
 
+	"github.com/MostafaSensei106/GoPix/internal/cache"
 	appErrors "github.com/MostafaSensei106/GoPix/internal/errors"
 )
 
 // ConvertOptions contains the settings for the image conversion process.
 type ConvertOptions struct {
-	Quality      uint16
-	MaxDimension uint16
-	KeepOriginal bool
-	DryRun       bool
-	Backup       bool
-	Metadata     string
+	Quality         uint16
+	MaxDimension    uint16 // Fit the longest side, used when Resize is not set
+	Resize          ResizeOptions
+	Renditions      RenditionOptions // Several resized/encoded variants per source from one decode
+	Animation       AnimationOptions // Frame selection for animated sources
+	Pages           PageOptions      // Page selection for multi-page TIFF and PDF sources
+	Color           ColorOptions     // Output color profile and bit depth
+	NoAutoOrient    bool             // Keep the pixels as stored instead of applying the EXIF orientation
+	Operations      []Operation      // Transform pipeline run before resizing, in order
+	Watermark       WatermarkOptions // Image or text overlay composited after resizing
+	Adjust          AdjustOptions    // Sharpen, blur and tone filters applied after resizing
+	Alpha           AlphaOptions     // Handling of transparency the target format cannot store
+	Raw             RawOptions       // Decoding and development of camera RAW sources
+	KeepOriginal    bool
+	DryRun          bool
+	Backup          bool
+	Metadata        string
+	MetadataAllow   []string // Tags kept regardless of the metadata mode (glob patterns)
+	MetadataDeny    []string // Tags always removed (glob patterns)
+	Encoder         EncoderOptions
+	MemoryBudget    int64        // Decoded pixel and encoded output bytes allowed in flight across all workers, 0 = unlimited
+	Cache           *cache.Store // Persistent conversion cache, nil = disabled
+	TargetSize      int64        // Maximum output size in bytes, searched by quality, 0 = off
+	TargetDownscale bool         // Shrink the image when even the lowest quality exceeds TargetSize
+	TargetSSIM      float64      // Minimum SSIM of the output against the source, searched by quality, 0 = off
+	OnlyIfSmaller   bool         // Discard outputs that do not save space and keep the original
+	MinSavings      float64      // Percentage an output must save to count as smaller
+	Optimize        bool         // Re-encode files already in the target format losslessly instead of refusing them
 }
 
 // ConversionResult holds the outcome of a single image conversion.
@@ -35,21 +59,24 @@ type ConversionResult struct {
 	NewSize      int64
 	Duration     time.Duration
 	Error        error
+	SkipReason   string  // Why the file was not converted, e.g. an output conflict
+	Quality      int     // Encoder quality used for the output
+	Scale        float64 // Extra downscale applied to reach the target size, 0 = none
+	SSIM         float64 // Similarity of the output to the source when TargetSSIM is set
+	Frames       int     // Frames written for an animated source, as one animation or split files
+	Page         int     // Page of a document converted as its own job, 0 = whole file
+	HasAlpha     bool    // The source has transparency
+	Optimized    bool    // Re-encoded losslessly in its own format by the optimize mode
+	// NotBeneficial is set when the output was discarded by OnlyIfSmaller.
+	// NewSize then holds the size the output would have had.
+	NotBeneficial bool
 }
 
 // ImageConverter is responsible for converting images.
 type ImageConverter struct {
 	options ConvertOptions
 	bufPool *bufferPool
-	cache   sync.Map
-}
-
-// cacheEntry stores metadata about converted images.
-type cacheEntry struct {
-	outputPath   string
-	outputSize   int64
-	lastModified time.Time
-	configHash   string
+	budget  *MemoryBudget
 }
 
 // bufferPool manages reusable buffers to reduce GC pressure using sync.Pool
@@ -72,7 +99,7 @@ func (bp *bufferPool) get() []byte {
 }
 
 func (bp *bufferPool) put(buf []byte) {
-	bp.pool.Put(&buf)
+	bp.pool.Put(buf)
 }
 
 // NewImageConverter returns a new ImageConverter instance.
@@ -80,7 +107,7 @@ func NewImageConverter(options ConvertOptions) *ImageConverter {
 	return &ImageConverter{
 		options: options,
 		bufPool: newBufferPool(32 * 1024), // 32KB buffers
-		cache:   sync.Map{},
+		budget:  NewMemoryBudget(options.MemoryBudget),
 	}
 }
 
@@ -91,9 +118,17 @@ func (ic *ImageConverter) Convert(path string, format string) *ConversionResult
 
 // ConvertWithOutputPath converts the image at the given path to the given format with a custom output path.
 func (ic *ImageConverter) ConvertWithOutputPath(path string, format string, outputPath string) *ConversionResult {
+	return ic.ConvertPage(path, format, outputPath, 0)
+}
+
+// ConvertPage converts a single page (1-based) of a multi-page document to
+// the given format, or the whole file when page is 0. Page jobs never back up
+// or remove their source, which is shared with the jobs of the other pages.
+func (ic *ImageConverter) ConvertPage(path string, format string, outputPath string, page int) *ConversionResult {
 	start := time.Now()
 	result := &ConversionResult{
 		OriginalPath: path,
+		Page:         page,
 	}
 
 	defer func() {
@@ -107,68 +142,83 @@ func (ic *ImageConverter) ConvertWithOutputPath(path string, format string, outp
 	}
 	result.OriginalSize = stat.Size()
 
-	currentExt := getFileExtension(path)
+	current := sourceFormat(path)
 	format = strings.ToLower(format)
 
-	if isAlreadyInFormat(currentExt, format) {
+	// Pages and joined documents are new files, so they may keep the source
+	// format. A file whose extension lies about its content is converted,
+	// and one already in the target format only optimized when asked to.
+	// Content already in the target format under another extension, such as
+	// a PNG named photo.jpg, is written again under the right name.
+	sameFormat := isAlreadyInFormat(current, format)
+	misnamed := sameFormat && !isAlreadyInFormat(getFileExtension(path), format)
+	optimize := sameFormat && page == 0 && !ic.joinsPages(path)
+	if optimize && !misnamed && !ic.options.Optimize {
 		result.Error = fmt.Errorf("file already in target format")
 		return result
 	}
 
-	if outputPath != "" {
+	switch {
+	case outputPath != "":
 		result.NewPath = outputPath
-	} else {
+	case optimize && !misnamed:
+		result.NewPath = path
+	default:
 		basePath := strings.TrimSuffix(path, filepath.Ext(path))
 		result.NewPath = basePath + "." + format
 	}
+	if sameFormat && !(optimize && ic.options.Optimize) && result.NewPath == path {
+		result.Error = fmt.Errorf("%w: output would overwrite its source %s", appErrors.ErrInvalidOption, path)
+		return result
+	}
 
-	cacheKey := ic.getCacheKey(path, format)
-	if cached, exists := ic.cache.Load(cacheKey); exists {
-		cachedEntry, ok := cached.(*cacheEntry)
-		if ok && ic.isCacheValid(cachedEntry, stat.ModTime(), result.NewPath) {
-			result.NewSize = cachedEntry.outputSize
+	settingsHash := ic.getConfigHash(format)
+	if ic.options.Cache != nil {
+		if entry, hit := ic.options.Cache.Lookup(result.NewPath, path, settingsHash); hit {
+			result.NewSize = entry.OutputSize
+			result.SkipReason = "unchanged since last run (cached)"
 			return result
 		}
-		ic.cache.Delete(cacheKey)
-	}
-
-	if newStat, err := os.Stat(result.NewPath); err == nil {
-		result.NewSize = newStat.Size()
-		ic.cache.Store(cacheKey, &cacheEntry{
-			outputPath:   result.NewPath,
-			outputSize:   result.NewSize,
-			lastModified: time.Now(),
-			configHash:   ic.getConfigHash(),
-		})
 	}
 
 	if ic.options.DryRun {
 		return result
 	}
 
-	if ic.options.Backup {
+	if ic.options.Backup && page == 0 {
 		if err := ic.createBackup(path); err != nil {
 			result.Error = fmt.Errorf("backup failed: %w", err)
 			return result
 		}
 	}
 
-	if err := ic.convertImage(path, result.NewPath, format); err != nil {
+	convert := ic.convertImage
+	if optimize && ic.options.Optimize {
+		convert = ic.optimizeImage
+	}
+	if err := convert(path, format, result); err != nil {
 		result.Error = err
 		return result
 	}
+	if result.NotBeneficial || result.SkipReason != "" {
+		return result
+	}
 
-	if newStat, err := os.Stat(result.NewPath); err == nil {
-		result.NewSize = newStat.Size()
-		ic.cache.Store(cacheKey, &cacheEntry{
-			outputPath:   result.NewPath,
-			outputSize:   result.NewSize,
-			lastModified: stat.ModTime(),
-			configHash:   ic.getConfigHash(),
-		})
+	if result.NewSize == 0 {
+		if newStat, err := os.Stat(result.NewPath); err == nil {
+			result.NewSize = newStat.Size()
+		}
+	}
+	// Only kept sources can be looked up again, and split frames are several
+	// outputs the cache cannot track. A failed cache update just means the
+	// file is converted again next time.
+	if ic.options.Cache != nil && ic.options.KeepOriginal && !ic.options.Animation.Split {
+		ic.options.Cache.Put(result.NewPath, path, settingsHash)
 	}
 
-	if !ic.options.KeepOriginal {
+	// The output has been verified and renamed into place at this point, so
+	// the original can go. Never remove it when it is the output itself.
+	if !ic.options.KeepOriginal && result.NewPath != path && page == 0 {
 		if err := os.Remove(path); err != nil {
 			result.Error = fmt.Errorf("failed to remove original: %w", err)
 			return result
@@ -178,94 +228,206 @@ func (ic *ImageConverter) ConvertWithOutputPath(path string, format string, outp
 	return result
 }
 
-func (ic *ImageConverter) convertImage(inputPath, outputPath, format string) error {
-	img, err := vips.NewImageFromFile(inputPath)
+func (ic *ImageConverter) convertImage(inputPath, format string, result *ConversionResult) error {
+	img, err := ic.loadImage(inputPath, result.Page, format)
 	if err != nil {
-		return fmt.Errorf("%w: %w", appErrors.ErrCorruptedImage, err)
+		return err
 	}
-	defer img.Close()
 
-	// Resize if max dimension is set
-	if ic.options.MaxDimension > 0 {
-		maxDim := float64(ic.options.MaxDimension)
-		scale := 1.0
-		if img.Width() > img.Height() {
-			if float64(img.Width()) > maxDim {
-				scale = maxDim / float64(img.Width())
-			}
-		} else {
-			if float64(img.Height()) > maxDim {
-				scale = maxDim / float64(img.Height())
-			}
-		}
-		if scale < 1.0 {
-			if err := img.Resize(scale, vips.KernelLanczos3); err != nil {
-				return fmt.Errorf("failed to resize image: %w", err)
-			}
+	// libvips decodes lazily, so only the header has been read at this point.
+	// Reserve the decoded size before any pixel work starts.
+	reserved := ic.budget.Acquire(DecodedSize(img))
+	released := false
+	releaseImage := func() {
+		if !released {
+			img.Close()
+			ic.budget.Release(reserved)
+			released = true
 		}
 	}
+	defer releaseImage()
 
-	// Get export parameters based on format
-	params := ic.getExportParams(format)
+	// Settle transparency the target format cannot store, which may skip the
+	// file or switch to the fallback format
+	if format, err = ic.resolveAlpha(img, format, result); err != nil || format == "" {
+		return err
+	}
+	outputPath := result.NewPath
 
-	// Export the image to a byte buffer
-	imgBytes, _, err := img.Export(params)
+	// Turn the pixels upright first, so the resize sees the displayed size
+	if err := ic.autoOrient(img); err != nil {
+		return err
+	}
+
+	// Rotate, crop, trim, pad, ... as requested
+	if err := ic.applyOperations(img); err != nil {
+		return err
+	}
+
+	// Resize to the requested box, percentage or legacy max dimension
+	sourceWidth := img.Width()
+	if err := ic.resizeImage(img); err != nil {
+		return err
+	}
+
+	// Convert to the output profile after resizing, so fewer pixels are transformed
+	if err := ic.applyColorManagement(img, format); err != nil {
+		return err
+	}
+
+	// Sharpen what the resize softened, then the other filters
+	if err := ic.applyAdjustments(img, img.Width() < sourceWidth); err != nil {
+		return err
+	}
+
+	// Mark the output in its final size and colors
+	if err := ic.applyWatermark(img); err != nil {
+		return err
+	}
+
+	// Remove the metadata rejected by the metadata mode and allow/deny lists
+	if err := ic.applyMetadataPolicy(img); err != nil {
+		return err
+	}
+
+	// Blend transparency the target format cannot store onto the background
+	if err := ic.flattenAlpha(img, format); err != nil {
+		return err
+	}
+
+	// Write every frame of an animation to its own file
+	if ic.options.Animation.Split && frameCount(img) > 1 {
+		return ic.writeFrames(img, format, result)
+	}
+
+	// Encode the image with the per-format encoder options, or search the
+	// quality for the target size. The encoded bytes stay in the budget until
+	// they are written.
+	imgBytes, releaseBytes, err := ic.encodeHeld(img, format, result)
 	if err != nil {
-		return fmt.Errorf("failed to export image: %w", err)
+		return err
+	}
+	defer releaseBytes()
+
+	// Keep the original when the new encoding does not save enough space
+	if ic.notBeneficial(int64(len(imgBytes)), result) {
+		return nil
 	}
 
-	// Write the buffer to the output file
-	if err := os.WriteFile(outputPath, imgBytes, 0644); err != nil {
+	// Free the decoded pixels before writing so the next job can start decoding
+	width, height, frames := img.Width(), img.PageHeight(), frameCount(img)
+	releaseImage()
+
+	// Write through a temp file in the destination directory, check that it
+	// decodes back to the expected image and only then rename it into place
+	write := func(w io.Writer) error {
+		_, err := w.Write(imgBytes)
+		return err
+	}
+	verify := func(tmpPath string) error {
+		return verifyOutput(tmpPath, format, width, height, frames)
+	}
+	if err := writeFileAtomic(outputPath, write, verify); err != nil {
+		if errors.Is(err, appErrors.ErrVerifyFailed) {
+			return err
+		}
 		return fmt.Errorf("failed to write image to file: %w", err)
 	}
 
+	if frames > 1 {
+		result.Frames = frames
+	}
 	return nil
 }
 
-func (ic *ImageConverter) getExportParams(format string) *vips.ExportParams {
-	params := vips.NewDefaultExportParams()
-	quality := int(ic.options.Quality)
-
-	// Handle metadata stripping
-	switch ic.options.Metadata {
-	case "strip":
-		params.StripMetadata = true
-	case "keep":
-		params.StripMetadata = false
-	case "strip-location":
-		// TODO: Implement selective stripping of location tags
-		params.StripMetadata = false // For now, keep all metadata
-	default:
-		params.StripMetadata = false // Default to keeping metadata
-	}
-
-	switch format {
-	case "png":
-		params.Format = vips.ImageTypePNG
-		params.Compression = 6 // Default compression
-		params.Quality = quality
-	case "jpg", "jpeg":
-		params.Format = vips.ImageTypeJPEG
-		params.Quality = quality
-	case "webp":
-		params.Format = vips.ImageTypeWEBP
-		params.Quality = quality
-	case "tiff":
-		params.Format = vips.ImageTypeTIFF
-		params.Quality = quality
-	case "gif":
-		params.Format = vips.ImageTypeGIF
-		params.Quality = quality
-	case "avif":
-		params.Format = vips.ImageTypeAVIF
-		params.Quality = quality
-	case "heif":
-		params.Format = vips.ImageTypeHEIF
-		params.Quality = quality
-	default:
-		params.Format = vips.ImageTypeJPEG
+// notBeneficial reports whether an output of size bytes fails the
+// OnlyIfSmaller policy, and marks the result accordingly.
+func (ic *ImageConverter) notBeneficial(size int64, result *ConversionResult) bool {
+	if !ic.options.OnlyIfSmaller {
+		return false
+	}
+	limit := float64(result.OriginalSize) * (1 - ic.options.MinSavings/100)
+	if size < result.OriginalSize && float64(size) <= limit {
+		return false
 	}
-	return params
+	result.NotBeneficial = true
+	result.NewSize = size
+	return true
+}
+
+// OutputPaths returns every path the conversion of the source at path to
+// format writes when its planned output is outputPath: one per rendition
+// variant, one per frame when frames are split, and outputPath otherwise.
+// page is the page of a split document job. Variants without a width are
+// named after the upright source width, before any operation changes it.
+func (ic *ImageConverter) OutputPaths(path, format, outputPath string, page int) ([]string, error) {
+	if ro := ic.options.Renditions; ro.Enabled() {
+		width := 0
+		if len(ro.Widths) == 0 && strings.Contains(ro.template(), "{width}") {
+			img, err := ic.loadImage(path, 0)
+			if err != nil {
+				return nil, err
+			}
+			width = img.Width()
+			if !ic.options.NoAutoOrient && img.Orientation() >= 5 && img.Orientation() <= 8 {
+				width = img.Height()
+			}
+			img.Close()
+		}
+		return ro.outputPaths(outputPath, format, width), nil
+	}
+
+	if ic.options.Animation.Split && page == 0 {
+		frames, err := ic.splitFrames(path)
+		if err != nil {
+			return nil, err
+		}
+		if frames > 1 {
+			paths := make([]string, frames)
+			for i := range paths {
+				paths[i] = FramePath(outputPath, i+1, frames)
+			}
+			return paths, nil
+		}
+	}
+	return []string{outputPath}, nil
+}
+
+// verifyOutput re-reads the header of a freshly written image and checks that
+// it decodes as the target format with the expected frame dimensions and,
+// for animations, the expected number of frames. Outputs written by a
+// pure-Go backend are decoded by it, since libvips may not load them natively
+// (BMP only through ImageMagick); that only checks the size, and not even
+// that when the encoder picks it.
+func verifyOutput(path, format string, width, height, frames int) error {
+	f := LookupFormat(format)
+	if f != nil && !f.vipsWrites() && f.GoDecode != nil {
+		decoded, err := decodeWithGo(path, f)
+		if err != nil {
+			return fmt.Errorf("%w: output does not decode: %v", appErrors.ErrVerifyFailed, err)
+		}
+		if size := decoded.Bounds().Size(); !f.Resizes && (size.X != width || size.Y != height) {
+			return fmt.Errorf("%w: expected %dx%d output, got %dx%d", appErrors.ErrVerifyFailed, width, height, size.X, size.Y)
+		}
+		return nil
+	}
+
+	img, err := vips.NewImageFromFile(path)
+	if err != nil {
+		return fmt.Errorf("%w: output does not decode: %v", appErrors.ErrVerifyFailed, err)
+	}
+	defer img.Close()
+
+	if f != nil && img.Format() != f.VipsType {
+		return fmt.Errorf("%w: expected %s output, got %s", appErrors.ErrVerifyFailed, format, vips.ImageTypes[img.Format()])
+	}
+	if img.Width() != width || img.Height() != height {
+		return fmt.Errorf("%w: expected %dx%d output, got %dx%d", appErrors.ErrVerifyFailed, width, height, img.Width(), img.Height())
+	}
+	if frames > 1 && img.Pages() != frames {
+		return fmt.Errorf("%w: expected %d frames, got %d", appErrors.ErrVerifyFailed, frames, img.Pages())
+	}
+	return nil
 }
 
 // getFileExtension efficiently extracts and normalizes file extension.
@@ -278,40 +440,63 @@ func getFileExtension(path string) string {
 }
 
 // isAlreadyInFormat checks if file is already in target format.
-func isAlreadyInFormat(currentExt, targetFormat string) bool {
-	if currentExt == targetFormat {
-		return true
-	}
-	return (currentExt == "jpg" && targetFormat == "jpeg") ||
-		(currentExt == "jpeg" && targetFormat == "jpg")
+func isAlreadyInFormat(currentFormat, targetFormat string) bool {
+	return sameFormat(currentFormat, targetFormat)
 }
 
-// getCacheKey generates a unique key for caching based on input path and target format.
-func (ic *ImageConverter) getCacheKey(inputPath, format string) string {
-	hasher := md5.New()
-	hasher.Write([]byte(inputPath))
-	hasher.Write([]byte(format))
-	hasher.Write([]byte(ic.getConfigHash()))
-	return hex.EncodeToString(hasher.Sum(nil))
-}
-
-// getConfigHash creates a hash of conversion settings for cache validation.
-func (ic *ImageConverter) getConfigHash() string {
-	return strconv.FormatUint(uint64(ic.options.Quality), 10) + "_" + strconv.FormatUint(uint64(ic.options.MaxDimension), 10)
-}
-
-// isCacheValid checks if cached conversion is still valid.
-func (ic *ImageConverter) isCacheValid(cached *cacheEntry, sourceModTime time.Time, expectedOutputPath string) bool {
-	if sourceModTime.After(cached.lastModified) {
-		return false
-	}
-	if _, err := os.Stat(expectedOutputPath); err != nil {
-		return false
+// getConfigHash hashes every setting that affects the output for format, so
+// changing any of them invalidates cached conversions.
+func (ic *ImageConverter) getConfigHash(format string) string {
+	settings := struct {
+		Format        string
+		Quality       uint16
+		MaxDimension  uint16
+		Resize        ResizeOptions
+		Renditions    RenditionOptions
+		Animation     AnimationOptions
+		Pages         PageOptions
+		Color         ColorOptions
+		NoAutoOrient  bool
+		Operations    []Operation
+		Watermark     WatermarkOptions
+		Adjust        AdjustOptions
+		Alpha         AlphaOptions
+		Raw           RawOptions
+		Metadata      string
+		MetadataAllow []string
+		MetadataDeny  []string
+		Encoder       EncoderOptions
+		TargetSize    int64
+		Downscale     bool
+		TargetSSIM    float64
+		Optimize      bool
+	}{
+		Format:        format,
+		Quality:       ic.options.Quality,
+		MaxDimension:  ic.options.MaxDimension,
+		Resize:        ic.options.Resize,
+		Renditions:    ic.options.Renditions,
+		Animation:     ic.options.Animation,
+		Pages:         ic.options.Pages,
+		Color:         ic.options.Color,
+		NoAutoOrient:  ic.options.NoAutoOrient,
+		Operations:    ic.options.Operations,
+		Watermark:     ic.options.Watermark,
+		Adjust:        ic.options.Adjust,
+		Alpha:         ic.options.Alpha,
+		Raw:           ic.options.Raw,
+		Metadata:      ic.options.Metadata,
+		MetadataAllow: ic.options.MetadataAllow,
+		MetadataDeny:  ic.options.MetadataDeny,
+		Encoder:       ic.options.Encoder,
+		TargetSize:    ic.options.TargetSize,
+		Downscale:     ic.options.TargetDownscale,
+		TargetSSIM:    ic.options.TargetSSIM,
+		Optimize:      ic.options.Optimize,
 	}
-	if cached.configHash != ic.getConfigHash() {
-		return false
-	}
-	return true
+	data, _ := json.Marshal(settings)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }
 
 // createBackup creates a backup of the specified file.
@@ -327,13 +512,30 @@ func (ic *ImageConverter) createBackup(path string) error {
 }
 
 // copyFileOptimized performs an optimized atomic file copy.
-func (ic *ImageConverter) copyFileOptimized(src, dst string) (err error) {
+func (ic *ImageConverter) copyFileOptimized(src, dst string) error {
 	srcFile, err := os.Open(src)
 	if err != nil {
 		return fmt.Errorf("failed to open source: %w", err)
 	}
 	defer srcFile.Close()
 
+	buf := ic.bufPool.get()
+	defer ic.bufPool.put(buf)
+
+	return writeFileAtomic(dst, func(w io.Writer) error {
+		if _, err := io.CopyBuffer(w, srcFile, buf); err != nil {
+			return fmt.Errorf("failed to copy data: %w", err)
+		}
+		return nil
+	}, nil)
+}
+
+// writeFileAtomic writes dst through a temp file created in the same directory,
+// syncs it, runs the optional verify check on it and renames it into place, so
+// dst is either absent, the old content or the complete new content, never a
+// partial write. The directory is synced afterwards so the rename is durable
+// before callers act on it, e.g. by deleting the original.
+func writeFileAtomic(dst string, write func(w io.Writer) error, verify func(tmpPath string) error) (err error) {
 	tmpFile, err := os.CreateTemp(filepath.Dir(dst), ".tmp_"+filepath.Base(dst))
 	if err != nil {
 		return fmt.Errorf("failed to create temp file: %w", err)
@@ -346,11 +548,11 @@ func (ic *ImageConverter) copyFileOptimized(src, dst string) (err error) {
 		}
 	}()
 
-	buf := ic.bufPool.get()
-	defer ic.bufPool.put(buf)
-
-	if _, err = io.CopyBuffer(tmpFile, srcFile, buf); err != nil {
-		return fmt.Errorf("failed to copy data: %w", err)
+	if err = write(tmpFile); err != nil {
+		return err
+	}
+	if err = tmpFile.Chmod(0644); err != nil {
+		return fmt.Errorf("failed to set temp file permissions: %w", err)
 	}
 	if err = tmpFile.Sync(); err != nil {
 		return fmt.Errorf("failed to sync temp file: %w", err)
@@ -358,10 +560,26 @@ func (ic *ImageConverter) copyFileOptimized(src, dst string) (err error) {
 	if err = tmpFile.Close(); err != nil {
 		return fmt.Errorf("failed to close temp file: %w", err)
 	}
+	if verify != nil {
+		if err = verify(tmpFile.Name()); err != nil {
+			return err
+		}
+	}
 	if err = os.Rename(tmpFile.Name(), dst); err != nil {
-		os.Remove(tmpFile.Name())
 		return fmt.Errorf("failed to rename temp file: %w", err)
 	}
+	syncDir(filepath.Dir(dst))
 
 	return nil
 }
+
+// syncDir flushes a directory entry to disk. It is best effort: some platforms
+// (notably Windows) do not support syncing directories.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,604 @@
+package converter
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+
+	appErrors "github.com/MostafaSensei106/GoPix/internal/errors"
+)
+
+// EncoderOptions holds the per-format encoder settings used when exporting.
+// A zero Quality in any of the format options means "use ConvertOptions.Quality".
+type EncoderOptions struct {
+	PNG  PNGOptions
+	JPEG JPEGOptions
+	WebP WebPOptions
+	AVIF HEIFOptions
+	HEIF HEIFOptions
+	TIFF TIFFOptions
+	GIF  GIFOptions
+	JXL  JXLOptions
+	JP2  JP2Options
+	ICO  ICOOptions
+}
+
+// PNGOptions contains the PNG encoder settings.
+type PNGOptions struct {
+	Quality     int  // Only used when Palette is enabled
+	Compression int  // zlib compression level, 0-9
+	Interlace   bool // Adam7 interlacing
+	Palette     bool // Quantise to an 8-bit palette
+}
+
+// JPEGOptions contains the JPEG encoder settings.
+type JPEGOptions struct {
+	Quality        int
+	Progressive    bool
+	OptimizeCoding bool
+	Subsampling    vips.SubsampleMode
+}
+
+// WebPOptions contains the WebP encoder settings.
+type WebPOptions struct {
+	Quality      int
+	Lossless     bool
+	NearLossless bool
+	Effort       int // 0 (fastest) to 6 (slowest)
+}
+
+// HEIFOptions contains the settings shared by the AVIF and HEIF encoders.
+type HEIFOptions struct {
+	Quality  int
+	Lossless bool
+	Effort   int // 0 (fastest) to 9 (slowest)
+	BitDepth int // 8, 10 or 12
+}
+
+// TIFFOptions contains the TIFF encoder settings.
+type TIFFOptions struct {
+	Quality     int // Only used with jpeg/webp compression
+	Compression vips.TiffCompression
+	Predictor   vips.TiffPredictor
+}
+
+// GIFOptions contains the GIF encoder settings.
+type GIFOptions struct {
+	Quality int
+	Effort  int // 1 (fastest) to 10 (slowest)
+	Dither  float64
+}
+
+// JXLOptions contains the JPEG XL encoder settings.
+type JXLOptions struct {
+	Quality  int
+	Lossless bool
+	Effort   int // 1 (fastest) to 9 (slowest)
+}
+
+// JP2Options contains the JPEG 2000 encoder settings.
+type JP2Options struct {
+	Quality     int
+	Lossless    bool
+	Subsampling vips.SubsampleMode
+}
+
+// ICOOptions contains the ICO encoder settings.
+type ICOOptions struct {
+	Sizes []int // Square sizes stored in the icon, 1-256 pixels each
+}
+
+// DefaultEncoderOptions returns the encoder settings used when nothing is configured.
+func DefaultEncoderOptions() EncoderOptions {
+	return EncoderOptions{
+		PNG:  PNGOptions{Compression: 6},
+		JPEG: JPEGOptions{Subsampling: vips.VipsForeignSubsampleAuto},
+		WebP: WebPOptions{Effort: 4},
+		AVIF: HEIFOptions{Effort: 5, BitDepth: 8},
+		HEIF: HEIFOptions{Effort: 5, BitDepth: 8},
+		TIFF: TIFFOptions{Compression: vips.TiffCompressionLzw, Predictor: vips.TiffPredictorHorizontal},
+		GIF:  GIFOptions{Effort: 7},
+		JXL:  JXLOptions{Effort: 7},
+		JP2:  JP2Options{Subsampling: vips.VipsForeignSubsampleAuto},
+		ICO:  ICOOptions{Sizes: DefaultICOSizes},
+	}
+}
+
+var pngCompressionLevels = map[string]int{
+	"none":             0,
+	"no_compression":   0,
+	"best_speed":       1,
+	"default":          6,
+	"best_compression": 9,
+}
+
+var jpegSubsampleModes = map[string]vips.SubsampleMode{
+	"auto": vips.VipsForeignSubsampleAuto,
+	"on":   vips.VipsForeignSubsampleOn,
+	"420":  vips.VipsForeignSubsampleOn,
+	"off":  vips.VipsForeignSubsampleOff,
+	"444":  vips.VipsForeignSubsampleOff,
+}
+
+var tiffCompressions = map[string]vips.TiffCompression{
+	"none":     vips.TiffCompressionNone,
+	"jpeg":     vips.TiffCompressionJpeg,
+	"deflate":  vips.TiffCompressionDeflate,
+	"packbits": vips.TiffCompressionPackbits,
+	"lzw":      vips.TiffCompressionLzw,
+	"webp":     vips.TiffCompressionWebp,
+	"zstd":     vips.TiffCompressionZstd,
+}
+
+var tiffPredictors = map[string]vips.TiffPredictor{
+	"none":       vips.TiffPredictorNone,
+	"horizontal": vips.TiffPredictorHorizontal,
+	"float":      vips.TiffPredictorFloat,
+}
+
+// ParseEncoderOptions builds EncoderOptions from the output_settings section
+// of the configuration file. Each key is a target format holding a mapping of
+// option names to values, e.g. {"webp": {"lossless": true}}. Unknown formats
+// and options are rejected so that typos do not silently fall back to defaults.
+func ParseEncoderOptions(settings map[string]interface{}) (EncoderOptions, error) {
+	opts := DefaultEncoderOptions()
+
+	// Sort formats so aliases such as jpg/jpeg are applied in a stable order
+	formats := make([]string, 0, len(settings))
+	for format := range settings {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+
+	for _, format := range formats {
+		values, ok := settings[format].(map[string]interface{})
+		if !ok {
+			return opts, fmt.Errorf("%w: output_settings.%s must be a mapping of options", appErrors.ErrInvalidOption, format)
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := opts.Set(format, key, values[key]); err != nil {
+				return opts, err
+			}
+		}
+	}
+	return opts, nil
+}
+
+// ApplyOverrides applies command line overrides in the form "format.option=value",
+// for example "png.interlace=true" or "webp.effort=6".
+func (eo *EncoderOptions) ApplyOverrides(overrides []string) error {
+	for _, override := range overrides {
+		name, value, ok := strings.Cut(override, "=")
+		format, key, hasKey := strings.Cut(name, ".")
+		if !ok || !hasKey {
+			return fmt.Errorf("%w: encoder option %q must look like format.option=value", appErrors.ErrInvalidOption, override)
+		}
+		if err := eo.Set(strings.TrimSpace(format), strings.TrimSpace(key), strings.TrimSpace(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetQuality forces the given quality on every format, discarding the per-format
+// qualities from the configuration file. It is used when --quality is passed explicitly.
+func (eo *EncoderOptions) SetQuality(quality int) {
+	for _, f := range Formats() {
+		if f.Settings == nil {
+			continue
+		}
+		if setting := f.Settings(eo).QualitySetting(); setting != nil {
+			*setting = quality
+		}
+	}
+}
+
+// Set validates and stores a single encoder option for the given format.
+func (eo *EncoderOptions) Set(format, key string, value interface{}) error {
+	format = strings.ToLower(format)
+	key = strings.ToLower(key)
+
+	f := LookupFormat(format)
+	if f == nil || f.Settings == nil {
+		return fmt.Errorf("%w: no encoder options for format %s", appErrors.ErrUnsupportedFormat, format)
+	}
+	if !f.hasOption(key) {
+		return fmt.Errorf("%w: %s.%s: unknown option (expected one of %s)", appErrors.ErrInvalidOption, format, key, strings.Join(f.Options, ", "))
+	}
+	if err := f.Settings(eo).Set(key, value); err != nil {
+		return fmt.Errorf("%w: %s.%s: %v", appErrors.ErrInvalidOption, format, key, err)
+	}
+	return nil
+}
+
+func (o *PNGOptions) Set(key string, value interface{}) (err error) {
+	switch key {
+	case "quality":
+		o.Quality, err = toIntInRange(value, 1, 100)
+	case "compression":
+		if name, ok := value.(string); ok {
+			if level, known := pngCompressionLevels[strings.ToLower(name)]; known {
+				o.Compression = level
+				return nil
+			}
+		}
+		o.Compression, err = toIntInRange(value, 0, 9)
+	case "interlace":
+		o.Interlace, err = toBool(value)
+	case "palette":
+		o.Palette, err = toBool(value)
+	default:
+		err = fmt.Errorf("unknown option")
+	}
+	return err
+}
+
+func (o *JPEGOptions) Set(key string, value interface{}) (err error) {
+	switch key {
+	case "quality":
+		o.Quality, err = toIntInRange(value, 1, 100)
+	case "progressive", "interlace":
+		o.Progressive, err = toBool(value)
+	case "optimize_coding":
+		o.OptimizeCoding, err = toBool(value)
+	case "subsampling":
+		mode, ok := jpegSubsampleModes[strings.ToLower(fmt.Sprint(value))]
+		if !ok {
+			return fmt.Errorf("expected one of auto, 420, 444")
+		}
+		o.Subsampling = mode
+	default:
+		err = fmt.Errorf("unknown option")
+	}
+	return err
+}
+
+func (o *WebPOptions) Set(key string, value interface{}) (err error) {
+	switch key {
+	case "quality":
+		o.Quality, err = toIntInRange(value, 1, 100)
+	case "lossless":
+		o.Lossless, err = toBool(value)
+	case "near_lossless":
+		o.NearLossless, err = toBool(value)
+	case "effort":
+		o.Effort, err = toIntInRange(value, 0, 6)
+	case "alpha_quality":
+		err = fmt.Errorf("not supported: the govips bindings do not expose libvips' alpha_q, transparency is always encoded at alpha quality 100")
+	default:
+		err = fmt.Errorf("unknown option")
+	}
+	return err
+}
+
+func (o *HEIFOptions) Set(key string, value interface{}) (err error) {
+	switch key {
+	case "quality":
+		o.Quality, err = toIntInRange(value, 1, 100)
+	case "lossless":
+		o.Lossless, err = toBool(value)
+	case "effort":
+		o.Effort, err = toIntInRange(value, 0, 9)
+	case "speed":
+		// speed is the inverse of effort: 0 is slowest, 9 is fastest
+		var speed int
+		speed, err = toIntInRange(value, 0, 9)
+		o.Effort = 9 - speed
+	case "bit_depth":
+		o.BitDepth, err = toInt(value)
+		if err == nil && o.BitDepth != 8 && o.BitDepth != 10 && o.BitDepth != 12 {
+			err = fmt.Errorf("expected 8, 10 or 12")
+		}
+	default:
+		err = fmt.Errorf("unknown option")
+	}
+	return err
+}
+
+func (o *TIFFOptions) Set(key string, value interface{}) (err error) {
+	switch key {
+	case "quality":
+		o.Quality, err = toIntInRange(value, 1, 100)
+	case "compression":
+		compression, ok := tiffCompressions[strings.ToLower(fmt.Sprint(value))]
+		if !ok {
+			return fmt.Errorf("expected one of none, jpeg, deflate, packbits, lzw, webp, zstd")
+		}
+		o.Compression = compression
+	case "predictor":
+		predictor, ok := tiffPredictors[strings.ToLower(fmt.Sprint(value))]
+		if !ok {
+			return fmt.Errorf("expected one of none, horizontal, float")
+		}
+		o.Predictor = predictor
+	default:
+		err = fmt.Errorf("unknown option")
+	}
+	return err
+}
+
+func (o *GIFOptions) Set(key string, value interface{}) (err error) {
+	switch key {
+	case "quality":
+		o.Quality, err = toIntInRange(value, 1, 100)
+	case "effort":
+		o.Effort, err = toIntInRange(value, 1, 10)
+	case "dither":
+		o.Dither, err = toFloat(value)
+		if err == nil && (o.Dither < 0 || o.Dither > 1) {
+			err = fmt.Errorf("expected a value between 0 and 1")
+		}
+	default:
+		err = fmt.Errorf("unknown option")
+	}
+	return err
+}
+
+func (o *JXLOptions) Set(key string, value interface{}) (err error) {
+	switch key {
+	case "quality":
+		o.Quality, err = toIntInRange(value, 1, 100)
+	case "lossless":
+		o.Lossless, err = toBool(value)
+	case "effort":
+		o.Effort, err = toIntInRange(value, 1, 9)
+	default:
+		err = fmt.Errorf("unknown option")
+	}
+	return err
+}
+
+func (o *JP2Options) Set(key string, value interface{}) (err error) {
+	switch key {
+	case "quality":
+		o.Quality, err = toIntInRange(value, 1, 100)
+	case "lossless":
+		o.Lossless, err = toBool(value)
+	case "subsampling":
+		mode, ok := jpegSubsampleModes[strings.ToLower(fmt.Sprint(value))]
+		if !ok {
+			return fmt.Errorf("expected one of auto, 420, 444")
+		}
+		o.Subsampling = mode
+	default:
+		err = fmt.Errorf("unknown option")
+	}
+	return err
+}
+
+func (o *ICOOptions) Set(key string, value interface{}) (err error) {
+	switch key {
+	case "sizes":
+		o.Sizes, err = toIconSizes(value)
+	default:
+		err = fmt.Errorf("unknown option")
+	}
+	return err
+}
+
+// toIconSizes converts a YAML list or a comma separated string such as
+// "16,32,48,256" to a list of distinct icon sizes.
+func toIconSizes(value interface{}) ([]int, error) {
+	var items []interface{}
+	switch v := value.(type) {
+	case []interface{}:
+		items = v
+	case string:
+		for _, item := range strings.Split(v, ",") {
+			items = append(items, strings.TrimSpace(item))
+		}
+	default:
+		items = []interface{}{value}
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("expected at least one size")
+	}
+	sizes := make([]int, 0, len(items))
+	for _, item := range items {
+		size, err := toIntInRange(item, 1, icoMaxSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, seen := range sizes {
+			if seen == size {
+				return nil, fmt.Errorf("size %d is listed twice", size)
+			}
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+// exportImage encodes the image to the target format using the per-format
+// encoder options and the configured metadata handling.
+func (ic *ImageConverter) exportImage(img *vips.ImageRef, format string) ([]byte, error) {
+	return ic.exportImageWithQuality(img, format, 0)
+}
+
+// exportImageWithQuality is exportImage with the quality forced to quality,
+// unless it is 0.
+func (ic *ImageConverter) exportImageWithQuality(img *vips.ImageRef, format string, quality int) ([]byte, error) {
+	f := LookupFormat(format)
+	if f == nil {
+		return nil, fmt.Errorf("%w: %s", appErrors.ErrUnsupportedFormat, format)
+	}
+	if quality == 0 {
+		quality = ic.formatQuality(format)
+	}
+	buf, err := f.encode(img, EncodeParams{
+		Options: &ic.options.Encoder,
+		Quality: quality,
+		Strip:   ic.stripsAllMetadata(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export image: %w", err)
+	}
+	return buf, nil
+}
+
+// quality returns the per-format quality if set, otherwise the global quality.
+func (ic *ImageConverter) quality(formatQuality int) int {
+	if formatQuality > 0 {
+		return formatQuality
+	}
+	return int(ic.options.Quality)
+}
+
+// formatQuality returns the quality exportImage uses for format.
+func (ic *ImageConverter) formatQuality(format string) int {
+	f := LookupFormat(format)
+	if f == nil || f.Settings == nil {
+		return ic.quality(0)
+	}
+	if setting := f.Settings(&ic.options.Encoder).QualitySetting(); setting != nil {
+		return ic.quality(*setting)
+	}
+	return ic.quality(0)
+}
+
+// qualityAffectsSize reports whether the encoder quality changes the output
+// size for format with the current encoder options. Lossless encoders and
+// formats without options ignore it.
+func (ic *ImageConverter) qualityAffectsSize(format string) bool {
+	f := LookupFormat(format)
+	if f == nil || f.Settings == nil {
+		return false
+	}
+	return f.Settings(&ic.options.Encoder).Lossy()
+}
+
+// QualitySetting implements FormatSettings.
+func (o *PNGOptions) QualitySetting() *int { return &o.Quality }
+
+// Lossy implements FormatSettings, only palette quantisation uses the quality.
+func (o *PNGOptions) Lossy() bool { return o.Palette }
+
+// QualitySetting implements FormatSettings.
+func (o *JPEGOptions) QualitySetting() *int { return &o.Quality }
+
+// Lossy implements FormatSettings.
+func (o *JPEGOptions) Lossy() bool { return true }
+
+// QualitySetting implements FormatSettings.
+func (o *WebPOptions) QualitySetting() *int { return &o.Quality }
+
+// Lossy implements FormatSettings.
+func (o *WebPOptions) Lossy() bool { return !o.Lossless }
+
+// QualitySetting implements FormatSettings.
+func (o *HEIFOptions) QualitySetting() *int { return &o.Quality }
+
+// Lossy implements FormatSettings.
+func (o *HEIFOptions) Lossy() bool { return !o.Lossless }
+
+// QualitySetting implements FormatSettings.
+func (o *TIFFOptions) QualitySetting() *int { return &o.Quality }
+
+// Lossy implements FormatSettings, only jpeg and webp compression use the quality.
+func (o *TIFFOptions) Lossy() bool {
+	return o.Compression == vips.TiffCompressionJpeg || o.Compression == vips.TiffCompressionWebp
+}
+
+// QualitySetting implements FormatSettings.
+func (o *GIFOptions) QualitySetting() *int { return &o.Quality }
+
+// Lossy implements FormatSettings.
+func (o *GIFOptions) Lossy() bool { return false }
+
+// QualitySetting implements FormatSettings.
+func (o *JXLOptions) QualitySetting() *int { return &o.Quality }
+
+// Lossy implements FormatSettings.
+func (o *JXLOptions) Lossy() bool { return !o.Lossless }
+
+// QualitySetting implements FormatSettings.
+func (o *JP2Options) QualitySetting() *int { return &o.Quality }
+
+// Lossy implements FormatSettings.
+func (o *JP2Options) Lossy() bool { return !o.Lossless }
+
+// QualitySetting implements FormatSettings, icons are stored losslessly.
+func (o *ICOOptions) QualitySetting() *int { return nil }
+
+// Lossy implements FormatSettings.
+func (o *ICOOptions) Lossy() bool { return false }
+
+// toInt converts YAML and command line values to an int.
+func toInt(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case int:
+		return v, nil
+	case int64:
+		return int(v), nil
+	case uint64:
+		return int(v), nil
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, fmt.Errorf("expected a whole number, got %v", v)
+		}
+		return int(v), nil
+	case string:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("expected a number, got %q", v)
+		}
+		return n, nil
+	default:
+		return 0, fmt.Errorf("expected a number, got %v", value)
+	}
+}
+
+// toIntInRange converts value to an int and checks that it lies within [min, max].
+func toIntInRange(value interface{}, min, max int) (int, error) {
+	n, err := toInt(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < min || n > max {
+		return 0, fmt.Errorf("expected a value between %d and %d, got %d", min, max, n)
+	}
+	return n, nil
+}
+
+// toFloat converts YAML and command line values to a float64.
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("expected a number, got %q", v)
+		}
+		return f, nil
+	default:
+		return 0, fmt.Errorf("expected a number, got %v", value)
+	}
+}
+
+// toBool converts YAML and command line values to a bool.
+func toBool(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("expected true or false, got %q", v)
+		}
+		return b, nil
+	default:
+		return false, fmt.Errorf("expected true or false, got %v", value)
+	}
+}
@@ -0,0 +1,553 @@
+package converter
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
+
+	appErrors "github.com/MostafaSensei106/GoPix/internal/errors"
+)
+
+// Format describes an image format: its names, what it can store, its
+// encoder options and the backends that read and write it. Every format is
+// registered once, and the validator, the encoder options and the converter
+// all look it up here.
+type Format struct {
+	Name       string         // Canonical name, e.g. "jpg"
+	Aliases    []string       // Other names accepted for the format, e.g. "jpeg"
+	Extensions []string       // File extensions of the format, without the dot
+	Alpha      bool           // Can store transparency
+	Animation  bool           // Can store several frames
+	CMYK       bool           // Can store CMYK pixels
+	Lossless   bool           // Can be encoded without loss
+	Resizes    bool           // The encoder picks the output dimensions, e.g. icon sizes
+	VipsType   vips.ImageType // Type libvips detects on load
+	Options    []string       // Encoder option keys accepted in output_settings and --encoder-opt
+
+	// Sniff reports whether the leading bytes of a file are in the format,
+	// see DetectFormat. nil when the format cannot be recognised.
+	Sniff func(header []byte) bool
+
+	// Settings returns the section of the encoder options of the format, nil
+	// when the format has no options.
+	Settings func(eo *EncoderOptions) FormatSettings
+	// Encode writes the format with libvips, nil when the format is only read.
+	Encode func(img *vips.ImageRef, params EncodeParams) ([]byte, error)
+
+	// GoDecode and GoEncode are pure-Go backends, used when libvips was built
+	// without the codec. nil when there is none.
+	GoDecode func(r io.Reader) (image.Image, error)
+	GoEncode func(w io.Writer, img image.Image, params EncodeParams) error
+}
+
+// FormatSettings is the section of EncoderOptions that belongs to a format.
+type FormatSettings interface {
+	Set(key string, value interface{}) error // Validate and store a single option
+	QualitySetting() *int                    // Per-format quality, 0 = the global quality, nil = no quality
+	Lossy() bool                             // Whether the quality changes the output with these settings
+}
+
+// EncodeParams holds what an encoder needs besides the image.
+type EncodeParams struct {
+	Options *EncoderOptions
+	Quality int  // Quality resolved for the format
+	Strip   bool // Drop all metadata
+}
+
+// registry holds the registered formats by name, alias and extension.
+var registry = map[string]*Format{}
+
+// RegisterFormat adds f to the registry, replacing any format registered
+// under one of its names or extensions.
+func RegisterFormat(f *Format) {
+	for _, name := range append(append([]string{f.Name}, f.Aliases...), f.Extensions...) {
+		registry[strings.ToLower(name)] = f
+	}
+}
+
+// LookupFormat returns the format registered under a name, alias or
+// extension, or nil.
+func LookupFormat(name string) *Format {
+	return registry[strings.ToLower(strings.TrimPrefix(name, "."))]
+}
+
+// Formats returns the registered formats sorted by name.
+func Formats() []*Format {
+	seen := make(map[*Format]bool, len(registry))
+	list := make([]*Format, 0, len(registry))
+	for _, f := range registry {
+		if !seen[f] {
+			seen[f] = true
+			list = append(list, f)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// IsTargetFormat reports whether name is a registered format that can be written.
+func IsTargetFormat(name string) bool {
+	f := LookupFormat(name)
+	return f != nil && f.CanEncode()
+}
+
+// TargetName returns the registered name of the format called name, e.g. jpg
+// for jpeg, or "" when it is unknown or cannot be written.
+func TargetName(name string) string {
+	f := LookupFormat(name)
+	if f == nil || !f.CanEncode() {
+		return ""
+	}
+	return f.Name
+}
+
+// TargetFormats lists the names of the formats that can be written.
+func TargetFormats() []string {
+	var names []string
+	for _, f := range Formats() {
+		if f.CanEncode() {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
+
+// formatIs reports whether the format registered as name has the capability.
+func formatIs(name string, capability func(f *Format) bool) bool {
+	f := LookupFormat(name)
+	return f != nil && capability(f)
+}
+
+// sameFormat reports whether two names refer to the same format, e.g. jpg and jpeg.
+func sameFormat(a, b string) bool {
+	if strings.EqualFold(a, b) {
+		return true
+	}
+	f := LookupFormat(a)
+	return f != nil && f == LookupFormat(b)
+}
+
+// vipsReads reports whether the linked libvips has a loader for the format.
+// libvips is built with both directions of a codec, so this also tells
+// whether Encode can be used.
+func (f *Format) vipsReads() bool {
+	return f.VipsType != vips.ImageTypeUnknown && vips.IsTypeSupported(f.VipsType)
+}
+
+// CanEncode reports whether the format can be written by any backend.
+func (f *Format) CanEncode() bool {
+	return f.Encode != nil || f.GoEncode != nil
+}
+
+// hasOption reports whether key is one of the encoder options of the format.
+func (f *Format) hasOption(key string) bool {
+	return containsString(f.Options, key)
+}
+
+// vipsWrites reports whether encode writes the format with libvips rather
+// than with the pure-Go backend.
+func (f *Format) vipsWrites() bool {
+	return f.Encode != nil && (f.vipsReads() || f.GoEncode == nil)
+}
+
+// encode writes img in the format, with libvips when it has the codec and
+// with the pure-Go backend otherwise.
+func (f *Format) encode(img *vips.ImageRef, params EncodeParams) ([]byte, error) {
+	if f.vipsWrites() {
+		return f.Encode(img, params)
+	}
+	if f.GoEncode == nil {
+		return nil, fmt.Errorf("%w: no encoder for %s", appErrors.ErrUnsupportedFormat, f.Name)
+	}
+
+	// The Go encoders write a single frame
+	if frameCount(img) > 1 {
+		first, err := extractFrame(img, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer first.Close()
+		img = first
+	}
+	decoded, err := img.ToImage(vips.NewDefaultPNGExportParams())
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := f.GoEncode(&buf, decoded, params); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// goFallback returns the format of path when it has to be decoded by its
+// pure-Go backend, or nil when libvips reads it.
+func goFallback(path string) *Format {
+	f := LookupFormat(sourceFormat(path))
+	if f == nil || f.GoDecode == nil || f.vipsReads() {
+		return nil
+	}
+	return f
+}
+
+// OpenImage opens the image at path, decoding it with the pure-Go backend of
+// its format when libvips lacks the codec, and RAW files from their embedded
+// preview. libvips only reads the header until the pixels are needed.
+func OpenImage(path string) (*vips.ImageRef, error) {
+	if isRawFile(path) {
+		return loadRawPreview(path)
+	}
+	if f := goFallback(path); f != nil {
+		return loadWithGo(path, f)
+	}
+	img, err := vips.NewImageFromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", appErrors.ErrCorruptedImage, err)
+	}
+	return img, nil
+}
+
+// decodeWithGo decodes the file at path with the pure-Go backend of f.
+func decodeWithGo(path string, f *Format) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	decoded, err := f.GoDecode(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", appErrors.ErrCorruptedImage, err)
+	}
+	return decoded, nil
+}
+
+// loadWithGo decodes the file at path with the pure-Go backend of f and hands
+// the pixels to libvips as an uncompressed PNG.
+func loadWithGo(path string, f *Format) (*vips.ImageRef, error) {
+	decoded, err := decodeWithGo(path, f)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.NoCompression}
+	if err := encoder.Encode(&buf, decoded); err != nil {
+		return nil, fmt.Errorf("%w: %w", appErrors.ErrCorruptedImage, err)
+	}
+	img, err := vips.NewImageFromBuffer(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", appErrors.ErrCorruptedImage, err)
+	}
+	return img, nil
+}
+
+// pngCompression maps the zlib level of the PNG options to the levels of image/png.
+func pngCompression(level int) png.CompressionLevel {
+	switch {
+	case level == 0:
+		return png.NoCompression
+	case level <= 3:
+		return png.BestSpeed
+	case level >= 9:
+		return png.BestCompression
+	default:
+		return png.DefaultCompression
+	}
+}
+
+func init() {
+	RegisterFormat(&Format{
+		Name:       "png",
+		Extensions: []string{"png"},
+		Sniff:      hasPrefix("\x89PNG\r\n\x1a\n"),
+		Alpha:      true,
+		Lossless:   true,
+		VipsType:   vips.ImageTypePNG,
+		Options:    []string{"quality", "compression", "interlace", "palette"},
+		Settings:   func(eo *EncoderOptions) FormatSettings { return &eo.PNG },
+		Encode: func(img *vips.ImageRef, p EncodeParams) ([]byte, error) {
+			params := vips.NewPngExportParams()
+			params.StripMetadata = p.Strip
+			params.Compression = p.Options.PNG.Compression
+			params.Interlace = p.Options.PNG.Interlace
+			params.Palette = p.Options.PNG.Palette
+			params.Quality = p.Quality
+			buf, _, err := img.ExportPng(params)
+			return buf, err
+		},
+		GoDecode: png.Decode,
+		GoEncode: func(w io.Writer, img image.Image, p EncodeParams) error {
+			encoder := png.Encoder{CompressionLevel: pngCompression(p.Options.PNG.Compression)}
+			return encoder.Encode(w, img)
+		},
+	})
+
+	RegisterFormat(&Format{
+		Name:       "jpg",
+		Aliases:    []string{"jpeg"},
+		Extensions: []string{"jpg", "jpeg"},
+		Sniff:      hasPrefix("\xff\xd8\xff"),
+		CMYK:       true,
+		VipsType:   vips.ImageTypeJPEG,
+		Options:    []string{"quality", "progressive", "interlace", "optimize_coding", "subsampling"},
+		Settings:   func(eo *EncoderOptions) FormatSettings { return &eo.JPEG },
+		Encode: func(img *vips.ImageRef, p EncodeParams) ([]byte, error) {
+			params := vips.NewJpegExportParams()
+			params.StripMetadata = p.Strip
+			params.Quality = p.Quality
+			params.Interlace = p.Options.JPEG.Progressive
+			params.OptimizeCoding = p.Options.JPEG.OptimizeCoding
+			params.SubsampleMode = p.Options.JPEG.Subsampling
+			buf, _, err := img.ExportJpeg(params)
+			return buf, err
+		},
+		GoDecode: jpeg.Decode,
+		GoEncode: func(w io.Writer, img image.Image, p EncodeParams) error {
+			return jpeg.Encode(w, img, &jpeg.Options{Quality: p.Quality})
+		},
+	})
+
+	RegisterFormat(&Format{
+		Name:       "webp",
+		Extensions: []string{"webp"},
+		Sniff:      sniffWebP,
+		Alpha:      true,
+		Animation:  true,
+		Lossless:   true,
+		VipsType:   vips.ImageTypeWEBP,
+		Options:    []string{"quality", "lossless", "near_lossless", "effort", "alpha_quality"},
+		Settings:   func(eo *EncoderOptions) FormatSettings { return &eo.WebP },
+		Encode: func(img *vips.ImageRef, p EncodeParams) ([]byte, error) {
+			params := vips.NewWebpExportParams()
+			params.StripMetadata = p.Strip
+			params.Quality = p.Quality
+			params.Lossless = p.Options.WebP.Lossless
+			params.NearLossless = p.Options.WebP.NearLossless
+			params.ReductionEffort = p.Options.WebP.Effort
+			buf, _, err := img.ExportWebp(params)
+			return buf, err
+		},
+		// x/image only decodes WebP
+		GoDecode: webp.Decode,
+	})
+
+	RegisterFormat(&Format{
+		Name:       "tiff",
+		Aliases:    []string{"tif"},
+		Extensions: []string{"tiff", "tif"},
+		Sniff:      hasPrefix("II*\x00", "MM\x00*"),
+		Alpha:      true,
+		CMYK:       true,
+		Lossless:   true,
+		VipsType:   vips.ImageTypeTIFF,
+		Options:    []string{"quality", "compression", "predictor"},
+		Settings:   func(eo *EncoderOptions) FormatSettings { return &eo.TIFF },
+		Encode: func(img *vips.ImageRef, p EncodeParams) ([]byte, error) {
+			params := vips.NewTiffExportParams()
+			params.StripMetadata = p.Strip
+			params.Quality = p.Quality
+			params.Compression = p.Options.TIFF.Compression
+			params.Predictor = p.Options.TIFF.Predictor
+			buf, _, err := img.ExportTiff(params)
+			return buf, err
+		},
+		GoDecode: tiff.Decode,
+		GoEncode: func(w io.Writer, img image.Image, p EncodeParams) error {
+			options := &tiff.Options{Compression: tiff.Deflate, Predictor: p.Options.TIFF.Predictor != vips.TiffPredictorNone}
+			if p.Options.TIFF.Compression == vips.TiffCompressionNone {
+				options.Compression = tiff.Uncompressed
+			}
+			return tiff.Encode(w, img, options)
+		},
+	})
+
+	RegisterFormat(&Format{
+		Name:       "gif",
+		Extensions: []string{"gif"},
+		Sniff:      hasPrefix("GIF87a", "GIF89a"),
+		Alpha:      true,
+		Animation:  true,
+		VipsType:   vips.ImageTypeGIF,
+		Options:    []string{"quality", "effort", "dither"},
+		Settings:   func(eo *EncoderOptions) FormatSettings { return &eo.GIF },
+		Encode: func(img *vips.ImageRef, p EncodeParams) ([]byte, error) {
+			params := vips.NewGifExportParams()
+			params.StripMetadata = p.Strip
+			params.Quality = p.Quality
+			params.Effort = p.Options.GIF.Effort
+			params.Dither = p.Options.GIF.Dither
+			buf, _, err := img.ExportGIF(params)
+			return buf, err
+		},
+		GoDecode: gif.Decode,
+		GoEncode: func(w io.Writer, img image.Image, p EncodeParams) error {
+			return gif.Encode(w, img, &gif.Options{NumColors: 256})
+		},
+	})
+
+	RegisterFormat(&Format{
+		Name:       "avif",
+		Extensions: []string{"avif"},
+		Sniff:      hasBrand("avif", "avis"),
+		Alpha:      true,
+		Animation:  true,
+		Lossless:   true,
+		VipsType:   vips.ImageTypeAVIF,
+		Options:    []string{"quality", "lossless", "effort", "speed", "bit_depth"},
+		Settings:   func(eo *EncoderOptions) FormatSettings { return &eo.AVIF },
+		Encode: func(img *vips.ImageRef, p EncodeParams) ([]byte, error) {
+			params := vips.NewAvifExportParams()
+			params.StripMetadata = p.Strip
+			params.Quality = p.Quality
+			params.Lossless = p.Options.AVIF.Lossless
+			params.Effort = p.Options.AVIF.Effort
+			params.Bitdepth = p.Options.AVIF.BitDepth
+			buf, _, err := img.ExportAvif(params)
+			return buf, err
+		},
+	})
+
+	RegisterFormat(&Format{
+		Name:       "heif",
+		Aliases:    []string{"heic"},
+		Extensions: []string{"heif", "heic"},
+		Sniff:      sniffHEIF,
+		Alpha:      true,
+		Lossless:   true,
+		VipsType:   vips.ImageTypeHEIF,
+		Options:    []string{"quality", "lossless", "effort", "speed", "bit_depth"},
+		Settings:   func(eo *EncoderOptions) FormatSettings { return &eo.HEIF },
+		Encode: func(img *vips.ImageRef, p EncodeParams) ([]byte, error) {
+			// The HEIF encoder has no strip flag, so drop the metadata up front,
+			// keeping the frame timing of animations
+			if p.Strip {
+				if err := img.RemoveMetadata(animationFields...); err != nil {
+					return nil, fmt.Errorf("failed to strip metadata: %w", err)
+				}
+			}
+			params := vips.NewHeifExportParams()
+			params.Quality = p.Quality
+			params.Lossless = p.Options.HEIF.Lossless
+			params.Effort = p.Options.HEIF.Effort
+			params.Bitdepth = p.Options.HEIF.BitDepth
+			buf, _, err := img.ExportHeif(params)
+			return buf, err
+		},
+	})
+
+	RegisterFormat(&Format{
+		Name:       "jxl",
+		Extensions: []string{"jxl"},
+		Sniff:      hasPrefix("\xff\x0a", "\x00\x00\x00\x0cJXL \r\n\x87\n"),
+		Alpha:      true,
+		Lossless:   true,
+		VipsType:   vips.ImageTypeJXL,
+		Options:    []string{"quality", "lossless", "effort"},
+		Settings:   func(eo *EncoderOptions) FormatSettings { return &eo.JXL },
+		Encode: func(img *vips.ImageRef, p EncodeParams) ([]byte, error) {
+			if p.Strip {
+				if err := img.RemoveMetadata(); err != nil {
+					return nil, fmt.Errorf("failed to strip metadata: %w", err)
+				}
+			}
+			params := vips.NewJxlExportParams()
+			params.Quality = p.Quality
+			params.Lossless = p.Options.JXL.Lossless
+			params.Effort = p.Options.JXL.Effort
+			buf, _, err := img.ExportJxl(params)
+			return buf, err
+		},
+	})
+
+	RegisterFormat(&Format{
+		Name:       "jp2",
+		Aliases:    []string{"jp2k", "j2k"},
+		Extensions: []string{"jp2", "j2k"},
+		Sniff:      hasPrefix("\x00\x00\x00\x0cjP  \r\n\x87\n", "\xff\x4f\xff\x51"),
+		Alpha:      true,
+		Lossless:   true,
+		VipsType:   vips.ImageTypeJP2K,
+		Options:    []string{"quality", "lossless", "subsampling"},
+		Settings:   func(eo *EncoderOptions) FormatSettings { return &eo.JP2 },
+		Encode: func(img *vips.ImageRef, p EncodeParams) ([]byte, error) {
+			if p.Strip {
+				if err := img.RemoveMetadata(); err != nil {
+					return nil, fmt.Errorf("failed to strip metadata: %w", err)
+				}
+			}
+			params := vips.NewJp2kExportParams()
+			params.Quality = p.Quality
+			params.Lossless = p.Options.JP2.Lossless
+			params.SubsampleMode = p.Options.JP2.Subsampling
+			buf, _, err := img.ExportJp2k(params)
+			return buf, err
+		},
+	})
+
+	// libvips reads BMP only through ImageMagick and cannot write it
+	RegisterFormat(&Format{
+		Name:       "bmp",
+		Extensions: []string{"bmp"},
+		Sniff:      sniffBMP,
+		Lossless:   true,
+		VipsType:   vips.ImageTypeBMP,
+		GoDecode:   bmp.Decode,
+		GoEncode: func(w io.Writer, img image.Image, p EncodeParams) error {
+			return bmp.Encode(w, img)
+		},
+	})
+
+	RegisterFormat(&Format{
+		Name:       "qoi",
+		Extensions: []string{"qoi"},
+		Sniff:      hasPrefix("qoif"),
+		Alpha:      true,
+		Lossless:   true,
+		GoDecode:   decodeQOI,
+		GoEncode: func(w io.Writer, img image.Image, p EncodeParams) error {
+			return encodeQOI(w, img)
+		},
+	})
+
+	RegisterFormat(&Format{
+		Name:       "ico",
+		Extensions: []string{"ico"},
+		Sniff:      sniffICO,
+		Alpha:      true,
+		Lossless:   true,
+		Resizes:    true,
+		Options:    []string{"sizes"},
+		Settings:   func(eo *EncoderOptions) FormatSettings { return &eo.ICO },
+		GoDecode:   decodeICO,
+		GoEncode: func(w io.Writer, img image.Image, p EncodeParams) error {
+			return encodeICO(w, img, p.Options.ICO.Sizes)
+		},
+	})
+
+	// Camera RAW files are only read, see RawOptions
+	RegisterFormat(&Format{
+		Name:       "raw",
+		Extensions: RawExtensions,
+		Sniff:      sniffRaw,
+	})
+
+	// Documents are only read, see PageOptions
+	RegisterFormat(&Format{
+		Name:       "pdf",
+		Extensions: []string{"pdf"},
+		Sniff:      hasPrefix("%PDF-"),
+		CMYK:       true,
+		VipsType:   vips.ImageTypePDF,
+	})
+}
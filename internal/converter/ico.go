@@ -0,0 +1,189 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+// ICO codec. libvips only reads icons through ImageMagick and cannot write
+// them, so icons are handled in Go: every size is stored as a PNG entry,
+// which Windows supports since Vista, and both PNG and 24/32-bit BMP entries
+// are read.
+
+const (
+	icoHeaderSize = 6
+	icoEntrySize  = 16
+	icoMaxSize    = 256
+)
+
+// DefaultICOSizes are the icon sizes written when none are configured.
+var DefaultICOSizes = []int{16, 32, 48, 256}
+
+// icoEntry is a directory entry of an icon file.
+type icoEntry struct {
+	Width, Height byte // 0 = 256
+	Colors        byte
+	Reserved      byte
+	Planes        uint16
+	BitCount      uint16
+	Size          uint32
+	Offset        uint32
+}
+
+// encodeICO writes img as an icon holding one square entry per size. Images
+// that are not square are fitted in the middle of a transparent square.
+func encodeICO(w io.Writer, img image.Image, sizes []int) error {
+	if len(sizes) == 0 {
+		sizes = DefaultICOSizes
+	}
+	entries := make([][]byte, len(sizes))
+	for i, size := range sizes {
+		if size < 1 || size > icoMaxSize {
+			return fmt.Errorf("ico: size %d out of range 1-%d", size, icoMaxSize)
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, fitSquare(img, size)); err != nil {
+			return err
+		}
+		entries[i] = buf.Bytes()
+	}
+
+	var header [icoHeaderSize]byte
+	binary.LittleEndian.PutUint16(header[2:], 1) // Icon
+	binary.LittleEndian.PutUint16(header[4:], uint16(len(sizes)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	offset := uint32(icoHeaderSize + icoEntrySize*len(sizes))
+	for i, size := range sizes {
+		entry := icoEntry{
+			Width:    byte(size % icoMaxSize),
+			Height:   byte(size % icoMaxSize),
+			Planes:   1,
+			BitCount: 32,
+			Size:     uint32(len(entries[i])),
+			Offset:   offset,
+		}
+		if err := binary.Write(w, binary.LittleEndian, entry); err != nil {
+			return err
+		}
+		offset += entry.Size
+	}
+	for _, data := range entries {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fitSquare scales img to fit a size x size transparent square, keeping its
+// aspect ratio.
+func fitSquare(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := size, size
+	if bounds.Dx() > bounds.Dy() {
+		height = max(size*bounds.Dy()/bounds.Dx(), 1)
+	} else if bounds.Dy() > bounds.Dx() {
+		width = max(size*bounds.Dx()/bounds.Dy(), 1)
+	}
+	square := image.NewNRGBA(image.Rect(0, 0, size, size))
+	x, y := (size-width)/2, (size-height)/2
+	draw.CatmullRom.Scale(square, image.Rect(x, y, x+width, y+height), img, bounds, draw.Src, nil)
+	return square
+}
+
+// decodeICO decodes the largest entry of an icon file.
+func decodeICO(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < icoHeaderSize || binary.LittleEndian.Uint16(data) != 0 || binary.LittleEndian.Uint16(data[2:]) != 1 {
+		return nil, errors.New("ico: invalid header")
+	}
+	count := int(binary.LittleEndian.Uint16(data[4:]))
+	if count == 0 || len(data) < icoHeaderSize+icoEntrySize*count {
+		return nil, errors.New("ico: invalid directory")
+	}
+
+	var best icoEntry
+	bestSize := -1
+	for i := 0; i < count; i++ {
+		var entry icoEntry
+		if err := binary.Read(bytes.NewReader(data[icoHeaderSize+icoEntrySize*i:]), binary.LittleEndian, &entry); err != nil {
+			return nil, err
+		}
+		size := int(entry.Width)
+		if size == 0 {
+			size = icoMaxSize
+		}
+		if size > bestSize {
+			best, bestSize = entry, size
+		}
+	}
+	end := uint64(best.Offset) + uint64(best.Size)
+	if end > uint64(len(data)) {
+		return nil, errors.New("ico: entry out of bounds")
+	}
+	entry := data[best.Offset:end]
+	if bytes.HasPrefix(entry, []byte("\x89PNG")) {
+		return png.Decode(bytes.NewReader(entry))
+	}
+	return decodeDIB(entry)
+}
+
+// decodeDIB decodes the 24 or 32-bit bitmap of an icon entry: a
+// BITMAPINFOHEADER with twice the icon height, the bottom-up color rows and
+// a 1-bit transparency mask.
+func decodeDIB(data []byte) (image.Image, error) {
+	if len(data) < 40 {
+		return nil, errors.New("ico: truncated bitmap header")
+	}
+	headerSize := binary.LittleEndian.Uint32(data)
+	width := int(int32(binary.LittleEndian.Uint32(data[4:])))
+	height := int(int32(binary.LittleEndian.Uint32(data[8:]))) / 2
+	bitCount := int(binary.LittleEndian.Uint16(data[14:]))
+	compression := binary.LittleEndian.Uint32(data[16:])
+	if width <= 0 || height <= 0 || width > icoMaxSize || height > icoMaxSize {
+		return nil, fmt.Errorf("ico: invalid bitmap size %dx%d", width, height)
+	}
+	if compression != 0 || (bitCount != 24 && bitCount != 32) {
+		return nil, fmt.Errorf("ico: unsupported %d-bit bitmap", bitCount)
+	}
+
+	stride := (width*bitCount/8 + 3) &^ 3
+	maskStride := ((width+7)/8 + 3) &^ 3
+	pixels := data[min(int(headerSize), len(data)):]
+	if len(pixels) < stride*height {
+		return nil, errors.New("ico: truncated bitmap")
+	}
+	mask := pixels[stride*height:]
+	hasMask := bitCount == 24 && len(mask) >= maskStride*height
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		row := pixels[(height-1-y)*stride:]
+		for x := 0; x < width; x++ {
+			c := color.NRGBA{A: 255}
+			if bitCount == 32 {
+				c.B, c.G, c.R, c.A = row[x*4], row[x*4+1], row[x*4+2], row[x*4+3]
+			} else {
+				c.B, c.G, c.R = row[x*3], row[x*3+1], row[x*3+2]
+				if hasMask && mask[(height-1-y)*maskStride+x/8]&(0x80>>(x%8)) != 0 {
+					c.A = 0
+				}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img, nil
+}
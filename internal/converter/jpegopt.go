@@ -0,0 +1,803 @@
+package converter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Lossless JPEG transcoding, as jpegtran -optimize and -progressive do it.
+// Sequential Huffman JPEGs are decoded to their quantized DCT coefficients
+// and written back with Huffman tables computed for the image, as one
+// sequential scan or as a progressive scan script. The coefficients, and so
+// the pixels, are carried over as they are. libvips always decodes to pixels,
+// so this is done in Go.
+
+// JPEG markers.
+const (
+	jpegSOF0 = 0xc0 // Baseline
+	jpegSOF1 = 0xc1 // Extended sequential, Huffman
+	jpegSOF2 = 0xc2 // Progressive, Huffman
+	jpegDHT  = 0xc4
+	jpegRST0 = 0xd0
+	jpegRST7 = 0xd7
+	jpegSOI  = 0xd8
+	jpegEOI  = 0xd9
+	jpegSOS  = 0xda
+	jpegDQT  = 0xdb
+	jpegDRI  = 0xdd
+	jpegAPP0 = 0xe0
+	jpegAPPF = 0xef
+	jpegCOM  = 0xfe
+)
+
+// jpegSegment is a marker segment, with its data but not its length field.
+type jpegSegment struct {
+	marker byte
+	data   []byte
+}
+
+// jpegComponent is a color component of a frame with its coefficients.
+type jpegComponent struct {
+	id, h, v         byte
+	blocksW, blocksH int     // Blocks covering the component
+	paddedW, paddedH int     // Blocks in whole MCUs
+	coefs            []int16 // 64 coefficients per block, in zigzag order
+	dcTable, acTable byte    // Tables selected by the scan being decoded
+}
+
+// block returns the coefficients of the block at bx, by.
+func (c *jpegComponent) block(bx, by int) []int16 {
+	i := (by*c.paddedW + bx) * 64
+	return c.coefs[i : i+64 : i+64]
+}
+
+// jpegStream is a parsed JPEG stream.
+type jpegStream struct {
+	meta   []jpegSegment // APPn and COM segments, in file order
+	body   []byte        // Every other segment and the scans, verbatim
+	tables []jpegSegment // DQT segments
+
+	// Set when the coefficients were decoded
+	frame        []byte // SOF segment data
+	width        int
+	height       int
+	mcusX, mcusY int
+	comps        []*jpegComponent
+	decoded      bool
+}
+
+// parseJPEG splits a JPEG stream into its metadata and the rest, and decodes
+// the coefficients of sequential Huffman streams. Data after EOI is dropped.
+// Streams whose coefficients cannot be decoded are returned with decoded
+// unset, so their metadata can still be trimmed; a non-nil error means the
+// segments cannot be parsed.
+func parseJPEG(data []byte) (*jpegStream, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != jpegSOI {
+		return nil, errors.New("jpeg: missing SOI marker")
+	}
+	js := &jpegStream{}
+	var huffman [2][4]*huffmanTable
+	restart := 0
+	decodable := false
+
+	pos := 2
+	for {
+		// Markers may be preceded by fill bytes
+		for pos < len(data) && data[pos] == 0xff && pos+1 < len(data) && data[pos+1] == 0xff {
+			pos++
+		}
+		if pos+2 > len(data) || data[pos] != 0xff {
+			return nil, errors.New("jpeg: truncated stream or missing marker")
+		}
+		marker := data[pos+1]
+		if marker == jpegEOI {
+			break
+		}
+		if marker >= jpegRST0 && marker <= jpegRST7 || marker == 0x01 {
+			pos += 2
+			continue
+		}
+		if pos+4 > len(data) {
+			return nil, errors.New("jpeg: truncated segment")
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end > len(data) || end < pos+4 {
+			return nil, errors.New("jpeg: truncated segment")
+		}
+		segment := data[pos+4 : end]
+
+		switch {
+		case marker >= jpegAPP0 && marker <= jpegAPPF || marker == jpegCOM:
+			js.meta = append(js.meta, jpegSegment{marker: marker, data: segment})
+			pos = end
+			continue
+		case marker == jpegDQT:
+			js.tables = append(js.tables, jpegSegment{marker: marker, data: segment})
+		case marker == jpegDHT:
+			if err := parseDHT(segment, &huffman); err != nil {
+				return nil, err
+			}
+		case marker == jpegDRI:
+			if len(segment) < 2 {
+				return nil, errors.New("jpeg: invalid DRI segment")
+			}
+			restart = int(binary.BigEndian.Uint16(segment))
+		case marker >= 0xc0 && marker <= 0xcf && marker != jpegDHT && marker != 0xc8 && marker != 0xcc:
+			if js.comps != nil {
+				return nil, errors.New("jpeg: several frames")
+			}
+			var err error
+			decodable, err = js.parseFrame(marker, segment)
+			if err != nil {
+				return nil, err
+			}
+		case marker == jpegSOS:
+			scanEnd := scanLength(data, end)
+			// Scans that fail to decode leave the stream to be copied
+			if decodable && js.decodeScan(segment, data[end:scanEnd], &huffman, restart) != nil {
+				decodable = false
+			}
+			js.body = append(js.body, data[pos:scanEnd]...)
+			pos = scanEnd
+			continue
+		}
+		js.body = append(js.body, data[pos:end]...)
+		pos = end
+	}
+	js.decoded = decodable && js.comps != nil
+	return js, nil
+}
+
+// scanLength returns the end of the entropy-coded data starting at pos: the
+// first marker that is neither a stuffed 0xff nor a restart marker.
+func scanLength(data []byte, pos int) int {
+	for pos+1 < len(data) {
+		if data[pos] == 0xff && data[pos+1] != 0 && (data[pos+1] < jpegRST0 || data[pos+1] > jpegRST7) {
+			return pos
+		}
+		pos++
+	}
+	return len(data)
+}
+
+// parseFrame reads the SOF segment and allocates the coefficients of the
+// components. It reports whether the frame can be decoded here.
+func (js *jpegStream) parseFrame(marker byte, segment []byte) (bool, error) {
+	if len(segment) < 6 {
+		return false, errors.New("jpeg: invalid SOF segment")
+	}
+	precision := segment[0]
+	js.height = int(binary.BigEndian.Uint16(segment[1:]))
+	js.width = int(binary.BigEndian.Uint16(segment[3:]))
+	count := int(segment[5])
+	if len(segment) < 6+3*count || count == 0 {
+		return false, errors.New("jpeg: invalid SOF segment")
+	}
+	js.comps = make([]*jpegComponent, count)
+	if (marker != jpegSOF0 && marker != jpegSOF1) || precision != 8 || count > 4 || js.width == 0 || js.height == 0 {
+		return false, nil
+	}
+
+	var hmax, vmax int
+	for i := range js.comps {
+		c := &jpegComponent{id: segment[6+3*i], h: segment[7+3*i] >> 4, v: segment[7+3*i] & 0x0f}
+		if c.h < 1 || c.h > 4 || c.v < 1 || c.v > 4 {
+			return false, fmt.Errorf("jpeg: invalid sampling factors %dx%d", c.h, c.v)
+		}
+		hmax, vmax = max(hmax, int(c.h)), max(vmax, int(c.v))
+		js.comps[i] = c
+	}
+	js.mcusX = (js.width + 8*hmax - 1) / (8 * hmax)
+	js.mcusY = (js.height + 8*vmax - 1) / (8 * vmax)
+	for _, c := range js.comps {
+		width := (js.width*int(c.h) + hmax - 1) / hmax
+		height := (js.height*int(c.v) + vmax - 1) / vmax
+		c.blocksW, c.blocksH = (width+7)/8, (height+7)/8
+		c.paddedW, c.paddedH = js.mcusX*int(c.h), js.mcusY*int(c.v)
+		c.coefs = make([]int16, 64*c.paddedW*c.paddedH)
+	}
+	js.frame = segment
+	return true, nil
+}
+
+// eachBlock calls fn for the blocks of a scan over comps in coding order,
+// with the index of the MCU. A scan of one component visits the blocks
+// covering it, one per MCU; an interleaved scan whole MCUs.
+func (js *jpegStream) eachBlock(comps []*jpegComponent, fn func(mcu, ci int, block []int16) error) error {
+	if len(comps) == 1 {
+		c := comps[0]
+		for by := 0; by < c.blocksH; by++ {
+			for bx := 0; bx < c.blocksW; bx++ {
+				if err := fn(by*c.blocksW+bx, 0, c.block(bx, by)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for my := 0; my < js.mcusY; my++ {
+		for mx := 0; mx < js.mcusX; mx++ {
+			for ci, c := range comps {
+				for v := 0; v < int(c.v); v++ {
+					for h := 0; h < int(c.h); h++ {
+						if err := fn(my*js.mcusX+mx, ci, c.block(mx*int(c.h)+h, my*int(c.v)+v)); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// decodeScan decodes the coefficients of a sequential scan.
+func (js *jpegStream) decodeScan(header, data []byte, huffman *[2][4]*huffmanTable, restart int) error {
+	if len(header) < 1 {
+		return errors.New("jpeg: invalid SOS segment")
+	}
+	count := int(header[0])
+	if count < 1 || count > 4 || len(header) < 1+2*count+3 {
+		return errors.New("jpeg: invalid SOS segment")
+	}
+	comps := make([]*jpegComponent, count)
+	for i := range comps {
+		id, tables := header[1+2*i], header[2+2*i]
+		for _, c := range js.comps {
+			if c.id == id {
+				comps[i] = c
+			}
+		}
+		if comps[i] == nil {
+			return fmt.Errorf("jpeg: scan of unknown component %d", id)
+		}
+		comps[i].dcTable, comps[i].acTable = tables>>4&3, tables&3
+		if huffman[0][comps[i].dcTable] == nil || huffman[1][comps[i].acTable] == nil {
+			return errors.New("jpeg: scan uses an undefined Huffman table")
+		}
+	}
+	ss, se, approx := header[1+2*count], header[2+2*count], header[3+2*count]
+	if ss != 0 || se != 63 || approx != 0 {
+		return errors.New("jpeg: invalid spectral selection for a sequential scan")
+	}
+
+	intervals := unstuff(data)
+	interval := 0
+	r := &jpegBitReader{data: intervals[0]}
+	preds := make([]int32, count)
+	lastMCU := 0
+	return js.eachBlock(comps, func(mcu, ci int, block []int16) error {
+		if restart > 0 && mcu != lastMCU && mcu%restart == 0 {
+			interval++
+			if interval >= len(intervals) {
+				return errors.New("jpeg: missing restart marker")
+			}
+			r = &jpegBitReader{data: intervals[interval]}
+			clear(preds)
+		}
+		lastMCU = mcu
+
+		c := comps[ci]
+		size, err := huffman[0][c.dcTable].decode(r)
+		if err != nil {
+			return err
+		}
+		diff, err := r.receive(size)
+		if err != nil {
+			return err
+		}
+		preds[ci] += diff
+		block[0] = int16(preds[ci])
+
+		ac := huffman[1][c.acTable]
+		for k := 1; k < 64; k++ {
+			symbol, err := ac.decode(r)
+			if err != nil {
+				return err
+			}
+			run, size := int(symbol>>4), symbol&0x0f
+			if size == 0 {
+				if run != 15 {
+					break // EOB
+				}
+				k += 15 // ZRL
+				continue
+			}
+			k += run
+			if k > 63 {
+				return errors.New("jpeg: coefficient out of the block")
+			}
+			value, err := r.receive(size)
+			if err != nil {
+				return err
+			}
+			block[k] = int16(value)
+		}
+		return nil
+	})
+}
+
+// unstuff splits entropy-coded data at its restart markers and removes the
+// zero bytes stuffed after every 0xff.
+func unstuff(data []byte) [][]byte {
+	intervals := [][]byte{nil}
+	current := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		if b == 0xff && i+1 < len(data) {
+			next := data[i+1]
+			i++
+			if next >= jpegRST0 && next <= jpegRST7 {
+				intervals[len(intervals)-1] = current
+				intervals = append(intervals, nil)
+				current = current[len(current):]
+				continue
+			}
+			if next != 0 {
+				continue
+			}
+		}
+		current = append(current, b)
+	}
+	intervals[len(intervals)-1] = current
+	return intervals
+}
+
+// jpegBitReader reads the bits of one restart interval, most significant
+// bit first.
+type jpegBitReader struct {
+	data []byte
+	pos  int
+	acc  byte
+	n    uint
+}
+
+// bit returns the next bit.
+func (r *jpegBitReader) bit() (int32, error) {
+	if r.n == 0 {
+		if r.pos >= len(r.data) {
+			return 0, fmt.Errorf("jpeg: %w", io.ErrUnexpectedEOF)
+		}
+		r.acc, r.n = r.data[r.pos], 8
+		r.pos++
+	}
+	r.n--
+	return int32(r.acc>>r.n) & 1, nil
+}
+
+// receive reads a value of size bits and extends its sign (F.2.2.1).
+func (r *jpegBitReader) receive(size byte) (int32, error) {
+	if size > 16 {
+		return 0, errors.New("jpeg: invalid coefficient size")
+	}
+	var v int32
+	for i := byte(0); i < size; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	if size > 0 && v < 1<<(size-1) {
+		v -= 1<<size - 1
+	}
+	return v, nil
+}
+
+// huffmanTable is a JPEG Huffman table: the number of codes of each length
+// and the symbols in code order.
+type huffmanTable struct {
+	counts  [16]byte
+	symbols []byte
+
+	// Canonical codes (F.2.2.3): the last code of each length, -1 when
+	// there is none, and the index of the first symbol of each length
+	maxCode [17]int32
+	minCode [17]int32
+	valPtr  [17]int32
+}
+
+// newHuffmanTable builds the decoding tables of a Huffman table.
+func newHuffmanTable(counts [16]byte, symbols []byte) *huffmanTable {
+	t := &huffmanTable{counts: counts, symbols: symbols}
+	var code, index int32
+	for l := 1; l <= 16; l++ {
+		n := int32(counts[l-1])
+		t.valPtr[l], t.minCode[l], t.maxCode[l] = index, code, -1
+		if n > 0 {
+			t.maxCode[l] = code + n - 1
+		}
+		code, index = (code+n)<<1, index+n
+	}
+	return t
+}
+
+// decode reads one symbol.
+func (t *huffmanTable) decode(r *jpegBitReader) (byte, error) {
+	var code int32
+	for l := 1; l <= 16; l++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | b
+		if code <= t.maxCode[l] {
+			return t.symbols[t.valPtr[l]+code-t.minCode[l]], nil
+		}
+	}
+	return 0, errors.New("jpeg: invalid Huffman code")
+}
+
+// parseDHT reads the Huffman tables of a DHT segment into tables, indexed by
+// class (0 = DC, 1 = AC) and destination.
+func parseDHT(segment []byte, tables *[2][4]*huffmanTable) error {
+	for len(segment) > 0 {
+		if len(segment) < 17 {
+			return errors.New("jpeg: invalid DHT segment")
+		}
+		class, id := segment[0]>>4, segment[0]&0x0f
+		if class > 1 || id > 3 {
+			return errors.New("jpeg: invalid Huffman table destination")
+		}
+		var counts [16]byte
+		copy(counts[:], segment[1:17])
+		total := 0
+		for _, n := range counts {
+			total += int(n)
+		}
+		if total > 256 || len(segment) < 17+total {
+			return errors.New("jpeg: invalid DHT segment")
+		}
+		tables[class][id] = newHuffmanTable(counts, segment[17:17+total])
+		segment = segment[17+total:]
+	}
+	return nil
+}
+
+// optimalHuffman returns the code length counts and symbols of an optimal
+// Huffman code for the symbol frequencies, limited to 16 bits and leaving
+// out the all-ones code, the way libjpeg builds it (K.2).
+func optimalHuffman(freq *[256]int) ([16]byte, []byte) {
+	var f [257]int
+	copy(f[:], freq[:])
+	f[256] = 1 // Reserves the all-ones code
+	var codeSize, others [257]int
+	for i := range others {
+		others[i] = -1
+	}
+	for {
+		// The two least frequent symbols, the highest index on ties
+		c1, c2 := -1, -1
+		for i := range f {
+			if f[i] > 0 && (c1 < 0 || f[i] <= f[c1]) {
+				c1 = i
+			}
+		}
+		for i := range f {
+			if f[i] > 0 && i != c1 && (c2 < 0 || f[i] <= f[c2]) {
+				c2 = i
+			}
+		}
+		if c2 < 0 {
+			break
+		}
+		f[c1] += f[c2]
+		f[c2] = 0
+		codeSize[c1]++
+		for others[c1] >= 0 {
+			c1 = others[c1]
+			codeSize[c1]++
+		}
+		others[c1] = c2
+		codeSize[c2]++
+		for others[c2] >= 0 {
+			c2 = others[c2]
+			codeSize[c2]++
+		}
+	}
+
+	var lengths [258]int
+	longest := 0
+	for _, size := range codeSize {
+		if size > 0 {
+			lengths[size]++
+			longest = max(longest, size)
+		}
+	}
+	// Move codes longer than 16 bits up the tree
+	for i := longest; i > 16; i-- {
+		for lengths[i] > 0 {
+			j := i - 2
+			for lengths[j] == 0 {
+				j--
+			}
+			lengths[i] -= 2
+			lengths[i-1]++
+			lengths[j+1] += 2
+			lengths[j]--
+		}
+	}
+	// Drop the reserved code from the longest length
+	i := 16
+	for lengths[i] == 0 {
+		i--
+	}
+	lengths[i]--
+
+	var counts [16]byte
+	for l := 1; l <= 16; l++ {
+		counts[l-1] = byte(lengths[l])
+	}
+	var symbols []byte
+	for size := 1; size <= longest; size++ {
+		for s := 0; s < 256; s++ {
+			if codeSize[s] == size {
+				symbols = append(symbols, byte(s))
+			}
+		}
+	}
+	return counts, symbols
+}
+
+// huffmanCode maps symbols to their canonical codes.
+type huffmanCode struct {
+	code [256]uint16
+	size [256]byte
+}
+
+// newHuffmanCode assigns the canonical codes of a table (C.2).
+func newHuffmanCode(counts [16]byte, symbols []byte) *huffmanCode {
+	hc := &huffmanCode{}
+	code, k := uint16(0), 0
+	for l := 1; l <= 16; l++ {
+		for n := 0; n < int(counts[l-1]); n++ {
+			hc.code[symbols[k]], hc.size[symbols[k]] = code, byte(l)
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return hc
+}
+
+// entropySink receives the coded symbols of a scan: counted to build optimal
+// tables, then written with them.
+type entropySink interface {
+	symbol(table int, s byte)
+	bits(value uint32, size uint)
+}
+
+// symbolCounter counts the symbols coded with each table.
+type symbolCounter struct {
+	freq [][256]int
+}
+
+func (sc *symbolCounter) symbol(table int, s byte)     { sc.freq[table][s]++ }
+func (sc *symbolCounter) bits(value uint32, size uint) {}
+
+// entropyWriter writes coded symbols and values, stuffing a zero byte after
+// every 0xff.
+type entropyWriter struct {
+	codes []*huffmanCode
+	out   []byte
+	acc   uint32
+	n     uint
+}
+
+func (ew *entropyWriter) symbol(table int, s byte) {
+	hc := ew.codes[table]
+	ew.bits(uint32(hc.code[s]), uint(hc.size[s]))
+}
+
+func (ew *entropyWriter) bits(value uint32, size uint) {
+	ew.acc = ew.acc<<size | value&(1<<size-1)
+	ew.n += size
+	for ew.n >= 8 {
+		ew.n -= 8
+		b := byte(ew.acc >> ew.n)
+		ew.out = append(ew.out, b)
+		if b == 0xff {
+			ew.out = append(ew.out, 0)
+		}
+	}
+}
+
+// flush pads the last byte with one bits.
+func (ew *entropyWriter) flush() {
+	if ew.n > 0 {
+		ew.bits(1<<(8-ew.n)-1, 8-ew.n)
+	}
+}
+
+// codeValue codes a DC difference or AC coefficient: the symbol built from
+// run and the bit length of v, followed by the bits of v (F.1.2).
+func codeValue(sink entropySink, table, run int, v int32) {
+	magnitude := v
+	if v < 0 {
+		magnitude = -v
+		v--
+	}
+	size := uint(bits.Len32(uint32(magnitude)))
+	sink.symbol(table, byte(run<<4)|byte(size))
+	if size > 0 {
+		sink.bits(uint32(v), size)
+	}
+}
+
+// jpegScan is a scan of the output: its components and spectral band.
+// Successive approximation is not used, so every scan sends full values.
+type jpegScan struct {
+	comps  []int // Indices into the frame components
+	ss, se int
+}
+
+// progressiveScript returns the scans of a progressive stream: the DC
+// coefficients of all components, then the AC bands of each, low luma
+// frequencies first, like the libjpeg script without successive
+// approximation.
+func progressiveScript(count int) []jpegScan {
+	dc := jpegScan{ss: 0, se: 0}
+	for i := 0; i < count; i++ {
+		dc.comps = append(dc.comps, i)
+	}
+	script := []jpegScan{dc, {comps: []int{0}, ss: 1, se: 5}}
+	for i := 1; i < count; i++ {
+		script = append(script, jpegScan{comps: []int{i}, ss: 1, se: 63})
+	}
+	return append(script, jpegScan{comps: []int{0}, ss: 6, se: 63})
+}
+
+// tableClass returns the Huffman table destination of a component: 0 for
+// the first (luma) component, 1 for the others.
+func tableClass(ci int) int {
+	return min(ci, 1)
+}
+
+// encodeScan codes a scan into sink. DC tables are numbered by class, the
+// AC tables follow them.
+func (js *jpegStream) encodeScan(scan jpegScan, sink entropySink) {
+	comps := make([]*jpegComponent, len(scan.comps))
+	for i, ci := range scan.comps {
+		comps[i] = js.comps[ci]
+	}
+	preds := make([]int32, len(comps))
+	eobRun := 0
+	// An AC table follows the DC tables of both classes
+	acTable := func(ci int) int { return 2 + tableClass(scan.comps[ci]) }
+	flushEOB := func(table int) {
+		if eobRun > 0 {
+			size := uint(bits.Len(uint(eobRun)) - 1)
+			sink.symbol(table, byte(size<<4))
+			if size > 0 {
+				sink.bits(uint32(eobRun), size)
+			}
+			eobRun = 0
+		}
+	}
+
+	js.eachBlock(comps, func(mcu, ci int, block []int16) error {
+		if scan.ss == 0 {
+			diff := int32(block[0]) - preds[ci]
+			preds[ci] = int32(block[0])
+			codeValue(sink, tableClass(scan.comps[ci]), 0, diff)
+		}
+		if scan.se == 0 {
+			return nil
+		}
+
+		table := acTable(ci)
+		run := 0
+		for k := max(scan.ss, 1); k <= scan.se; k++ {
+			v := int32(block[k])
+			if v == 0 {
+				run++
+				continue
+			}
+			flushEOB(table)
+			for run > 15 {
+				sink.symbol(table, 0xf0)
+				run -= 16
+			}
+			codeValue(sink, table, run, v)
+			run = 0
+		}
+		switch {
+		case run == 0:
+		case scan.ss == 0:
+			sink.symbol(table, 0x00) // Sequential scans end every block
+		default:
+			// Progressive scans count the blocks ending in zeros
+			eobRun++
+			if eobRun == 0x7fff {
+				flushEOB(table)
+			}
+		}
+		return nil
+	})
+	if scan.ss > 0 {
+		flushEOB(acTable(0))
+	}
+}
+
+// transcode writes the decoded coefficients as a new stream with optimal
+// Huffman tables, progressive or sequential, preceded by the meta segments.
+func (js *jpegStream) transcode(meta []jpegSegment, progressive bool) []byte {
+	out := []byte{0xff, jpegSOI}
+	for _, segment := range meta {
+		out = appendSegment(out, segment.marker, segment.data)
+	}
+	for _, segment := range js.tables {
+		out = appendSegment(out, segment.marker, segment.data)
+	}
+
+	all := make([]int, len(js.comps))
+	for i := range all {
+		all[i] = i
+	}
+	script := []jpegScan{{comps: all, ss: 0, se: 63}}
+	sof := byte(jpegSOF0)
+	if progressive {
+		script = progressiveScript(len(js.comps))
+		sof = jpegSOF2
+	}
+	out = appendSegment(out, sof, js.frame)
+
+	for _, scan := range script {
+		counter := &symbolCounter{freq: make([][256]int, 4)}
+		js.encodeScan(scan, counter)
+
+		// One DHT segment with the tables the scan uses
+		var dht []byte
+		codes := make([]*huffmanCode, 4)
+		for table, freq := range counter.freq {
+			used := false
+			for _, n := range freq {
+				used = used || n > 0
+			}
+			if !used {
+				continue
+			}
+			counts, symbols := optimalHuffman(&counter.freq[table])
+			codes[table] = newHuffmanCode(counts, symbols)
+			dht = append(dht, byte(table/2)<<4|byte(table%2))
+			dht = append(dht, counts[:]...)
+			dht = append(dht, symbols...)
+		}
+		out = appendSegment(out, jpegDHT, dht)
+
+		sos := []byte{byte(len(scan.comps))}
+		for _, ci := range scan.comps {
+			class := byte(tableClass(ci))
+			sos = append(sos, js.comps[ci].id, class<<4|class)
+		}
+		sos = append(sos, byte(scan.ss), byte(scan.se), 0)
+		out = appendSegment(out, jpegSOS, sos)
+
+		writer := &entropyWriter{codes: codes, out: out}
+		js.encodeScan(scan, writer)
+		writer.flush()
+		out = writer.out
+	}
+	return append(out, 0xff, jpegEOI)
+}
+
+// rewrite writes the stream unchanged but for its metadata, for streams
+// whose coefficients were not decoded.
+func (js *jpegStream) rewrite(meta []jpegSegment) []byte {
+	out := []byte{0xff, jpegSOI}
+	for _, segment := range meta {
+		out = appendSegment(out, segment.marker, segment.data)
+	}
+	out = append(out, js.body...)
+	return append(out, 0xff, jpegEOI)
+}
+
+// appendSegment appends a marker segment to out.
+func appendSegment(out []byte, marker byte, data []byte) []byte {
+	out = append(out, 0xff, marker)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(data)+2))
+	return append(out, data...)
+}
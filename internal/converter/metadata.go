@@ -0,0 +1,661 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// MetadataModes lists the accepted values for ConvertOptions.Metadata.
+var MetadataModes = []string{"keep", "strip", "strip-location", "keep-copyright"}
+
+// IsValidMetadataMode reports whether mode is one of MetadataModes.
+func IsValidMetadataMode(mode string) bool {
+	for _, m := range MetadataModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	vipsExifField = "exif-data"
+	vipsXMPField  = "xmp-data"
+	vipsIPTCField = "iptc-data"
+
+	// vipsOrientationField holds the EXIF orientation, which pixels that are
+	// not auto-oriented rely on.
+	vipsOrientationField = "exif-ifd0-Orientation"
+)
+
+// xmpPrefixes maps well known XMP namespace URIs to their conventional prefix,
+// so allow/deny lists can use names such as "photoshop:City" regardless of
+// the prefix chosen by the writing application.
+var xmpPrefixes = map[string]string{
+	"http://ns.adobe.com/exif/1.0/":                "exif",
+	"http://ns.adobe.com/tiff/1.0/":                "tiff",
+	"http://ns.adobe.com/photoshop/1.0/":           "photoshop",
+	"http://purl.org/dc/elements/1.1/":             "dc",
+	"http://ns.adobe.com/xap/1.0/":                 "xmp",
+	"http://ns.adobe.com/xap/1.0/rights/":          "xmpRights",
+	"http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/":  "Iptc4xmpCore",
+	"http://iptc.org/std/Iptc4xmpExt/2008-02-29/":  "Iptc4xmpExt",
+	"http://www.w3.org/1999/02/22-rdf-syntax-ns#":  "rdf",
+	"http://ns.adobe.com/exif/1.0/aux/":            "aux",
+	"http://ns.adobe.com/xap/1.0/mm/":              "xmpMM",
+	"http://ns.adobe.com/photoshop/1.0/camera-raw": "crs",
+}
+
+// iptcDatasets names the IPTC IIM application record (2:xx) datasets.
+var iptcDatasets = map[byte]string{
+	5:   "ObjectName",
+	25:  "Keywords",
+	55:  "DateCreated",
+	60:  "TimeCreated",
+	80:  "By-line",
+	85:  "By-lineTitle",
+	90:  "City",
+	92:  "Sub-location",
+	95:  "Province-State",
+	100: "Country-PrimaryLocationCode",
+	101: "Country-PrimaryLocationName",
+	105: "Headline",
+	110: "Credit",
+	115: "Source",
+	116: "CopyrightNotice",
+	120: "Caption-Abstract",
+}
+
+// locationTags are the non-GPS tags that describe where an image was taken.
+var locationTags = map[string]bool{
+	"photoshop:City":              true,
+	"photoshop:State":             true,
+	"photoshop:Country":           true,
+	"Iptc4xmpCore:Location":       true,
+	"Iptc4xmpCore:CountryCode":    true,
+	"Iptc4xmpExt:LocationCreated": true,
+	"Iptc4xmpExt:LocationShown":   true,
+	"City":                        true,
+	"Sub-location":                true,
+	"Province-State":              true,
+	"Country-PrimaryLocationCode": true,
+	"Country-PrimaryLocationName": true,
+}
+
+// copyrightTags are the tags kept by the keep-copyright mode.
+var copyrightTags = map[string]bool{
+	"Copyright":                       true,
+	"Artist":                          true,
+	"dc:rights":                       true,
+	"dc:creator":                      true,
+	"xmpRights:Marked":                true,
+	"xmpRights:UsageTerms":            true,
+	"xmpRights:WebStatement":          true,
+	"photoshop:Credit":                true,
+	"Iptc4xmpCore:CreatorContactInfo": true,
+	"By-line":                         true,
+	"Credit":                          true,
+	"CopyrightNotice":                 true,
+}
+
+// metadataFilter decides which EXIF, XMP and IPTC tags survive a conversion.
+// Deny entries always win, a non-empty allow list keeps only the listed tags,
+// and otherwise the mode decides. Entries are case-insensitive glob patterns
+// matched against the bare tag name ("GPSLatitude", "photoshop:City", "City")
+// and the name qualified by its block ("exif:GPSLatitude", "xmp:photoshop:City",
+// "iptc:City").
+type metadataFilter struct {
+	mode  string
+	allow []string
+	deny  []string
+}
+
+// keep reports whether the tag from the given block (exif, xmp, iptc) is retained.
+func (f *metadataFilter) keep(block, name string) bool {
+	if matchesTag(f.deny, block, name) {
+		return false
+	}
+	if len(f.allow) > 0 {
+		return matchesTag(f.allow, block, name)
+	}
+	switch f.mode {
+	case "strip":
+		return false
+	case "strip-location":
+		return !isLocationTag(name)
+	case "keep-copyright":
+		return copyrightTags[name]
+	default:
+		return true
+	}
+}
+
+// isLocationTag reports whether the tag holds GPS or place information.
+func isLocationTag(name string) bool {
+	bare := name
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		bare = name[i+1:]
+	}
+	return strings.HasPrefix(bare, "GPS") || locationTags[name]
+}
+
+func matchesTag(patterns []string, block, name string) bool {
+	lowerName := strings.ToLower(name)
+	qualified := strings.ToLower(block + ":" + name)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if ok, _ := path.Match(pattern, lowerName); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, qualified); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// stripsAllMetadata reports whether the encoder can simply drop all metadata.
+func (ic *ImageConverter) stripsAllMetadata() bool {
+	return ic.options.Metadata == "strip" && len(ic.options.MetadataAllow) == 0
+}
+
+// filtersMetadata reports whether metadata has to be filtered tag by tag.
+func (ic *ImageConverter) filtersMetadata() bool {
+	if ic.stripsAllMetadata() {
+		return false
+	}
+	return ic.options.Metadata == "strip-location" || ic.options.Metadata == "keep-copyright" ||
+		len(ic.options.MetadataAllow) > 0 || len(ic.options.MetadataDeny) > 0
+}
+
+// applyMetadataPolicy removes the EXIF, XMP and IPTC tags rejected by the
+// metadata mode and allow/deny lists. EXIF tags are removed from the image
+// fields, which libvips uses to rebuild the EXIF block on save; XMP and IPTC
+// blocks are rewritten in place. ICC profile and orientation are always kept.
+func (ic *ImageConverter) applyMetadataPolicy(img *vips.ImageRef) error {
+	if !ic.filtersMetadata() {
+		return nil
+	}
+
+	filter := &metadataFilter{
+		mode:  ic.options.Metadata,
+		allow: ic.options.MetadataAllow,
+		deny:  ic.options.MetadataDeny,
+	}
+
+	var xmpData, iptcData []byte
+	keep := make([]string, 0, 64)
+	keptExif := false
+	for _, field := range img.GetFields() {
+		switch {
+		case field == vipsExifField:
+			// Kept below only if at least one EXIF tag survives
+		case field == vipsOrientationField:
+			keep = append(keep, field)
+			keptExif = true
+		case strings.HasPrefix(field, "exif-ifd"):
+			if filter.keep("exif", exifTagName(field)) {
+				keep = append(keep, field)
+				keptExif = true
+			}
+		case field == vipsXMPField:
+			filtered, err := filterXMP(img.GetBlob(field), filter)
+			if err != nil {
+				return fmt.Errorf("failed to filter XMP metadata: %w", err)
+			}
+			if len(filtered) > 0 {
+				xmpData = filtered
+				keep = append(keep, field)
+			}
+		case field == vipsIPTCField:
+			filtered := filterIPTC(img.GetBlob(field), filter)
+			if len(filtered) > 0 {
+				iptcData = filtered
+				keep = append(keep, field)
+			}
+		case strings.Contains(field, "comment"):
+			if filter.mode != "keep-copyright" && len(filter.allow) == 0 {
+				keep = append(keep, field)
+			}
+		default:
+			keep = append(keep, field)
+		}
+	}
+	if keptExif {
+		keep = append(keep, vipsExifField)
+	}
+
+	// RemoveMetadata works on a copy, so the blobs are replaced on the copy
+	// rather than on an image that may be shared through the vips cache.
+	if err := img.RemoveMetadata(keep...); err != nil {
+		return fmt.Errorf("failed to remove metadata: %w", err)
+	}
+	if xmpData != nil {
+		img.SetBlob(vipsXMPField, xmpData)
+	}
+	if iptcData != nil {
+		img.SetBlob(vipsIPTCField, iptcData)
+	}
+	return nil
+}
+
+// exifTagName extracts the tag name from a libvips EXIF field such as
+// "exif-ifd3-GPSLatitude".
+func exifTagName(field string) string {
+	name := strings.TrimPrefix(field, "exif-ifd")
+	if i := strings.Index(name, "-"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// exifTagNames names the tags of the main and EXIF directories as libvips
+// does, so the allow/deny lists match them in JPEGs optimized without
+// libvips. Unknown tags are named by their number, e.g. "0xa500".
+var exifTagNames = map[uint16]string{
+	0x010e: "ImageDescription",
+	0x010f: "Make",
+	0x0110: "Model",
+	0x0112: "Orientation",
+	0x011a: "XResolution",
+	0x011b: "YResolution",
+	0x0128: "ResolutionUnit",
+	0x0131: "Software",
+	0x0132: "DateTime",
+	0x013b: "Artist",
+	0x0213: "YCbCrPositioning",
+	0x8298: "Copyright",
+	0x829a: "ExposureTime",
+	0x829d: "FNumber",
+	0x8822: "ExposureProgram",
+	0x8827: "ISOSpeedRatings",
+	0x8830: "SensitivityType",
+	0x9000: "ExifVersion",
+	0x9003: "DateTimeOriginal",
+	0x9004: "DateTimeDigitized",
+	0x9010: "OffsetTime",
+	0x9011: "OffsetTimeOriginal",
+	0x9012: "OffsetTimeDigitized",
+	0x9101: "ComponentsConfiguration",
+	0x9201: "ShutterSpeedValue",
+	0x9202: "ApertureValue",
+	0x9203: "BrightnessValue",
+	0x9204: "ExposureBiasValue",
+	0x9205: "MaxApertureValue",
+	0x9206: "SubjectDistance",
+	0x9207: "MeteringMode",
+	0x9208: "LightSource",
+	0x9209: "Flash",
+	0x920a: "FocalLength",
+	0x9214: "SubjectArea",
+	0x927c: "MakerNote",
+	0x9286: "UserComment",
+	0x9290: "SubSecTime",
+	0x9291: "SubSecTimeOriginal",
+	0x9292: "SubSecTimeDigitized",
+	0xa000: "FlashPixVersion",
+	0xa001: "ColorSpace",
+	0xa002: "PixelXDimension",
+	0xa003: "PixelYDimension",
+	0xa217: "SensingMethod",
+	0xa300: "FileSource",
+	0xa301: "SceneType",
+	0xa401: "CustomRendered",
+	0xa402: "ExposureMode",
+	0xa403: "WhiteBalance",
+	0xa404: "DigitalZoomRatio",
+	0xa405: "FocalLengthIn35mmFilm",
+	0xa406: "SceneCaptureType",
+	0xa407: "GainControl",
+	0xa408: "Contrast",
+	0xa409: "Saturation",
+	0xa40a: "Sharpness",
+	0xa40c: "SubjectDistanceRange",
+	0xa420: "ImageUniqueID",
+	0xa430: "CameraOwnerName",
+	0xa431: "BodySerialNumber",
+	0xa432: "LensSpecification",
+	0xa433: "LensMake",
+	0xa434: "LensModel",
+	0xa435: "LensSerialNumber",
+}
+
+// gpsTagNames names the tags of the GPS directory.
+var gpsTagNames = []string{
+	"GPSVersionID", "GPSLatitudeRef", "GPSLatitude", "GPSLongitudeRef",
+	"GPSLongitude", "GPSAltitudeRef", "GPSAltitude", "GPSTimeStamp",
+	"GPSSatellites", "GPSStatus", "GPSMeasureMode", "GPSDOP",
+	"GPSSpeedRef", "GPSSpeed", "GPSTrackRef", "GPSTrack",
+	"GPSImgDirectionRef", "GPSImgDirection", "GPSMapDatum", "GPSDestLatitudeRef",
+	"GPSDestLatitude", "GPSDestLongitudeRef", "GPSDestLongitude", "GPSDestBearingRef",
+	"GPSDestBearing", "GPSDestDistanceRef", "GPSDestDistance", "GPSProcessingMethod",
+	"GPSAreaInformation", "GPSDateStamp", "GPSDifferential", "GPSHPositioningError",
+}
+
+// tagOrientation is the EXIF orientation tag.
+const tagOrientation = 0x0112
+
+// filterExif removes the tags rejected by the filter from an EXIF TIFF block,
+// for JPEGs whose EXIF segment is rewritten without libvips. The orientation
+// is always kept. The thumbnail directory, the interoperability directory
+// and the maker note are dropped, since the offsets inside them cannot be
+// carried over. It returns nil when no tag is left.
+func filterExif(data []byte, filter *metadataFilter) []byte {
+	r := newTIFFReader(data)
+	if r == nil {
+		return nil
+	}
+	keep := func(entries []tiffEntry, name func(tag uint16) string) []tiffEntry {
+		var kept []tiffEntry
+		for _, entry := range entries {
+			switch entry.tag {
+			case tagExifIFD, tagGPSIFD, tagInterop, tagMakerNote:
+			case tagOrientation:
+				kept = append(kept, entry)
+			default:
+				if filter.keep("exif", name(entry.tag)) {
+					kept = append(kept, entry)
+				}
+			}
+		}
+		return kept
+	}
+	exifName := func(tag uint16) string {
+		if name, ok := exifTagNames[tag]; ok {
+			return name
+		}
+		return fmt.Sprintf("0x%04x", tag)
+	}
+	// Unknown GPS tags still count as location
+	gpsName := func(tag uint16) string {
+		if int(tag) < len(gpsTagNames) {
+			return gpsTagNames[tag]
+		}
+		return fmt.Sprintf("GPS0x%04x", tag)
+	}
+
+	ifd0 := r.readIFD(r.firstIFD())
+	main := keep(ifd0, exifName)
+	exif := keep(r.readIFD(r.pointer(ifd0, tagExifIFD)), exifName)
+	gps := keep(r.readIFD(r.pointer(ifd0, tagGPSIFD)), gpsName)
+	if len(main) == 0 && len(exif) == 0 && len(gps) == 0 {
+		return nil
+	}
+	return writeExif(r.order, main, exif, gps)
+}
+
+var xmpAttrPattern = regexp.MustCompile(`\s+([\w.-]+):([\w.-]+)\s*=\s*("[^"]*"|'[^']*')`)
+
+// filterXMP removes the XMP properties rejected by the filter. Properties can
+// appear either as attributes of rdf:Description or as child elements, so the
+// packet is walked with the XML decoder and the rejected byte ranges are cut
+// out of the original text, leaving everything else untouched.
+func filterXMP(data []byte, filter *metadataFilter) ([]byte, error) {
+	// XMP packets are often padded with NUL bytes
+	data = bytes.TrimRight(data, "\x00")
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	type cut struct{ start, end int64 }
+	type scope map[string]string // prefix -> namespace URI
+
+	var (
+		cuts      []cut
+		replaced  = map[int64][]byte{} // start offset -> rewritten start tag
+		tagEnds   = map[int64]int64{}
+		scopes    = []scope{{}}
+		names     = []string{""}
+		skipDepth = 0
+		skipStart int64
+		descDepth = -1
+		depth     = 0
+		kept      = 0
+	)
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	for {
+		start := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		end := decoder.InputOffset()
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			current := scope{}
+			for prefix, uri := range scopes[len(scopes)-1] {
+				current[prefix] = uri
+			}
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" {
+					current[attr.Name.Local] = attr.Value
+				}
+			}
+			scopes = append(scopes, current)
+			name := xmpName(current, t.Name.Space, t.Name.Local)
+			parent := names[len(names)-1]
+			names = append(names, name)
+
+			if skipDepth > 0 {
+				continue
+			}
+
+			if descDepth >= 0 && depth == descDepth+1 {
+				// A property element directly below rdf:Description
+				if !filter.keep("xmp", name) {
+					skipDepth = depth
+					skipStart = start
+					continue
+				}
+				kept++
+			}
+			// Only top level descriptions hold properties; nested ones are
+			// structured values and are kept or dropped with their property.
+			if name == "rdf:Description" && parent == "rdf:RDF" {
+				descDepth = depth
+				tag := data[start:end]
+				rewritten := xmpAttrPattern.ReplaceAllFunc(tag, func(m []byte) []byte {
+					parts := xmpAttrPattern.FindSubmatch(m)
+					prefix := string(parts[1])
+					if prefix == "xmlns" || prefix == "rdf" || prefix == "xml" {
+						return m
+					}
+					if filter.keep("xmp", xmpName(current, prefix, string(parts[2]))) {
+						kept++
+						return m
+					}
+					return nil
+				})
+				if !bytes.Equal(tag, rewritten) {
+					replaced[start] = rewritten
+					tagEnds[start] = end
+				}
+			}
+
+		case xml.EndElement:
+			if skipDepth == depth {
+				cuts = append(cuts, cut{skipStart, end})
+				skipDepth = 0
+			}
+			if depth == descDepth {
+				descDepth = -1
+			}
+			scopes = scopes[:len(scopes)-1]
+			names = names[:len(names)-1]
+			depth--
+		}
+	}
+
+	if kept == 0 {
+		return nil, nil
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(data))
+	pos := int64(0)
+	for pos < int64(len(data)) {
+		if rewritten, ok := replaced[pos]; ok {
+			out.Write(rewritten)
+			pos = tagEnds[pos]
+			continue
+		}
+		if len(cuts) > 0 && cuts[0].start == pos {
+			pos = cuts[0].end
+			cuts = cuts[1:]
+			continue
+		}
+		next := int64(len(data))
+		if len(cuts) > 0 && cuts[0].start < next {
+			next = cuts[0].start
+		}
+		for offset := range replaced {
+			if offset > pos && offset < next {
+				next = offset
+			}
+		}
+		out.Write(data[pos:next])
+		pos = next
+	}
+	return out.Bytes(), nil
+}
+
+// xmpName returns the conventional "prefix:local" name of an XMP property.
+// space is either a namespace prefix (RawToken) or a URI.
+func xmpName(current map[string]string, space, local string) string {
+	uri := space
+	if resolved, ok := current[space]; ok {
+		uri = resolved
+	}
+	if prefix, ok := xmpPrefixes[uri]; ok {
+		return prefix + ":" + local
+	}
+	if space != "" {
+		return space + ":" + local
+	}
+	return local
+}
+
+var photoshopHeader = []byte("Photoshop 3.0\x00")
+
+// filterIPTC removes the IPTC IIM datasets rejected by the filter. The block
+// is a Photoshop image resource list (optionally prefixed by the JPEG APP13
+// signature) where resource 0x0404 holds the IIM records. Blocks that cannot
+// be parsed are kept or dropped as a whole.
+func filterIPTC(data []byte, filter *metadataFilter) []byte {
+	var out bytes.Buffer
+	rest := data
+	if bytes.HasPrefix(rest, photoshopHeader) {
+		out.Write(photoshopHeader)
+		rest = rest[len(photoshopHeader):]
+	}
+
+	kept := 0
+	for len(rest) >= 12 && bytes.HasPrefix(rest, []byte("8BIM")) {
+		id := binary.BigEndian.Uint16(rest[4:6])
+		nameLen := int(rest[6])
+		headerLen := 6 + 1 + nameLen
+		if headerLen%2 != 0 {
+			headerLen++
+		}
+		if len(rest) < headerLen+4 {
+			break
+		}
+		size := int(binary.BigEndian.Uint32(rest[headerLen : headerLen+4]))
+		dataStart := headerLen + 4
+		padded := size
+		if padded%2 != 0 {
+			padded++
+		}
+		if len(rest) < dataStart+size {
+			break
+		}
+		resource := rest[dataStart : dataStart+size]
+
+		if id == 0x0404 {
+			filtered, n, ok := filterIIM(resource, filter)
+			if !ok {
+				if !filter.keep("iptc", "*") {
+					filtered, n = nil, 0
+				} else {
+					filtered, n = resource, 1
+				}
+			}
+			if n > 0 {
+				out.Write(rest[:headerLen])
+				binary.Write(&out, binary.BigEndian, uint32(len(filtered)))
+				out.Write(filtered)
+				if len(filtered)%2 != 0 {
+					out.WriteByte(0)
+				}
+				kept += n
+			}
+		} else {
+			// Other Photoshop resources (thumbnails, slices, ...) are kept as-is
+			end := dataStart + padded
+			if end > len(rest) {
+				end = len(rest)
+			}
+			out.Write(rest[:end])
+			kept++
+		}
+
+		if dataStart+padded >= len(rest) {
+			rest = nil
+			break
+		}
+		rest = rest[dataStart+padded:]
+	}
+
+	if kept == 0 {
+		return nil
+	}
+	return out.Bytes()
+}
+
+// filterIIM filters the datasets of an IPTC IIM stream and returns the new
+// stream, the number of datasets kept and whether the stream could be parsed.
+func filterIIM(data []byte, filter *metadataFilter) ([]byte, int, bool) {
+	var out bytes.Buffer
+	kept := 0
+	for len(data) > 0 {
+		if len(data) < 5 || data[0] != 0x1C {
+			return nil, 0, false
+		}
+		record, dataset := data[1], data[2]
+		size := int(binary.BigEndian.Uint16(data[3:5]))
+		if size&0x8000 != 0 || len(data) < 5+size {
+			// Extended datasets are not used for textual tags
+			return nil, 0, false
+		}
+
+		name := strconv.Itoa(int(record)) + ":" + strconv.Itoa(int(dataset))
+		if known, ok := iptcDatasets[dataset]; ok && record == 2 {
+			name = known
+		}
+		// The envelope record and record version are structural and kept
+		if record != 2 || dataset == 0 || filter.keep("iptc", name) {
+			out.Write(data[:5+size])
+			if record == 2 && dataset != 0 {
+				kept++
+			}
+		}
+		data = data[5+size:]
+	}
+	return out.Bytes(), kept, true
+}
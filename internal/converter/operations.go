@@ -0,0 +1,248 @@
+package converter
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+
+	appErrors "github.com/MostafaSensei106/GoPix/internal/errors"
+)
+
+// Operations supported by the transform pipeline.
+const (
+	OpRotate  = "rotate"  // rotate=DEGREES[,COLOR], clockwise, COLOR fills the corners of odd angles
+	OpFlip    = "flip"    // Mirror top to bottom
+	OpFlop    = "flop"    // Mirror left to right
+	OpCrop    = "crop"    // crop=LEFT,TOP,WIDTH,HEIGHT
+	OpTrim    = "trim"    // trim[=THRESHOLD], remove borders of the top-left pixel's color
+	OpPad     = "pad"     // pad=W:H[,COLOR], pad to the aspect ratio W:H
+	OpFlatten = "flatten" // flatten[=COLOR], replace transparency by COLOR (default white)
+)
+
+// OperationNames lists the accepted operation names.
+var OperationNames = []string{OpRotate, OpFlip, OpFlop, OpCrop, OpTrim, OpPad, OpFlatten}
+
+// defaultTrimThreshold is how far a pixel may differ from the border color
+// and still be trimmed.
+const defaultTrimThreshold = 10
+
+// Operation is one step of the transform pipeline, parsed from a spec such as
+// "rotate=90", "crop=0,0,800,600" or "pad=16:9,#ffffff".
+type Operation struct {
+	Name          string
+	Angle         float64 // rotate: clockwise degrees
+	Left, Top     int     // crop: top-left corner of the box
+	Width, Height int     // crop: size of the box; pad: aspect ratio
+	Threshold     float64 // trim: color difference still treated as border
+	Color         string  // rotate, pad and flatten: background color
+}
+
+// ParseOperations parses the operation specs of the --op flag or the
+// operations config list, keeping their order.
+func ParseOperations(specs []string) ([]Operation, error) {
+	ops := make([]Operation, 0, len(specs))
+	for _, spec := range specs {
+		op, err := parseOperation(spec)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// parseOperation parses a single NAME[=ARG,ARG...] spec.
+func parseOperation(spec string) (Operation, error) {
+	name, value, _ := strings.Cut(strings.TrimSpace(spec), "=")
+	op := Operation{Name: strings.ToLower(strings.TrimSpace(name))}
+	var args []string
+	if strings.TrimSpace(value) != "" {
+		args = strings.Split(value, ",")
+		for i := range args {
+			args[i] = strings.TrimSpace(args[i])
+		}
+	}
+	invalid := func(format string, a ...interface{}) (Operation, error) {
+		return Operation{}, fmt.Errorf("%w: operation %q: %s", appErrors.ErrInvalidOption, spec, fmt.Sprintf(format, a...))
+	}
+
+	var err error
+	switch op.Name {
+	case OpRotate:
+		if len(args) < 1 || len(args) > 2 {
+			return invalid("expected rotate=DEGREES[,COLOR]")
+		}
+		if op.Angle, err = strconv.ParseFloat(args[0], 64); err != nil {
+			return invalid("invalid angle %q", args[0])
+		}
+		if len(args) == 2 {
+			op.Color = args[1]
+		}
+	case OpFlip, OpFlop:
+		if len(args) > 0 {
+			return invalid("takes no arguments")
+		}
+	case OpCrop:
+		if len(args) != 4 {
+			return invalid("expected crop=LEFT,TOP,WIDTH,HEIGHT")
+		}
+		box := make([]int, 4)
+		for i, arg := range args {
+			if box[i], err = strconv.Atoi(arg); err != nil || box[i] < 0 {
+				return invalid("invalid crop value %q", arg)
+			}
+		}
+		op.Left, op.Top, op.Width, op.Height = box[0], box[1], box[2], box[3]
+		if op.Width == 0 || op.Height == 0 {
+			return invalid("crop box must not be empty")
+		}
+	case OpTrim:
+		op.Threshold = defaultTrimThreshold
+		if len(args) > 1 {
+			return invalid("expected trim[=THRESHOLD]")
+		}
+		if len(args) == 1 {
+			if op.Threshold, err = strconv.ParseFloat(args[0], 64); err != nil || op.Threshold < 0 {
+				return invalid("invalid threshold %q", args[0])
+			}
+		}
+	case OpPad:
+		if len(args) < 1 || len(args) > 2 {
+			return invalid("expected pad=W:H[,COLOR]")
+		}
+		w, h, ok := strings.Cut(args[0], ":")
+		op.Width, err = strconv.Atoi(w)
+		if !ok || err != nil || op.Width <= 0 {
+			return invalid("invalid aspect ratio %q", args[0])
+		}
+		if op.Height, err = strconv.Atoi(h); err != nil || op.Height <= 0 {
+			return invalid("invalid aspect ratio %q", args[0])
+		}
+		if len(args) == 2 {
+			op.Color = args[1]
+		}
+	case OpFlatten:
+		op.Color = "#ffffff"
+		if len(args) > 1 {
+			return invalid("expected flatten[=COLOR]")
+		}
+		if len(args) == 1 {
+			op.Color = args[0]
+		}
+	default:
+		return invalid("unknown operation (expected one of %s)", strings.Join(OperationNames, ", "))
+	}
+	if op.Color != "" {
+		if _, err := ParseColor(op.Color); err != nil {
+			return Operation{}, err
+		}
+	}
+	return op, nil
+}
+
+// applyOperations runs the transform pipeline on img in order. It runs after
+// the EXIF orientation is applied, so boxes refer to the upright image, and
+// before the resize stage. Frame strips of animations cannot be rotated or
+// cropped as one image, so they are rejected.
+func (ic *ImageConverter) applyOperations(img *vips.ImageRef) error {
+	if len(ic.options.Operations) == 0 {
+		return nil
+	}
+	if frames := frameCount(img); frames > 1 {
+		return fmt.Errorf("%w: operations cannot be applied to the %d frames of an animation, select one with --frame", appErrors.ErrInvalidOption, frames)
+	}
+	for _, op := range ic.options.Operations {
+		if err := applyOperation(img, op); err != nil {
+			return fmt.Errorf("operation %s: %w", op.Name, err)
+		}
+	}
+	return nil
+}
+
+// applyOperation applies a single operation to img.
+func applyOperation(img *vips.ImageRef, op Operation) error {
+	switch op.Name {
+	case OpRotate:
+		return rotate(img, op.Angle, op.Color)
+	case OpFlip:
+		return img.Flip(vips.DirectionVertical)
+	case OpFlop:
+		return img.Flip(vips.DirectionHorizontal)
+	case OpCrop:
+		if op.Left+op.Width > img.Width() || op.Top+op.Height > img.Height() {
+			return fmt.Errorf("%w: crop box %dx%d at %d,%d exceeds the %dx%d image",
+				appErrors.ErrInvalidOption, op.Width, op.Height, op.Left, op.Top, img.Width(), img.Height())
+		}
+		return img.ExtractArea(op.Left, op.Top, op.Width, op.Height)
+	case OpTrim:
+		return trim(img, op.Threshold)
+	case OpPad:
+		width, height := img.Width(), img.Height()
+		ratio := float64(op.Width) / float64(op.Height)
+		if float64(width)/float64(height) < ratio {
+			width = int(math.Round(float64(height) * ratio))
+		} else {
+			height = int(math.Round(float64(width) / ratio))
+		}
+		return padToBox(img, width, height, "centre", op.Color)
+	case OpFlatten:
+		if !img.HasAlpha() {
+			return nil
+		}
+		return flatten(img, op.Color)
+	}
+	return fmt.Errorf("unknown operation")
+}
+
+// rotate rotates img clockwise by angle degrees. Right angles are lossless,
+// other angles enlarge the canvas and fill the corners with background, or
+// transparency / black by default.
+func rotate(img *vips.ImageRef, angle float64, background string) error {
+	angle = math.Mod(math.Mod(angle, 360)+360, 360)
+	rightAngles := map[float64]vips.Angle{0: vips.Angle0, 90: vips.Angle90, 180: vips.Angle180, 270: vips.Angle270}
+	if right, ok := rightAngles[angle]; ok {
+		if right == vips.Angle0 {
+			return nil
+		}
+		return img.Rotate(right)
+	}
+
+	bg := vips.ColorRGBA{A: 255}
+	if img.HasAlpha() {
+		bg.A = 0
+	}
+	if background != "" {
+		parsed, err := ParseColor(background)
+		if err != nil {
+			return err
+		}
+		bg = parsed
+	}
+	return img.Similarity(1, angle, &bg, 0, 0, 0, 0)
+}
+
+// trim removes the borders that differ from the top-left pixel by at most
+// threshold. Images of a single color are left alone.
+func trim(img *vips.ImageRef, threshold float64) error {
+	corner, err := img.GetPoint(0, 0)
+	if err != nil {
+		return err
+	}
+	bg := &vips.Color{}
+	if len(corner) >= 3 {
+		bg.R, bg.G, bg.B = uint8(corner[0]), uint8(corner[1]), uint8(corner[2])
+	} else if len(corner) > 0 {
+		bg.R, bg.G, bg.B = uint8(corner[0]), uint8(corner[0]), uint8(corner[0])
+	}
+	left, top, width, height, err := img.FindTrim(threshold, bg)
+	if err != nil {
+		return err
+	}
+	if width <= 0 || height <= 0 || (width == img.Width() && height == img.Height()) {
+		return nil
+	}
+	return img.ExtractArea(left, top, width, height)
+}
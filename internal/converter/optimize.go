@@ -0,0 +1,288 @@
+package converter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/davidbyttow/govips/v2/vips"
+
+	appErrors "github.com/MostafaSensei106/GoPix/internal/errors"
+)
+
+// Lossless optimization. With ConvertOptions.Optimize, files already in the
+// target format are re-encoded without changing a pixel instead of being
+// refused: PNGs through a search of the row filters at the highest deflate
+// level, JPEGs by transcoding their coefficients with optimal Huffman tables,
+// sequential and progressive. Metadata is trimmed to what the metadata policy
+// keeps. Every candidate is decoded and compared with the source, and the
+// smallest identical one replaces the file only when it is smaller.
+
+// OptimizableFormats lists the formats the optimize mode can re-encode.
+var OptimizableFormats = []string{"jpg", "png"}
+
+// pngFilters are the row filters tried on PNGs: each one for every row, then
+// the best one per row.
+var pngFilters = []vips.PngFilter{
+	vips.PngFilterNone,
+	vips.PngFilterSub,
+	vips.PngFilterUo,
+	vips.PngFilterAvg,
+	vips.PngFilterPaeth,
+	vips.PngFilterAll,
+}
+
+// JPEG segments that describe the pixels rather than the picture, and are
+// kept whatever the metadata policy.
+var (
+	jfifHeader  = []byte("JFIF\x00")
+	iccHeader   = []byte("ICC_PROFILE\x00")
+	adobeHeader = []byte("Adobe")
+)
+
+// JPEG metadata segment signatures.
+var (
+	exifHeader        = []byte("Exif\x00\x00")
+	xmpHeader         = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	xmpExtendedHeader = []byte("http://ns.adobe.com/xmp/extension/\x00")
+)
+
+// optimizeImage re-encodes the file at path losslessly in its own format and
+// writes the smallest result to result.NewPath when it is smaller than the
+// source. Sources that do not shrink are reported as not beneficial.
+func (ic *ImageConverter) optimizeImage(path, format string, result *ConversionResult) error {
+	f := LookupFormat(format)
+	if f == nil || !containsString(OptimizableFormats, f.Name) {
+		result.SkipReason = "no lossless optimizer for " + format
+		return nil
+	}
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read image: %w", err)
+	}
+	img, err := vips.NewImageFromBuffer(source)
+	if err != nil {
+		return fmt.Errorf("%w: %w", appErrors.ErrCorruptedImage, err)
+	}
+	reserved := ic.budget.Acquire(DecodedSize(img))
+	defer ic.budget.Release(reserved)
+	defer img.Close()
+
+	var candidates [][]byte
+	switch f.Name {
+	case "jpg":
+		candidates, err = ic.optimizeJPEG(source)
+	case "png":
+		candidates, err = ic.optimizePNG(img, source)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The smallest candidate that decodes to the source pixels wins
+	sort.SliceStable(candidates, func(i, j int) bool { return len(candidates[i]) < len(candidates[j]) })
+	pixels, err := img.ToBytes()
+	if err != nil {
+		return fmt.Errorf("%w: %w", appErrors.ErrCorruptedImage, err)
+	}
+	var best []byte
+	for _, candidate := range candidates {
+		if int64(len(candidate)) >= result.OriginalSize {
+			break
+		}
+		same, err := samePixels(img, pixels, candidate)
+		if err != nil {
+			return err
+		}
+		if same {
+			best = candidate
+			break
+		}
+	}
+	if best == nil {
+		result.NotBeneficial = true
+		result.NewSize = result.OriginalSize
+		return nil
+	}
+	if ic.notBeneficial(int64(len(best)), result) {
+		return nil
+	}
+
+	width, height := img.Width(), img.Height()
+	write := func(w io.Writer) error {
+		_, err := w.Write(best)
+		return err
+	}
+	verify := func(tmpPath string) error {
+		return verifyOutput(tmpPath, format, width, height, 1)
+	}
+	if err := writeFileAtomic(result.NewPath, write, verify); err != nil {
+		if errors.Is(err, appErrors.ErrVerifyFailed) {
+			return err
+		}
+		return fmt.Errorf("failed to write image to file: %w", err)
+	}
+	result.NewSize = int64(len(best))
+	result.Optimized = true
+	return nil
+}
+
+// samePixels reports whether the encoded candidate decodes to the pixels of
+// the source image.
+func samePixels(source *vips.ImageRef, pixels, candidate []byte) (bool, error) {
+	img, err := vips.NewImageFromBuffer(candidate)
+	if err != nil {
+		return false, fmt.Errorf("%w: optimized image does not decode: %v", appErrors.ErrVerifyFailed, err)
+	}
+	defer img.Close()
+	if img.Width() != source.Width() || img.Height() != source.Height() ||
+		img.Bands() != source.Bands() || img.BandFormat() != source.BandFormat() {
+		return false, nil
+	}
+	decoded, err := img.ToBytes()
+	if err != nil {
+		return false, fmt.Errorf("%w: optimized image does not decode: %v", appErrors.ErrVerifyFailed, err)
+	}
+	return bytes.Equal(decoded, pixels), nil
+}
+
+// optimizeJPEG returns the lossless re-encodings of a JPEG: sequential and
+// progressive with optimal Huffman tables, only progressive when the JPEG
+// encoder options ask for it. Streams whose coefficients cannot be decoded,
+// such as progressive ones, are only trimmed of metadata.
+func (ic *ImageConverter) optimizeJPEG(source []byte) ([][]byte, error) {
+	js, err := parseJPEG(source)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", appErrors.ErrCorruptedImage, err)
+	}
+	meta, err := ic.jpegMetadata(js.meta)
+	if err != nil {
+		return nil, err
+	}
+	if !js.decoded {
+		return [][]byte{js.rewrite(meta)}, nil
+	}
+	candidates := [][]byte{js.transcode(meta, true)}
+	if !ic.options.Encoder.JPEG.Progressive {
+		candidates = append(candidates, js.transcode(meta, false))
+	}
+	return candidates, nil
+}
+
+// jpegMetadata returns the metadata segments an optimized JPEG keeps. The
+// JFIF, ICC profile and Adobe segments describe the pixels and are always
+// kept; EXIF, XMP, IPTC and comments go through the metadata policy; other
+// segments, such as JFXX thumbnails and multi-picture indexes, are dropped.
+func (ic *ImageConverter) jpegMetadata(segments []jpegSegment) ([]jpegSegment, error) {
+	strip, filters := ic.stripsAllMetadata(), ic.filtersMetadata()
+	filter := &metadataFilter{
+		mode:  ic.options.Metadata,
+		allow: ic.options.MetadataAllow,
+		deny:  ic.options.MetadataDeny,
+	}
+
+	var kept []jpegSegment
+	for _, segment := range segments {
+		data := segment.data
+		switch {
+		case segment.marker == jpegAPP0 && bytes.HasPrefix(data, jfifHeader),
+			segment.marker == jpegAPP0+2 && bytes.HasPrefix(data, iccHeader),
+			segment.marker == jpegAPP0+14 && bytes.HasPrefix(data, adobeHeader):
+		case segment.marker == jpegAPP0+1 && bytes.HasPrefix(data, exifHeader):
+			// Stripping keeps the orientation, which the pixels rely on
+			if strip || filters {
+				exif := filterExif(data[len(exifHeader):], filter)
+				if exif == nil {
+					continue
+				}
+				data = append(append([]byte(nil), exifHeader...), exif...)
+			}
+		case segment.marker == jpegAPP0+1 && bytes.HasPrefix(data, xmpHeader):
+			if strip {
+				continue
+			}
+			if filters {
+				xmp, err := filterXMP(data[len(xmpHeader):], filter)
+				if err != nil {
+					return nil, fmt.Errorf("failed to filter XMP metadata: %w", err)
+				}
+				if len(xmp) == 0 {
+					continue
+				}
+				data = append(append([]byte(nil), xmpHeader...), xmp...)
+			}
+		case segment.marker == jpegAPP0+1 && bytes.HasPrefix(data, xmpExtendedHeader):
+			// Extended XMP cannot be filtered on its own
+			if strip || filters {
+				continue
+			}
+		case segment.marker == jpegAPP0+13 && bytes.HasPrefix(data, photoshopHeader):
+			if strip {
+				continue
+			}
+			if filters {
+				if data = filterIPTC(data, filter); data == nil {
+					continue
+				}
+			}
+		case segment.marker == jpegCOM:
+			if strip || filter.mode == "keep-copyright" || len(filter.allow) > 0 {
+				continue
+			}
+		default:
+			continue
+		}
+		if len(data) > 0xffff-2 {
+			continue
+		}
+		kept = append(kept, jpegSegment{marker: segment.marker, data: data})
+	}
+	return kept, nil
+}
+
+// optimizePNG returns the lossless re-encodings of a PNG, one per row filter
+// at the highest deflate level, and as palette images too for palette
+// sources. libvips loads palette images as RGB, and its quantizer keeps the
+// colors of images with up to 256 of them, which the pixel comparison checks.
+func (ic *ImageConverter) optimizePNG(img *vips.ImageRef, source []byte) ([][]byte, error) {
+	if ic.stripsAllMetadata() {
+		// Keeps the ICC profile, which the pixels rely on
+		if err := img.RemoveMetadata(); err != nil {
+			return nil, fmt.Errorf("failed to strip metadata: %w", err)
+		}
+	} else if err := ic.applyMetadataPolicy(img); err != nil {
+		return nil, err
+	}
+
+	// The bit depth and color type follow the signature and IHDR header
+	palettes := []bool{false}
+	bitDepth := 0
+	if len(source) > 25 && source[25] == 3 {
+		palettes = append(palettes, true)
+		bitDepth = int(source[24])
+	}
+
+	var candidates [][]byte
+	for _, palette := range palettes {
+		for _, filter := range pngFilters {
+			params := vips.NewPngExportParams()
+			params.Compression = 9
+			params.Filter = filter
+			params.Interlace = ic.options.Encoder.PNG.Interlace
+			if palette {
+				params.Palette = true
+				params.Quality = 100
+				params.Bitdepth = bitDepth
+			}
+			buf, _, err := img.ExportPng(params)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode image: %w", err)
+			}
+			candidates = append(candidates, buf)
+		}
+	}
+	return candidates, nil
+}
@@ -0,0 +1,205 @@
+package converter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+
+	appErrors "github.com/MostafaSensei106/GoPix/internal/errors"
+)
+
+// Page modes supported by PageOptions.Mode.
+const (
+	PagesSingle = "single" // Convert one page, the first selected one (default)
+	PagesSplit  = "split"  // Convert every selected page to its own file
+	PagesJoin   = "join"   // Write the selected pages into one multi-page TIFF
+)
+
+// PageModes lists the accepted values for PageOptions.Mode.
+var PageModes = []string{PagesSingle, PagesSplit, PagesJoin}
+
+// PagedFormats are the source formats whose pages are document pages rather
+// than animation frames.
+var PagedFormats = []string{"tiff", "tif", "pdf"}
+
+// PageOptions controls how multi-page TIFF and PDF sources are converted.
+type PageOptions struct {
+	Ranges string // Selected pages (1-based), e.g. "1-3,5" or "2-", empty = all pages
+	Mode   string // single, split or join (default single)
+}
+
+// pageRange is an inclusive range of 1-based pages, last 0 meaning "to the end".
+type pageRange struct {
+	first, last int
+}
+
+// Enabled reports whether page handling differs from converting the first page.
+func (po *PageOptions) Enabled() bool {
+	return po.Ranges != "" || (po.Mode != "" && po.Mode != PagesSingle)
+}
+
+// Validate checks the page mode and the syntax of the page ranges.
+func (po *PageOptions) Validate() error {
+	if po.Mode != "" && !containsString(PageModes, po.Mode) {
+		return fmt.Errorf("%w: unknown page mode %q (expected one of %s)", appErrors.ErrInvalidOption, po.Mode, strings.Join(PageModes, ", "))
+	}
+	_, err := parsePageRanges(po.Ranges)
+	return err
+}
+
+// parsePageRanges parses a comma separated list of pages and ranges such as
+// "1-3,5,8-". An empty spec selects every page.
+func parsePageRanges(spec string) ([]pageRange, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	var ranges []pageRange
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		first, last, isRange := strings.Cut(part, "-")
+		r := pageRange{}
+		var err error
+		if r.first, err = strconv.Atoi(strings.TrimSpace(first)); err != nil || r.first < 1 {
+			return nil, fmt.Errorf("%w: invalid page %q in %q (pages start at 1)", appErrors.ErrInvalidOption, part, spec)
+		}
+		switch {
+		case !isRange:
+			r.last = r.first
+		case strings.TrimSpace(last) != "":
+			if r.last, err = strconv.Atoi(strings.TrimSpace(last)); err != nil || r.last < r.first {
+				return nil, fmt.Errorf("%w: invalid page range %q in %q", appErrors.ErrInvalidOption, part, spec)
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// Select returns the selected 1-based pages of a source with the given page
+// count, in ascending order and without duplicates. Pages past the end are
+// ignored.
+func (po *PageOptions) Select(pages int) ([]int, error) {
+	ranges, err := parsePageRanges(po.Ranges)
+	if err != nil {
+		return nil, err
+	}
+	if len(ranges) == 0 {
+		ranges = []pageRange{{first: 1}}
+	}
+	selected := make([]bool, pages+1)
+	for _, r := range ranges {
+		last := r.last
+		if last == 0 || last > pages {
+			last = pages
+		}
+		for page := r.first; page <= last; page++ {
+			selected[page] = true
+		}
+	}
+	var result []int
+	for page := 1; page <= pages; page++ {
+		if selected[page] {
+			result = append(result, page)
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%w: none of pages %q exist, the document has %d", appErrors.ErrInvalidOption, po.Ranges, pages)
+	}
+	return result, nil
+}
+
+// PagesOf returns the selected pages of the document at path when it should
+// be split into one job per page, or nil when it is converted as a whole.
+func (po *PageOptions) PagesOf(path string) ([]int, error) {
+	if po.Mode != PagesSplit || !isPagedSource(path) {
+		return nil, nil
+	}
+	img, err := vips.NewImageFromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", appErrors.ErrCorruptedImage, err)
+	}
+	pages := img.Pages()
+	img.Close()
+	if pages <= 1 {
+		return nil, nil
+	}
+	return po.Select(pages)
+}
+
+// isPagedSource reports whether the file at path is a document whose pages
+// are handled by PageOptions.
+func isPagedSource(path string) bool {
+	return containsString(PagedFormats, sourceFormat(path))
+}
+
+// sourcePage resolves the page of a document to load for a whole-file job in
+// single mode: the first selected page, or 0 for the default first page.
+func (ic *ImageConverter) sourcePage(path string, pages int) (int, error) {
+	po := ic.options.Pages
+	if po.Ranges == "" || (po.Mode != "" && po.Mode != PagesSingle) || !isPagedSource(path) {
+		return 0, nil
+	}
+	selected, err := po.Select(pages)
+	if err != nil {
+		return 0, err
+	}
+	return selected[0], nil
+}
+
+// joinsPages reports whether the pages of the document at path are joined.
+func (ic *ImageConverter) joinsPages(path string) bool {
+	return ic.options.Pages.Mode == PagesJoin && isPagedSource(path)
+}
+
+// loadPages decodes the selected pages of a document stacked vertically, the
+// layout libvips uses for multi-page images, so they are encoded as one
+// multi-page file. Every selected page must have the same size.
+func (ic *ImageConverter) loadPages(path string, pages int) (*vips.ImageRef, error) {
+	selected, err := ic.options.Pages.Select(pages)
+	if err != nil {
+		return nil, err
+	}
+
+	// The first page becomes the joined image, the others are released once
+	// joined. Everything is released when anything fails.
+	loaded := make([]*vips.ImageRef, 0, len(selected))
+	joined := false
+	defer func() {
+		for i, page := range loaded {
+			if i > 0 || !joined {
+				page.Close()
+			}
+		}
+	}()
+	for _, page := range selected {
+		params := vips.NewImportParams()
+		params.Page.Set(page - 1)
+		img, err := vips.LoadImageFromFile(path, params)
+		if err != nil {
+			return nil, fmt.Errorf("%w: page %d: %w", appErrors.ErrCorruptedImage, page, err)
+		}
+		loaded = append(loaded, img)
+		if img.Width() != loaded[0].Width() || img.Height() != loaded[0].Height() {
+			return nil, fmt.Errorf("%w: page %d is %dx%d but page %d is %dx%d, only pages of the same size can be joined",
+				appErrors.ErrInvalidOption, page, img.Width(), img.Height(), selected[0], loaded[0].Width(), loaded[0].Height())
+		}
+	}
+
+	img := loaded[0]
+	if len(loaded) > 1 {
+		pageHeight := img.Height()
+		if err := img.ArrayJoin(loaded[1:], 1); err != nil {
+			return nil, fmt.Errorf("failed to join pages: %w", err)
+		}
+		if err := img.SetPageHeight(pageHeight); err != nil {
+			return nil, fmt.Errorf("failed to join pages: %w", err)
+		}
+		if err := img.SetPages(len(loaded)); err != nil {
+			return nil, fmt.Errorf("failed to join pages: %w", err)
+		}
+	}
+	joined = true
+	return img, nil
+}
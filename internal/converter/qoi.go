@@ -0,0 +1,179 @@
+package converter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// QOI ("Quite OK Image") codec, see https://qoiformat.org/qoi-specification.pdf.
+// libvips has no QOI support, so the format is read and written in Go.
+
+const (
+	qoiOpIndex = 0x00
+	qoiOpDiff  = 0x40
+	qoiOpLuma  = 0x80
+	qoiOpRun   = 0xc0
+	qoiOpRGB   = 0xfe
+	qoiOpRGBA  = 0xff
+	qoiMask    = 0xc0
+
+	qoiHeaderSize = 14
+	qoiPixelsMax  = 400_000_000 // Limit of the reference implementation
+)
+
+var (
+	qoiMagic   = []byte("qoif")
+	qoiPadding = []byte{0, 0, 0, 0, 0, 0, 0, 1}
+)
+
+// qoiHash returns the index position of a pixel in the running array.
+func qoiHash(c color.NRGBA) int {
+	return (int(c.R)*3 + int(c.G)*5 + int(c.B)*7 + int(c.A)*11) % 64
+}
+
+// decodeQOIConfig reads the size of a QOI image from its header.
+func decodeQOIConfig(r io.Reader) (image.Config, error) {
+	var header [qoiHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return image.Config{}, err
+	}
+	if string(header[:4]) != string(qoiMagic) {
+		return image.Config{}, errors.New("qoi: invalid magic")
+	}
+	width := binary.BigEndian.Uint32(header[4:])
+	height := binary.BigEndian.Uint32(header[8:])
+	if width == 0 || height == 0 || uint64(width)*uint64(height) > qoiPixelsMax {
+		return image.Config{}, fmt.Errorf("qoi: invalid size %dx%d", width, height)
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: int(width), Height: int(height)}, nil
+}
+
+// decodeQOI decodes a QOI image into an NRGBA image.
+func decodeQOI(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	config, err := decodeQOIConfig(br)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, config.Width, config.Height))
+
+	var index [64]color.NRGBA
+	px := color.NRGBA{A: 255}
+	run := 0
+	for i := 0; i < len(img.Pix); i += 4 {
+		if run > 0 {
+			run--
+		} else {
+			b1, err := br.ReadByte()
+			if err != nil {
+				return nil, fmt.Errorf("qoi: truncated data: %w", err)
+			}
+			switch {
+			case b1 == qoiOpRGB:
+				var rgb [3]byte
+				if _, err := io.ReadFull(br, rgb[:]); err != nil {
+					return nil, fmt.Errorf("qoi: truncated data: %w", err)
+				}
+				px.R, px.G, px.B = rgb[0], rgb[1], rgb[2]
+			case b1 == qoiOpRGBA:
+				var rgba [4]byte
+				if _, err := io.ReadFull(br, rgba[:]); err != nil {
+					return nil, fmt.Errorf("qoi: truncated data: %w", err)
+				}
+				px = color.NRGBA{R: rgba[0], G: rgba[1], B: rgba[2], A: rgba[3]}
+			case b1&qoiMask == qoiOpIndex:
+				px = index[b1]
+			case b1&qoiMask == qoiOpDiff:
+				px.R += (b1>>4)&0x03 - 2
+				px.G += (b1>>2)&0x03 - 2
+				px.B += b1&0x03 - 2
+			case b1&qoiMask == qoiOpLuma:
+				b2, err := br.ReadByte()
+				if err != nil {
+					return nil, fmt.Errorf("qoi: truncated data: %w", err)
+				}
+				vg := b1&0x3f - 32
+				px.R += vg - 8 + (b2>>4)&0x0f
+				px.G += vg
+				px.B += vg - 8 + b2&0x0f
+			case b1&qoiMask == qoiOpRun:
+				run = int(b1 & 0x3f)
+			}
+			index[qoiHash(px)] = px
+		}
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = px.R, px.G, px.B, px.A
+	}
+	return img, nil
+}
+
+// encodeQOI writes img as QOI, with an alpha channel unless it is opaque.
+func encodeQOI(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 || width*height > qoiPixelsMax {
+		return fmt.Errorf("qoi: cannot encode a %dx%d image", width, height)
+	}
+
+	bw := bufio.NewWriter(w)
+	var header [qoiHeaderSize]byte
+	copy(header[:], qoiMagic)
+	binary.BigEndian.PutUint32(header[4:], uint32(width))
+	binary.BigEndian.PutUint32(header[8:], uint32(height))
+	header[12] = 4
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		header[12] = 3
+	}
+	header[13] = 0 // sRGB with linear alpha
+	bw.Write(header[:])
+
+	var index [64]color.NRGBA
+	prev := color.NRGBA{A: 255}
+	run := 0
+	last := width*height - 1
+	for i := 0; i <= last; i++ {
+		px := color.NRGBAModel.Convert(img.At(bounds.Min.X+i%width, bounds.Min.Y+i/width)).(color.NRGBA)
+		if px == prev {
+			run++
+			if run == 62 || i == last {
+				bw.WriteByte(qoiOpRun | byte(run-1))
+				run = 0
+			}
+			continue
+		}
+		if run > 0 {
+			bw.WriteByte(qoiOpRun | byte(run-1))
+			run = 0
+		}
+
+		hash := qoiHash(px)
+		switch {
+		case index[hash] == px:
+			bw.WriteByte(qoiOpIndex | byte(hash))
+		case px.A != prev.A:
+			index[hash] = px
+			bw.Write([]byte{qoiOpRGBA, px.R, px.G, px.B, px.A})
+		default:
+			index[hash] = px
+			dr := int(int8(px.R - prev.R))
+			dg := int(int8(px.G - prev.G))
+			db := int(int8(px.B - prev.B))
+			drdg, dbdg := dr-dg, db-dg
+			switch {
+			case dr >= -2 && dr <= 1 && dg >= -2 && dg <= 1 && db >= -2 && db <= 1:
+				bw.WriteByte(qoiOpDiff | byte(dr+2)<<4 | byte(dg+2)<<2 | byte(db+2))
+			case dg >= -32 && dg <= 31 && drdg >= -8 && drdg <= 7 && dbdg >= -8 && dbdg <= 7:
+				bw.Write([]byte{qoiOpLuma | byte(dg+32), byte(drdg+8)<<4 | byte(dbdg+8)})
+			default:
+				bw.Write([]byte{qoiOpRGB, px.R, px.G, px.B})
+			}
+		}
+		prev = px
+	}
+	bw.Write(qoiPadding)
+	return bw.Flush()
+}
@@ -0,0 +1,573 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image/jpeg"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+
+	appErrors "github.com/MostafaSensei106/GoPix/internal/errors"
+)
+
+// RAW decoders supported by RawOptions.Decode.
+const (
+	RawPreview = "preview" // Embedded full-size JPEG preview (default)
+	RawFull    = "full"    // Demosaic with libvips, which needs libraw or an ImageMagick RAW delegate
+	RawOff     = "off"     // Do not pick up RAW files
+)
+
+// RawDecoders lists the accepted values for RawOptions.Decode.
+var RawDecoders = []string{RawPreview, RawFull, RawOff}
+
+// White balance modes supported by RawOptions.WhiteBalance, besides explicit
+// "r,g,b" channel gains.
+const (
+	WhiteBalanceCamera = "camera" // As shot (default)
+	WhiteBalanceAuto   = "auto"   // Grey world: scale the channels to the same average
+)
+
+// RawExtensions lists the camera RAW file extensions picked up as sources.
+var RawExtensions = []string{"dng", "cr2", "cr3", "nef", "nrw", "arw", "srf", "sr2", "raf", "orf", "rw2", "pef", "srw"}
+
+// RawOptions controls how camera RAW files are decoded and developed.
+type RawOptions struct {
+	Decode       string  // preview, full or off (default preview)
+	WhiteBalance string  // camera, auto or "r,g,b" gains, e.g. "1.1,1,0.9" (default camera)
+	Exposure     float64 // Exposure compensation in stops, -5 to 5
+}
+
+// Validate checks the decoder, the white balance and the exposure.
+func (ro *RawOptions) Validate() error {
+	if ro.Decode != "" && !containsString(RawDecoders, ro.Decode) {
+		return fmt.Errorf("%w: unknown RAW decoder %q (expected one of %s)", appErrors.ErrInvalidOption, ro.Decode, strings.Join(RawDecoders, ", "))
+	}
+	if _, err := ro.gains(); err != nil {
+		return err
+	}
+	if ro.Exposure < -5 || ro.Exposure > 5 {
+		return fmt.Errorf("%w: RAW exposure must be between -5 and 5 stops, got %g", appErrors.ErrInvalidOption, ro.Exposure)
+	}
+	return nil
+}
+
+// Enabled reports whether RAW files are picked up as sources.
+func (ro *RawOptions) Enabled() bool {
+	return ro.Decode != RawOff
+}
+
+// gains parses explicit "r,g,b" white balance gains, nil for the named modes.
+func (ro *RawOptions) gains() ([]float64, error) {
+	switch ro.WhiteBalance {
+	case "", WhiteBalanceCamera, WhiteBalanceAuto:
+		return nil, nil
+	}
+	parts := strings.Split(ro.WhiteBalance, ",")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: white balance must be camera, auto or r,g,b gains, got %q", appErrors.ErrInvalidOption, ro.WhiteBalance)
+	}
+	gains := make([]float64, len(parts))
+	for i, part := range parts {
+		gain, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || gain <= 0 || gain > 10 {
+			return nil, fmt.Errorf("%w: white balance gains must be between 0 and 10, got %q", appErrors.ErrInvalidOption, ro.WhiteBalance)
+		}
+		gains[i] = gain
+	}
+	return gains, nil
+}
+
+// isRawFile reports whether the file at path is a camera RAW file.
+func isRawFile(path string) bool {
+	return sourceFormat(path) == "raw"
+}
+
+// loadRaw decodes the RAW file at path with the configured decoder and
+// develops it with the white balance and exposure settings.
+func (ic *ImageConverter) loadRaw(path string) (*vips.ImageRef, error) {
+	img, err := loadRawPreview(path)
+	if ic.options.Raw.Decode == RawFull {
+		previewPixels := 0
+		if err == nil {
+			previewPixels = img.Width() * img.Height()
+			img.Close()
+		}
+		img, err = loadRawFull(path, previewPixels)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := ic.developRaw(img); err != nil {
+		img.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+// loadRawFull asks libvips to decode the RAW file at path. libvips picks the
+// loader by content, so without a RAW loader it may open the small TIFF
+// thumbnail instead; anything smaller than the embedded preview is rejected.
+func loadRawFull(path string, previewPixels int) (*vips.ImageRef, error) {
+	img, err := vips.NewImageFromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: libvips cannot decode %s, use the preview decoder: %v", appErrors.ErrUnsupportedFormat, path, err)
+	}
+	if img.Width()*img.PageHeight() < previewPixels {
+		img.Close()
+		return nil, fmt.Errorf("%w: libvips has no RAW loader for %s, use the preview decoder", appErrors.ErrUnsupportedFormat, path)
+	}
+	return img, nil
+}
+
+// developRaw applies the white balance and the exposure compensation in
+// linear light, keeping the depth of img.
+func (ic *ImageConverter) developRaw(img *vips.ImageRef) error {
+	ro := ic.options.Raw
+	gains, _ := ro.gains()
+	auto := ro.WhiteBalance == WhiteBalanceAuto
+	if (gains == nil && !auto && ro.Exposure == 0) || img.Bands() < 3 {
+		return nil
+	}
+
+	target := vips.InterpretationSRGB
+	if img.BandFormat() == vips.BandFormatUshort {
+		target = vips.InterpretationRGB16
+	}
+	err := keepingFormat(img, func() error {
+		if err := img.ToColorSpace(vips.InterpretationScRGB); err != nil {
+			return err
+		}
+		if auto {
+			var err error
+			if gains, err = greyWorldGains(img); err != nil {
+				return err
+			}
+		}
+		exposure := math.Pow(2, ro.Exposure)
+		a := make([]float64, img.Bands())
+		b := make([]float64, img.Bands())
+		for i := range a {
+			a[i] = 1
+			if i < 3 {
+				a[i] = exposure
+				if gains != nil {
+					a[i] *= gains[i]
+				}
+			}
+		}
+		if err := img.Linear(a, b); err != nil {
+			return err
+		}
+		return img.ToColorSpace(target)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to develop RAW image: %w", err)
+	}
+	return nil
+}
+
+// greyWorldGains returns the gains that bring the averages of the three color
+// bands of img to their common mean.
+func greyWorldGains(img *vips.ImageRef) ([]float64, error) {
+	averages := make([]float64, 3)
+	mean := 0.0
+	for i := range averages {
+		band, err := img.ExtractBandToImage(i, 1)
+		if err != nil {
+			return nil, err
+		}
+		averages[i], err = band.Average()
+		band.Close()
+		if err != nil {
+			return nil, err
+		}
+		mean += averages[i] / 3
+	}
+	gains := make([]float64, 3)
+	for i, average := range averages {
+		gains[i] = 1
+		if average > 0 {
+			gains[i] = mean / average
+		}
+	}
+	return gains, nil
+}
+
+// loadRawPreview loads the largest JPEG embedded in the RAW file at path,
+// with the EXIF tags of the RAW file when they can be read.
+func loadRawPreview(path string) (*vips.ImageRef, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	preview := rawPreview(data)
+	if preview == nil {
+		return nil, fmt.Errorf("%w: no embedded preview found in %s", appErrors.ErrCorruptedImage, path)
+	}
+	if exif := rawExif(data); exif != nil {
+		preview = withExif(preview, exif)
+	}
+	img, err := vips.NewImageFromBuffer(preview)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", appErrors.ErrCorruptedImage, err)
+	}
+	return img, nil
+}
+
+// rawPreview scans data for embedded baseline or progressive JPEG streams
+// and returns the largest one. RAW containers differ per vendor, but all of
+// them carry such a preview; the lossless JPEG of the sensor data is not
+// decodable by image/jpeg and is skipped.
+func rawPreview(data []byte) []byte {
+	var best []byte
+	bestPixels := 0
+	for i := 0; ; {
+		n := bytes.Index(data[i:], []byte{0xff, 0xd8, 0xff})
+		if n < 0 {
+			break
+		}
+		start := i + n
+		length := jpegLength(data[start:])
+		if length == 0 {
+			i = start + 2
+			continue
+		}
+		stream := data[start : start+length]
+		if config, err := jpeg.DecodeConfig(bytes.NewReader(stream)); err == nil && config.Width*config.Height > bestPixels {
+			best, bestPixels = stream, config.Width*config.Height
+		}
+		i = start + length
+	}
+	return best
+}
+
+// jpegLength walks the segments of the JPEG stream at the start of data and
+// returns its length up to and including the EOI marker, or 0 when the
+// stream is malformed or truncated.
+func jpegLength(data []byte) int {
+	pos := 2
+	for pos+2 <= len(data) {
+		if data[pos] != 0xff {
+			return 0
+		}
+		marker := data[pos+1]
+		switch {
+		case marker == 0xff:
+			pos++ // Fill byte
+			continue
+		case marker == 0xd9:
+			return pos + 2
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			pos += 2
+			continue
+		case pos+4 > len(data):
+			return 0
+		}
+		segment := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if segment < 2 {
+			return 0
+		}
+		pos += 2 + segment
+		if marker != 0xda {
+			continue
+		}
+		// Entropy-coded data runs to the next marker that is not a stuffed
+		// zero or a restart marker
+		for pos+1 < len(data) && (data[pos] != 0xff || data[pos+1] == 0 || (data[pos+1] >= 0xd0 && data[pos+1] <= 0xd7)) {
+			pos++
+		}
+	}
+	return 0
+}
+
+// withExif returns the JPEG stream with its EXIF segment replaced by exif,
+// a TIFF block.
+func withExif(stream, exif []byte) []byte {
+	const exifHeader = "Exif\x00\x00"
+	if len(exif)+len(exifHeader)+2 > math.MaxUint16 {
+		return stream
+	}
+	out := make([]byte, 0, len(stream)+len(exif)+10)
+	out = append(out, 0xff, 0xd8, 0xff, 0xe1)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(exif)+len(exifHeader)+2))
+	out = append(out, exifHeader...)
+	out = append(out, exif...)
+
+	// Copy the other segments, dropping the EXIF segments of the preview
+	pos := 2
+	for pos+4 <= len(stream) && stream[pos] == 0xff {
+		marker := stream[pos+1]
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(stream[pos+2:]))
+		if end > len(stream) {
+			return stream
+		}
+		if marker != 0xe1 || !bytes.HasPrefix(stream[pos+4:], []byte(exifHeader)) {
+			out = append(out, stream[pos:end]...)
+		}
+		pos = end
+	}
+	return append(out, stream[pos:]...)
+}
+
+// TIFF tags handled when the EXIF tags of a RAW file are copied.
+const (
+	tagExifIFD   = 0x8769
+	tagGPSIFD    = 0x8825
+	tagInterop   = 0xa005
+	tagMakerNote = 0x927c
+)
+
+// rawIFD0Tags are the tags of the main RAW directory that describe the photo
+// rather than the sensor data.
+var rawIFD0Tags = map[uint16]bool{
+	0x010e: true, // ImageDescription
+	0x010f: true, // Make
+	0x0110: true, // Model
+	0x0112: true, // Orientation
+	0x011a: true, // XResolution
+	0x011b: true, // YResolution
+	0x0128: true, // ResolutionUnit
+	0x0131: true, // Software
+	0x0132: true, // DateTime
+	0x013b: true, // Artist
+	0x8298: true, // Copyright
+}
+
+// tiffTypeSizes holds the byte size of the TIFF field types.
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4}
+
+// tiffEntry is a directory entry with its value bytes, in the byte order of
+// the file it was read from.
+type tiffEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+// tiffReader reads the directories of a TIFF block.
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// newTIFFReader checks the header of a TIFF block. Olympus and Panasonic use
+// their own magic numbers.
+func newTIFFReader(data []byte) *tiffReader {
+	if len(data) < 8 {
+		return nil
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+	switch order.Uint16(data[2:]) {
+	case 42, 0x4f52, 0x5352, 0x55:
+		return &tiffReader{data: data, order: order}
+	}
+	return nil
+}
+
+// firstIFD returns the offset of the first directory.
+func (r *tiffReader) firstIFD() uint32 {
+	return r.order.Uint32(r.data[4:])
+}
+
+// readIFD returns the entries of the directory at offset, skipping entries
+// whose value lies outside the data. Offset 0 is a missing directory.
+func (r *tiffReader) readIFD(offset uint32) []tiffEntry {
+	if offset == 0 || uint64(offset)+2 > uint64(len(r.data)) {
+		return nil
+	}
+	count := int(r.order.Uint16(r.data[offset:]))
+	var entries []tiffEntry
+	for i := 0; i < count; i++ {
+		pos := int(offset) + 2 + 12*i
+		if pos+12 > len(r.data) {
+			break
+		}
+		entry := tiffEntry{
+			tag:   r.order.Uint16(r.data[pos:]),
+			typ:   r.order.Uint16(r.data[pos+2:]),
+			count: r.order.Uint32(r.data[pos+4:]),
+		}
+		size := uint64(tiffTypeSizes[entry.typ]) * uint64(entry.count)
+		if size == 0 {
+			continue
+		}
+		start := uint64(pos + 8)
+		if size > 4 {
+			start = uint64(r.order.Uint32(r.data[pos+8:]))
+		}
+		if start+size > uint64(len(r.data)) {
+			continue
+		}
+		entry.value = r.data[start : start+size]
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// pointer returns the directory offset stored in the entry with tag, or 0.
+func (r *tiffReader) pointer(entries []tiffEntry, tag uint16) uint32 {
+	for _, entry := range entries {
+		if entry.tag == tag && len(entry.value) >= 4 && (entry.typ == 4 || entry.typ == 13) {
+			return r.order.Uint32(entry.value)
+		}
+	}
+	return 0
+}
+
+// rawExif copies the descriptive tags of a RAW file into a new TIFF block
+// suitable for an EXIF segment: the main directory, the EXIF directory
+// without the maker note, and the GPS directory. TIFF based RAW files hold
+// them in their own header; CR3 files in CMT boxes. It returns nil when no
+// tags are found.
+func rawExif(data []byte) []byte {
+	if r := newTIFFReader(data); r != nil {
+		ifd0 := r.readIFD(r.firstIFD())
+		exif, gps := r.readIFD(r.pointer(ifd0, tagExifIFD)), r.readIFD(r.pointer(ifd0, tagGPSIFD))
+		return buildExif(r.order, ifd0, exif, gps)
+	}
+
+	// CR3: CMT1 holds the main directory, CMT2 the EXIF and CMT4 the GPS
+	// directory, each as a TIFF block of its own
+	var order binary.ByteOrder
+	var dirs [3][]tiffEntry
+	for i, box := range []string{"CMT1", "CMT2", "CMT4"} {
+		pos := bytes.Index(data, []byte(box))
+		if pos < 4 {
+			continue
+		}
+		size := int(binary.BigEndian.Uint32(data[pos-4:]))
+		if size < 8 || pos-4+size > len(data) {
+			continue
+		}
+		r := newTIFFReader(data[pos+4 : pos-4+size])
+		if r == nil || (order != nil && r.order != order) {
+			continue
+		}
+		order = r.order
+		dirs[i] = r.readIFD(r.firstIFD())
+	}
+	if order == nil {
+		return nil
+	}
+	return buildExif(order, dirs[0], dirs[1], dirs[2])
+}
+
+// buildExif writes a TIFF block holding the descriptive tags of ifd0 and, when
+// not empty, the exif and gps directories it points to.
+func buildExif(order binary.ByteOrder, ifd0, exif, gps []tiffEntry) []byte {
+	var main []tiffEntry
+	for _, entry := range ifd0 {
+		if rawIFD0Tags[entry.tag] {
+			main = append(main, entry)
+		}
+	}
+	var exifTags []tiffEntry
+	for _, entry := range exif {
+		if entry.tag != tagMakerNote && entry.tag != tagInterop {
+			exifTags = append(exifTags, entry)
+		}
+	}
+	if len(main) == 0 && len(exifTags) == 0 {
+		return nil
+	}
+	return writeExif(order, main, exifTags, gps)
+}
+
+// writeExif writes a TIFF block holding the ifd0 directory, which must not
+// hold sub-directory pointers, and, when not empty, the exif and gps
+// directories it then points to.
+func writeExif(order binary.ByteOrder, ifd0, exifTags, gps []tiffEntry) []byte {
+	main := append([]tiffEntry(nil), ifd0...)
+
+	// Pointers to the sub-directories are patched once their offsets are known
+	pointer := func(tag uint16) tiffEntry {
+		return tiffEntry{tag: tag, typ: 4, count: 1, value: make([]byte, 4)}
+	}
+	if len(exifTags) > 0 {
+		main = append(main, pointer(tagExifIFD))
+	}
+	if len(gps) > 0 {
+		main = append(main, pointer(tagGPSIFD))
+	}
+	sort.Slice(main, func(i, j int) bool { return main[i].tag < main[j].tag })
+
+	ifdSize := func(entries []tiffEntry) int {
+		size := 2 + 12*len(entries) + 4
+		for _, entry := range entries {
+			if len(entry.value) > 4 {
+				size += len(entry.value) + len(entry.value)%2
+			}
+		}
+		return size
+	}
+	exifOffset := 8 + ifdSize(main)
+	gpsOffset := exifOffset + ifdSize(exifTags)
+	for _, entry := range main {
+		switch entry.tag {
+		case tagExifIFD:
+			order.PutUint32(entry.value, uint32(exifOffset))
+		case tagGPSIFD:
+			order.PutUint32(entry.value, uint32(gpsOffset))
+		}
+	}
+
+	out := make([]byte, 8, gpsOffset+ifdSize(gps))
+	copy(out, "II")
+	if order == binary.BigEndian {
+		copy(out, "MM")
+	}
+	order.PutUint16(out[2:], 42)
+	order.PutUint32(out[4:], 8)
+	out = writeIFD(out, order, main)
+	if len(exifTags) > 0 {
+		out = writeIFD(out, order, exifTags)
+	}
+	if len(gps) > 0 {
+		out = writeIFD(out, order, gps)
+	}
+	return out
+}
+
+// writeIFD appends a directory with its out-of-line values to out.
+func writeIFD(out []byte, order binary.ByteOrder, entries []tiffEntry) []byte {
+	dataOffset := len(out) + 2 + 12*len(entries) + 4
+	var count [2]byte
+	order.PutUint16(count[:], uint16(len(entries)))
+	out = append(out, count[:]...)
+	var data []byte
+	for _, entry := range entries {
+		var field [12]byte
+		order.PutUint16(field[0:], entry.tag)
+		order.PutUint16(field[2:], entry.typ)
+		order.PutUint32(field[4:], entry.count)
+		if len(entry.value) <= 4 {
+			copy(field[8:], entry.value)
+		} else {
+			order.PutUint32(field[8:], uint32(dataOffset+len(data)))
+			data = append(data, entry.value...)
+			if len(entry.value)%2 == 1 {
+				data = append(data, 0)
+			}
+		}
+		out = append(out, field[:]...)
+	}
+	out = append(out, 0, 0, 0, 0) // No next directory
+	return append(out, data...)
+}
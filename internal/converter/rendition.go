@@ -0,0 +1,445 @@
+package converter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidbyttow/govips/v2/vips"
+
+	appErrors "github.com/MostafaSensei106/GoPix/internal/errors"
+)
+
+// DefaultRenditionTemplate names rendition outputs after the source, the
+// requested width and the output format.
+const DefaultRenditionTemplate = "{name}-{width}w.{ext}"
+
+// RenditionOptions describes the variants produced from a single decode of
+// each source: every width in Widths is encoded to every format in Formats.
+type RenditionOptions struct {
+	Widths   []int    // Output widths in pixels, empty = keep the size from the resize stage
+	Formats  []string // Output formats, empty = the job's target format
+	Template string   // Output file name with {name}, {width} and {ext} tokens
+}
+
+// Enabled reports whether renditions have been requested.
+func (ro *RenditionOptions) Enabled() bool {
+	return len(ro.Widths) > 0 || len(ro.Formats) > 0
+}
+
+// Count returns the number of variants produced per source.
+func (ro *RenditionOptions) Count() int {
+	if !ro.Enabled() {
+		return 1
+	}
+	return max(len(ro.Widths), 1) * max(len(ro.Formats), 1)
+}
+
+// Validate checks the rendition options and that the template yields a
+// distinct file name for every variant of every source.
+func (ro *RenditionOptions) Validate() error {
+	if !ro.Enabled() {
+		return nil
+	}
+	seenWidths := make(map[int]bool, len(ro.Widths))
+	for _, width := range ro.Widths {
+		if width <= 0 {
+			return fmt.Errorf("%w: rendition width must be positive, got %d", appErrors.ErrInvalidOption, width)
+		}
+		if seenWidths[width] {
+			return fmt.Errorf("%w: duplicate rendition width %d", appErrors.ErrInvalidOption, width)
+		}
+		seenWidths[width] = true
+	}
+	seenFormats := make(map[string]bool, len(ro.Formats))
+	for _, format := range ro.Formats {
+		format = strings.ToLower(format)
+		if !IsTargetFormat(format) {
+			return fmt.Errorf("%w: unsupported rendition format %q", appErrors.ErrInvalidOption, format)
+		}
+		if seenFormats[format] {
+			return fmt.Errorf("%w: duplicate rendition format %q", appErrors.ErrInvalidOption, format)
+		}
+		seenFormats[format] = true
+	}
+
+	template := ro.template()
+	// Without the source name every source of a job would write the same files
+	if !strings.Contains(template, "{name}") {
+		return fmt.Errorf("%w: rendition template %q needs {name}", appErrors.ErrInvalidOption, template)
+	}
+	if len(ro.Widths) > 1 && !strings.Contains(template, "{width}") {
+		return fmt.Errorf("%w: rendition template %q needs {width} for multiple widths", appErrors.ErrInvalidOption, template)
+	}
+	if len(ro.Formats) > 1 && !strings.Contains(template, "{ext}") {
+		return fmt.Errorf("%w: rendition template %q needs {ext} for multiple formats", appErrors.ErrInvalidOption, template)
+	}
+	if strings.ContainsAny(strings.NewReplacer("{name}", "", "{width}", "", "{ext}", "").Replace(template), "{}") {
+		return fmt.Errorf("%w: unknown token in rendition template %q (expected {name}, {width}, {ext})", appErrors.ErrInvalidOption, template)
+	}
+	return nil
+}
+
+// template returns the configured template or the default one.
+func (ro *RenditionOptions) template() string {
+	if ro.Template != "" {
+		return ro.Template
+	}
+	if len(ro.Widths) == 0 {
+		return "{name}.{ext}"
+	}
+	return DefaultRenditionTemplate
+}
+
+// fileName expands the template for one variant.
+func (ro *RenditionOptions) fileName(name string, width int, format string) string {
+	return strings.NewReplacer(
+		"{name}", name,
+		"{width}", strconv.Itoa(width),
+		"{ext}", format,
+	).Replace(ro.template())
+}
+
+// variants returns the widths, largest first (0 = keep the size), and the
+// formats of the variants of a source converted to format.
+func (ro *RenditionOptions) variants(format string) ([]int, []string) {
+	widths := append([]int(nil), ro.Widths...)
+	sort.Sort(sort.Reverse(sort.IntSlice(widths)))
+	if len(widths) == 0 {
+		widths = []int{0}
+	}
+	formats := ro.Formats
+	if len(formats) == 0 {
+		formats = []string{format}
+	}
+	return widths, formats
+}
+
+// outputPaths returns the paths of the variants next to outputPath, in the
+// order of the results of ConvertRenditions. width stands for the variants
+// that keep the size.
+func (ro *RenditionOptions) outputPaths(outputPath, format string, width int) []string {
+	widths, formats := ro.variants(format)
+	dir := filepath.Dir(outputPath)
+	name := strings.TrimSuffix(filepath.Base(outputPath), filepath.Ext(outputPath))
+	paths := make([]string, 0, len(widths)*len(formats))
+	for _, w := range widths {
+		if w == 0 {
+			w = width
+		}
+		for _, f := range formats {
+			paths = append(paths, filepath.Join(dir, ro.fileName(name, w, strings.ToLower(f))))
+		}
+	}
+	return paths
+}
+
+// HasRenditions reports whether jobs should go through ConvertRenditions.
+func (ic *ImageConverter) HasRenditions() bool {
+	return ic.options.Renditions.Enabled()
+}
+
+// RenditionCount returns the number of results produced per source image.
+func (ic *ImageConverter) RenditionCount() int {
+	return ic.options.Renditions.Count()
+}
+
+// renditionResize returns the resize options for a variant of the given width.
+// An explicit resize box is scaled to the width so its aspect ratio is kept.
+func (ic *ImageConverter) renditionResize(width int) ResizeOptions {
+	ro := ic.options.Resize
+	if ro.Width > 0 && ro.Height > 0 {
+		ro.Height = ro.Height * width / ro.Width
+	} else {
+		ro.Height = 0
+	}
+	ro.Width = width
+	ro.Percent = 0
+	if ro.Mode == "" {
+		ro.Mode = ResizeFit
+	}
+	return ro
+}
+
+// ConvertRenditions decodes the image at path once and writes every variant
+// described by the rendition options next to outputPath (or the source when
+// outputPath is empty). One ConversionResult is returned per variant, in
+// width then format order, so callers can account for each output on its own.
+// The original is only removed once every variant has been written, so a
+// variant discarded by OnlyIfSmaller keeps it.
+func (ic *ImageConverter) ConvertRenditions(path, format, outputPath string) []*ConversionResult {
+	ro := ic.options.Renditions
+	start := time.Now()
+
+	widths, formats := ro.variants(format)
+
+	results := make([]*ConversionResult, 0, len(widths)*len(formats))
+	for range widths {
+		for range formats {
+			results = append(results, &ConversionResult{OriginalPath: path})
+		}
+	}
+	fail := func(err error) []*ConversionResult {
+		for _, result := range results {
+			if result.Error == nil {
+				result.Error = err
+			}
+		}
+		results[0].Duration = time.Since(start)
+		return results
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return fail(fmt.Errorf("failed to stat file: %w", err))
+	}
+
+	img, err := ic.loadImage(path, 0, formats...)
+	if err != nil {
+		return fail(err)
+	}
+	reserved := ic.budget.Acquire(DecodedSize(img))
+	defer func() {
+		img.Close()
+		ic.budget.Release(reserved)
+	}()
+	// Widths and file names refer to the upright, transformed image
+	if err := ic.autoOrient(img); err != nil {
+		return fail(err)
+	}
+	if err := ic.applyOperations(img); err != nil {
+		return fail(err)
+	}
+
+	if outputPath == "" {
+		outputPath = path
+	}
+	for i, newPath := range ro.outputPaths(outputPath, format, img.Width()) {
+		result := results[i]
+		result.OriginalSize = stat.Size()
+		result.NewPath = newPath
+		if result.NewPath == path {
+			return fail(fmt.Errorf("%w: rendition %s would overwrite its source", appErrors.ErrInvalidOption, result.NewPath))
+		}
+	}
+
+	// Settle transparency the formats cannot store, per variant. A fallback
+	// already among the formats is left to that variant.
+	lowered := make([]string, len(formats))
+	for i, f := range formats {
+		lowered[i] = strings.ToLower(f)
+	}
+	variantFormats := make([]string, len(results))
+	for i, result := range results {
+		f := lowered[i%len(formats)]
+		resolved, err := ic.resolveAlpha(img, f, result)
+		if err != nil {
+			result.Error = err
+			continue
+		}
+		if resolved != f && resolved != "" && containsString(lowered, resolved) {
+			result.SkipReason = "has transparency, kept by the " + resolved + " rendition"
+			continue
+		}
+		variantFormats[i] = resolved
+	}
+
+	// Skip the whole source when every variant is still cached
+	if ic.cachedRenditions(path, variantFormats, results) {
+		return results
+	}
+
+	if ic.options.DryRun {
+		for _, result := range results {
+			if newStat, err := os.Stat(result.NewPath); err == nil {
+				result.NewSize = newStat.Size()
+			}
+		}
+		return results
+	}
+
+	if ic.options.Backup {
+		if err := ic.createBackup(path); err != nil {
+			return fail(fmt.Errorf("backup failed: %w", err))
+		}
+	}
+
+	// Convert the colors and filter the metadata once, every variant copies
+	// the result
+	if err := ic.applyColorManagement(img, formats...); err != nil {
+		return fail(err)
+	}
+	if err := ic.applyMetadataPolicy(img); err != nil {
+		return fail(err)
+	}
+
+	// Each result is charged the time since the previous one, so the decode
+	// is accounted to the first variant and the durations add up to the total.
+	mark := start
+	incomplete := false
+	for i, width := range widths {
+		variant, err := ic.renditionVariant(img, width)
+		for j := range formats {
+			k := i*len(formats) + j
+			result := results[k]
+			switch {
+			case variantFormats[k] == "":
+				// Failed or skipped by the alpha policy
+			case err == nil:
+				result.Error = ic.writeRendition(variant, variantFormats[k], result)
+			default:
+				result.Error = err
+			}
+			incomplete = incomplete || result.Error != nil || result.NotBeneficial || result.SkipReason != ""
+			result.Duration = time.Since(mark)
+			mark = time.Now()
+		}
+		if variant != nil {
+			variant.Close()
+		}
+	}
+
+	// Only kept sources can be looked up again
+	if ic.options.Cache != nil && ic.options.KeepOriginal {
+		for i, result := range results {
+			if result.Error == nil && !result.NotBeneficial && result.SkipReason == "" {
+				ic.options.Cache.Put(result.NewPath, path, ic.getConfigHash(variantFormats[i]))
+			}
+		}
+	}
+
+	if !incomplete && !ic.options.KeepOriginal {
+		if err := os.Remove(path); err != nil {
+			results[len(results)-1].Error = fmt.Errorf("failed to remove original: %w", err)
+		}
+	}
+
+	return results
+}
+
+// cachedRenditions reports whether every variant of path written in the
+// given formats (one per result, "" when not written) is up to date in the
+// cache, in which case the results are marked as cached.
+func (ic *ImageConverter) cachedRenditions(path string, formats []string, results []*ConversionResult) bool {
+	if ic.options.Cache == nil {
+		return false
+	}
+	sizes := make([]int64, len(results))
+	for i, result := range results {
+		if formats[i] == "" {
+			continue
+		}
+		entry, hit := ic.options.Cache.Lookup(result.NewPath, path, ic.getConfigHash(formats[i]))
+		if !hit {
+			return false
+		}
+		sizes[i] = entry.OutputSize
+	}
+	for i, result := range results {
+		if formats[i] == "" {
+			continue
+		}
+		result.NewSize = sizes[i]
+		result.SkipReason = "unchanged since last run (cached)"
+	}
+	return true
+}
+
+// renditionVariant returns a resized, filtered and watermarked copy of img for
+// the given width, or a copy resized by the regular resize stage when width
+// is 0.
+func (ic *ImageConverter) renditionVariant(img *vips.ImageRef, width int) (*vips.ImageRef, error) {
+	variant, err := img.Copy()
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy image: %w", err)
+	}
+	if width == 0 {
+		err = ic.resizeImage(variant)
+	} else {
+		err = resizeTo(variant, ic.renditionResize(width))
+	}
+	if err == nil {
+		err = ic.applyAdjustments(variant, variant.Width() < img.Width())
+	}
+	if err == nil {
+		err = ic.applyWatermark(variant)
+	}
+	if err != nil {
+		variant.Close()
+		return nil, err
+	}
+	return variant, nil
+}
+
+// writeRendition encodes variant to format and writes it to result.NewPath
+// through a verified temp file. Animations are reduced to their first frame
+// for formats that cannot store them.
+func (ic *ImageConverter) writeRendition(variant *vips.ImageRef, format string, result *ConversionResult) error {
+	if frameCount(variant) > 1 && !isAnimated(format) {
+		first, err := extractFrame(variant, 0)
+		if err != nil {
+			return err
+		}
+		defer first.Close()
+		variant = first
+	}
+
+	// Reaching a target size may shrink the image, keep that from the other formats
+	if ic.options.TargetSize > 0 && ic.options.TargetDownscale {
+		copied, err := variant.Copy()
+		if err != nil {
+			return fmt.Errorf("failed to copy image: %w", err)
+		}
+		defer copied.Close()
+		variant = copied
+	}
+
+	// Flattening changes the variant, keep the transparency for the other formats
+	if variant.HasAlpha() && !SupportsAlpha(format) {
+		copied, err := variant.Copy()
+		if err != nil {
+			return fmt.Errorf("failed to copy image: %w", err)
+		}
+		defer copied.Close()
+		if err := ic.flattenAlpha(copied, format); err != nil {
+			return err
+		}
+		variant = copied
+	}
+
+	imgBytes, releaseBytes, err := ic.encodeHeld(variant, format, result)
+	if err != nil {
+		return err
+	}
+	defer releaseBytes()
+	if ic.notBeneficial(int64(len(imgBytes)), result) {
+		return nil
+	}
+
+	width, height, frames := variant.Width(), variant.PageHeight(), frameCount(variant)
+	write := func(w io.Writer) error {
+		_, err := w.Write(imgBytes)
+		return err
+	}
+	verify := func(tmpPath string) error {
+		return verifyOutput(tmpPath, format, width, height, frames)
+	}
+	if err := writeFileAtomic(result.NewPath, write, verify); err != nil {
+		if errors.Is(err, appErrors.ErrVerifyFailed) {
+			return err
+		}
+		return fmt.Errorf("failed to write image to file: %w", err)
+	}
+
+	result.NewSize = int64(len(imgBytes))
+	if frames > 1 {
+		result.Frames = frames
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package converter
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+
+	appErrors "github.com/MostafaSensei106/GoPix/internal/errors"
+)
+
+// Resize modes supported by ResizeOptions.Mode.
+const (
+	ResizeFit     = "fit"     // Scale to fit inside the box, keeping the aspect ratio
+	ResizeContain = "contain" // Fit inside the box and pad the rest with the background
+	ResizeCover   = "cover"   // Scale to cover the box, keeping the aspect ratio
+	ResizeFill    = "fill"    // Cover the box and crop the overflow using the gravity
+	ResizeExact   = "exact"   // Stretch to the box, ignoring the aspect ratio, enlarging if needed
+)
+
+// ResizeOptions contains the settings of the resize stage.
+// Width or Height may be left at 0 to derive it from the aspect ratio.
+type ResizeOptions struct {
+	Width      int
+	Height     int
+	Mode       string  // fit, contain, cover, fill or exact (default fit)
+	Percent    float64 // Scale by percentage instead of a target box
+	Upscale    bool    // Allow enlarging images smaller than the target, exact mode always does
+	Gravity    string  // Crop/pad anchor: centre, north, south, east, west, north-east, ..., smart, attention
+	Kernel     string  // nearest, linear, cubic, mitchell, lanczos2 or lanczos3 (default)
+	Background string  // Padding color for contain and fill, e.g. "#ffffff" or "transparent"
+}
+
+var resizeKernels = map[string]vips.Kernel{
+	"nearest":  vips.KernelNearest,
+	"linear":   vips.KernelLinear,
+	"cubic":    vips.KernelCubic,
+	"mitchell": vips.KernelMitchell,
+	"lanczos2": vips.KernelLanczos2,
+	"lanczos3": vips.KernelLanczos3,
+}
+
+var resizeModes = []string{ResizeFit, ResizeContain, ResizeCover, ResizeFill, ResizeExact}
+
+// gravities maps gravity names to the relative x/y anchor of the kept area.
+var gravities = map[string][2]float64{
+	"centre":     {0.5, 0.5},
+	"center":     {0.5, 0.5},
+	"north":      {0.5, 0},
+	"south":      {0.5, 1},
+	"east":       {1, 0.5},
+	"west":       {0, 0.5},
+	"north-east": {1, 0},
+	"north-west": {0, 0},
+	"south-east": {1, 1},
+	"south-west": {0, 1},
+}
+
+// smartGravities use libvips' smart crop instead of a fixed anchor.
+var smartGravities = map[string]vips.Interesting{
+	"smart":     vips.InterestingEntropy,
+	"entropy":   vips.InterestingEntropy,
+	"attention": vips.InterestingAttention,
+}
+
+// IsZero reports whether no resizing has been requested.
+func (ro *ResizeOptions) IsZero() bool {
+	return ro.Width == 0 && ro.Height == 0 && ro.Percent == 0
+}
+
+// Validate checks the resize options for unknown names and impossible values.
+func (ro *ResizeOptions) Validate() error {
+	if ro.Width < 0 || ro.Height < 0 {
+		return fmt.Errorf("%w: resize width and height must not be negative", appErrors.ErrInvalidOption)
+	}
+	if ro.Percent < 0 {
+		return fmt.Errorf("%w: resize percentage must not be negative", appErrors.ErrInvalidOption)
+	}
+	if ro.Percent > 0 && (ro.Width > 0 || ro.Height > 0) {
+		return fmt.Errorf("%w: resize percentage cannot be combined with width/height", appErrors.ErrInvalidOption)
+	}
+	if ro.Mode != "" && !containsString(resizeModes, ro.Mode) {
+		return fmt.Errorf("%w: unknown resize mode %q (expected one of %s)", appErrors.ErrInvalidOption, ro.Mode, strings.Join(resizeModes, ", "))
+	}
+	if (ro.Mode == ResizeContain || ro.Mode == ResizeFill || ro.Mode == ResizeExact) && (ro.Width == 0 || ro.Height == 0) {
+		return fmt.Errorf("%w: resize mode %s needs both width and height", appErrors.ErrInvalidOption, ro.Mode)
+	}
+	if _, ok := resizeKernels[ro.Kernel]; ro.Kernel != "" && !ok {
+		return fmt.Errorf("%w: unknown resize kernel %q", appErrors.ErrInvalidOption, ro.Kernel)
+	}
+	if ro.Gravity != "" {
+		_, fixed := gravities[ro.Gravity]
+		_, smart := smartGravities[ro.Gravity]
+		if !fixed && !smart {
+			return fmt.Errorf("%w: unknown gravity %q", appErrors.ErrInvalidOption, ro.Gravity)
+		}
+	}
+	if ro.Background != "" {
+		if _, err := ParseColor(ro.Background); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// autoOrient rotates and flips img upright according to its EXIF orientation
+// and resets the tag to 1, so the resize stage compares the displayed width
+// and height and outputs without metadata are not shown sideways. Frame
+// strips of multi-frame images are left alone, rotating them would mix up
+// the frames.
+func (ic *ImageConverter) autoOrient(img *vips.ImageRef) error {
+	if ic.options.NoAutoOrient || img.Orientation() <= 1 || frameCount(img) > 1 {
+		return nil
+	}
+	if err := img.AutoRotate(); err != nil {
+		return fmt.Errorf("failed to apply EXIF orientation: %w", err)
+	}
+	if err := img.SetOrientation(1); err != nil {
+		return fmt.Errorf("failed to reset EXIF orientation: %w", err)
+	}
+	return nil
+}
+
+// resizeImage applies the resize stage. Without explicit resize options the
+// legacy MaxDimension setting fits the longest side into a square box.
+func (ic *ImageConverter) resizeImage(img *vips.ImageRef) error {
+	ro := ic.options.Resize
+	if ro.IsZero() {
+		if ic.options.MaxDimension == 0 {
+			return nil
+		}
+		maxDim := int(ic.options.MaxDimension)
+		ro = ResizeOptions{Width: maxDim, Height: maxDim, Mode: ResizeFit, Kernel: ro.Kernel}
+	}
+	return resizeTo(img, ro)
+}
+
+// resizeTo applies ro to img. A zero ro leaves the image untouched.
+func resizeTo(img *vips.ImageRef, ro ResizeOptions) error {
+	if ro.IsZero() {
+		return nil
+	}
+
+	kernel := vips.KernelLanczos3
+	if k, ok := resizeKernels[ro.Kernel]; ok {
+		kernel = k
+	}
+
+	srcWidth, srcHeight := float64(img.Width()), float64(img.PageHeight())
+	clamp := func(scale float64) float64 {
+		if scale > 1 && !ro.Upscale {
+			return 1
+		}
+		return scale
+	}
+
+	if ro.Percent > 0 {
+		scale := clamp(ro.Percent / 100)
+		return scaleImage(img, scale, scale, kernel)
+	}
+
+	width, height := float64(ro.Width), float64(ro.Height)
+	if width == 0 {
+		width = math.Round(srcWidth * height / srcHeight)
+	}
+	if height == 0 {
+		height = math.Round(srcHeight * width / srcWidth)
+	}
+	hScale, vScale := width/srcWidth, height/srcHeight
+
+	switch ro.Mode {
+	case ResizeExact:
+		// Stretching ignores the aspect ratio anyway, so the box is always
+		// reached, clamping one axis would only distort differently
+		return scaleImage(img, hScale, vScale, kernel)
+
+	case ResizeCover, ResizeFill:
+		scale := clamp(math.Max(hScale, vScale))
+		if err := scaleImage(img, scale, scale, kernel); err != nil {
+			return err
+		}
+		if ro.Mode == ResizeFill {
+			if err := cropToBox(img, int(width), int(height), ro.Gravity); err != nil {
+				return err
+			}
+			// A source too small to cover the box without --upscale, or one
+			// rounded a pixel short, is padded so the box is always reached
+			return padToBox(img, int(width), int(height), ro.Gravity, ro.Background)
+		}
+		return nil
+
+	default: // fit, contain
+		scale := clamp(math.Min(hScale, vScale))
+		if err := scaleImage(img, scale, scale, kernel); err != nil {
+			return err
+		}
+		if ro.Mode == ResizeContain {
+			return padToBox(img, int(width), int(height), ro.Gravity, ro.Background)
+		}
+		return nil
+	}
+}
+
+// scaleImage resizes img by the given factors, skipping no-op resizes.
+func scaleImage(img *vips.ImageRef, hScale, vScale float64, kernel vips.Kernel) error {
+	if hScale == 1 && vScale == 1 {
+		return nil
+	}
+	if err := img.ResizeWithVScale(hScale, vScale, kernel); err != nil {
+		return fmt.Errorf("failed to resize image: %w", err)
+	}
+	return nil
+}
+
+// cropToBox crops img to at most width x height, anchored by gravity.
+func cropToBox(img *vips.ImageRef, width, height int, gravity string) error {
+	width = min(width, img.Width())
+	height = min(height, img.PageHeight())
+	if width == img.Width() && height == img.PageHeight() {
+		return nil
+	}
+
+	// Smart crop would judge the whole strip of frames, so animations are
+	// anchored at the centre instead
+	if interesting, ok := smartGravities[gravity]; ok && img.Height() == img.PageHeight() {
+		if err := img.SmartCrop(width, height, interesting); err != nil {
+			return fmt.Errorf("failed to smart crop image: %w", err)
+		}
+		return nil
+	}
+
+	left, top := anchor(gravity, img.Width()-width, img.PageHeight()-height)
+	if err := img.ExtractArea(left, top, width, height); err != nil {
+		return fmt.Errorf("failed to crop image: %w", err)
+	}
+	return nil
+}
+
+// padToBox centres (or anchors by gravity) img on a width x height canvas.
+func padToBox(img *vips.ImageRef, width, height int, gravity, background string) error {
+	if width <= img.Width() && height <= img.PageHeight() {
+		return nil
+	}
+	width = max(width, img.Width())
+	height = max(height, img.PageHeight())
+
+	bg := vips.ColorRGBA{A: 255}
+	if img.HasAlpha() {
+		bg.A = 0
+	}
+	if background != "" {
+		parsed, err := ParseColor(background)
+		if err != nil {
+			return err
+		}
+		bg = parsed
+	}
+
+	left, top := anchor(gravity, width-img.Width(), height-img.PageHeight())
+	if err := img.EmbedBackgroundRGBA(left, top, width, height, &bg); err != nil {
+		return fmt.Errorf("failed to pad image: %w", err)
+	}
+	return nil
+}
+
+// anchor distributes the free horizontal and vertical space according to gravity.
+func anchor(gravity string, freeX, freeY int) (int, int) {
+	pos, ok := gravities[gravity]
+	if !ok {
+		pos = gravities["centre"]
+	}
+	return int(math.Round(float64(freeX) * pos[0])), int(math.Round(float64(freeY) * pos[1]))
+}
+
+// ParseColor parses "#rgb", "#rrggbb", "#rrggbbaa", "transparent", "white" or "black".
+func ParseColor(s string) (vips.ColorRGBA, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "transparent":
+		return vips.ColorRGBA{}, nil
+	case "white":
+		return vips.ColorRGBA{R: 255, G: 255, B: 255, A: 255}, nil
+	case "black":
+		return vips.ColorRGBA{A: 255}, nil
+	}
+
+	hexValue := strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(hexValue) == 3 {
+		hexValue = string([]byte{hexValue[0], hexValue[0], hexValue[1], hexValue[1], hexValue[2], hexValue[2]})
+	}
+	if len(hexValue) == 6 {
+		hexValue += "ff"
+	}
+	raw, err := hex.DecodeString(hexValue)
+	if err != nil || len(raw) != 4 {
+		return vips.ColorRGBA{}, fmt.Errorf("%w: invalid color %q (expected #rrggbb, #rrggbbaa or a name)", appErrors.ErrInvalidOption, s)
+	}
+	return vips.ColorRGBA{R: raw[0], G: raw[1], B: raw[2], A: raw[3]}, nil
+}
+
+// containsString reports whether list contains s.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Content sniffing. File names are not trusted to tell the format of an
+// image: a PNG saved as photo.jpg or a file without an extension is
+// recognised by its leading bytes, and Format.Sniff holds the signature of
+// every registered format.
+
+// sniffSize is the number of leading bytes read to detect a format, enough
+// for the brand list of an ISO media ftyp box.
+const sniffSize = 64
+
+// detection is a format detected by DetectFormat, with the size and
+// modification time of the file it was detected in.
+type detection struct {
+	format  string
+	size    int64
+	modTime time.Time
+}
+
+// detections caches the detected format per path, so that collecting a file
+// and the several checks of its conversion read its header only once. An
+// entry is used as long as the file keeps its size and modification time.
+var detections sync.Map
+
+// DetectFormat returns the name of the registered format the content of the
+// file at path is in, or "" when its leading bytes match no format. Most
+// camera RAW files are TIFF files, so TIFF content with a RAW extension is
+// reported as RAW.
+func DetectFormat(path string) (string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if cached, ok := detections.Load(path); ok {
+		if d := cached.(detection); d.size == stat.Size() && d.modTime.Equal(stat.ModTime()) {
+			return d.format, nil
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	header := make([]byte, sniffSize)
+	n, err := io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	format := detectFormat(header[:n])
+	if format == "tiff" && containsString(RawExtensions, getFileExtension(path)) {
+		format = "raw"
+	}
+	detections.Store(path, detection{format: format, size: stat.Size(), modTime: stat.ModTime()})
+	return format, nil
+}
+
+// detectFormat returns the name of the first registered format whose
+// signature matches header, or "".
+func detectFormat(header []byte) string {
+	for _, f := range Formats() {
+		if f.Sniff != nil && f.Sniff(header) {
+			return f.Name
+		}
+	}
+	return ""
+}
+
+// sourceFormat returns the format of the file at path: the one detected from
+// its content, or the one of its extension when the content is not
+// recognised or cannot be read.
+func sourceFormat(path string) string {
+	if format, err := DetectFormat(path); err == nil && format != "" {
+		return format
+	}
+	ext := getFileExtension(path)
+	if f := LookupFormat(ext); f != nil {
+		return f.Name
+	}
+	return ext
+}
+
+// hasPrefix returns a signature matching headers that start with one of the
+// prefixes.
+func hasPrefix(prefixes ...string) func(header []byte) bool {
+	return func(header []byte) bool {
+		for _, prefix := range prefixes {
+			if bytes.HasPrefix(header, []byte(prefix)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// isoBrands returns the major and compatible brands of an ISO base media
+// file (HEIF, AVIF, CR3), or nil when header does not start with an ftyp box.
+func isoBrands(header []byte) []string {
+	if len(header) < 12 || string(header[4:8]) != "ftyp" {
+		return nil
+	}
+	size := int(binary.BigEndian.Uint32(header))
+	if size < 16 {
+		size = 16
+	}
+	brands := []string{string(header[8:12])}
+	// Compatible brands follow the minor version
+	for pos := 16; pos+4 <= min(size, len(header)); pos += 4 {
+		brands = append(brands, string(header[pos:pos+4]))
+	}
+	return brands
+}
+
+// hasBrand returns a signature matching ISO base media files with one of
+// the brands.
+func hasBrand(brands ...string) func(header []byte) bool {
+	return func(header []byte) bool {
+		for _, brand := range isoBrands(header) {
+			if containsString(brands, brand) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// sniffWebP matches a RIFF container holding a WebP image.
+func sniffWebP(header []byte) bool {
+	return len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WEBP"
+}
+
+// sniffHEIF matches HEIF brands, except AVIF files, which share them.
+func sniffHEIF(header []byte) bool {
+	return hasBrand("heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1")(header) &&
+		!hasBrand("avif", "avis")(header)
+}
+
+// sniffBMP matches a bitmap file header followed by a known DIB header size,
+// so that text starting with "BM" is not taken for a bitmap.
+func sniffBMP(header []byte) bool {
+	if len(header) < 18 || string(header[:2]) != "BM" {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(header[14:]) {
+	case 12, 40, 52, 56, 64, 108, 124:
+		return true
+	}
+	return false
+}
+
+// sniffICO matches an icon directory with at least one entry.
+func sniffICO(header []byte) bool {
+	return len(header) >= icoHeaderSize && bytes.HasPrefix(header, []byte{0, 0, 1, 0}) &&
+		binary.LittleEndian.Uint16(header[4:]) > 0
+}
+
+// sniffRaw matches the camera RAW files that are not plain TIFF files:
+// Canon CR2 and CR3, Fujifilm RAF, Olympus ORF and Panasonic RW2. The TIFF
+// based ones are told apart by DetectFormat.
+func sniffRaw(header []byte) bool {
+	if hasPrefix("FUJIFILMCCD-RAW", "IIRO", "IIRS", "MMOR", "IIU\x00")(header) || hasBrand("crx ")(header) {
+		return true
+	}
+	return len(header) >= 11 && string(header[:4]) == "II*\x00" && string(header[8:11]) == "CR\x02"
+}
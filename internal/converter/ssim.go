@@ -0,0 +1,178 @@
+package converter
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+const (
+	// ssimWindow and ssimStride define the sliding windows the SSIM is averaged over.
+	ssimWindow = 8
+	ssimStride = 4
+	// ssimMaxPixels caps the resolution the SSIM is computed at. Larger images
+	// are compared downsampled, which keeps the search fast and still tracks
+	// visible compression artifacts.
+	ssimMaxPixels = 2 << 20
+)
+
+// DSSIMToSSIM converts a DSSIM ceiling to the equivalent SSIM floor.
+func DSSIMToSSIM(dssim float64) float64 {
+	return 1 - 2*dssim
+}
+
+// encodeToSSIM binary searches the lowest quality, up to the configured one,
+// whose decoded output keeps an SSIM of at least TargetSSIM against img. When
+// even the configured quality falls short, its output is used.
+func (ic *ImageConverter) encodeToSSIM(img *vips.ImageRef, format string, result *ConversionResult) ([]byte, error) {
+	reference, width, height, err := lumaPixels(img)
+	if err != nil {
+		return nil, err
+	}
+	// Animations are compared frame strip against frame strip
+	params := vips.NewImportParams()
+	if frameCount(img) > 1 {
+		params.NumPages.Set(-1)
+	}
+	score := func(buf []byte) (float64, error) {
+		decoded, err := vips.LoadImageFromBuffer(buf, params)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decode encoded image: %w", err)
+		}
+		defer decoded.Close()
+		pixels, w, h, err := lumaPixels(decoded)
+		if err != nil {
+			return 0, err
+		}
+		if w != width || h != height {
+			return 0, fmt.Errorf("encoded image is %dx%d, expected %dx%d", w, h, width, height)
+		}
+		return ssim(reference, pixels, width, height), nil
+	}
+
+	bestQuality := ic.formatQuality(format)
+	best, err := ic.exportImageWithQuality(img, format, bestQuality)
+	if err != nil {
+		return nil, err
+	}
+	bestScore, err := score(best)
+	if err != nil {
+		return nil, err
+	}
+
+	if ic.qualityAffectsSize(format) && bestScore >= ic.options.TargetSSIM {
+		lo, hi := minSearchQuality, bestQuality-1
+		for lo <= hi {
+			mid := (lo + hi) / 2
+			buf, err := ic.exportImageWithQuality(img, format, mid)
+			if err != nil {
+				return nil, err
+			}
+			s, err := score(buf)
+			if err != nil {
+				return nil, err
+			}
+			if s >= ic.options.TargetSSIM {
+				best, bestQuality, bestScore = buf, mid, s
+				hi = mid - 1
+			} else {
+				lo = mid + 1
+			}
+		}
+	}
+
+	result.Quality = bestQuality
+	result.SSIM = bestScore
+	return best, nil
+}
+
+// lumaPixels returns the 8-bit luma plane of img, downsampled to at most
+// ssimMaxPixels. Alpha is flattened against white so transparent areas
+// compare equal regardless of the hidden color.
+func lumaPixels(img *vips.ImageRef) ([]uint8, int, int, error) {
+	luma, err := img.Copy()
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to copy image: %w", err)
+	}
+	defer luma.Close()
+
+	if luma.HasAlpha() {
+		if err := luma.Flatten(&vips.Color{R: 255, G: 255, B: 255}); err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to flatten image: %w", err)
+		}
+	}
+	// B_W is 8-bit, so this also brings 16-bit and grey16 images to 0-255
+	if luma.Interpretation() != vips.InterpretationBW {
+		if err := luma.ToColorSpace(vips.InterpretationBW); err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to convert image to grayscale: %w", err)
+		}
+	}
+	if luma.Bands() > 1 {
+		if err := luma.ExtractBand(0, 1); err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to extract luma: %w", err)
+		}
+	}
+	if luma.BandFormat() != vips.BandFormatUchar {
+		if err := luma.Cast(vips.BandFormatUchar); err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to convert image to 8-bit: %w", err)
+		}
+	}
+	if pixels := luma.Width() * luma.Height(); pixels > ssimMaxPixels {
+		scale := math.Sqrt(float64(ssimMaxPixels) / float64(pixels))
+		if err := luma.Resize(scale, vips.KernelLinear); err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to downsample image: %w", err)
+		}
+	}
+
+	data, err := luma.ToBytes()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return data, luma.Width(), luma.Height(), nil
+}
+
+// ssim returns the mean structural similarity of two equally sized 8-bit
+// planes, computed over sliding square windows. 1 means identical.
+func ssim(a, b []uint8, width, height int) float64 {
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+
+	window := min(ssimWindow, width, height)
+	stride := max(min(ssimStride, window/2), 1)
+	n := float64(window * window)
+
+	var total float64
+	var count int
+	for y := 0; y+window <= height; y += stride {
+		for x := 0; x+window <= width; x += stride {
+			var sumA, sumB, sumAA, sumBB, sumAB uint64
+			for wy := 0; wy < window; wy++ {
+				row := (y+wy)*width + x
+				for wx := 0; wx < window; wx++ {
+					pa, pb := uint64(a[row+wx]), uint64(b[row+wx])
+					sumA += pa
+					sumB += pb
+					sumAA += pa * pa
+					sumBB += pb * pb
+					sumAB += pa * pb
+				}
+			}
+
+			meanA, meanB := float64(sumA)/n, float64(sumB)/n
+			varA := float64(sumAA)/n - meanA*meanA
+			varB := float64(sumBB)/n - meanB*meanB
+			cov := float64(sumAB)/n - meanA*meanB
+
+			total += ((2*meanA*meanB + c1) * (2*cov + c2)) /
+				((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+			count++
+		}
+	}
+	if count == 0 {
+		return 1
+	}
+	return total / float64(count)
+}
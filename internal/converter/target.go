@@ -0,0 +1,110 @@
+package converter
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/davidbyttow/govips/v2/vips"
+
+	appErrors "github.com/MostafaSensei106/GoPix/internal/errors"
+)
+
+const (
+	// minSearchQuality is the lowest quality tried when searching for a target size.
+	minSearchQuality = 1
+	// maxDownscaleSteps bounds how often an image is shrunk to reach a target size.
+	maxDownscaleSteps = 8
+	// minDownscale is the smallest total scale applied to reach a target size.
+	minDownscale = 0.05
+)
+
+// encode encodes img to format and records the encoding choices in result.
+// With a perceptual target the lowest quality keeping the SSIM is searched;
+// with a target size the quality is searched, and the image optionally
+// downscaled, until the output fits.
+func (ic *ImageConverter) encode(img *vips.ImageRef, format string, result *ConversionResult) ([]byte, error) {
+	switch {
+	case ic.options.TargetSSIM > 0:
+		return ic.encodeToSSIM(img, format, result)
+	case ic.options.TargetSize > 0:
+		return ic.encodeToTargetSize(img, format, result)
+	default:
+		result.Quality = ic.formatQuality(format)
+		return ic.exportImage(img, format)
+	}
+}
+
+// encodeToTargetSize binary searches the highest quality, up to the
+// configured one, whose output is at most TargetSize bytes. When even the
+// lowest quality is too large and TargetDownscale is set, the image is shrunk
+// by the estimated factor and the search repeated.
+func (ic *ImageConverter) encodeToTargetSize(img *vips.ImageRef, format string, result *ConversionResult) ([]byte, error) {
+	target := ic.options.TargetSize
+	maxQuality := ic.formatQuality(format)
+	scale := 1.0
+
+	for step := 0; ; step++ {
+		buf, quality, smallest, err := ic.searchQuality(img, format, maxQuality, target)
+		if err != nil {
+			return nil, err
+		}
+		if buf != nil {
+			result.Quality = quality
+			if scale < 1 {
+				result.Scale = scale
+			}
+			return buf, nil
+		}
+
+		if !ic.options.TargetDownscale || step == maxDownscaleSteps || scale <= minDownscale {
+			return nil, fmt.Errorf("%w: smallest output is %d bytes, target is %d bytes", appErrors.ErrTargetSize, smallest, target)
+		}
+
+		// The encoded size roughly follows the pixel count, aim slightly below
+		factor := math.Sqrt(float64(target)/float64(smallest)) * 0.95
+		factor = math.Max(math.Min(factor, 0.95), minDownscale/scale)
+		if err := scaleImage(img, factor, factor, vips.KernelLanczos3); err != nil {
+			return nil, err
+		}
+		scale *= factor
+	}
+}
+
+// searchQuality returns the output of the highest quality in
+// [minSearchQuality, maxQuality] that fits in target bytes, or a nil buffer
+// and the size of the smallest output when none does.
+func (ic *ImageConverter) searchQuality(img *vips.ImageRef, format string, maxQuality int, target int64) ([]byte, int, int64, error) {
+	buf, err := ic.exportImageWithQuality(img, format, maxQuality)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if int64(len(buf)) <= target {
+		return buf, maxQuality, 0, nil
+	}
+	if !ic.qualityAffectsSize(format) {
+		return nil, 0, int64(len(buf)), nil
+	}
+
+	var (
+		best        []byte
+		bestQuality int
+		smallest    = int64(len(buf))
+	)
+	lo, hi := minSearchQuality, maxQuality-1
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		buf, err := ic.exportImageWithQuality(img, format, mid)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		size := int64(len(buf))
+		smallest = min(smallest, size)
+		if size <= target {
+			best, bestQuality = buf, mid
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+	return best, bestQuality, smallest, nil
+}
@@ -0,0 +1,263 @@
+package converter
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+
+	"github.com/davidbyttow/govips/v2/vips"
+
+	appErrors "github.com/MostafaSensei106/GoPix/internal/errors"
+)
+
+// defaultTextScale is the width of a text watermark relative to the output
+// width when no scale is set.
+const defaultTextScale = 0.25
+
+// WatermarkOptions controls the overlay composited onto every output after
+// resizing. Either Image or Text is set.
+type WatermarkOptions struct {
+	Image    string  // Overlay image file, e.g. a logo PNG with transparency
+	Text     string  // Overlay text, rendered with Font and Color
+	Font     string  // Pango font description for Text, e.g. "sans bold" (default sans)
+	Color    string  // Text color (default white)
+	Position string  // Gravity: centre, north, south, east, west, north-east, ... (default south-east)
+	Margin   int     // Distance to the image edges and between tiles in pixels
+	Opacity  float64 // Overlay opacity up to 1, 0 = fully opaque
+	Scale    float64 // Overlay width relative to the output width, 0 = image size or 0.25 for text
+	Tile     bool    // Repeat the overlay over the whole image, Position is ignored
+}
+
+// Enabled reports whether a watermark has been configured.
+func (wo *WatermarkOptions) Enabled() bool {
+	return wo.Image != "" || wo.Text != ""
+}
+
+// Validate checks the watermark options and that the overlay image exists.
+func (wo *WatermarkOptions) Validate() error {
+	if !wo.Enabled() {
+		return nil
+	}
+	if wo.Image != "" && wo.Text != "" {
+		return fmt.Errorf("%w: a watermark is either an image or a text, not both", appErrors.ErrInvalidOption)
+	}
+	if wo.Image != "" {
+		if _, err := os.Stat(wo.Image); err != nil {
+			return fmt.Errorf("%w: watermark image: %w", appErrors.ErrInvalidOption, err)
+		}
+	}
+	if _, ok := gravities[wo.Position]; wo.Position != "" && !ok {
+		return fmt.Errorf("%w: unknown watermark position %q", appErrors.ErrInvalidOption, wo.Position)
+	}
+	if wo.Margin < 0 {
+		return fmt.Errorf("%w: watermark margin must not be negative", appErrors.ErrInvalidOption)
+	}
+	if wo.Opacity < 0 || wo.Opacity > 1 {
+		return fmt.Errorf("%w: watermark opacity must be between 0 and 1, got %g", appErrors.ErrInvalidOption, wo.Opacity)
+	}
+	if wo.Scale < 0 || wo.Scale > 1 {
+		return fmt.Errorf("%w: watermark scale must be between 0 and 1, got %g", appErrors.ErrInvalidOption, wo.Scale)
+	}
+	if wo.Color != "" {
+		if _, err := ParseColor(wo.Color); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyWatermark composites the watermark onto img. The overlay is laid out
+// on a transparent layer of one frame, repeated for every frame of an
+// animation, so each frame is marked at the same spot.
+func (ic *ImageConverter) applyWatermark(img *vips.ImageRef) error {
+	wo := ic.options.Watermark
+	if !wo.Enabled() {
+		return nil
+	}
+
+	width, height, frames := img.Width(), img.PageHeight(), frameCount(img)
+	var (
+		overlay *vips.ImageRef
+		err     error
+	)
+	if wo.Image != "" {
+		overlay, err = imageOverlay(wo, width)
+	} else {
+		overlay, err = textOverlay(wo, width)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create watermark: %w", err)
+	}
+	defer overlay.Close()
+
+	if err := setOpacity(overlay, wo.Opacity); err != nil {
+		return fmt.Errorf("failed to create watermark: %w", err)
+	}
+	if err := layoutOverlay(overlay, wo, width, height); err != nil {
+		return fmt.Errorf("failed to place watermark: %w", err)
+	}
+	if frames > 1 {
+		if err := overlay.Replicate(1, frames); err != nil {
+			return fmt.Errorf("failed to place watermark: %w", err)
+		}
+	}
+
+	// Compositing adds an alpha band, which opaque images do not need
+	hadAlpha := img.HasAlpha()
+	if err := img.Composite(overlay, vips.BlendModeOver, 0, 0); err != nil {
+		return fmt.Errorf("failed to composite watermark: %w", err)
+	}
+	if !hadAlpha && img.HasAlpha() {
+		if err := img.ExtractBand(0, img.Bands()-1); err != nil {
+			return fmt.Errorf("failed to composite watermark: %w", err)
+		}
+	}
+	return nil
+}
+
+// imageOverlay loads the watermark image with an alpha band, scaled to its
+// share of the output width.
+func imageOverlay(wo WatermarkOptions, width int) (*vips.ImageRef, error) {
+	overlay, err := vips.NewImageFromFile(wo.Image)
+	if err != nil {
+		return nil, err
+	}
+	if !overlay.HasAlpha() {
+		if err := overlay.AddAlpha(); err != nil {
+			overlay.Close()
+			return nil, err
+		}
+	}
+	if wo.Scale > 0 {
+		factor := wo.Scale * float64(width) / float64(overlay.Width())
+		if err := overlay.Resize(factor, vips.KernelLanczos3); err != nil {
+			overlay.Close()
+			return nil, err
+		}
+	}
+	return overlay, nil
+}
+
+// textOverlay renders the watermark text as large as fits its share of the
+// output width. libvips renders the text as a coverage mask, which becomes
+// the alpha band of a layer filled with the text color.
+func textOverlay(wo WatermarkOptions, width int) (*vips.ImageRef, error) {
+	scale := wo.Scale
+	if scale == 0 {
+		scale = defaultTextScale
+	}
+	boxWidth := max(int(math.Round(scale*float64(width))), 1)
+	boxHeight := max(boxWidth/4, 1)
+	font := wo.Font
+	if font == "" {
+		font = "sans"
+	}
+	textColor := vips.ColorRGBA{R: 255, G: 255, B: 255, A: 255}
+	if wo.Color != "" {
+		parsed, err := ParseColor(wo.Color)
+		if err != nil {
+			return nil, err
+		}
+		textColor = parsed
+	}
+
+	mask, err := vips.Black(boxWidth, boxHeight)
+	if err != nil {
+		return nil, err
+	}
+	defer mask.Close()
+	err = mask.Label(&vips.LabelParams{
+		Text:    wo.Text,
+		Font:    font,
+		Width:   vips.ValueOf(float64(boxWidth)),
+		Height:  vips.ValueOf(float64(boxHeight)),
+		Opacity: 1,
+		Color:   vips.Color{R: 255, G: 255, B: 255},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Cut the mask down to the rendered text, white on black in every band
+	left, top, textWidth, textHeight, err := mask.FindTrim(10, &vips.Color{})
+	if err != nil {
+		return nil, err
+	}
+	if textWidth <= 0 || textHeight <= 0 {
+		return nil, fmt.Errorf("text %q renders empty", wo.Text)
+	}
+	if err := mask.ExtractArea(left, top, textWidth, textHeight); err != nil {
+		return nil, err
+	}
+	if err := mask.ExtractBand(0, 1); err != nil {
+		return nil, err
+	}
+
+	overlay, err := solidImage(textWidth, textHeight, textColor)
+	if err != nil {
+		return nil, err
+	}
+	if err := overlay.BandJoin(mask); err != nil {
+		overlay.Close()
+		return nil, err
+	}
+	return overlay, nil
+}
+
+// solidImage returns an opaque sRGB image of the given size filled with c.
+func solidImage(width, height int, c vips.ColorRGBA) (*vips.ImageRef, error) {
+	canvas := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(color.NRGBA{R: c.R, G: c.G, B: c.B, A: 255}), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas); err != nil {
+		return nil, err
+	}
+	return vips.NewImageFromBuffer(buf.Bytes())
+}
+
+// setOpacity scales the alpha band of overlay by opacity, unless it is 0 or 1.
+func setOpacity(overlay *vips.ImageRef, opacity float64) error {
+	if opacity == 0 || opacity == 1 {
+		return nil
+	}
+	bands := overlay.Bands()
+	a := make([]float64, bands)
+	b := make([]float64, bands)
+	for i := range a {
+		a[i] = 1
+	}
+	a[bands-1] = opacity
+	if err := overlay.Linear(a, b); err != nil {
+		return err
+	}
+	return overlay.Cast(vips.BandFormatUchar)
+}
+
+// layoutOverlay turns overlay into a transparent width x height layer with
+// the overlay anchored by the position, or tiled across the layer.
+func layoutOverlay(overlay *vips.ImageRef, wo WatermarkOptions, width, height int) error {
+	transparent := &vips.ColorRGBA{}
+	if !wo.Tile {
+		position := wo.Position
+		if position == "" {
+			position = "south-east"
+		}
+		x, y := anchor(position, width-overlay.Width()-2*wo.Margin, height-overlay.Height()-2*wo.Margin)
+		return overlay.EmbedBackgroundRGBA(x+wo.Margin, y+wo.Margin, width, height, transparent)
+	}
+
+	cellWidth, cellHeight := overlay.Width()+wo.Margin, overlay.Height()+wo.Margin
+	if err := overlay.EmbedBackgroundRGBA(0, 0, cellWidth, cellHeight, transparent); err != nil {
+		return err
+	}
+	across := (width + cellWidth - 1) / cellWidth
+	down := (height + cellHeight - 1) / cellHeight
+	if err := overlay.Replicate(across, down); err != nil {
+		return err
+	}
+	return overlay.ExtractArea(0, 0, width, height)
+}
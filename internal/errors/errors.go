@@ -7,5 +7,8 @@ var (
 	ErrUnsupportedFormat = errors.New("unsupported format")
 	ErrPermissionDenied  = errors.New("permission denied")
 	ErrSourceNotFound    = errors.New("source not found")
-	ErrFatal           = errors.New("fatal error")
+	ErrInvalidOption     = errors.New("invalid option")
+	ErrVerifyFailed      = errors.New("output verification failed")
+	ErrTargetSize        = errors.New("target size not reachable")
+	ErrFatal             = errors.New("fatal error")
 )
@@ -18,13 +18,25 @@ type FailureAnalysis struct {
 	Corrupted   uint32
 	Permission  uint32
 	Unsupported uint32
+	Verify      uint32
+	TargetSize  uint32
 	Other       uint32
 }
 
+// PerceptualStats summarizes the outputs encoded with a perceptual quality target.
+type PerceptualStats struct {
+	Scored      uint32
+	QualitySum  uint64
+	SSIMSum     float64
+	MinSSIM     float64
+	MinSSIMPath string
+}
+
 type ConversionStatistics struct {
 	TotalFiles           uint32
 	ConvertedFiles       uint32
 	SkippedFiles         uint32
+	NotBeneficialFiles   uint32 // Outputs discarded by --only-if-smaller, originals kept
 	FailedFiles          uint32
 	TotalSizeBefore      uint64
 	TotalSizeAfter       uint64
@@ -33,10 +45,15 @@ type ConversionStatistics struct {
 	SpaceSaved           int
 	CompressionRatio     float64
 	Failures             FailureAnalysis
+	Perceptual           PerceptualStats
 	DirectoriesProcessed map[string]int
 	BatchMode            bool
 	RecursiveSearch      bool
 	PreserveStructure    bool
+	OptimizedFiles       uint32 // Files re-encoded losslessly in their own format
+	OptimizedSaved       uint64 // Bytes saved by the lossless optimization
+	ExtensionMismatches  uint32 // Sources whose extension does not match their content
+	ExtensionsFixed      uint32 // Mismatched sources renamed by --fix-extensions
 }
 
 func NewConversionStatistics() *ConversionStatistics {
@@ -58,13 +75,22 @@ func (cs *ConversionStatistics) AddResult(result *converter.ConversionResult) {
 			cs.Failures.Permission++
 		case errors.Is(result.Error, appErrors.ErrUnsupportedFormat):
 			cs.Failures.Unsupported++
+		case errors.Is(result.Error, appErrors.ErrVerifyFailed):
+			cs.Failures.Verify++
+		case errors.Is(result.Error, appErrors.ErrTargetSize):
+			cs.Failures.TargetSize++
 		default:
 			cs.Failures.Other++
 		}
 		return
 	}
 
-	if result.OriginalPath == "" && result.NewSize == 0 {
+	if result.NotBeneficial {
+		cs.NotBeneficialFiles++
+		return
+	}
+
+	if result.SkipReason != "" || (result.OriginalPath == "" && result.NewSize == 0) {
 		cs.SkippedFiles++
 		return
 	}
@@ -73,6 +99,22 @@ func (cs *ConversionStatistics) AddResult(result *converter.ConversionResult) {
 	cs.TotalSizeBefore += uint64(result.OriginalSize)
 	cs.TotalSizeAfter += uint64(result.NewSize)
 
+	if result.Optimized {
+		cs.OptimizedFiles++
+		cs.OptimizedSaved += uint64(result.OriginalSize - result.NewSize)
+	}
+
+	if result.SSIM > 0 {
+		p := &cs.Perceptual
+		p.Scored++
+		p.QualitySum += uint64(result.Quality)
+		p.SSIMSum += result.SSIM
+		if p.Scored == 1 || result.SSIM < p.MinSSIM {
+			p.MinSSIM = result.SSIM
+			p.MinSSIMPath = result.NewPath
+		}
+	}
+
 	if cs.BatchMode {
 		dir := filepath.Dir(result.OriginalPath)
 		cs.DirectoriesProcessed[dir]++
@@ -99,6 +141,9 @@ func (cs *ConversionStatistics) PrintReport() {
 	// File statistics
 	color.Green("✅ Converted: %d", cs.ConvertedFiles)
 	color.Yellow("⏭️ Skipped: %d", cs.SkippedFiles)
+	if cs.NotBeneficialFiles > 0 {
+		color.Yellow("♻️ Not beneficial (larger than source, original kept): %d", cs.NotBeneficialFiles)
+	}
 	color.Red("❌ Failed: %d", cs.FailedFiles)
 	color.Cyan("📁 Total processed: %d", cs.TotalFiles)
 
@@ -116,20 +161,38 @@ func (cs *ConversionStatistics) PrintReport() {
 	if cs.TotalSizeBefore > 0 {
 		color.Cyan("\n💾 Size Analysis")
 		color.Cyan(strings.Repeat("=", 50))
-		color.White("🗂️ Original total size: %s", formatBytes(int64(cs.TotalSizeBefore)))
-		color.White("🆕 New total size: %s", formatBytes(int64(cs.TotalSizeAfter)))
+		color.White("🗂️ Original total size: %s", FormatBytes(int64(cs.TotalSizeBefore)))
+		color.White("🆕 New total size: %s", FormatBytes(int64(cs.TotalSizeAfter)))
 
 		if cs.SpaceSaved > 0 {
 			color.Green("💰 Space saved: %s (%.1f%% reduction)",
-				formatBytes(int64(cs.SpaceSaved)),
+				FormatBytes(int64(cs.SpaceSaved)),
 				(1-cs.CompressionRatio)*100)
 		} else if cs.SpaceSaved < 0 {
 			color.Red("📈 Size increased: %s (%.1f%% increase)",
-				formatBytes(-int64(cs.SpaceSaved)),
+				FormatBytes(-int64(cs.SpaceSaved)),
 				(cs.CompressionRatio-1)*100)
 		}
 	}
 
+	// Perceptual quality search
+	if p := cs.Perceptual; p.Scored > 0 {
+		color.Cyan("\n🎯 Perceptual Quality")
+		color.Cyan(strings.Repeat("=", 50))
+		color.White("🖼️ Scored outputs: %d", p.Scored)
+		color.White("🎚️ Avg. chosen quality: %.1f", float64(p.QualitySum)/float64(p.Scored))
+		color.White("📐 Avg. SSIM: %.4f", p.SSIMSum/float64(p.Scored))
+		color.White("🔻 Lowest SSIM: %.4f (%s)", p.MinSSIM, filepath.Base(p.MinSSIMPath))
+	}
+
+	// Lossless optimization of files already in the target format
+	if cs.OptimizedFiles > 0 {
+		color.Cyan("\n🗜️ Lossless Optimization")
+		color.Cyan(strings.Repeat("=", 50))
+		color.White("🖼️ Optimized files: %d", cs.OptimizedFiles)
+		color.Green("💰 Space saved: %s", FormatBytes(int64(cs.OptimizedSaved)))
+	}
+
 	// Batch processing information
 	if cs.BatchMode {
 		color.Cyan("\n📁 Batch Processing")
@@ -145,6 +208,9 @@ func (cs *ConversionStatistics) PrintReport() {
 			color.White("📂 Directory structure: Flattened")
 		}
 		color.White("📊 Directories processed: %d", len(cs.DirectoriesProcessed))
+		if cs.ExtensionMismatches > 0 {
+			color.Yellow("🔎 Extension mismatches: %d (%d renamed)", cs.ExtensionMismatches, cs.ExtensionsFixed)
+		}
 	}
 
 	// Failure analysis
@@ -160,13 +226,20 @@ func (cs *ConversionStatistics) PrintReport() {
 		if cs.Failures.Unsupported > 0 {
 			color.Red("  • Unsupported formats: %d", cs.Failures.Unsupported)
 		}
+		if cs.Failures.Verify > 0 {
+			color.Red("  • Output verification failures (original kept): %d", cs.Failures.Verify)
+		}
+		if cs.Failures.TargetSize > 0 {
+			color.Red("  • Target size not reachable (original kept): %d", cs.Failures.TargetSize)
+		}
 		if cs.Failures.Other > 0 {
 			color.Red("  • Other errors: %d", cs.Failures.Other)
 		}
 	}
 }
 
-func formatBytes(bytes int64) string {
+// FormatBytes renders a byte count with a binary unit, e.g. "1.5 MB".
+func FormatBytes(bytes int64) string {
 	const unit = 1024
 	if bytes < unit {
 		return strconv.FormatInt(bytes, 10) + " B"
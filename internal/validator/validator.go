@@ -14,6 +14,10 @@ type ValidationError struct {
 	Message string
 }
 
+// FormatResolver returns the canonical name of a format that can be written,
+// for example jpg for jpeg, or "" when the format is unknown or read-only.
+type FormatResolver func(format string) string
+
 // Error implements the error interface.
 func (e *ValidationError) Error() string {
 	return fmt.Sprintf("%s: %s", e.Field, e.Message)
@@ -21,10 +25,12 @@ func (e *ValidationError) Error() string {
 
 // ValidateInputs validates the input directory and target format.
 //
-// It checks if the input directory exists and has read permission, and if the target format is supported.
+// It checks if the input directory exists and has read permission, and if the
+// target format is in supportedFormats. With a resolver the target must also
+// be writable, and matches a supported format under any of its names.
 //
 // If any of the checks fail, it returns a specific error type.
-func ValidateInputs(inputDirectory, targetFormat string, supportedFormats []string) error {
+func ValidateInputs(inputDirectory, targetFormat string, supportedFormats []string, resolve FormatResolver) error {
 	if inputDirectory == "" {
 		return fmt.Errorf("%w: input directory is required", appErrors.ErrSourceNotFound)
 	}
@@ -37,7 +43,7 @@ func ValidateInputs(inputDirectory, targetFormat string, supportedFormats []stri
 		return fmt.Errorf("%w: input directory %s does not have read permission", appErrors.ErrPermissionDenied, inputDirectory)
 	}
 
-	if !isValidFormat(targetFormat, supportedFormats) {
+	if !isValidFormat(targetFormat, supportedFormats, resolve) {
 		return fmt.Errorf("%w: target format %s is not supported", appErrors.ErrUnsupportedFormat, targetFormat)
 	}
 	return nil
@@ -65,11 +71,20 @@ func hasReadPermission(path string) bool {
 }
 
 // isValidFormat checks if the given format is present in the list of supported formats.
-// Returns true if the format is supported, otherwise returns false.
+// With a resolver, the format must be writable and names are compared after
+// resolving, so jpeg matches jpg. Returns true if the format is supported, otherwise returns false.
 
-func isValidFormat(format string, supportedFormats []string) bool {
+func isValidFormat(format string, supportedFormats []string, resolve FormatResolver) bool {
+	if resolve != nil {
+		if format = resolve(format); format == "" {
+			return false
+		}
+	}
 	// For small lists, linear search is actually faster than map creation
 	for _, supportedFormat := range supportedFormats {
+		if resolve != nil {
+			supportedFormat = resolve(supportedFormat)
+		}
 		if format == supportedFormat {
 			return true
 		}
@@ -13,6 +13,7 @@ type Job struct {
 	Path       string
 	Format     string
 	OutputPath string // Optional custom output path for batch processing
+	Page       int    // Page of a split document (1-based), 0 = whole file
 }
 
 type WorkerPool struct {
@@ -112,9 +113,23 @@ func (wp *WorkerPool) worker() {
 			}
 		}
 
+		// Renditions produce one result per variant from a single decode
+		if wp.converter.HasRenditions() {
+			for _, result := range wp.converter.ConvertRenditions(job.Path, job.Format, job.OutputPath) {
+				select {
+				case wp.results <- result:
+				case <-wp.ctx.Done():
+					return
+				}
+			}
+			continue
+		}
+
 		// Process the job
 		var result *conv.ConversionResult
-		if job.OutputPath != "" {
+		if job.Page > 0 {
+			result = wp.converter.ConvertPage(job.Path, job.Format, job.OutputPath, job.Page)
+		} else if job.OutputPath != "" {
 			result = wp.converter.ConvertWithOutputPath(job.Path, job.Format, job.OutputPath)
 		} else {
 			result = wp.converter.Convert(job.Path, job.Format)
@@ -2,18 +2,33 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/MostafaSensei106/GoPix/internal/batch"
+	"github.com/MostafaSensei106/GoPix/internal/cache"
 	"github.com/MostafaSensei106/GoPix/internal/config"
 	"github.com/MostafaSensei106/GoPix/internal/converter"
+	appErrors "github.com/MostafaSensei106/GoPix/internal/errors"
 	"github.com/MostafaSensei106/GoPix/internal/logger"
 	"github.com/MostafaSensei106/GoPix/internal/platform"
 	"github.com/MostafaSensei106/GoPix/internal/progress"
@@ -21,6 +36,7 @@ import (
 	"github.com/MostafaSensei106/GoPix/internal/stats"
 	"github.com/MostafaSensei106/GoPix/internal/validator"
 	"github.com/MostafaSensei106/GoPix/internal/worker"
+	"github.com/davidbyttow/govips/v2/vips"
 	"github.com/sirupsen/logrus"
 )
 
@@ -83,6 +99,73 @@ func TestConfig(t *testing.T) {
 			t.Errorf("expected png, got %s", cfg.DefaultFormat)
 		}
 	})
+
+	t.Run("GeneratedQualities", func(t *testing.T) {
+		home := t.TempDir()
+		t.Setenv("HOME", home)
+		// jpg and webp are as an earlier release wrote them, jpeg was edited
+		data := `quality: 60
+output_settings:
+  jpg:
+    quality: 80
+  jpeg:
+    quality: 80
+    progressive: true
+  webp:
+    quality: 80
+    lossless: false
+`
+		configPath := filepath.Join(home, ".gopix", "config", "config.yaml")
+		if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+			t.Fatalf("failed to create config directory: %v", err)
+		}
+		if err := os.WriteFile(configPath, []byte(data), 0644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+		cfg, err := config.LoadConfig()
+		if err != nil {
+			t.Fatalf("failed to load config: %v", err)
+		}
+		opts, err := converter.ParseEncoderOptions(cfg.OutputSettings)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if opts.JPEG.Quality != 80 {
+			t.Errorf("expected the edited jpeg quality 80 to be kept, got %d", opts.JPEG.Quality)
+		}
+		if opts.WebP.Quality != 0 || opts.WebP.Lossless {
+			t.Errorf("expected the generated webp quality to be dropped, got %+v", opts.WebP)
+		}
+	})
+
+	t.Run("GeneratedExtensions", func(t *testing.T) {
+		home := t.TempDir()
+		t.Setenv("HOME", home)
+		configPath := filepath.Join(home, ".gopix", "config", "config.yaml")
+		if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+			t.Fatalf("failed to create config directory: %v", err)
+		}
+		for _, tc := range []struct {
+			extensions string
+			expected   []string
+		}{
+			// The list an earlier release generated gains the new formats
+			{"[png, jpg, jpeg, webp, avif, heif, gif, tiff]", config.DefaultConfig().Extentions},
+			// An edited list is left alone
+			{"[png, jpg]", []string{"png", "jpg"}},
+		} {
+			if err := os.WriteFile(configPath, []byte("extentions: "+tc.extensions+"\n"), 0644); err != nil {
+				t.Fatalf("failed to write config: %v", err)
+			}
+			cfg, err := config.LoadConfig()
+			if err != nil {
+				t.Fatalf("failed to load config: %v", err)
+			}
+			if !slices.Equal(cfg.Extentions, tc.expected) {
+				t.Errorf("%s: expected %v, got %v", tc.extensions, tc.expected, cfg.Extentions)
+			}
+		}
+	})
 }
 
 func TestValidator(t *testing.T) {
@@ -152,6 +235,2421 @@ func TestConverter(t *testing.T) {
 	})
 }
 
+func TestEncoderOptions(t *testing.T) {
+	t.Run("ParseOutputSettings", func(t *testing.T) {
+		opts, err := converter.ParseEncoderOptions(config.DefaultConfig().OutputSettings)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if opts.PNG.Compression != 1 {
+			t.Errorf("expected png compression 1 (best_speed), got %d", opts.PNG.Compression)
+		}
+		// The default config leaves the quality to the top-level setting
+		if opts.JPEG.Quality != 0 {
+			t.Errorf("expected no jpg quality, got %d", opts.JPEG.Quality)
+		}
+	})
+
+	t.Run("Overrides", func(t *testing.T) {
+		opts := converter.DefaultEncoderOptions()
+		if err := opts.ApplyOverrides([]string{"webp.lossless=true", "png.interlace=true", "avif.speed=9"}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !opts.WebP.Lossless || !opts.PNG.Interlace || opts.AVIF.Effort != 0 {
+			t.Errorf("overrides not applied: %+v", opts)
+		}
+	})
+
+	t.Run("InvalidOptions", func(t *testing.T) {
+		opts := converter.DefaultEncoderOptions()
+		for _, override := range []string{"webp.effort=7", "png.colour=true", "bmp.quality=80", "jpg.quality"} {
+			if err := opts.ApplyOverrides([]string{override}); err == nil {
+				t.Errorf("expected error for %s, got nil", override)
+			}
+		}
+	})
+}
+
+// writeGPSTaggedJPEG writes a small JPEG whose EXIF block holds a camera make,
+// a copyright notice and a GPS IFD with latitude tags.
+func writeGPSTaggedJPEG(t *testing.T, path string) {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 16; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 16), 128, 255})
+		}
+	}
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, nil); err != nil {
+		t.Fatalf("failed to encode jpeg: %v", err)
+	}
+
+	// Little endian TIFF structure: IFD0 (Make, Copyright, GPS pointer) followed by the GPS IFD
+	le := binary.LittleEndian
+	tiff := &bytes.Buffer{}
+	entry := func(tag, typ uint16, count, value uint32) {
+		binary.Write(tiff, le, tag)
+		binary.Write(tiff, le, typ)
+		binary.Write(tiff, le, count)
+		binary.Write(tiff, le, value)
+	}
+	camera, copyright := "GoPix\x00", "(c) GoPix\x00"
+	const ifd0 = 8
+	const ifd0Size = 2 + 3*12 + 4
+	makeOffset := uint32(ifd0 + ifd0Size)
+	copyrightOffset := makeOffset + uint32(len(camera))
+	gpsOffset := copyrightOffset + uint32(len(copyright))
+	const gpsSize = 2 + 2*12 + 4
+	latitudeOffset := gpsOffset + gpsSize
+
+	tiff.WriteString("II")
+	binary.Write(tiff, le, uint16(42))
+	binary.Write(tiff, le, uint32(ifd0))
+	binary.Write(tiff, le, uint16(3))
+	entry(0x010F, 2, uint32(len(camera)), makeOffset)
+	entry(0x8298, 2, uint32(len(copyright)), copyrightOffset)
+	entry(0x8825, 4, 1, gpsOffset)
+	binary.Write(tiff, le, uint32(0))
+	tiff.WriteString(camera)
+	tiff.WriteString(copyright)
+	binary.Write(tiff, le, uint16(2))
+	entry(0x0001, 2, 2, uint32('N'))
+	entry(0x0002, 5, 3, latitudeOffset)
+	binary.Write(tiff, le, uint32(0))
+	for _, v := range []uint32{52, 1, 30, 1, 0, 1} {
+		binary.Write(tiff, le, v)
+	}
+
+	app1 := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	var out bytes.Buffer
+	out.Write(encoded.Bytes()[:2]) // SOI
+	out.Write([]byte{0xFF, 0xE1})
+	binary.Write(&out, binary.BigEndian, uint16(len(app1)+2))
+	out.Write(app1)
+	out.Write(encoded.Bytes()[2:])
+	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write test image: %v", err)
+	}
+}
+
+// exifFields returns the EXIF fields libvips reports for the image at path.
+func exifFields(t *testing.T, path string) []string {
+	t.Helper()
+	img, err := vips.NewImageFromFile(path)
+	if err != nil {
+		t.Fatalf("failed to load %s: %v", path, err)
+	}
+	defer img.Close()
+
+	var fields []string
+	for _, field := range img.GetFields() {
+		if strings.HasPrefix(field, "exif-ifd") {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+func hasField(fields []string, substr string) bool {
+	for _, field := range fields {
+		if strings.Contains(field, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMetadata(t *testing.T) {
+	tmpDir := t.TempDir()
+	source := filepath.Join(tmpDir, "gps.jpg")
+	writeGPSTaggedJPEG(t, source)
+
+	if fields := exifFields(t, source); !hasField(fields, "GPSLatitude") {
+		t.Fatalf("test image has no GPS tags: %v", fields)
+	}
+
+	convert := func(t *testing.T, opts converter.ConvertOptions, name string) []string {
+		t.Helper()
+		output := filepath.Join(tmpDir, name)
+		convertTo(t, opts, source, "webp", output)
+		return exifFields(t, output)
+	}
+
+	t.Run("StripLocation", func(t *testing.T) {
+		fields := convert(t, converter.ConvertOptions{Metadata: "strip-location"}, "strip-location.webp")
+		if hasField(fields, "GPS") {
+			t.Errorf("expected GPS tags to be removed, got %v", fields)
+		}
+		if !hasField(fields, "-Make") || !hasField(fields, "-Copyright") {
+			t.Errorf("expected camera and copyright tags to be kept, got %v", fields)
+		}
+	})
+
+	t.Run("KeepCopyright", func(t *testing.T) {
+		fields := convert(t, converter.ConvertOptions{Metadata: "keep-copyright"}, "keep-copyright.webp")
+		if hasField(fields, "GPS") || hasField(fields, "-Make") {
+			t.Errorf("expected only copyright tags, got %v", fields)
+		}
+		if !hasField(fields, "-Copyright") {
+			t.Errorf("expected copyright tag to be kept, got %v", fields)
+		}
+	})
+
+	t.Run("DenyList", func(t *testing.T) {
+		fields := convert(t, converter.ConvertOptions{Metadata: "keep", MetadataDeny: []string{"gps*"}}, "deny.webp")
+		if hasField(fields, "GPS") {
+			t.Errorf("expected GPS tags to be removed, got %v", fields)
+		}
+		if !hasField(fields, "-Make") {
+			t.Errorf("expected Make tag to be kept, got %v", fields)
+		}
+	})
+
+	t.Run("AllowList", func(t *testing.T) {
+		fields := convert(t, converter.ConvertOptions{Metadata: "strip", MetadataAllow: []string{"exif:Make"}}, "allow.webp")
+		if hasField(fields, "GPS") || hasField(fields, "-Copyright") {
+			t.Errorf("expected only the Make tag, got %v", fields)
+		}
+		if !hasField(fields, "-Make") {
+			t.Errorf("expected Make tag to be kept, got %v", fields)
+		}
+	})
+}
+
+// writeOrientedJPEG writes a width x height JPEG stored with the given EXIF
+// orientation.
+func writeOrientedJPEG(t *testing.T, path string, width, height, orientation int) {
+	t.Helper()
+	stored := filepath.Join(t.TempDir(), "stored.png")
+	writeTestPNG(t, stored, width, height)
+	img, err := vips.NewImageFromFile(stored)
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+	defer img.Close()
+	if err := img.SetOrientation(orientation); err != nil {
+		t.Fatalf("failed to set orientation: %v", err)
+	}
+	buf, _, err := img.ExportJpeg(vips.NewJpegExportParams())
+	if err != nil {
+		t.Fatalf("failed to encode fixture: %v", err)
+	}
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatalf("failed to write fixture: %v", err)
+	}
+}
+
+// writeTestPNG writes an opaque width x height PNG with a horizontal gradient.
+func writeTestPNG(t *testing.T, path string, width, height int) {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 255 / width), G: 128, B: uint8(y * 255 / height), A: 255})
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", path, err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatalf("failed to encode %s: %v", path, err)
+	}
+}
+
+// testConverter returns a converter keeping its sources, at quality 80 and
+// with the default encoder options unless opts sets them.
+func testConverter(opts converter.ConvertOptions) *converter.ImageConverter {
+	if opts.Quality == 0 {
+		opts.Quality = 80
+	}
+	if reflect.ValueOf(opts.Encoder).IsZero() {
+		opts.Encoder = converter.DefaultEncoderOptions()
+	}
+	opts.KeepOriginal = true
+	return converter.NewImageConverter(opts)
+}
+
+// convertTo converts source to format with testConverter(opts), writing
+// output or, when it is empty, the default output path. The test fails when
+// the conversion does.
+func convertTo(t *testing.T, opts converter.ConvertOptions, source, format, output string) *converter.ConversionResult {
+	t.Helper()
+	result := testConverter(opts).ConvertWithOutputPath(source, format, output)
+	if result.Error != nil {
+		t.Fatalf("conversion of %s to %s failed: %v", filepath.Base(source), format, result.Error)
+	}
+	return result
+}
+
+// imageSize returns the width and height of the image at path.
+func imageSize(t *testing.T, path string) (int, int) {
+	t.Helper()
+	img, err := vips.NewImageFromFile(path)
+	if err != nil {
+		t.Fatalf("failed to load %s: %v", path, err)
+	}
+	defer img.Close()
+	return img.Width(), img.Height()
+}
+
+func TestResize(t *testing.T) {
+	tmpDir := t.TempDir()
+	source := filepath.Join(tmpDir, "wide.png")
+	writeTestPNG(t, source, 80, 40)
+
+	cases := []struct {
+		name          string
+		opts          converter.ResizeOptions
+		width, height int
+	}{
+		{"Fit", converter.ResizeOptions{Width: 20, Height: 20}, 20, 10},
+		{"Fill", converter.ResizeOptions{Width: 20, Height: 20, Mode: converter.ResizeFill}, 20, 20},
+		{"FillSmallSource", converter.ResizeOptions{Width: 100, Height: 100, Mode: converter.ResizeFill}, 100, 100},
+		{"Contain", converter.ResizeOptions{Width: 20, Height: 20, Mode: converter.ResizeContain, Background: "#fff"}, 20, 20},
+		{"Exact", converter.ResizeOptions{Width: 30, Height: 30, Mode: converter.ResizeExact}, 30, 30},
+		{"ExactEnlarges", converter.ResizeOptions{Width: 60, Height: 60, Mode: converter.ResizeExact}, 60, 60},
+		{"Percent", converter.ResizeOptions{Percent: 25}, 20, 10},
+		{"NoUpscale", converter.ResizeOptions{Width: 160}, 80, 40},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.opts.Validate(); err != nil {
+				t.Fatalf("invalid resize options: %v", err)
+			}
+			output := filepath.Join(tmpDir, strings.ToLower(tc.name)+".png")
+			convertTo(t, converter.ConvertOptions{Resize: tc.opts}, source, "png", output)
+			width, height := imageSize(t, output)
+			if width != tc.width || height != tc.height {
+				t.Errorf("expected %dx%d, got %dx%d", tc.width, tc.height, width, height)
+			}
+		})
+	}
+
+	t.Run("InvalidOptions", func(t *testing.T) {
+		invalid := []converter.ResizeOptions{
+			{Width: 10, Mode: converter.ResizeFill},
+			{Width: 10, Percent: 50},
+			{Width: 10, Mode: "squash"},
+			{Width: 10, Kernel: "bilinear"},
+			{Width: 10, Height: 10, Mode: converter.ResizeContain, Background: "#zzz"},
+		}
+		for _, ro := range invalid {
+			if err := ro.Validate(); err == nil {
+				t.Errorf("expected error for %+v, got nil", ro)
+			}
+		}
+	})
+}
+
+func TestAutoOrient(t *testing.T) {
+	tmpDir := t.TempDir()
+	// An 80x40 JPEG tagged to be displayed rotated by 90 degrees
+	source := filepath.Join(tmpDir, "phone.jpg")
+	writeOrientedJPEG(t, source, 80, 40, 6)
+
+	convert := func(t *testing.T, opts converter.ConvertOptions, name string) (int, int, int) {
+		t.Helper()
+		output := filepath.Join(tmpDir, name)
+		convertTo(t, opts, source, "jpg", output)
+		out, err := vips.NewImageFromFile(output)
+		if err != nil {
+			t.Fatalf("failed to load %s: %v", output, err)
+		}
+		defer out.Close()
+		return out.Width(), out.Height(), out.Orientation()
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		width, height, orientation := convert(t, converter.ConvertOptions{Metadata: "keep"}, "upright.jpeg")
+		if width != 40 || height != 80 {
+			t.Errorf("expected the pixels rotated to 40x80, got %dx%d", width, height)
+		}
+		if orientation > 1 {
+			t.Errorf("expected the orientation to be reset, got %d", orientation)
+		}
+	})
+
+	t.Run("Stripped", func(t *testing.T) {
+		width, height, _ := convert(t, converter.ConvertOptions{Metadata: "strip"}, "stripped.jpeg")
+		if width != 40 || height != 80 {
+			t.Errorf("expected 40x80, got %dx%d", width, height)
+		}
+	})
+
+	t.Run("BeforeResize", func(t *testing.T) {
+		// The displayed image is tall, so the height is the longest side
+		width, height, _ := convert(t, converter.ConvertOptions{MaxDimension: 40}, "fitted.jpeg")
+		if width != 20 || height != 40 {
+			t.Errorf("expected 20x40, got %dx%d", width, height)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		width, height, orientation := convert(t, converter.ConvertOptions{NoAutoOrient: true}, "stored.jpeg")
+		if width != 80 || height != 40 || orientation != 6 {
+			t.Errorf("expected the stored 80x40 pixels with orientation 6, got %dx%d with %d", width, height, orientation)
+		}
+	})
+
+	t.Run("DisabledWithFilters", func(t *testing.T) {
+		// Filtering metadata never drops the orientation the stored pixels need
+		for name, opts := range map[string]converter.ConvertOptions{
+			"allow.jpeg":     {NoAutoOrient: true, Metadata: "strip", MetadataAllow: []string{"exif:Make"}},
+			"copyright.jpeg": {NoAutoOrient: true, Metadata: "keep-copyright"},
+		} {
+			width, height, orientation := convert(t, opts, name)
+			if width != 80 || height != 40 || orientation != 6 {
+				t.Errorf("%s: expected the stored 80x40 pixels with orientation 6, got %dx%d with %d", name, width, height, orientation)
+			}
+		}
+	})
+}
+
+func TestOperations(t *testing.T) {
+	tmpDir := t.TempDir()
+	source := filepath.Join(tmpDir, "wide.png")
+	writeTestPNG(t, source, 80, 40)
+
+	// A 10x10 red square on a white 40x30 canvas
+	bordered := filepath.Join(tmpDir, "bordered.png")
+	canvas := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			c := color.RGBA{R: 255, G: 255, B: 255, A: 255}
+			if x >= 5 && x < 15 && y >= 8 && y < 18 {
+				c = color.RGBA{R: 255, A: 255}
+			}
+			canvas.Set(x, y, c)
+		}
+	}
+	f, err := os.Create(bordered)
+	if err != nil {
+		t.Fatalf("failed to create fixture: %v", err)
+	}
+	if err := png.Encode(f, canvas); err != nil {
+		t.Fatalf("failed to encode fixture: %v", err)
+	}
+	f.Close()
+
+	transform := func(t *testing.T, input string, specs ...string) (int, int) {
+		t.Helper()
+		ops, err := converter.ParseOperations(specs)
+		if err != nil {
+			t.Fatalf("failed to parse operations: %v", err)
+		}
+		output := filepath.Join(tmpDir, "out.png")
+		convertTo(t, converter.ConvertOptions{Operations: ops}, input, "png", output)
+		return imageSize(t, output)
+	}
+
+	cases := []struct {
+		name          string
+		input         string
+		specs         []string
+		width, height int
+	}{
+		{"RotateThenCrop", source, []string{"rotate=90", "crop=0,0,20,30"}, 20, 30},
+		{"CropThenRotate", source, []string{"crop=0,0,20,30", "rotate=-90"}, 30, 20},
+		{"FlipFlop", source, []string{"flip", "flop"}, 80, 40},
+		{"Trim", bordered, []string{"trim"}, 10, 10},
+		{"Pad", source, []string{"pad=1:1,#ffffff"}, 80, 80},
+		{"TrimThenPad", bordered, []string{"trim", "pad=2:1", "flatten=#000"}, 20, 10},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			width, height := transform(t, tc.input, tc.specs...)
+			if width != tc.width || height != tc.height {
+				t.Errorf("expected %dx%d, got %dx%d", tc.width, tc.height, width, height)
+			}
+		})
+	}
+
+	t.Run("OddAngle", func(t *testing.T) {
+		width, height := transform(t, source, "rotate=45")
+		if width <= 80 || height <= 40 {
+			t.Errorf("expected the canvas to grow past 80x40, got %dx%d", width, height)
+		}
+	})
+
+	t.Run("InvalidOperations", func(t *testing.T) {
+		for _, spec := range []string{"rotate", "rotate=a", "flip=1", "crop=1,2,3", "crop=0,0,0,10", "pad=16", "pad=0:1", "flatten=#zz", "spin"} {
+			if _, err := converter.ParseOperations([]string{spec}); err == nil {
+				t.Errorf("expected error for %q, got nil", spec)
+			}
+		}
+	})
+}
+
+// writeSolidPNG writes a width x height PNG filled with c.
+func writeSolidPNG(t *testing.T, path string, width, height int, c color.Color) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", path, err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatalf("failed to encode %s: %v", path, err)
+	}
+}
+
+func TestWatermark(t *testing.T) {
+	tmpDir := t.TempDir()
+	source := filepath.Join(tmpDir, "photo.png")
+	writeSolidPNG(t, source, 100, 50, color.Black)
+	logo := filepath.Join(tmpDir, "logo.png")
+	writeSolidPNG(t, logo, 40, 40, color.White)
+
+	// mark converts the source with the watermark and returns the red value of
+	// the given output pixels
+	mark := func(t *testing.T, wo converter.WatermarkOptions, points ...[2]int) []float64 {
+		t.Helper()
+		if err := wo.Validate(); err != nil {
+			t.Fatalf("invalid watermark options: %v", err)
+		}
+		output := filepath.Join(tmpDir, "marked.png")
+		convertTo(t, converter.ConvertOptions{Watermark: wo}, source, "png", output)
+		img, err := vips.NewImageFromFile(output)
+		if err != nil {
+			t.Fatalf("failed to load output: %v", err)
+		}
+		defer img.Close()
+		if img.Width() != 100 || img.Height() != 50 || img.HasAlpha() {
+			t.Fatalf("expected an opaque 100x50 output, got %dx%d with alpha %v", img.Width(), img.Height(), img.HasAlpha())
+		}
+		values := make([]float64, len(points))
+		for i, p := range points {
+			pixel, err := img.GetPoint(p[0], p[1])
+			if err != nil {
+				t.Fatalf("failed to read pixel %v: %v", p, err)
+			}
+			values[i] = pixel[0]
+		}
+		return values
+	}
+
+	t.Run("Position", func(t *testing.T) {
+		// A 20x20 logo (scale 0.2) in the south-east corner, 5 pixels from the edges
+		values := mark(t, converter.WatermarkOptions{Image: logo, Scale: 0.2, Margin: 5}, [2]int{85, 35}, [2]int{97, 47}, [2]int{10, 10})
+		if values[0] < 250 {
+			t.Errorf("expected the logo at 85,35, got %v", values[0])
+		}
+		if values[1] > 5 || values[2] > 5 {
+			t.Errorf("expected the margin and the rest of the image untouched, got %v", values[1:])
+		}
+	})
+
+	t.Run("Opacity", func(t *testing.T) {
+		values := mark(t, converter.WatermarkOptions{Image: logo, Scale: 0.2, Position: "centre", Opacity: 0.5}, [2]int{50, 25})
+		if values[0] < 110 || values[0] > 145 {
+			t.Errorf("expected a half transparent logo, got %v", values[0])
+		}
+	})
+
+	t.Run("Tile", func(t *testing.T) {
+		values := mark(t, converter.WatermarkOptions{Image: logo, Scale: 0.2, Margin: 10, Tile: true}, [2]int{5, 5}, [2]int{35, 5}, [2]int{25, 5})
+		if values[0] < 250 || values[1] < 250 {
+			t.Errorf("expected tiles at 0,0 and 30,0, got %v", values[:2])
+		}
+		if values[2] > 5 {
+			t.Errorf("expected a gap between the tiles, got %v", values[2])
+		}
+	})
+
+	t.Run("Text", func(t *testing.T) {
+		values := mark(t, converter.WatermarkOptions{Text: "GoPix", Color: "#ff0000", Scale: 0.5, Position: "centre"}, [2]int{5, 5})
+		if values[0] > 5 {
+			t.Errorf("expected the corners untouched, got %v", values[0])
+		}
+	})
+
+	t.Run("InvalidOptions", func(t *testing.T) {
+		for _, wo := range []converter.WatermarkOptions{
+			{Image: logo, Text: "both"},
+			{Image: filepath.Join(tmpDir, "missing.png")},
+			{Text: "x", Position: "smart"},
+			{Text: "x", Opacity: 1.5},
+			{Text: "x", Scale: 2},
+			{Text: "x", Color: "#zz"},
+		} {
+			if err := wo.Validate(); err == nil {
+				t.Errorf("expected error for %+v, got nil", wo)
+			}
+		}
+	})
+}
+
+func TestAdjustments(t *testing.T) {
+	tmpDir := t.TempDir()
+	source := filepath.Join(tmpDir, "photo.png")
+	writeSolidPNG(t, source, 100, 50, color.RGBA{R: 160, G: 100, B: 60, A: 255})
+
+	// adjust converts the source with the filters and returns the output
+	adjust := func(t *testing.T, ao converter.AdjustOptions, width int) *vips.ImageRef {
+		t.Helper()
+		if err := ao.Validate(); err != nil {
+			t.Fatalf("invalid adjust options: %v", err)
+		}
+		output := filepath.Join(tmpDir, "adjusted.png")
+		convertTo(t, converter.ConvertOptions{Resize: converter.ResizeOptions{Width: width}, Adjust: ao}, source, "png", output)
+		img, err := vips.NewImageFromFile(output)
+		if err != nil {
+			t.Fatalf("failed to load output: %v", err)
+		}
+		t.Cleanup(img.Close)
+		return img
+	}
+
+	t.Run("Brightness", func(t *testing.T) {
+		before, err := adjust(t, converter.AdjustOptions{}, 0).Average()
+		if err != nil {
+			t.Fatalf("failed to average: %v", err)
+		}
+		after, err := adjust(t, converter.AdjustOptions{Brightness: 1.3}, 0).Average()
+		if err != nil {
+			t.Fatalf("failed to average: %v", err)
+		}
+		if after <= before {
+			t.Errorf("expected a brighter output, got average %v from %v", after, before)
+		}
+	})
+
+	t.Run("Grayscale", func(t *testing.T) {
+		if img := adjust(t, converter.AdjustOptions{Grayscale: true}, 0); img.Bands() != 1 {
+			t.Errorf("expected 1 band, got %d", img.Bands())
+		}
+	})
+
+	t.Run("Sepia", func(t *testing.T) {
+		img := adjust(t, converter.AdjustOptions{Sepia: true}, 0)
+		pixel, err := img.GetPoint(10, 10)
+		if err != nil {
+			t.Fatalf("failed to read pixel: %v", err)
+		}
+		if len(pixel) != 3 || pixel[0] < pixel[1] || pixel[1] < pixel[2] {
+			t.Errorf("expected sepia tones with red > green > blue, got %v", pixel)
+		}
+	})
+
+	t.Run("SharpenAuto", func(t *testing.T) {
+		for _, width := range []int{0, 50} {
+			img := adjust(t, converter.AdjustOptions{Sharpen: converter.SharpenAuto, Blur: 1, Contrast: 1.2, Gamma: 1.1}, width)
+			if width > 0 && img.Width() != width {
+				t.Errorf("expected width %d, got %d", width, img.Width())
+			}
+		}
+	})
+
+	t.Run("InvalidOptions", func(t *testing.T) {
+		for _, ao := range []converter.AdjustOptions{
+			{Sharpen: "sometimes"},
+			{Blur: -1},
+			{Brightness: -0.5},
+			{Gamma: -2},
+			{Grayscale: true, Sepia: true},
+		} {
+			if err := ao.Validate(); err == nil {
+				t.Errorf("expected error for %+v, got nil", ao)
+			}
+		}
+	})
+}
+
+func TestAlpha(t *testing.T) {
+	tmpDir := t.TempDir()
+	source := filepath.Join(tmpDir, "logo.png")
+	writeSolidPNG(t, source, 40, 20, color.NRGBA{R: 0, G: 0, B: 255, A: 0})
+	opaque := filepath.Join(tmpDir, "photo.png")
+	writeSolidPNG(t, opaque, 40, 20, color.Black)
+
+	convert := func(t *testing.T, ao converter.AlphaOptions, path string) *converter.ConversionResult {
+		t.Helper()
+		if err := ao.Validate(); err != nil {
+			t.Fatalf("invalid alpha options: %v", err)
+		}
+		return testConverter(converter.ConvertOptions{Alpha: ao}).ConvertWithOutputPath(path, "jpg", filepath.Join(tmpDir, "out.jpg"))
+	}
+	// pixel returns the output pixel at 10,10
+	pixel := func(t *testing.T, path string) []float64 {
+		t.Helper()
+		img, err := vips.NewImageFromFile(path)
+		if err != nil {
+			t.Fatalf("failed to load output: %v", err)
+		}
+		defer img.Close()
+		values, err := img.GetPoint(10, 10)
+		if err != nil {
+			t.Fatalf("failed to read pixel: %v", err)
+		}
+		return values
+	}
+
+	t.Run("FlattenWhite", func(t *testing.T) {
+		result := convert(t, converter.AlphaOptions{}, source)
+		if result.Error != nil {
+			t.Fatalf("conversion failed: %v", result.Error)
+		}
+		if !result.HasAlpha {
+			t.Error("expected the source to be reported with alpha")
+		}
+		if values := pixel(t, result.NewPath); values[0] < 245 || values[2] < 245 {
+			t.Errorf("expected a white background, got %v", values)
+		}
+	})
+
+	t.Run("Background", func(t *testing.T) {
+		result := convert(t, converter.AlphaOptions{Background: "#ff0000"}, source)
+		if result.Error != nil {
+			t.Fatalf("conversion failed: %v", result.Error)
+		}
+		if values := pixel(t, result.NewPath); values[0] < 245 || values[1] > 10 {
+			t.Errorf("expected a red background, got %v", values)
+		}
+	})
+
+	t.Run("Fail", func(t *testing.T) {
+		result := convert(t, converter.AlphaOptions{Policy: converter.AlphaFail}, source)
+		if !errors.Is(result.Error, appErrors.ErrUnsupportedFormat) {
+			t.Errorf("expected ErrUnsupportedFormat, got %v", result.Error)
+		}
+		if result := convert(t, converter.AlphaOptions{Policy: converter.AlphaFail}, opaque); result.Error != nil {
+			t.Errorf("expected opaque sources to convert, got %v", result.Error)
+		}
+	})
+
+	t.Run("Skip", func(t *testing.T) {
+		os.Remove(filepath.Join(tmpDir, "out.jpg"))
+		result := convert(t, converter.AlphaOptions{Policy: converter.AlphaSkip}, source)
+		if result.Error != nil || result.SkipReason == "" {
+			t.Fatalf("expected the file to be skipped, got error %v", result.Error)
+		}
+		if _, err := os.Stat(filepath.Join(tmpDir, "out.jpg")); !os.IsNotExist(err) {
+			t.Errorf("expected no output, got %v", err)
+		}
+	})
+
+	t.Run("Fallback", func(t *testing.T) {
+		result := convert(t, converter.AlphaOptions{Policy: converter.AlphaFallback, Fallback: "webp"}, source)
+		if result.Error != nil {
+			t.Fatalf("conversion failed: %v", result.Error)
+		}
+		if filepath.Ext(result.NewPath) != ".webp" {
+			t.Fatalf("expected a webp output, got %s", result.NewPath)
+		}
+		img, err := vips.NewImageFromFile(result.NewPath)
+		if err != nil {
+			t.Fatalf("failed to load output: %v", err)
+		}
+		defer img.Close()
+		if !img.HasAlpha() {
+			t.Error("expected the fallback to keep the transparency")
+		}
+	})
+
+	t.Run("InvalidOptions", func(t *testing.T) {
+		for _, ao := range []converter.AlphaOptions{
+			{Policy: "drop"},
+			{Background: "#zz"},
+			{Fallback: "jpg"},
+		} {
+			if err := ao.Validate(); err == nil {
+				t.Errorf("expected error for %+v, got nil", ao)
+			}
+		}
+	})
+}
+
+func TestFormatRegistry(t *testing.T) {
+	t.Run("Lookup", func(t *testing.T) {
+		if f := converter.LookupFormat("JPEG"); f == nil || f.Name != "jpg" {
+			t.Errorf("expected jpeg to be an alias of jpg, got %+v", f)
+		}
+		if f := converter.LookupFormat(".tif"); f == nil || f.Name != "tiff" {
+			t.Errorf("expected the tif extension to be tiff, got %+v", f)
+		}
+		if converter.LookupFormat("xyz") != nil {
+			t.Error("expected no format for xyz")
+		}
+		if !converter.SupportsAlpha("webp") || converter.SupportsAlpha("jpeg") {
+			t.Error("expected webp to support alpha and jpeg not to")
+		}
+		if !converter.IsTargetFormat("heic") || converter.IsTargetFormat("pdf") {
+			t.Error("expected heic to be a target format and pdf not to")
+		}
+	})
+
+	t.Run("EncoderOptionsSchema", func(t *testing.T) {
+		opts := converter.DefaultEncoderOptions()
+		if err := opts.Set("tif", "predictor", "none"); err != nil {
+			t.Errorf("expected tif.predictor to be accepted, got %v", err)
+		}
+		if err := opts.Set("png", "lossless", true); !errors.Is(err, appErrors.ErrInvalidOption) {
+			t.Errorf("expected png.lossless to be rejected, got %v", err)
+		}
+		// libvips' alpha quality is not reachable through govips, so it is
+		// refused rather than silently ignored
+		if err := opts.Set("webp", "alpha_quality", 90); !errors.Is(err, appErrors.ErrInvalidOption) || !strings.Contains(err.Error(), "not supported") {
+			t.Errorf("expected webp.alpha_quality to be rejected as not supported, got %v", err)
+		}
+		if err := opts.Set("pdf", "quality", 80); !errors.Is(err, appErrors.ErrUnsupportedFormat) {
+			t.Errorf("expected pdf to have no encoder options, got %v", err)
+		}
+	})
+
+	t.Run("Validator", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		if err := validator.ValidateInputs(tmpDir, "jpeg", []string{"png", "jpg"}, converter.TargetName); err != nil {
+			t.Errorf("expected jpeg to match jpg, got %v", err)
+		}
+		if err := validator.ValidateInputs(tmpDir, "pdf", []string{"pdf"}, converter.TargetName); err == nil {
+			t.Error("expected pdf to be rejected as a target")
+		}
+		// An empty list enables nothing, with or without a resolver
+		if err := validator.ValidateInputs(tmpDir, "png", nil, converter.TargetName); err == nil {
+			t.Error("expected png to be rejected by an empty list")
+		}
+		if err := validator.ValidateInputs(tmpDir, "jpeg", []string{"jpg"}, nil); err == nil {
+			t.Error("expected jpeg to need an exact match without a resolver")
+		}
+	})
+
+	t.Run("GoBackend", func(t *testing.T) {
+		// A format libvips does not know is written and verified by its Go backend
+		converter.RegisterFormat(&converter.Format{
+			Name:       "gopng",
+			Extensions: []string{"gopng"},
+			Alpha:      true,
+			Lossless:   true,
+			GoDecode:   png.Decode,
+			GoEncode: func(w io.Writer, img image.Image, p converter.EncodeParams) error {
+				return png.Encode(w, img)
+			},
+		})
+		if !converter.IsTargetFormat("gopng") {
+			t.Fatal("expected the registered format to be a target")
+		}
+
+		tmpDir := t.TempDir()
+		source := filepath.Join(tmpDir, "photo.png")
+		writeTestPNG(t, source, 30, 20)
+		result := convertTo(t, converter.ConvertOptions{}, source, "gopng", "")
+		f, err := os.Open(result.NewPath)
+		if err != nil {
+			t.Fatalf("failed to open output: %v", err)
+		}
+		defer f.Close()
+		decoded, err := png.Decode(f)
+		if err != nil {
+			t.Fatalf("expected a PNG stream, got %v", err)
+		}
+		if size := decoded.Bounds().Size(); size.X != 30 || size.Y != 20 {
+			t.Errorf("expected 30x20, got %v", size)
+		}
+	})
+}
+
+func TestNewFormats(t *testing.T) {
+	tmpDir := t.TempDir()
+	source := filepath.Join(tmpDir, "photo.png")
+	writeSolidPNG(t, source, 40, 20, color.NRGBA{R: 200, G: 100, B: 50, A: 128})
+
+	t.Run("Lookup", func(t *testing.T) {
+		for name, want := range map[string]string{"jxl": "jxl", "j2k": "jp2", ".BMP": "bmp", "qoi": "qoi", "ico": "ico"} {
+			if f := converter.LookupFormat(name); f == nil || f.Name != want {
+				t.Errorf("expected %s to be %s, got %+v", name, want, f)
+			}
+			if !converter.IsTargetFormat(name) {
+				t.Errorf("expected %s to be a target format", name)
+			}
+		}
+		exts := config.DefaultConfig().Extentions
+		for _, ext := range []string{"jxl", "jp2", "bmp", "qoi", "ico"} {
+			if !slices.Contains(exts, ext) {
+				t.Errorf("expected %s in the default extensions", ext)
+			}
+		}
+	})
+
+	t.Run("QOIRoundTrip", func(t *testing.T) {
+		result := convertTo(t, converter.ConvertOptions{}, source, "qoi", "")
+		data, err := os.ReadFile(result.NewPath)
+		if err != nil {
+			t.Fatalf("failed to read output: %v", err)
+		}
+		if !bytes.HasPrefix(data, []byte("qoif")) || data[12] != 4 {
+			t.Fatalf("expected a QOI stream with alpha, got % x", data[:min(len(data), 14)])
+		}
+
+		// Converting back decodes the QOI with the Go backend
+		back := convertTo(t, converter.ConvertOptions{}, result.NewPath, "png", filepath.Join(tmpDir, "back.png"))
+		f, err := os.Open(back.NewPath)
+		if err != nil {
+			t.Fatalf("failed to open output: %v", err)
+		}
+		defer f.Close()
+		decoded, err := png.Decode(f)
+		if err != nil {
+			t.Fatalf("failed to decode output: %v", err)
+		}
+		// The source is stored premultiplied, so allow for rounding
+		c := color.NRGBAModel.Convert(decoded.At(5, 5)).(color.NRGBA)
+		if math.Abs(float64(c.R)-200) > 2 || math.Abs(float64(c.G)-100) > 2 || c.A != 128 {
+			t.Errorf("expected the pixels to survive the round trip, got %v", c)
+		}
+	})
+
+	t.Run("BMP", func(t *testing.T) {
+		result := convertTo(t, converter.ConvertOptions{}, source, "bmp", "")
+		data, err := os.ReadFile(result.NewPath)
+		if err != nil {
+			t.Fatalf("failed to read output: %v", err)
+		}
+		if !bytes.HasPrefix(data, []byte("BM")) {
+			t.Errorf("expected a BMP stream, got % x", data[:min(len(data), 2)])
+		}
+	})
+
+	t.Run("GoWrittenVerifiedByGo", func(t *testing.T) {
+		// libvips loads this output as a PNG, not as the format's own type,
+		// so only the Go decoder can verify it
+		converter.RegisterFormat(&converter.Format{
+			Name:       "vipsmismatch",
+			Extensions: []string{"vipsmismatch"},
+			Alpha:      true,
+			Lossless:   true,
+			VipsType:   vips.ImageTypeTIFF,
+			GoDecode:   png.Decode,
+			GoEncode: func(w io.Writer, img image.Image, p converter.EncodeParams) error {
+				return png.Encode(w, img)
+			},
+		})
+		convertTo(t, converter.ConvertOptions{}, source, "vipsmismatch", "")
+	})
+
+	t.Run("ICOSizes", func(t *testing.T) {
+		eo := converter.DefaultEncoderOptions()
+		if err := eo.ApplyOverrides([]string{"ico.sizes=16,32,48,256"}); err != nil {
+			t.Fatalf("failed to set sizes: %v", err)
+		}
+		result := convertTo(t, converter.ConvertOptions{Encoder: eo}, source, "ico", "")
+		data, err := os.ReadFile(result.NewPath)
+		if err != nil {
+			t.Fatalf("failed to read output: %v", err)
+		}
+		if len(data) < 6 || binary.LittleEndian.Uint16(data[2:]) != 1 {
+			t.Fatalf("expected an icon header, got % x", data[:min(len(data), 6)])
+		}
+		count := int(binary.LittleEndian.Uint16(data[4:]))
+		if count != 4 {
+			t.Fatalf("expected 4 entries, got %d", count)
+		}
+		var widths []int
+		for i := 0; i < count; i++ {
+			width := int(data[6+16*i])
+			if width == 0 {
+				width = 256
+			}
+			widths = append(widths, width)
+		}
+		if fmt.Sprint(widths) != "[16 32 48 256]" {
+			t.Errorf("expected sizes 16, 32, 48 and 256, got %v", widths)
+		}
+	})
+
+	t.Run("InvalidOptions", func(t *testing.T) {
+		for _, value := range []interface{}{"0", "16,300", "16,16", "big", []interface{}{}} {
+			eo := converter.DefaultEncoderOptions()
+			if err := eo.Set("ico", "sizes", value); !errors.Is(err, appErrors.ErrInvalidOption) {
+				t.Errorf("expected ico.sizes=%v to be rejected, got %v", value, err)
+			}
+		}
+		eo := converter.DefaultEncoderOptions()
+		if err := eo.Set("ico", "sizes", []interface{}{16, 32}); err != nil {
+			t.Errorf("expected a YAML list to be accepted, got %v", err)
+		}
+		if err := eo.Set("qoi", "quality", 80); !errors.Is(err, appErrors.ErrUnsupportedFormat) {
+			t.Errorf("expected qoi to have no encoder options, got %v", err)
+		}
+	})
+}
+
+func TestRaw(t *testing.T) {
+	tmpDir := t.TempDir()
+	source := filepath.Join(tmpDir, "DSC_0001.nef")
+	writeTestRAW(t, source, 40, 20, 6, color.RGBA{R: 200, G: 100, B: 100, A: 255})
+
+	convert := func(t *testing.T, ro converter.RawOptions) *vips.ImageRef {
+		t.Helper()
+		if err := ro.Validate(); err != nil {
+			t.Fatalf("invalid RAW options: %v", err)
+		}
+		result := convertTo(t, converter.ConvertOptions{Quality: 95, Raw: ro}, source, "jpg", filepath.Join(tmpDir, "out.jpg"))
+		img, err := vips.NewImageFromFile(result.NewPath)
+		if err != nil {
+			t.Fatalf("failed to load output: %v", err)
+		}
+		t.Cleanup(img.Close)
+		return img
+	}
+	pixel := func(t *testing.T, img *vips.ImageRef) []float64 {
+		t.Helper()
+		values, err := img.GetPoint(5, 5)
+		if err != nil {
+			t.Fatalf("failed to read pixel: %v", err)
+		}
+		return values
+	}
+
+	t.Run("Preview", func(t *testing.T) {
+		img := convert(t, converter.RawOptions{})
+		// Orientation 6 turns the 40x20 preview upright
+		if img.Width() != 20 || img.Height() != 40 {
+			t.Errorf("expected a 20x40 output, got %dx%d", img.Width(), img.Height())
+		}
+		if camera := img.GetString("exif-ifd0-Make"); !strings.HasPrefix(camera, "GoPix") {
+			t.Errorf("expected the camera make to be kept, got %q", camera)
+		}
+		if taken := img.GetString("exif-ifd2-DateTimeOriginal"); !strings.HasPrefix(taken, "2024:05:01") {
+			t.Errorf("expected the capture date to be kept, got %q", taken)
+		}
+	})
+
+	t.Run("Exposure", func(t *testing.T) {
+		base := pixel(t, convert(t, converter.RawOptions{}))
+		brighter := pixel(t, convert(t, converter.RawOptions{Exposure: 1}))
+		if brighter[1] <= base[1]+20 {
+			t.Errorf("expected +1 stop to brighten the image, got %v from %v", brighter, base)
+		}
+	})
+
+	t.Run("WhiteBalance", func(t *testing.T) {
+		values := pixel(t, convert(t, converter.RawOptions{WhiteBalance: converter.WhiteBalanceAuto}))
+		if math.Abs(values[0]-values[1]) > 10 || math.Abs(values[1]-values[2]) > 10 {
+			t.Errorf("expected auto white balance to neutralise the cast, got %v", values)
+		}
+		values = pixel(t, convert(t, converter.RawOptions{WhiteBalance: "0.2,1,1"}))
+		if values[0] > values[1]+10 {
+			t.Errorf("expected the red gain to remove the red cast, got %v", values)
+		}
+	})
+
+	t.Run("Collect", func(t *testing.T) {
+		bp := batch.NewBatchProcessor(&config.BatchConfig{NameTemplate: "{date:2006}/{name}"})
+		files, err := bp.CollectFiles(tmpDir, append([]string{"png"}, converter.RawExtensions...))
+		if err != nil {
+			t.Fatalf("failed to collect files: %v", err)
+		}
+		if len(files) != 1 || files[0].Path != source {
+			t.Fatalf("expected the RAW file to be collected, got %+v", files)
+		}
+		paths, err := bp.PlanOutputPaths(tmpDir, files, "jpg")
+		if err != nil {
+			t.Fatalf("failed to plan output paths: %v", err)
+		}
+		if expected := filepath.Join(tmpDir, "2024", "DSC_0001.jpg"); paths[0] != expected {
+			t.Errorf("expected the capture date in %s, got %s", expected, paths[0])
+		}
+	})
+
+	t.Run("InvalidOptions", func(t *testing.T) {
+		for _, ro := range []converter.RawOptions{
+			{Decode: "dcraw"},
+			{WhiteBalance: "tungsten"},
+			{WhiteBalance: "1,0,1"},
+			{Exposure: 6},
+		} {
+			if err := ro.Validate(); err == nil {
+				t.Errorf("expected error for %+v, got nil", ro)
+			}
+		}
+	})
+}
+
+// writeTestRAW writes a minimal TIFF based RAW file: a main directory with
+// the camera make and the orientation, an EXIF directory with the capture
+// date, and a solid JPEG preview standing in for the sensor data.
+func writeTestRAW(t *testing.T, path string, width, height int, orientation uint16, c color.Color) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	var preview bytes.Buffer
+	if err := jpeg.Encode(&preview, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("failed to encode preview: %v", err)
+	}
+
+	le := binary.LittleEndian
+	entry := func(buf []byte, tag, typ uint16, count, value uint32) []byte {
+		buf = le.AppendUint16(buf, tag)
+		buf = le.AppendUint16(buf, typ)
+		buf = le.AppendUint32(buf, count)
+		return le.AppendUint32(buf, value)
+	}
+	camera := "GoPix\x00"
+	taken := "2024:05:01 10:00:00\x00"
+	ifd0 := 8
+	makeOffset := ifd0 + 2 + 3*12 + 4
+	exifIFD := makeOffset + len(camera)
+	takenOffset := exifIFD + 2 + 12 + 4
+
+	data := []byte("II*\x00")
+	data = le.AppendUint32(data, uint32(ifd0))
+	data = le.AppendUint16(data, 3)
+	data = entry(data, 0x010f, 2, uint32(len(camera)), uint32(makeOffset)) // Make
+	data = entry(data, 0x0112, 3, 1, uint32(orientation))                  // Orientation
+	data = entry(data, 0x8769, 4, 1, uint32(exifIFD))                      // ExifIFD
+	data = le.AppendUint32(data, 0)
+	data = append(data, camera...)
+	data = le.AppendUint16(data, 1)
+	data = entry(data, 0x9003, 2, uint32(len(taken)), uint32(takenOffset)) // DateTimeOriginal
+	data = le.AppendUint32(data, 0)
+	data = append(data, taken...)
+	data = append(data, preview.Bytes()...)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func TestSniffing(t *testing.T) {
+	t.Run("Detect", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		writeTestPNG(t, filepath.Join(tmpDir, "png.jpg"), 8, 8)
+		writeTestRAW(t, filepath.Join(tmpDir, "raw.nef"), 8, 8, 1, color.White)
+		files := map[string][]byte{
+			"gif.png":  []byte("GIF89a\x08\x00\x08\x00"),
+			"webp.bin": []byte("RIFF\x24\x00\x00\x00WEBPVP8 "),
+			"heic.jpg": []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"),
+			"avif.jpg": []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf"),
+			"text.png": []byte("just some text"),
+		}
+		for name, data := range files {
+			if err := os.WriteFile(filepath.Join(tmpDir, name), data, 0644); err != nil {
+				t.Fatalf("failed to write %s: %v", name, err)
+			}
+		}
+		for name, expected := range map[string]string{
+			"png.jpg":  "png",
+			"raw.nef":  "raw",
+			"gif.png":  "gif",
+			"webp.bin": "webp",
+			"heic.jpg": "heif",
+			"avif.jpg": "avif",
+			"text.png": "",
+		} {
+			format, err := converter.DetectFormat(filepath.Join(tmpDir, name))
+			if err != nil {
+				t.Fatalf("failed to detect %s: %v", name, err)
+			}
+			if format != expected {
+				t.Errorf("expected %s to be detected as %q, got %q", name, expected, format)
+			}
+		}
+	})
+
+	t.Run("Collect", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		writeTestPNG(t, filepath.Join(tmpDir, "photo.jpg"), 8, 8)
+		writeTestPNG(t, filepath.Join(tmpDir, "download"), 8, 8)
+		writeTestPNG(t, filepath.Join(tmpDir, "icon.png"), 8, 8)
+		if err := os.WriteFile(filepath.Join(tmpDir, "README"), []byte("not an image"), 0644); err != nil {
+			t.Fatalf("failed to write README: %v", err)
+		}
+
+		bp := batch.NewBatchProcessor(&config.BatchConfig{})
+		files, err := bp.CollectFiles(tmpDir, []string{"jpg", "png"})
+		if err != nil {
+			t.Fatalf("failed to collect files: %v", err)
+		}
+		if len(files) != 3 {
+			t.Fatalf("expected the extensionless PNG to be collected and README not, got %+v", files)
+		}
+		for _, file := range files {
+			if file.Format != "png" {
+				t.Errorf("expected %s to be detected as png, got %q", file.RelPath, file.Format)
+			}
+			if mismatch := file.RelPath != "icon.png"; file.ExtensionMismatch() != mismatch {
+				t.Errorf("expected mismatch %v for %s", mismatch, file.RelPath)
+			}
+		}
+	})
+
+	t.Run("FixExtension", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		source := filepath.Join(tmpDir, "photo.jpg")
+		writeTestPNG(t, source, 8, 8)
+		bp := batch.NewBatchProcessor(&config.BatchConfig{})
+		files, err := bp.CollectFiles(tmpDir, []string{"jpg", "png"})
+		if err != nil || len(files) != 1 {
+			t.Fatalf("failed to collect files: %v %+v", err, files)
+		}
+
+		planned, err := batch.FixExtension(files[0], true)
+		if err != nil {
+			t.Fatalf("dry run failed: %v", err)
+		}
+		if _, err := os.Stat(source); err != nil || planned.Path != filepath.Join(tmpDir, "photo.png") {
+			t.Fatalf("expected the dry run to plan photo.png and keep photo.jpg, got %s (%v)", planned.Path, err)
+		}
+
+		before, _ := os.ReadFile(source)
+		fixed, err := batch.FixExtension(files[0], false)
+		if err != nil {
+			t.Fatalf("failed to fix extension: %v", err)
+		}
+		after, err := os.ReadFile(fixed.Path)
+		if err != nil {
+			t.Fatalf("expected %s to exist: %v", fixed.Path, err)
+		}
+		if !bytes.Equal(before, after) || fixed.Extension != "png" || fixed.ExtensionMismatch() {
+			t.Errorf("expected the file to be renamed unchanged, got %+v", fixed)
+		}
+		if _, err := os.Stat(source); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be renamed", source)
+		}
+
+		// An existing file of the new name is never replaced
+		writeTestPNG(t, source, 8, 8)
+		if _, err := batch.FixExtension(files[0], false); err == nil {
+			t.Error("expected an error when photo.png already exists")
+		}
+	})
+
+	t.Run("ConvertMisnamed", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		source := filepath.Join(tmpDir, "photo.jpg")
+		writeTestPNG(t, source, 8, 8)
+		ic := converter.NewImageConverter(converter.ConvertOptions{
+			Quality: 90,
+			Encoder: converter.DefaultEncoderOptions(),
+		})
+		// The extension already names the target, the content does not
+		result := ic.Convert(source, "jpg")
+		if result.Error != nil {
+			t.Fatalf("conversion failed: %v", result.Error)
+		}
+		if format, _ := converter.DetectFormat(source); format != "jpg" {
+			t.Errorf("expected %s to hold a JPEG, got %q", source, format)
+		}
+
+		result = ic.Convert(source, "jpg")
+		if result.Error == nil {
+			t.Error("expected a real JPEG to be reported as already in the target format")
+		}
+	})
+
+	t.Run("ConvertMisnamedToItsFormat", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		source := filepath.Join(tmpDir, "photo.jpg")
+		writeTestPNG(t, source, 8, 8)
+		ic := converter.NewImageConverter(converter.ConvertOptions{
+			Quality: 90,
+			Encoder: converter.DefaultEncoderOptions(),
+		})
+		// The content is already a PNG, it is written again under its name
+		result := ic.Convert(source, "png")
+		if result.Error != nil || result.SkipReason != "" {
+			t.Fatalf("expected the misnamed PNG to be converted, got %v (%s)", result.Error, result.SkipReason)
+		}
+		expected := filepath.Join(tmpDir, "photo.png")
+		if result.NewPath != expected {
+			t.Errorf("expected %s, got %s", expected, result.NewPath)
+		}
+		if format, _ := converter.DetectFormat(expected); format != "png" {
+			t.Errorf("expected %s to hold a PNG, got %q", expected, format)
+		}
+		if _, err := os.Stat(source); !os.IsNotExist(err) {
+			t.Errorf("expected the misnamed original to be removed, got %v", err)
+		}
+	})
+
+	t.Run("DetectChangedFile", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "image")
+		writeTestPNG(t, path, 8, 8)
+		if format, _ := converter.DetectFormat(path); format != "png" {
+			t.Fatalf("expected png, got %q", format)
+		}
+		// A file rewritten with other content is not served from the cache
+		if err := os.WriteFile(path, []byte("GIF89a\x08\x00\x08\x00"), 0644); err != nil {
+			t.Fatalf("failed to rewrite %s: %v", path, err)
+		}
+		if format, _ := converter.DetectFormat(path); format != "gif" {
+			t.Errorf("expected gif after the rewrite, got %q", format)
+		}
+	})
+}
+
+func TestTargetSize(t *testing.T) {
+	tmpDir := t.TempDir()
+	source := filepath.Join(tmpDir, "large.png")
+	writeTestPNG(t, source, 1024, 1024)
+
+	baseline := convertTo(t, converter.ConvertOptions{Quality: 90}, source, "jpg", filepath.Join(tmpDir, "baseline.jpg"))
+
+	t.Run("QualitySearch", func(t *testing.T) {
+		target := baseline.NewSize / 2
+		result := convertTo(t, converter.ConvertOptions{Quality: 90, TargetSize: target}, source, "jpg", filepath.Join(tmpDir, "half.jpg"))
+		if result.NewSize > target {
+			t.Errorf("expected at most %d bytes, got %d", target, result.NewSize)
+		}
+		if result.Quality <= 0 || result.Quality >= 90 {
+			t.Errorf("expected a searched quality below 90, got %d", result.Quality)
+		}
+	})
+
+	t.Run("Unreachable", func(t *testing.T) {
+		ic := testConverter(converter.ConvertOptions{Quality: 90, TargetSize: 3000})
+		result := ic.ConvertWithOutputPath(source, "jpg", filepath.Join(tmpDir, "tiny.jpg"))
+		if !errors.Is(result.Error, appErrors.ErrTargetSize) {
+			t.Errorf("expected ErrTargetSize, got %v", result.Error)
+		}
+	})
+
+	t.Run("Downscale", func(t *testing.T) {
+		opts := converter.ConvertOptions{Quality: 90, TargetSize: 3000, TargetDownscale: true}
+		result := convertTo(t, opts, source, "jpg", filepath.Join(tmpDir, "tiny-downscaled.jpg"))
+		if result.NewSize > 3000 || result.Scale <= 0 || result.Scale >= 1 {
+			t.Errorf("expected a downscaled output under 3000 bytes, got %d bytes at scale %.2f", result.NewSize, result.Scale)
+		}
+	})
+}
+
+func TestOnlyIfSmaller(t *testing.T) {
+	tmpDir := t.TempDir()
+	// A heavily compressed noisy JPEG only grows when stored losslessly
+	source := filepath.Join(tmpDir, "photo.jpg")
+	noise := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := range noise.Pix {
+		noise.Pix[i] = uint8(i * 7919 % 251)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, noise, &jpeg.Options{Quality: 10}); err != nil {
+		t.Fatalf("failed to encode source: %v", err)
+	}
+	if err := os.WriteFile(source, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+
+	output := filepath.Join(tmpDir, "photo.png")
+	ic := converter.NewImageConverter(converter.ConvertOptions{
+		Quality:       80,
+		Encoder:       converter.DefaultEncoderOptions(),
+		OnlyIfSmaller: true,
+		MinSavings:    10,
+	})
+	result := ic.ConvertWithOutputPath(source, "png", output)
+	if result.Error != nil {
+		t.Fatalf("conversion failed: %v", result.Error)
+	}
+	if !result.NotBeneficial {
+		t.Fatalf("expected a lossless PNG of a JPEG not to save space, got %d -> %d bytes", result.OriginalSize, result.NewSize)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("expected no output to be written, got %v", err)
+	}
+	if _, err := os.Stat(source); err != nil {
+		t.Errorf("expected the original to be kept, got %v", err)
+	}
+
+	statistics := stats.NewConversionStatistics()
+	statistics.AddResult(result)
+	if statistics.NotBeneficialFiles != 1 || statistics.ConvertedFiles != 0 {
+		t.Errorf("expected 1 not beneficial and 0 converted, got %d and %d", statistics.NotBeneficialFiles, statistics.ConvertedFiles)
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	decode := func(t *testing.T, path string) image.Image {
+		t.Helper()
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", path, err)
+		}
+		defer file.Close()
+		img, _, err := image.Decode(file)
+		if err != nil {
+			t.Fatalf("failed to decode %s: %v", path, err)
+		}
+		return img
+	}
+	samePixels := func(a, b image.Image) bool {
+		if a.Bounds() != b.Bounds() {
+			return false
+		}
+		for y := a.Bounds().Min.Y; y < a.Bounds().Max.Y; y++ {
+			for x := a.Bounds().Min.X; x < a.Bounds().Max.X; x++ {
+				r1, g1, b1, a1 := a.At(x, y).RGBA()
+				r2, g2, b2, a2 := b.At(x, y).RGBA()
+				if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	gradient := image.NewRGBA(image.Rect(0, 0, 96, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 96; x++ {
+			gradient.Set(x, y, color.RGBA{uint8(x * 2), uint8(y * 4), uint8(x + y), 255})
+		}
+	}
+	newConverter := func(optimize bool) *converter.ImageConverter {
+		return converter.NewImageConverter(converter.ConvertOptions{
+			Quality:  80,
+			Encoder:  converter.DefaultEncoderOptions(),
+			Metadata: "strip",
+			Optimize: optimize,
+		})
+	}
+
+	t.Run("Refused", func(t *testing.T) {
+		source := filepath.Join(t.TempDir(), "image.png")
+		writeTestPNG(t, source, 16, 16)
+		if result := newConverter(false).Convert(source, "png"); result.Error == nil {
+			t.Fatal("expected a file already in the target format to be refused without optimize")
+		}
+	})
+
+	t.Run("PNG", func(t *testing.T) {
+		source := filepath.Join(t.TempDir(), "image.png")
+		var buf bytes.Buffer
+		encoder := png.Encoder{CompressionLevel: png.NoCompression}
+		if err := encoder.Encode(&buf, gradient); err != nil {
+			t.Fatalf("failed to encode source: %v", err)
+		}
+		if err := os.WriteFile(source, buf.Bytes(), 0644); err != nil {
+			t.Fatalf("failed to write source: %v", err)
+		}
+		original := decode(t, source)
+
+		result := newConverter(true).Convert(source, "png")
+		if result.Error != nil {
+			t.Fatalf("optimization failed: %v", result.Error)
+		}
+		if !result.Optimized || result.NewPath != source || result.NewSize >= result.OriginalSize {
+			t.Fatalf("expected the PNG to be optimized in place, got %+v", result)
+		}
+		if !samePixels(original, decode(t, source)) {
+			t.Error("expected the optimized PNG to keep its pixels")
+		}
+
+		// An optimized file cannot shrink again and is left untouched
+		again := newConverter(true).Convert(source, "png")
+		if again.Error != nil {
+			t.Fatalf("optimization failed: %v", again.Error)
+		}
+		if !again.NotBeneficial || again.Optimized {
+			t.Errorf("expected a second optimization not to be beneficial, got %+v", again)
+		}
+		if stat, err := os.Stat(source); err != nil || stat.Size() != result.NewSize {
+			t.Errorf("expected the optimized file to be kept, got %v", err)
+		}
+
+		statistics := stats.NewConversionStatistics()
+		statistics.AddResult(result)
+		if statistics.OptimizedFiles != 1 || statistics.OptimizedSaved != uint64(result.OriginalSize-result.NewSize) {
+			t.Errorf("expected 1 optimized file to be counted, got %d saving %d bytes", statistics.OptimizedFiles, statistics.OptimizedSaved)
+		}
+	})
+
+	t.Run("JPEG", func(t *testing.T) {
+		source := filepath.Join(t.TempDir(), "photo.jpg")
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, gradient, &jpeg.Options{Quality: 90}); err != nil {
+			t.Fatalf("failed to encode source: %v", err)
+		}
+		// A comment the strip policy removes and bytes trailing the image
+		data := buf.Bytes()
+		comment := append([]byte{0xff, 0xfe, 0x00, 0x0f}, "13 byte note!"...)
+		data = append(append(append([]byte{}, data[:2]...), comment...), data[2:]...)
+		data = append(data, "trailing garbage"...)
+		if err := os.WriteFile(source, data, 0644); err != nil {
+			t.Fatalf("failed to write source: %v", err)
+		}
+		original := decode(t, source)
+
+		result := newConverter(true).Convert(source, "jpg")
+		if result.Error != nil {
+			t.Fatalf("optimization failed: %v", result.Error)
+		}
+		if !result.Optimized || result.NewSize >= result.OriginalSize {
+			t.Fatalf("expected the JPEG to be optimized, got %+v", result)
+		}
+		optimized, err := os.ReadFile(source)
+		if err != nil {
+			t.Fatalf("failed to read optimized file: %v", err)
+		}
+		if bytes.Contains(optimized, []byte("13 byte note!")) || bytes.Contains(optimized, []byte("trailing garbage")) {
+			t.Error("expected the comment and trailing data to be dropped")
+		}
+		if !samePixels(original, decode(t, source)) {
+			t.Error("expected the optimized JPEG to decode to the same pixels")
+		}
+	})
+}
+
+func TestTargetSSIM(t *testing.T) {
+	tmpDir := t.TempDir()
+	source := filepath.Join(tmpDir, "gradient.png")
+	writeTestPNG(t, source, 256, 256)
+
+	strict := convertTo(t, converter.ConvertOptions{Quality: 95, TargetSSIM: 0.995}, source, "jpg", filepath.Join(tmpDir, "strict.jpg"))
+	loose := convertTo(t, converter.ConvertOptions{Quality: 95, TargetSSIM: 0.9}, source, "jpg", filepath.Join(tmpDir, "loose.jpg"))
+	for _, tc := range []struct {
+		result *converter.ConversionResult
+		target float64
+	}{{strict, 0.995}, {loose, 0.9}} {
+		if tc.result.SSIM < tc.target || tc.result.SSIM > 1 {
+			t.Errorf("expected SSIM >= %.3f, got %.4f at quality %d", tc.target, tc.result.SSIM, tc.result.Quality)
+		}
+	}
+	if loose.Quality > strict.Quality {
+		t.Errorf("expected a looser target to pick a lower quality, got %d > %d", loose.Quality, strict.Quality)
+	}
+	if dssim := converter.DSSIMToSSIM(0.01); math.Abs(dssim-0.98) > 1e-9 {
+		t.Errorf("expected DSSIM 0.01 to map to SSIM 0.98, got %v", dssim)
+	}
+}
+
+func TestRenditions(t *testing.T) {
+	tmpDir := t.TempDir()
+	source := filepath.Join(tmpDir, "hero.png")
+	writeTestPNG(t, source, 80, 40)
+
+	ic := testConverter(converter.ConvertOptions{
+		Renditions: converter.RenditionOptions{
+			Widths:  []int{20, 40},
+			Formats: []string{"webp", "jpg"},
+		},
+	})
+	if ic.RenditionCount() != 4 {
+		t.Fatalf("expected 4 renditions, got %d", ic.RenditionCount())
+	}
+
+	planned, err := ic.OutputPaths(source, "webp", source, 0)
+	if err != nil {
+		t.Fatalf("failed to plan outputs: %v", err)
+	}
+	results := ic.ConvertRenditions(source, "webp", "")
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %d", len(results))
+	}
+	for i, result := range results {
+		if result.Error != nil {
+			t.Fatalf("rendition %s failed: %v", result.NewPath, result.Error)
+		}
+		if result.NewPath != planned[i] {
+			t.Errorf("rendition %d: planned %s, written %s", i, planned[i], result.NewPath)
+		}
+	}
+
+	for _, name := range []string{"hero-40w.webp", "hero-40w.jpg", "hero-20w.webp", "hero-20w.jpg"} {
+		var width int
+		fmt.Sscanf(name, "hero-%dw", &width)
+		if w, h := imageSize(t, filepath.Join(tmpDir, name)); w != width || h != width/2 {
+			t.Errorf("%s: expected %dx%d, got %dx%d", name, width, width/2, w, h)
+		}
+	}
+
+	t.Run("InvalidOptions", func(t *testing.T) {
+		invalid := []converter.RenditionOptions{
+			{Widths: []int{320, 640}, Template: "{name}.{ext}"},
+			{Formats: []string{"webp", "avif"}, Template: "{name}-{width}w.webp"},
+			{Widths: []int{0}},
+			{Widths: []int{320}, Formats: []string{"psd"}},
+			{Widths: []int{320}, Template: "{name}-{size}.{ext}"},
+			{Widths: []int{320, 640}, Template: "{width}w.{ext}"},
+		}
+		for _, ro := range invalid {
+			if err := ro.Validate(); err == nil {
+				t.Errorf("expected error for %+v, got nil", ro)
+			}
+		}
+	})
+}
+
+func TestAnimation(t *testing.T) {
+	tmpDir := t.TempDir()
+	source := filepath.Join(tmpDir, "spinner.gif")
+	delays := []int{10, 20, 30} // 1/100 s
+	anim := &gif.GIF{LoopCount: 2}
+	for i, delay := range delays {
+		frame := image.NewPaletted(image.Rect(0, 0, 24, 16), color.Palette{color.Black, color.White, color.RGBA{R: 255, A: 255}})
+		for x := 0; x < 24; x++ {
+			frame.SetColorIndex(x, i*5, uint8(1+i%2))
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, delay)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatalf("failed to encode source: %v", err)
+	}
+	if err := os.WriteFile(source, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+
+	loadAll := func(t *testing.T, path string) *vips.ImageRef {
+		t.Helper()
+		params := vips.NewImportParams()
+		params.NumPages.Set(-1)
+		img, err := vips.LoadImageFromFile(path, params)
+		if err != nil {
+			t.Fatalf("failed to load %s: %v", path, err)
+		}
+		return img
+	}
+
+	t.Run("KeepFrames", func(t *testing.T) {
+		output := filepath.Join(tmpDir, "spinner.webp")
+		result := convertTo(t, converter.ConvertOptions{}, source, "webp", output)
+		if result.Frames != len(delays) {
+			t.Errorf("expected %d frames in the result, got %d", len(delays), result.Frames)
+		}
+
+		in, out := loadAll(t, source), loadAll(t, output)
+		defer in.Close()
+		defer out.Close()
+		if out.Pages() != len(delays) || out.PageHeight() != 16 {
+			t.Fatalf("expected %d frames of height 16, got %d of height %d", len(delays), out.Pages(), out.PageHeight())
+		}
+		outDelays, err := out.PageDelay()
+		if err != nil {
+			t.Fatalf("failed to read frame delays: %v", err)
+		}
+		for i, delay := range delays {
+			if outDelays[i] != delay*10 {
+				t.Errorf("frame %d: expected a %d ms delay, got %d", i+1, delay*10, outDelays[i])
+			}
+		}
+		if in.GetInt("loop") != out.GetInt("loop") {
+			t.Errorf("expected loop count %d, got %d", in.GetInt("loop"), out.GetInt("loop"))
+		}
+	})
+
+	t.Run("SingleFrame", func(t *testing.T) {
+		output := filepath.Join(tmpDir, "frame2.png")
+		convertTo(t, converter.ConvertOptions{Animation: converter.AnimationOptions{Frame: 2}}, source, "png", output)
+		if width, height := imageSize(t, output); width != 24 || height != 16 {
+			t.Errorf("expected a single 24x16 frame, got %dx%d", width, height)
+		}
+
+		tooFar := converter.NewImageConverter(converter.ConvertOptions{Animation: converter.AnimationOptions{Frame: 9}})
+		if result := tooFar.ConvertWithOutputPath(source, "png", filepath.Join(tmpDir, "frame9.png")); result.Error == nil {
+			t.Error("expected an error for a frame past the end")
+		}
+	})
+
+	t.Run("SplitFrames", func(t *testing.T) {
+		ic := testConverter(converter.ConvertOptions{Animation: converter.AnimationOptions{Split: true}})
+		output := filepath.Join(tmpDir, "split", "spinner.png")
+		if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+			t.Fatalf("failed to create output directory: %v", err)
+		}
+		// Every frame file is planned before converting
+		planned, err := ic.OutputPaths(source, "png", output, 0)
+		if err != nil {
+			t.Fatalf("failed to plan outputs: %v", err)
+		}
+		if len(planned) != len(delays) || planned[0] != converter.FramePath(output, 1, len(delays)) {
+			t.Errorf("expected %d frame outputs, got %v", len(delays), planned)
+		}
+		result := ic.ConvertWithOutputPath(source, "png", output)
+		if result.Error != nil {
+			t.Fatalf("conversion failed: %v", result.Error)
+		}
+		if result.Frames != len(delays) {
+			t.Errorf("expected %d frames, got %d", len(delays), result.Frames)
+		}
+		for _, framePath := range planned {
+			if width, height := imageSize(t, framePath); width != 24 || height != 16 {
+				t.Errorf("%s: expected 24x16, got %dx%d", framePath, width, height)
+			}
+		}
+		if got := converter.FramePath("a/b.png", 3, 12); got != "a/b-03.png" {
+			t.Errorf("expected a/b-03.png, got %s", got)
+		}
+	})
+
+	t.Run("InvalidOptions", func(t *testing.T) {
+		for _, ao := range []converter.AnimationOptions{{Frame: -1}, {Frame: 2, Split: true}} {
+			if err := ao.Validate(); err == nil {
+				t.Errorf("expected error for %+v, got nil", ao)
+			}
+		}
+	})
+}
+
+func TestPages(t *testing.T) {
+	tmpDir := t.TempDir()
+	// A 4 page TIFF: 20x10 pages stacked in one strip
+	strip := filepath.Join(tmpDir, "strip.png")
+	writeTestPNG(t, strip, 20, 40)
+	img, err := vips.NewImageFromFile(strip)
+	if err != nil {
+		t.Fatalf("failed to load strip: %v", err)
+	}
+	if err := img.SetPageHeight(10); err != nil {
+		t.Fatalf("failed to set page height: %v", err)
+	}
+	if err := img.SetPages(4); err != nil {
+		t.Fatalf("failed to set pages: %v", err)
+	}
+	buf, _, err := img.ExportTiff(vips.NewTiffExportParams())
+	img.Close()
+	if err != nil {
+		t.Fatalf("failed to encode TIFF: %v", err)
+	}
+	source := filepath.Join(tmpDir, "scan.tiff")
+	if err := os.WriteFile(source, buf, 0644); err != nil {
+		t.Fatalf("failed to write TIFF: %v", err)
+	}
+	os.Remove(strip)
+
+	t.Run("Select", func(t *testing.T) {
+		for _, tc := range []struct {
+			ranges   string
+			pages    int
+			expected []int
+		}{
+			{"1-3,5", 6, []int{1, 2, 3, 5}},
+			{"2-", 4, []int{2, 3, 4}},
+			{"3,1,3", 4, []int{1, 3}},
+			{"", 3, []int{1, 2, 3}},
+			{"2-9", 3, []int{2, 3}},
+		} {
+			po := converter.PageOptions{Ranges: tc.ranges}
+			selected, err := po.Select(tc.pages)
+			if err != nil {
+				t.Errorf("%q: unexpected error: %v", tc.ranges, err)
+				continue
+			}
+			if fmt.Sprint(selected) != fmt.Sprint(tc.expected) {
+				t.Errorf("%q of %d pages: expected %v, got %v", tc.ranges, tc.pages, tc.expected, selected)
+			}
+		}
+		for _, po := range []converter.PageOptions{{Ranges: "0"}, {Ranges: "3-1"}, {Ranges: "a"}, {Mode: "merge"}} {
+			if err := po.Validate(); err == nil {
+				t.Errorf("expected error for %+v, got nil", po)
+			}
+		}
+	})
+
+	t.Run("Split", func(t *testing.T) {
+		po := converter.PageOptions{Ranges: "1,3", Mode: converter.PagesSplit}
+		bp := batch.NewBatchProcessor(&config.BatchConfig{})
+		files, err := bp.CollectFiles(tmpDir, []string{"tiff"})
+		if err != nil {
+			t.Fatalf("failed to collect files: %v", err)
+		}
+		files = bp.ExpandPages(files, po.PagesOf)
+		if len(files) != 2 || files[0].Page != 1 || files[1].Page != 3 {
+			t.Fatalf("expected pages 1 and 3 as separate files, got %+v", files)
+		}
+		paths, err := bp.PlanOutputPaths(tmpDir, files, "png")
+		if err != nil {
+			t.Fatalf("failed to plan output paths: %v", err)
+		}
+		expected := []string{filepath.Join(tmpDir, "scan-1.png"), filepath.Join(tmpDir, "scan-3.png")}
+		ic := converter.NewImageConverter(converter.ConvertOptions{
+			Quality: 80,
+			Encoder: converter.DefaultEncoderOptions(),
+			Pages:   po,
+		})
+		for i, file := range files {
+			if paths[i] != expected[i] {
+				t.Errorf("expected %s, got %s", expected[i], paths[i])
+			}
+			result := ic.ConvertPage(file.Path, "png", paths[i], file.Page)
+			if result.Error != nil {
+				t.Fatalf("page %d failed: %v", file.Page, result.Error)
+			}
+			page, err := vips.NewImageFromFile(paths[i])
+			if err != nil {
+				t.Fatalf("failed to load page output: %v", err)
+			}
+			if page.Width() != 20 || page.Height() != 10 {
+				t.Errorf("page %d: expected 20x10, got %dx%d", file.Page, page.Width(), page.Height())
+			}
+			page.Close()
+		}
+		if _, err := os.Stat(source); err != nil {
+			t.Errorf("expected page jobs to keep their source, got %v", err)
+		}
+
+		nt, err := batch.ParseNameTemplate("{name}/p{page:03}")
+		if err != nil {
+			t.Fatalf("failed to parse template: %v", err)
+		}
+		rel, err := nt.Expand(files[1], 2, "png")
+		if err != nil || rel != filepath.Join("scan", "p003.png") {
+			t.Errorf("expected scan/p003.png, got %q (%v)", rel, err)
+		}
+	})
+
+	t.Run("Join", func(t *testing.T) {
+		ic := testConverter(converter.ConvertOptions{Pages: converter.PageOptions{Ranges: "2-3", Mode: converter.PagesJoin}})
+		output := filepath.Join(tmpDir, "joined.tiff")
+		result := ic.ConvertWithOutputPath(source, "tiff", output)
+		if result.Error != nil {
+			t.Fatalf("join failed: %v", result.Error)
+		}
+		params := vips.NewImportParams()
+		params.NumPages.Set(-1)
+		joined, err := vips.LoadImageFromFile(output, params)
+		if err != nil {
+			t.Fatalf("failed to load joined TIFF: %v", err)
+		}
+		defer joined.Close()
+		if joined.Pages() != 2 || joined.PageHeight() != 10 || joined.Height() != 20 {
+			t.Errorf("expected 2 pages of 20x10, got %d pages of height %d", joined.Pages(), joined.PageHeight())
+		}
+
+		inPlace := ic.ConvertWithOutputPath(source, "tiff", "")
+		if inPlace.Error == nil {
+			t.Error("expected joining into the source itself to fail")
+		}
+	})
+}
+
+// iccColorSpace returns the color space signature of the ICC profile embedded
+// in the image at path, e.g. "RGB " or "CMYK", or "" without a profile.
+func iccColorSpace(t *testing.T, path string) string {
+	t.Helper()
+	img, err := vips.NewImageFromFile(path)
+	if err != nil {
+		t.Fatalf("failed to load %s: %v", path, err)
+	}
+	defer img.Close()
+	profile := img.GetICCProfile()
+	if len(profile) < 20 {
+		return ""
+	}
+	return string(profile[16:20])
+}
+
+func TestColorManagement(t *testing.T) {
+	tmpDir := t.TempDir()
+	// A CMYK JPEG with an embedded CMYK profile
+	rgb := filepath.Join(tmpDir, "rgb.png")
+	writeTestPNG(t, rgb, 32, 24)
+	img, err := vips.NewImageFromFile(rgb)
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+	if err := img.TransformICCProfile("cmyk"); err != nil {
+		t.Fatalf("failed to convert fixture to CMYK: %v", err)
+	}
+	buf, _, err := img.ExportJpeg(vips.NewJpegExportParams())
+	img.Close()
+	if err != nil {
+		t.Fatalf("failed to encode fixture: %v", err)
+	}
+	source := filepath.Join(tmpDir, "print.jpg")
+	if err := os.WriteFile(source, buf, 0644); err != nil {
+		t.Fatalf("failed to write fixture: %v", err)
+	}
+	if space := iccColorSpace(t, source); space != "CMYK" {
+		t.Fatalf("expected the fixture to embed a CMYK profile, got %q", space)
+	}
+
+	bands := func(t *testing.T, path string) (int, vips.BandFormat) {
+		t.Helper()
+		img, err := vips.NewImageFromFile(path)
+		if err != nil {
+			t.Fatalf("failed to load %s: %v", path, err)
+		}
+		defer img.Close()
+		return img.Bands(), img.BandFormat()
+	}
+
+	t.Run("CMYKToSRGB", func(t *testing.T) {
+		output := filepath.Join(tmpDir, "print.png")
+		convertTo(t, converter.ConvertOptions{}, source, "png", output)
+		if n, _ := bands(t, output); n != 3 {
+			t.Errorf("expected 3 bands, got %d", n)
+		}
+		if space := iccColorSpace(t, output); space != "RGB " {
+			t.Errorf("expected an embedded RGB profile, got %q", space)
+		}
+	})
+
+	t.Run("KeepCMYK", func(t *testing.T) {
+		output := filepath.Join(tmpDir, "print.tiff")
+		convertTo(t, converter.ConvertOptions{}, source, "tiff", output)
+		if space := iccColorSpace(t, output); space != "CMYK" {
+			t.Errorf("expected the CMYK profile to be kept, got %q", space)
+		}
+	})
+
+	t.Run("ProfileFile", func(t *testing.T) {
+		profile, err := vips.GetSRGBIEC6196621ICCProfilePath()
+		if err != nil {
+			t.Fatalf("failed to get the sRGB profile: %v", err)
+		}
+		output := filepath.Join(tmpDir, "print-srgb.jpg")
+		convertTo(t, converter.ConvertOptions{Color: converter.ColorOptions{Profile: profile}}, source, "jpg", output)
+		if space := iccColorSpace(t, output); space != "RGB " {
+			t.Errorf("expected an embedded RGB profile, got %q", space)
+		}
+	})
+
+	t.Run("Strip", func(t *testing.T) {
+		output := filepath.Join(tmpDir, "print-stripped.webp")
+		convertTo(t, converter.ConvertOptions{Color: converter.ColorOptions{ICC: converter.ICCStrip}}, source, "webp", output)
+		if space := iccColorSpace(t, output); space != "" {
+			t.Errorf("expected no profile, got %q", space)
+		}
+		if n, _ := bands(t, output); n != 3 {
+			t.Errorf("expected 3 bands, got %d", n)
+		}
+	})
+
+	t.Run("Depth", func(t *testing.T) {
+		deep := filepath.Join(tmpDir, "deep.tiff")
+		convertTo(t, converter.ConvertOptions{Color: converter.ColorOptions{Depth: 16}}, rgb, "tiff", deep)
+		if _, format := bands(t, deep); format != vips.BandFormatUshort {
+			t.Fatalf("expected a 16-bit output, got band format %v", format)
+		}
+		// 16 bits survive a conversion to PNG, unless 8 bits are requested
+		kept := filepath.Join(tmpDir, "deep.png")
+		convertTo(t, converter.ConvertOptions{}, deep, "png", kept)
+		if _, format := bands(t, kept); format != vips.BandFormatUshort {
+			t.Errorf("expected the 16-bit depth to be kept, got band format %v", format)
+		}
+		reduced := filepath.Join(tmpDir, "reduced.png")
+		convertTo(t, converter.ConvertOptions{Color: converter.ColorOptions{Depth: 8}}, deep, "png", reduced)
+		if _, format := bands(t, reduced); format != vips.BandFormatUchar {
+			t.Errorf("expected an 8-bit output, got band format %v", format)
+		}
+	})
+
+	t.Run("InvalidOptions", func(t *testing.T) {
+		for _, co := range []converter.ColorOptions{
+			{ICC: "keep"},
+			{Depth: 12},
+			{Profile: filepath.Join(tmpDir, "missing.icc")},
+		} {
+			if err := co.Validate(); err == nil {
+				t.Errorf("expected error for %+v, got nil", co)
+			}
+		}
+	})
+}
+
+// planOutputs collects the files with the given extensions under dir and plans
+// their outputs in format with a batch processor configured by cfg.
+func planOutputs(t *testing.T, cfg config.BatchConfig, dir string, exts []string, format string) ([]batch.FileInfo, []string) {
+	t.Helper()
+	bp := batch.NewBatchProcessor(&cfg)
+	files, err := bp.CollectFiles(dir, exts)
+	if err != nil {
+		t.Fatalf("failed to collect files: %v", err)
+	}
+	paths, err := bp.PlanOutputPaths(dir, files, format)
+	if err != nil {
+		t.Fatalf("failed to plan output paths: %v", err)
+	}
+	return files, paths
+}
+
+func TestNameTemplate(t *testing.T) {
+	tmpDir := t.TempDir()
+	subDir := filepath.Join(tmpDir, "trip")
+	if err := os.Mkdir(subDir, 0755); err != nil {
+		t.Fatalf("failed to create sub dir: %v", err)
+	}
+	writeTestPNG(t, filepath.Join(tmpDir, "a.png"), 16, 8)
+	writeTestPNG(t, filepath.Join(subDir, "b.png"), 16, 8)
+
+	plan := func(t *testing.T, template string) ([]batch.FileInfo, []string) {
+		t.Helper()
+		return planOutputs(t, config.BatchConfig{RecursiveSearch: true, NameTemplate: template}, tmpDir, []string{"png"}, "webp")
+	}
+
+	t.Run("Expand", func(t *testing.T) {
+		_, paths := plan(t, "{dir}/{index:03}-{name}-{width}x{height}")
+		expected := []string{
+			filepath.Join(tmpDir, "001-a-16x8.webp"),
+			filepath.Join(tmpDir, "trip", "002-b-16x8.webp"),
+		}
+		for i := range expected {
+			if paths[i] != expected[i] {
+				t.Errorf("expected %s, got %s", expected[i], paths[i])
+			}
+		}
+	})
+
+	t.Run("Orientation", func(t *testing.T) {
+		// A 16x8 photo displayed turned by a quarter is named by its upright size
+		dir := t.TempDir()
+		writeOrientedJPEG(t, filepath.Join(dir, "phone.jpg"), 16, 8, 6)
+		for _, tc := range []struct {
+			noAutoOrient bool
+			expected     string
+		}{
+			{false, "phone-8x16.webp"},
+			{true, "phone-16x8.webp"},
+		} {
+			cfg := config.BatchConfig{NameTemplate: "{name}-{width}x{height}", NoAutoOrient: tc.noAutoOrient}
+			_, paths := planOutputs(t, cfg, dir, []string{"jpg"}, "webp")
+			if len(paths) != 1 || paths[0] != filepath.Join(dir, tc.expected) {
+				t.Errorf("no auto-orient %v: expected %s, got %v", tc.noAutoOrient, tc.expected, paths)
+			}
+		}
+	})
+
+	t.Run("Collisions", func(t *testing.T) {
+		files, paths := plan(t, "{width}.{ext}")
+		collisions := batch.FindCollisions(files, paths)
+		if len(collisions) != 1 || len(collisions[0].Inputs) != 2 {
+			t.Errorf("expected one collision between both inputs, got %+v", collisions)
+		}
+		files, paths = plan(t, "{hash8}-{index}")
+		if collisions := batch.FindCollisions(files, paths); len(collisions) != 0 {
+			t.Errorf("expected no collisions, got %+v", collisions)
+		}
+	})
+
+	t.Run("InvalidTemplates", func(t *testing.T) {
+		for _, template := range []string{"{size}.{ext}", "{date}", "{index:x}", "{name", "{name:x}"} {
+			if _, err := batch.ParseNameTemplate(template); err == nil {
+				t.Errorf("expected error for %q, got nil", template)
+			}
+		}
+		nt, err := batch.ParseNameTemplate("../{name}")
+		if err != nil {
+			t.Fatalf("expected ../{name} to parse, got %v", err)
+		}
+		if _, err := nt.Expand(batch.FileInfo{Path: "x.png", RelPath: "x.png"}, 1, "webp"); err == nil {
+			t.Error("expected an error for a template leaving the output directory")
+		}
+	})
+}
+
+func TestConflictPolicy(t *testing.T) {
+	tmpDir := t.TempDir()
+	older := time.Now().Add(-time.Hour)
+	files := []batch.FileInfo{
+		{Path: filepath.Join(tmpDir, "a.png"), ModTime: time.Now()},
+		{Path: filepath.Join(tmpDir, "a.jpg"), ModTime: older},
+		{Path: filepath.Join(tmpDir, "b.png"), ModTime: older},
+	}
+	paths := []string{
+		filepath.Join(tmpDir, "a.webp"),
+		filepath.Join(tmpDir, "a.webp"),
+		filepath.Join(tmpDir, "b.webp"),
+	}
+	// b.webp already exists and is newer than b.png
+	if err := os.WriteFile(paths[2], []byte("existing"), 0644); err != nil {
+		t.Fatalf("failed to create existing output: %v", err)
+	}
+
+	skipped := func(plan []batch.PlannedOutput) []bool {
+		out := make([]bool, len(plan))
+		for i, planned := range plan {
+			out[i] = planned.SkipReason != ""
+		}
+		return out
+	}
+
+	cases := []struct {
+		policy  string
+		skipped []bool
+	}{
+		{batch.ConflictSkip, []bool{false, true, true}},
+		{batch.ConflictOverwrite, []bool{true, false, false}},
+		{batch.ConflictNewerWins, []bool{false, true, true}},
+		{batch.ConflictSuffixRename, []bool{false, false, false}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.policy, func(t *testing.T) {
+			plan, collisions, err := batch.ResolveConflicts(files, paths, tc.policy, nil)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if len(collisions) != 2 {
+				t.Errorf("expected 2 collisions, got %+v", collisions)
+			}
+			if got := skipped(plan); fmt.Sprint(got) != fmt.Sprint(tc.skipped) {
+				t.Errorf("expected skipped %v, got %v", tc.skipped, got)
+			}
+			if tc.policy == batch.ConflictSuffixRename {
+				if plan[1].OutputPath != filepath.Join(tmpDir, "a-1.webp") || plan[2].OutputPath != filepath.Join(tmpDir, "b-1.webp") {
+					t.Errorf("unexpected renamed outputs: %s, %s", plan[1].OutputPath, plan[2].OutputPath)
+				}
+			}
+		})
+	}
+
+	t.Run(batch.ConflictFail, func(t *testing.T) {
+		if _, _, err := batch.ResolveConflicts(files, paths, batch.ConflictFail, nil); err == nil {
+			t.Error("expected an error for conflicting outputs")
+		}
+		if _, _, err := batch.ResolveConflicts(files[:1], paths[:1], batch.ConflictFail, nil); err != nil {
+			t.Errorf("expected no error without conflicts, got %v", err)
+		}
+	})
+
+	t.Run("ExpandedOutputs", func(t *testing.T) {
+		// Renditions never write the planned path itself, only their variants
+		dir := t.TempDir()
+		files := []batch.FileInfo{{Path: filepath.Join(dir, "hero.png"), ModTime: older}}
+		paths := []string{filepath.Join(dir, "hero.webp")}
+		expand := func(i int, outputPath string) []string {
+			base := strings.TrimSuffix(outputPath, ".webp")
+			return []string{base + "-40w.webp", base + "-20w.webp"}
+		}
+		if err := os.WriteFile(filepath.Join(dir, "hero-20w.webp"), []byte("existing"), 0644); err != nil {
+			t.Fatalf("failed to create existing output: %v", err)
+		}
+
+		for _, policy := range []string{batch.ConflictSkip, batch.ConflictNewerWins} {
+			plan, collisions, err := batch.ResolveConflicts(files, paths, policy, expand)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if len(collisions) != 1 || collisions[0].OutputPath != filepath.Join(dir, "hero-20w.webp") {
+				t.Errorf("%s: expected the existing variant to collide, got %+v", policy, collisions)
+			}
+			if plan[0].SkipReason == "" {
+				t.Errorf("%s: expected the source to be skipped", policy)
+			}
+		}
+		if _, _, err := batch.ResolveConflicts(files, paths, batch.ConflictFail, expand); err == nil {
+			t.Error("expected an existing variant to fail the run")
+		}
+
+		plan, _, err := batch.ResolveConflicts(files, paths, batch.ConflictSuffixRename, expand)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		expected := []string{filepath.Join(dir, "hero-1-40w.webp"), filepath.Join(dir, "hero-1-20w.webp")}
+		if plan[0].OutputPath != filepath.Join(dir, "hero-1.webp") || fmt.Sprint(plan[0].Outputs) != fmt.Sprint(expected) {
+			t.Errorf("expected every variant to be renamed, got %s %v", plan[0].OutputPath, plan[0].Outputs)
+		}
+	})
+
+	t.Run("CaseSensitive", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "probe"), nil, 0644); err != nil {
+			t.Fatalf("failed to write probe: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "PROBE")); err == nil {
+			t.Skip("the temp directory is on a case-insensitive file system")
+		}
+		files := []batch.FileInfo{
+			{Path: filepath.Join(dir, "Photo.png"), ModTime: older},
+			{Path: filepath.Join(dir, "photo.png"), ModTime: older},
+		}
+		paths := []string{filepath.Join(dir, "Photo.webp"), filepath.Join(dir, "photo.webp")}
+		if collisions := batch.FindCollisions(files, paths); len(collisions) != 0 {
+			t.Errorf("expected paths differing in case not to collide, got %+v", collisions)
+		}
+		plan, _, err := batch.ResolveConflicts(files, paths, batch.ConflictOverwrite, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		for _, planned := range plan {
+			if planned.SkipReason != "" {
+				t.Errorf("expected %s to be converted, got %s", planned.File.Path, planned.SkipReason)
+			}
+		}
+	})
+}
+
+func TestCache(t *testing.T) {
+	tmpDir := t.TempDir()
+	source := filepath.Join(tmpDir, "photo.png")
+	output := filepath.Join(tmpDir, "photo.webp")
+	if err := os.WriteFile(source, []byte("source pixels"), 0644); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+	if err := os.WriteFile(output, []byte("encoded output"), 0644); err != nil {
+		t.Fatalf("failed to write output: %v", err)
+	}
+
+	cacheDir := filepath.Join(tmpDir, "cache")
+	store, err := cache.Open(cacheDir)
+	if err != nil {
+		t.Fatalf("failed to open cache: %v", err)
+	}
+	if err := store.Put(output, source, "settings-a"); err != nil {
+		t.Fatalf("failed to record conversion: %v", err)
+	}
+	if err := store.Save(); err != nil {
+		t.Fatalf("failed to save cache: %v", err)
+	}
+
+	store, err = cache.Open(cacheDir)
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %v", err)
+	}
+
+	t.Run("Hit", func(t *testing.T) {
+		if _, hit := store.Lookup(output, source, "settings-a"); !hit {
+			t.Error("expected a cache hit after reopening")
+		}
+	})
+
+	t.Run("SettingsChanged", func(t *testing.T) {
+		if _, hit := store.Lookup(output, source, "settings-b"); hit {
+			t.Error("expected a miss for different settings")
+		}
+	})
+
+	t.Run("TouchedButUnchanged", func(t *testing.T) {
+		later := time.Now().Add(time.Minute)
+		if err := os.Chtimes(source, later, later); err != nil {
+			t.Fatalf("failed to touch source: %v", err)
+		}
+		if _, hit := store.Lookup(output, source, "settings-a"); !hit {
+			t.Error("expected a hit for a touched source with the same content")
+		}
+	})
+
+	t.Run("ContentChanged", func(t *testing.T) {
+		if err := os.WriteFile(source, []byte("edited pixels"), 0644); err != nil {
+			t.Fatalf("failed to edit source: %v", err)
+		}
+		if _, hit := store.Lookup(output, source, "settings-a"); hit {
+			t.Error("expected a miss after the source content changed")
+		}
+	})
+
+	t.Run("PruneAndClear", func(t *testing.T) {
+		if stats := store.Stats(); stats.Entries != 1 || stats.Stale != 1 {
+			t.Errorf("expected 1 stale entry, got %+v", stats)
+		}
+		if removed := store.Prune(0); removed != 1 {
+			t.Errorf("expected 1 pruned entry, got %d", removed)
+		}
+		if err := store.Clear(); err != nil {
+			t.Errorf("failed to clear cache: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(cacheDir, "index.json")); !os.IsNotExist(err) {
+			t.Errorf("expected the index to be removed, got %v", err)
+		}
+	})
+}
+
+func TestVerifyOutput(t *testing.T) {
+	// Go backends writing broken outputs: a truncated stream and one of the
+	// wrong size
+	converter.RegisterFormat(&converter.Format{
+		Name:       "truncpng",
+		Extensions: []string{"truncpng"},
+		Alpha:      true,
+		Lossless:   true,
+		GoDecode:   png.Decode,
+		GoEncode: func(w io.Writer, img image.Image, p converter.EncodeParams) error {
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, img); err != nil {
+				return err
+			}
+			_, err := w.Write(buf.Bytes()[:buf.Len()/2])
+			return err
+		},
+	})
+	converter.RegisterFormat(&converter.Format{
+		Name:       "tinypng",
+		Extensions: []string{"tinypng"},
+		Alpha:      true,
+		Lossless:   true,
+		GoDecode:   png.Decode,
+		GoEncode: func(w io.Writer, img image.Image, p converter.EncodeParams) error {
+			return png.Encode(w, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+		},
+	})
+
+	assertNoTempFiles := func(t *testing.T, dir string) {
+		t.Helper()
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", dir, err)
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), ".tmp") || strings.HasSuffix(entry.Name(), ".tmp") {
+				t.Errorf("expected no temp file to be left, found %s", entry.Name())
+			}
+		}
+	}
+
+	for _, format := range []string{"truncpng", "tinypng"} {
+		t.Run(format, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			source := filepath.Join(tmpDir, "photo.png")
+			writeTestPNG(t, source, 30, 20)
+			ic := converter.NewImageConverter(converter.ConvertOptions{
+				Quality: 80,
+				Encoder: converter.DefaultEncoderOptions(),
+			})
+			result := ic.Convert(source, format)
+			if !errors.Is(result.Error, appErrors.ErrVerifyFailed) {
+				t.Fatalf("expected a verification failure, got %v", result.Error)
+			}
+			if _, err := os.Stat(source); err != nil {
+				t.Errorf("expected the original to be kept, got %v", err)
+			}
+			if _, err := os.Stat(result.NewPath); !os.IsNotExist(err) {
+				t.Errorf("expected no output to be written, got %v", err)
+			}
+			assertNoTempFiles(t, tmpDir)
+		})
+	}
+
+	t.Run("ExistingDestination", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		source := filepath.Join(tmpDir, "photo.png")
+		writeTestPNG(t, source, 30, 20)
+		output := filepath.Join(tmpDir, "previous.truncpng")
+		if err := os.WriteFile(output, []byte("previous output"), 0644); err != nil {
+			t.Fatalf("failed to write destination: %v", err)
+		}
+		ic := converter.NewImageConverter(converter.ConvertOptions{
+			Quality: 80,
+			Encoder: converter.DefaultEncoderOptions(),
+		})
+		result := ic.ConvertWithOutputPath(source, "truncpng", output)
+		if !errors.Is(result.Error, appErrors.ErrVerifyFailed) {
+			t.Fatalf("expected a verification failure, got %v", result.Error)
+		}
+		data, err := os.ReadFile(output)
+		if err != nil || string(data) != "previous output" {
+			t.Errorf("expected the destination to be unchanged, got %q (%v)", data, err)
+		}
+		if _, err := os.Stat(source); err != nil {
+			t.Errorf("expected the original to be kept, got %v", err)
+		}
+		assertNoTempFiles(t, tmpDir)
+	})
+}
+
+// acquireAsync starts an Acquire and returns a channel receiving the amount
+// reserved once it no longer blocks.
+func acquireAsync(mb *converter.MemoryBudget, n int64) <-chan int64 {
+	done := make(chan int64, 1)
+	go func() { done <- mb.Acquire(n) }()
+	return done
+}
+
+func expectBlocked(t *testing.T, done <-chan int64) {
+	t.Helper()
+	select {
+	case n := <-done:
+		t.Fatalf("expected acquire to block, it reserved %d bytes", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func expectReserved(t *testing.T, done <-chan int64, expected int64) {
+	t.Helper()
+	select {
+	case n := <-done:
+		if n != expected {
+			t.Errorf("expected %d bytes to be reserved, got %d", expected, n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected acquire to return after a release")
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	t.Run("Unlimited", func(t *testing.T) {
+		mb := converter.NewMemoryBudget(0)
+		if mb != nil {
+			t.Fatal("expected no budget without a capacity")
+		}
+		if n := mb.Acquire(1 << 40); n != 0 {
+			t.Errorf("expected nothing to be reserved, got %d", n)
+		}
+		mb.Release(0)
+	})
+
+	t.Run("Blocking", func(t *testing.T) {
+		mb := converter.NewMemoryBudget(100)
+		first := mb.Acquire(60)
+		done := acquireAsync(mb, 60)
+		expectBlocked(t, done)
+		mb.Release(first)
+		expectReserved(t, done, 60)
+	})
+
+	t.Run("Clamp", func(t *testing.T) {
+		mb := converter.NewMemoryBudget(100)
+		// An oversized request runs alone instead of waiting forever
+		if n := mb.Acquire(500); n != 100 {
+			t.Fatalf("expected the request to be clamped to 100, got %d", n)
+		}
+		done := acquireAsync(mb, 1)
+		expectBlocked(t, done)
+		mb.Release(100)
+		expectReserved(t, done, 1)
+	})
+
+	t.Run("Hold", func(t *testing.T) {
+		mb := converter.NewMemoryBudget(100)
+		reserved := mb.Acquire(80)
+		// Holding overdraws the budget instead of waiting
+		held := mb.Hold(50)
+		if held != 50 {
+			t.Fatalf("expected 50 bytes to be held, got %d", held)
+		}
+		done := acquireAsync(mb, 30)
+		expectBlocked(t, done)
+		mb.Release(held)
+		expectBlocked(t, done)
+		mb.Release(reserved)
+		expectReserved(t, done, 30)
+	})
+
+	t.Run("HoldBeyondCapacity", func(t *testing.T) {
+		mb := converter.NewMemoryBudget(100)
+		// An encoded output larger than the budget is charged in full
+		held := mb.Hold(500)
+		if held != 500 {
+			t.Fatalf("expected 500 bytes to be held, got %d", held)
+		}
+		done := acquireAsync(mb, 1)
+		mb.Release(400)
+		expectBlocked(t, done)
+		mb.Release(held - 400)
+		expectReserved(t, done, 1)
+	})
+}
+
+func TestDecodedSize(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		img      image.Image
+		expected int64
+	}{
+		{"gray", image.NewGray(image.Rect(0, 0, 30, 20)), 30 * 20},
+		{"rgba", image.NewNRGBA(image.Rect(0, 0, 30, 20)), 30 * 20 * 4},
+		{"rgba16", image.NewNRGBA64(image.Rect(0, 0, 30, 20)), 30 * 20 * 4 * 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, tc.img); err != nil {
+				t.Fatalf("failed to encode image: %v", err)
+			}
+			img, err := vips.NewImageFromBuffer(buf.Bytes())
+			if err != nil {
+				t.Fatalf("failed to load image: %v", err)
+			}
+			defer img.Close()
+			if size := converter.DecodedSize(img); size != tc.expected {
+				t.Errorf("expected %d bytes, got %d", tc.expected, size)
+			}
+		})
+	}
+}
+
 func TestWorker(t *testing.T) {
 	t.Run("NewWorkerPool", func(t *testing.T) {
 		wp := worker.NewWorkerPool(1, nil, 0)
@@ -190,13 +2688,13 @@ func TestAll(t *testing.T) {
 	// Test Validator
 	t.Run("Validator", func(t *testing.T) {
 		supportedFormats := []string{"png", "jpg"}
-		if err := validator.ValidateInputs(tmpDir, "png", supportedFormats); err != nil {
+		if err := validator.ValidateInputs(tmpDir, "png", supportedFormats, converter.TargetName); err != nil {
 			t.Errorf("Validation failed for valid inputs: %v", err)
 		}
-		if err := validator.ValidateInputs("nonexistent", "png", supportedFormats); err == nil {
+		if err := validator.ValidateInputs("nonexistent", "png", supportedFormats, converter.TargetName); err == nil {
 			t.Error("Expected error for nonexistent directory")
 		}
-		if err := validator.ValidateInputs(tmpDir, "gif", supportedFormats); err == nil {
+		if err := validator.ValidateInputs(tmpDir, "gif", supportedFormats, converter.TargetName); err == nil {
 			t.Error("Expected error for unsupported format")
 		}
 	})